@@ -17,6 +17,8 @@
 package commands
 
 import (
+	"time"
+
 	"github.com/nalej/unified-logging/internal/app/coord"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -43,6 +45,22 @@ func init() {
 	runCmd.PersistentFlags().BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", false, "Don't validate TLS certificates")
 	runCmd.PersistentFlags().StringVar(&config.CACertPath, "caCertPath", "", "Alternative certificate file to use for validation")
 	runCmd.PersistentFlags().StringVar(&config.ClientCertPath, "clientCertPath", "", "Alternative certificate file to use for validation")
+	runCmd.PersistentFlags().IntVar(&config.MaxFailedClusters, "maxFailedClusters", -1, "Application clusters that can fail without failing a search or an expiration, negative for no maximum")
+	runCmd.PersistentFlags().IntVar(&config.MaxConcurrentRequests, "maxConcurrentRequests", 10, "Maximum number of application clusters queried in parallel")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterTimeout, "clusterTimeout", 30*time.Second, "Timeout for the request to a single application cluster")
+	runCmd.PersistentFlags().IntVar(&config.ClusterFailureThreshold, "clusterFailureThreshold", 3, "Consecutive failures of an application cluster that stop the requests to it")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterBackoff, "clusterBackoff", 10*time.Second, "Time the requests to a failing application cluster are first stopped")
+	runCmd.PersistentFlags().DurationVar(&config.ClusterMaxBackoff, "clusterMaxBackoff", 5*time.Minute, "Maximum time the requests to a failing application cluster are stopped")
+	runCmd.PersistentFlags().IntVar(&config.RetryAttempts, "retryAttempts", 3, "Times an idempotent request is sent to an application cluster, 1 to not retry it")
+	runCmd.PersistentFlags().DurationVar(&config.RetryBackoff, "retryBackoff", 100*time.Millisecond, "Time waited before retrying a request to an application cluster, doubled for every retry")
+	runCmd.PersistentFlags().Float64Var(&config.HedgePercentile, "hedgePercentile", 0, "Latency percentile of an application cluster after which a request is sent again, 0 to not hedge")
+	runCmd.PersistentFlags().DurationVar(&config.ConnectionIdleTimeout, "connectionIdleTimeout", 10*time.Minute, "Time an unused connection to an application cluster is kept open")
+	runCmd.PersistentFlags().BoolVar(&config.Experimental, "experimental", false, "Enable the experimental features, which need the application cluster API to forward them")
+	runCmd.PersistentFlags().DurationVar(&config.TailPollInterval, "tailPollInterval", 5*time.Second, "Time between searches for new log entries when tailing")
+	runCmd.PersistentFlags().IntVar(&config.DefaultRetentionDays, "defaultRetentionDays", 7, "Days the log entries of an organization are kept when none of its retention policies applies")
+	runCmd.PersistentFlags().StringVar(&config.RetentionPoliciesPath, "retentionPoliciesPath", "", "File where the retention policies are stored, empty to keep them in memory")
+	runCmd.PersistentFlags().DurationVar(&config.RetentionSyncInterval, "retentionSyncInterval", 10*time.Minute, "Time between synchronizations of the retention policies with the application clusters")
+	runCmd.PersistentFlags().DurationVar(&config.TopologyTTL, "topologyTTL", time.Minute, "Time the clusters of an organization and the placement of an application are cached")
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -17,7 +17,13 @@
 package commands
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/nalej/unified-logging/internal/app/slave"
+	"github.com/nalej/unified-logging/internal/app/slave/expire"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
@@ -38,7 +44,35 @@ func init() {
 	runCmd.Flags().IntVar(&config.Port, "port", 8322, "Port for Unified Logging Slave gRPC API")
 	runCmd.PersistentFlags().StringVar(&config.ElasticAddress, "elasticAddress", "localhost:9200",
 		"ElasticSearch address (host:port)")
+	runCmd.Flags().StringVar(&config.StorageBackend, "storageBackend", loggingstorage.ElasticSearchBackend,
+		fmt.Sprintf("Logging storage backend, one of %s", strings.Join(loggingstorage.ProviderNames(), ", ")))
+	runCmd.Flags().StringVar(&config.StorageAddress, "storageAddress", "", "Storage backend address (host:port), elasticAddress if not set")
 	runCmd.Flags().BoolVar(&config.ExpireLogs, "expireLogs", true, "Flag to indicate if logs have to expire")
+	runCmd.Flags().DurationVar(&config.ExpireInterval, "expireInterval", 24*time.Hour, "Time between passes enforcing the retention of the logs")
+	runCmd.Flags().IntVar(&config.LogTTL, "logTTL", 7, "Number of days the logs without retention policies are kept")
+	runCmd.Flags().BoolVar(&config.DryRun, "dryRun", false, "Only log the logs and indices that would expire, without removing them")
+	runCmd.Flags().StringSliceVar(&config.IndexInclude, "indexInclude", []string{}, "Globs of the indices removed by the expiration, all if empty")
+	runCmd.Flags().StringSliceVar(&config.IndexExclude, "indexExclude", []string{".*"}, "Globs of the indices never removed by the expiration")
+	runCmd.Flags().StringSliceVar(&config.IndexLayouts, "indexLayouts", []string{string(expire.DailyLayout)},
+		fmt.Sprintf("Layouts of the dates in the names of the removed indices, tried in order, of %s", strings.Join(expire.DateLayoutNames(), ", ")))
+	runCmd.Flags().Int64Var(&config.MaxIndexSize, "maxIndexSize", 0, "Size in bytes of the log indices over which the oldest ones are removed, 0 for no limit")
+	runCmd.Flags().Float64Var(&config.DiskWatermark, "diskWatermark", 0, "Percentage of the storage disk in use over which the oldest log indices are removed, 0 for no limit")
+	runCmd.Flags().DurationVar(&config.SizeCheckInterval, "sizeCheckInterval", 5*time.Minute, "Time between checks of the size of the log indices")
+	runCmd.Flags().BoolVar(&config.ElasticSniff, "elasticSniff", false, "Discover the nodes of the ElasticSearch cluster")
+	runCmd.Flags().DurationVar(&config.ElasticHealthcheckInterval, "elasticHealthcheckInterval", time.Minute, "Time between ElasticSearch health checks, 0 to disable")
+	runCmd.Flags().IntVar(&config.ElasticMaxRetries, "elasticMaxRetries", 3, "Number of retries of a failed ElasticSearch request")
+	runCmd.Flags().DurationVar(&config.ElasticRetryBackoff, "elasticRetryBackoff", 100*time.Millisecond, "Wait before the first retry of an ElasticSearch request")
+	runCmd.Flags().DurationVar(&config.ElasticMaxRetryBackoff, "elasticMaxRetryBackoff", 5*time.Second, "Maximum wait between retries of an ElasticSearch request")
+	runCmd.Flags().DurationVar(&config.ElasticRequestTimeout, "elasticRequestTimeout", time.Minute, "Timeout of a single storage backend request")
+	runCmd.Flags().StringVar(&config.ILMPolicy, "ilmPolicy", "", "Name of the index lifecycle policy, template and rollover alias installed in ElasticSearch, empty to remove the indices by date")
+	runCmd.Flags().Int64Var(&config.ILMRolloverSize, "ilmRolloverSize", 5*1024*1024*1024, "Size in bytes of the primary shards over which the index is rolled over, 0 for no limit")
+	runCmd.Flags().DurationVar(&config.ILMRolloverAge, "ilmRolloverAge", 24*time.Hour, "Age after which the index is rolled over, 0 for no limit")
+	runCmd.Flags().DurationVar(&config.TailPollInterval, "tailPollInterval", 2*time.Second, "Time between searches for new log entries when tailing")
+	runCmd.Flags().BoolVar(&config.Experimental, "experimental", false, "Enable the experimental services, which need the application cluster API to forward them")
+	runCmd.Flags().StringVar(&config.LocalDir, "localDir", "/var/lib/unified-logging", "Directory of the local storage")
+	runCmd.Flags().Int64Var(&config.LocalSegmentSize, "localSegmentSize", 64*1024*1024, "Size in bytes of the segment files of the local storage")
+	runCmd.Flags().StringVar(&config.LocalLogPath, "localLogPath", "/var/log/containers/*.log", "Container log files ingested by the local storage, empty to disable ingestion")
+	runCmd.Flags().DurationVar(&config.LocalPollInterval, "localPollInterval", 2*time.Second, "Time between reads of the container log files by the local storage")
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -19,6 +19,8 @@
 package coord
 
 import (
+	"time"
+
 	"github.com/nalej/derrors"
 	"github.com/rs/zerolog/log"
 )
@@ -41,6 +43,38 @@ type Config struct {
 	CACertPath string
 	// client certificate path to use for validation
 	ClientCertPath string
+	// Maximum number of application clusters queried in parallel
+	MaxConcurrentRequests int
+	// Timeout for the request to a single application cluster
+	ClusterTimeout time.Duration
+	// Consecutive failures of an application cluster that stop the requests to it
+	ClusterFailureThreshold int
+	// Time the requests to a failing application cluster are first stopped
+	ClusterBackoff time.Duration
+	// Maximum time the requests to a failing application cluster are stopped
+	ClusterMaxBackoff time.Duration
+	// Application clusters that can fail without failing a search or an expiration, negative for no maximum
+	MaxFailedClusters int
+	// Times an idempotent request is sent to an application cluster, 1 to not retry it
+	RetryAttempts int
+	// Time waited before retrying a request to an application cluster, doubled for every retry
+	RetryBackoff time.Duration
+	// Latency percentile of an application cluster after which a request is sent again, 0 to not hedge
+	HedgePercentile float64
+	// Time an unused connection to an application cluster is kept open
+	ConnectionIdleTimeout time.Duration
+	// Enable the features that need the application cluster API to forward new metadata or services
+	Experimental bool
+	// Time between searches for new log entries when tailing
+	TailPollInterval time.Duration
+	// Days the log entries of an organization are kept when none of its retention policies applies
+	DefaultRetentionDays int
+	// File where the retention policies are stored, empty to keep them in memory
+	RetentionPoliciesPath string
+	// Time between synchronizations of the retention policies with the application clusters
+	RetentionSyncInterval time.Duration
+	// Time the clusters of an organization and the placement of an application are cached
+	TopologyTTL time.Duration
 }
 
 // Validate the configuration.
@@ -60,6 +94,45 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.ClientCertPath == "" {
 		return derrors.NewInvalidArgumentError("clientCertPath is required")
 	}
+	if conf.MaxConcurrentRequests <= 0 {
+		return derrors.NewInvalidArgumentError("maxConcurrentRequests must be positive")
+	}
+	if conf.ClusterTimeout < 0 {
+		return derrors.NewInvalidArgumentError("clusterTimeout cannot be negative")
+	}
+	if conf.ClusterFailureThreshold <= 0 {
+		return derrors.NewInvalidArgumentError("clusterFailureThreshold must be positive")
+	}
+	if conf.ClusterBackoff <= 0 {
+		return derrors.NewInvalidArgumentError("clusterBackoff must be positive")
+	}
+	if conf.ClusterMaxBackoff < conf.ClusterBackoff {
+		return derrors.NewInvalidArgumentError("clusterMaxBackoff cannot be shorter than clusterBackoff")
+	}
+	if conf.RetryAttempts <= 0 {
+		return derrors.NewInvalidArgumentError("retryAttempts must be positive")
+	}
+	if conf.RetryBackoff < 0 {
+		return derrors.NewInvalidArgumentError("retryBackoff cannot be negative")
+	}
+	if conf.HedgePercentile < 0 || conf.HedgePercentile >= 1 {
+		return derrors.NewInvalidArgumentError("hedgePercentile must be between 0 and 1")
+	}
+	if conf.ConnectionIdleTimeout <= 0 {
+		return derrors.NewInvalidArgumentError("connectionIdleTimeout must be positive")
+	}
+	if conf.TailPollInterval <= 0 {
+		return derrors.NewInvalidArgumentError("tailPollInterval must be positive")
+	}
+	if conf.DefaultRetentionDays <= 0 {
+		return derrors.NewInvalidArgumentError("defaultRetentionDays must be positive")
+	}
+	if conf.RetentionSyncInterval <= 0 {
+		return derrors.NewInvalidArgumentError("retentionSyncInterval must be positive")
+	}
+	if conf.TopologyTTL <= 0 {
+		return derrors.NewInvalidArgumentError("topologyTTL must be positive")
+	}
 	return nil
 }
 
@@ -70,4 +143,15 @@ func (conf *Config) Print() {
 	log.Info().Str("prefix", conf.AppClusterPrefix).Msg("appClusterPrefix")
 	log.Info().Int("port", conf.AppClusterPort).Msg("appClusterPort")
 	log.Info().Bool("tls", conf.UseTLS).Bool("skipServerCertValidation", conf.SkipServerCertValidation).Str("cert", conf.CACertPath).Str("cert", conf.ClientCertPath).Msg("TLS parameters")
+	log.Info().Int("maxConcurrentRequests", conf.MaxConcurrentRequests).Str("clusterTimeout", conf.ClusterTimeout.String()).Str("connectionIdleTimeout", conf.ConnectionIdleTimeout.String()).Msg("application cluster requests")
+	log.Info().Bool("experimental", conf.Experimental).Msg("experimental features")
+	log.Info().Int("failureThreshold", conf.ClusterFailureThreshold).Str("backoff", conf.ClusterBackoff.String()).
+		Str("maxBackoff", conf.ClusterMaxBackoff.String()).Msg("application cluster circuit breakers")
+	log.Info().Int("maxFailedClusters", conf.MaxFailedClusters).Msg("failure policy")
+	log.Info().Int("attempts", conf.RetryAttempts).Str("backoff", conf.RetryBackoff.String()).
+		Float64("hedgePercentile", conf.HedgePercentile).Msg("retry policy")
+	log.Info().Str("interval", conf.TailPollInterval.String()).Msg("tailPollInterval")
+	log.Info().Int("defaultDays", conf.DefaultRetentionDays).Str("path", conf.RetentionPoliciesPath).
+		Str("syncInterval", conf.RetentionSyncInterval.String()).Msg("retention policies")
+	log.Info().Str("ttl", conf.TopologyTTL.String()).Msg("topologyTTL")
 }
@@ -20,58 +20,194 @@ package manager
 
 import (
 	"context"
-	"github.com/nalej/derrors"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/nalej/grpc-app-cluster-api-go"
 	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-type ExecFunc func(context.Context, grpc_app_cluster_api_go.UnifiedLoggingClient, int) (int, error)
+// DefaultMaxConcurrentRequests is the number of clusters queried at the same time when no limit is configured
+const DefaultMaxConcurrentRequests = 10
+
+// ExecFunc executes a request on the client of a cluster
+type ExecFunc func(context.Context, client.LoggingClient, int) (int, error)
+
+// coordinatorError is an error creating the client of a cluster, as loading the certificates of
+// the coordinator, which tells nothing about the cluster
+type coordinatorError struct {
+	error
+}
 
 type LoggingExecutor struct {
 	clientFactory client.LoggingClientFactory
 	params        *client.LoggingClientParams
+	// maxConcurrentRequests is the maximum number of clusters queried in parallel
+	maxConcurrentRequests int
+	// clusterTimeout is the deadline of a single cluster request, bounded by the request context
+	clusterTimeout time.Duration
+	// Health keeps the circuit breakers of the clusters, nil to query every cluster
+	Health *HealthTracker
+	// Retry is the policy retrying and hedging the idempotent requests
+	Retry RetryPolicy
+	// latencies are the latencies of the clusters, to hedge their requests
+	latencies *latencies
 }
 
-func NewLoggingExecutor(factory client.LoggingClientFactory, params *client.LoggingClientParams) *LoggingExecutor {
+func NewLoggingExecutor(factory client.LoggingClientFactory, params *client.LoggingClientParams, maxConcurrentRequests int, clusterTimeout time.Duration) *LoggingExecutor {
+	if maxConcurrentRequests <= 0 {
+		maxConcurrentRequests = DefaultMaxConcurrentRequests
+	}
 	return &LoggingExecutor{
-		clientFactory: factory,
-		params:        params,
+		clientFactory:         factory,
+		params:                params,
+		maxConcurrentRequests: maxConcurrentRequests,
+		clusterTimeout:        clusterTimeout,
+		Health:                NewHealthTracker(DefaultFailureThreshold, DefaultBackoff, DefaultMaxBackoff),
+		Retry:                 DefaultRetryPolicy,
+		latencies:             newLatencies(),
 	}
 }
 
-func (le *LoggingExecutor) ExecRequests(ctx context.Context, hosts []ClusterInfo, f ExecFunc) (int, []string, derrors.Error) {
-	// TODO: concurrent execution of request
-	var total int = 0
-	errorIds := make([]string, 0)
-
+// admit returns the hosts whose circuit lets a request through, with their indices in hosts,
+// and the outcomes of the others
+func (le *LoggingExecutor) admit(hosts []ClusterInfo) ([]ClusterInfo, []int, entities.ClusterOutcomes) {
+	if le.Health == nil {
+		indices := make([]int, len(hosts))
+		for i := range hosts {
+			indices[i] = i
+		}
+		return hosts, indices, entities.ClusterOutcomes{}
+	}
+	admitted := make([]ClusterInfo, 0, len(hosts))
+	indices := make([]int, 0, len(hosts))
+	skipped := make(entities.ClusterOutcomes, 0)
 	for i, host := range hosts {
-		log.Debug().Str("host", host.host).Msg("executing on host")
-		client, err := le.clientFactory(host.host, le.params)
-		if err != nil {
-			log.Warn().Str("host", host.host).Err(err).Msg("failed creating connection")
-			errorIds = append(errorIds, host.id)
+		allowed, reason := le.Health.Allow(host.id)
+		if !allowed {
+			log.Warn().Str("host", host.host).Str("reason", reason).Msg("cluster skipped")
+			skipped = append(skipped, &entities.ClusterOutcome{
+				ClusterId: host.id,
+				Status:    entities.ClusterUnavailable,
+				Error:     reason,
+			})
 			continue
 		}
+		admitted = append(admitted, host)
+		indices = append(indices, i)
+	}
+	return admitted, indices, skipped
+}
+
+// ExecRequests executes f on every host, querying at most maxConcurrentRequests hosts at the same time.
+// f receives the index of the host in hosts, so results can be stored in a slice of the same length,
+// and the outcome of each host is returned in the same position.
+func (le *LoggingExecutor) ExecRequests(ctx context.Context, hosts []ClusterInfo, f ExecFunc) entities.ClusterOutcomes {
+	// Each host stores its outcome in its own position, so it's safe to fill it concurrently
+	outcomes := make(entities.ClusterOutcomes, len(hosts))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, le.maxConcurrentRequests)
+
+	for i, host := range hosts {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, host ClusterInfo) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			started := time.Now()
+			count, err := le.execRequest(ctx, host, i, f)
+			if le.Health != nil {
+				if _, local := err.(coordinatorError); ctx.Err() != nil || local {
+					// The request was cancelled or not sent, so it says nothing about the cluster
+					le.Health.Release(host.id)
+				} else {
+					le.Health.Record(host.id, err)
+				}
+			}
 
-		count, err := f(ctx, client, i)
-		if err != nil {
-			log.Warn().Str("host", host.host).Err(err).Msg("failed executing command")
-			errorIds = append(errorIds, host.id)
-			// Continue on to next host - after trying to close connection
+			outcomes[i] = &entities.ClusterOutcome{
+				ClusterId: host.id,
+				Status:    errorStatus(err),
+				Latency:   time.Since(started),
+				Entries:   count,
+			}
+			if err != nil {
+				outcomes[i].Error = err.Error()
+			}
+			log.Debug().Str("host", host.host).Int("count", count).Str("status", outcomes[i].Status.String()).Msg("rows returned")
+		}(i, host)
+	}
+	wg.Wait()
+
+	return outcomes
+}
+
+// errorStatus returns the status of a cluster whose request returned err
+func errorStatus(err error) entities.ClusterStatus {
+	if err == nil {
+		return entities.ClusterOK
+	}
+	if err == context.DeadlineExceeded {
+		return entities.ClusterTimeout
+	}
+	if _, local := err.(coordinatorError); local {
+		return entities.ClusterCoordinatorError
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return entities.ClusterUnavailable
+	}
+	switch s.Code() {
+	case codes.DeadlineExceeded:
+		return entities.ClusterTimeout
+	case codes.Unavailable, codes.Canceled:
+		// The handshake errors of the connection are only told by their message
+		message := strings.ToLower(s.Message())
+		for _, tlsMessage := range []string{"handshake", "x509", "tls:", "certificate"} {
+			if strings.Contains(message, tlsMessage) {
+				return entities.ClusterTLSError
+			}
 		}
-		total += count
-		log.Debug().Int("count", count).Int("total", total).Msg("rows returned")
+		return entities.ClusterUnavailable
+	}
+	return entities.ClusterStorageError
+}
 
+// execRequest executes f on a single host with its own deadline
+func (le *LoggingExecutor) execRequest(ctx context.Context, host ClusterInfo, i int, f ExecFunc) (int, error) {
+	log.Debug().Str("host", host.host).Msg("executing on host")
+	client, err := le.clientFactory(host.host, le.params)
+	if err != nil {
+		log.Warn().Str("host", host.host).Err(err).Msg("failed creating connection")
+		return 0, coordinatorError{err}
+	}
+	defer func() {
 		cerr := client.Close()
 		if cerr != nil {
 			log.Warn().Str("host", host.host).Err(cerr).Msg("failed closing connection")
 			// continue anyway
 		}
+	}()
+	if le.Retry.enabled() {
+		client = &retryingClient{LoggingClient: client, host: host.host, policy: le.Retry, latencies: le.latencies}
 	}
 
-	// TODO: collect errors
+	clusterCtx := ctx
+	if le.clusterTimeout > 0 {
+		var cancel context.CancelFunc
+		clusterCtx, cancel = context.WithTimeout(ctx, le.clusterTimeout)
+		defer cancel()
+	}
 
-	return total, errorIds, nil
+	count, err := f(clusterCtx, client, i)
+	if err != nil {
+		log.Warn().Str("host", host.host).Err(err).Msg("failed executing command")
+		return count, err
+	}
+	return count, nil
 }
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Expiration jobs for unified logging coordinator
+
+package manager
+
+import (
+	"context"
+	"sort"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Expire deletes the entries in every cluster of the organization with the Expire method of the
+// application cluster API, failing if more clusters than allowed by the failure policy fail
+func (m *Manager) Expire(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*grpc_common_go.Success, derrors.Error) {
+	success, _, err := m.ExpireClusters(ctx, request)
+	return success, err
+}
+
+// ExpireClusters expires the entries as Expire, returning the outcome of every cluster even if
+// the expiration fails because of the failure policy
+func (m *Manager) ExpireClusters(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*grpc_common_go.Success, entities.ClusterOutcomes, derrors.Error) {
+	hosts, err := m.GetHosts(ctx, &entities.FilterFields{
+		OrganizationId: request.GetOrganizationId(),
+		AppInstanceId:  request.GetAppInstanceId(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		_, err := client.Expire(ctx, request)
+		return 0, err
+	}
+	outcomes := m.execRequests(ctx, request.GetOrganizationId(), hosts, execFunc)
+	err = outcomes.CoordinatorError()
+	if err != nil {
+		return nil, outcomes, err
+	}
+	err = m.FailurePolicy.Check(outcomes)
+	if err != nil {
+		return nil, outcomes, err
+	}
+	if failed := outcomes.FailedClusterIds(); len(failed) > 0 {
+		log.Warn().Str("organizationId", request.OrganizationId).Strs("errors", failed).Msg("expiration failed in some clusters")
+	}
+
+	return &grpc_common_go.Success{}, outcomes, nil
+}
+
+// StartExpiration starts an expiration job in every cluster of the organization. The job
+// identifier has the jobs of the clusters, so their progress can be asked for by any coordinator.
+// The clusters whose application cluster API does not forward the jobs delete the entries with
+// Expire instead, and are reported as completed once it returns, as Expire waits for the deletion.
+func (m *Manager) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, derrors.Error) {
+	job, _, err := m.startExpiration(ctx, request)
+	return job, err
+}
+
+// startExpiration starts an expiration job, returning the outcome of every cluster
+func (m *Manager) startExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, entities.ClusterOutcomes, derrors.Error) {
+	hosts, err := m.GetHosts(ctx, &entities.FilterFields{
+		OrganizationId: request.GetOrganizationId(),
+		AppInstanceId:  request.GetAppInstanceId(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each host stores its result in its own position, so it's safe to fill it concurrently
+	clusters := make([]*entities.ClusterExpirationJob, len(hosts))
+	execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		job, err := client.StartExpiration(ctx, request)
+		if status.Code(err) == codes.Unimplemented {
+			_, err = client.Expire(ctx, request)
+			if err == nil {
+				clusters[i] = untrackedClusterJob(hosts[i].id)
+				return 0, nil
+			}
+		}
+		if err != nil {
+			clusters[i] = failedClusterJob(hosts[i].id, err.Error())
+			return 0, err
+		}
+		clusters[i] = clusterJob(hosts[i].id, job)
+		return 0, nil
+	}
+	outcomes := m.execRequests(ctx, request.GetOrganizationId(), hosts, execFunc)
+
+	// The clusters without job were skipped or could not be connected to
+	failures := make(map[string]string)
+	for _, outcome := range outcomes {
+		failures[outcome.ClusterId] = outcome.Error
+	}
+	jobs := make(entities.ClusterJobs, len(hosts))
+	for i, host := range hosts {
+		if clusters[i] == nil {
+			clusters[i] = failedClusterJob(host.id, failures[host.id])
+		}
+		jobs[host.id] = clusters[i].JobId
+	}
+
+	job := &entities.ExpirationJob{
+		OrganizationId: request.GetOrganizationId(),
+		AppInstanceId:  request.GetAppInstanceId(),
+		JobId:          jobs.Encode(),
+		Clusters:       clusters,
+	}
+	job.SummarizeClusters()
+	log.Info().Str("organizationId", job.OrganizationId).Str("appInstanceId", job.AppInstanceId).
+		Int("clusters", len(clusters)).Str("state", job.State.String()).Msg("expiration started")
+	return job, outcomes, nil
+}
+
+// GetExpirationJob returns the progress of a job in every cluster it started in. The clusters
+// where it could not start, or that are not available, are reported as failed.
+func (m *Manager) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, derrors.Error) {
+	jobs, err := entities.DecodeClusterJobs(id.JobId)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := m.GetHosts(ctx, &entities.FilterFields{OrganizationId: id.OrganizationId})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the clusters where the job started are asked for it
+	available := make(map[string]ClusterInfo, len(hosts))
+	for _, host := range hosts {
+		available[host.id] = host
+	}
+	pending := make([]ClusterInfo, 0, len(jobs))
+	clusters := make([]*entities.ClusterExpirationJob, 0, len(jobs))
+	for clusterId, jobId := range jobs {
+		host, exists := available[clusterId]
+		switch {
+		case jobId == entities.UntrackedClusterJob:
+			clusters = append(clusters, untrackedClusterJob(clusterId))
+		case jobId == "":
+			clusters = append(clusters, failedClusterJob(clusterId, "expiration could not start"))
+		case !exists:
+			clusters = append(clusters, failedClusterJob(clusterId, "cluster not available"))
+		default:
+			pending = append(pending, host)
+		}
+	}
+
+	results := make([]*entities.ClusterExpirationJob, len(pending))
+	execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		clusterId := pending[i].id
+		job, err := client.GetExpirationJob(ctx, &entities.ExpirationJobId{OrganizationId: id.OrganizationId, JobId: jobs[clusterId]})
+		if err != nil {
+			results[i] = failedClusterJob(clusterId, err.Error())
+			results[i].JobId = jobs[clusterId]
+			return 0, err
+		}
+		results[i] = clusterJob(clusterId, job)
+		return 0, nil
+	}
+	m.execRequests(ctx, id.OrganizationId, pending, execFunc)
+	for i, host := range pending {
+		if results[i] == nil {
+			results[i] = failedClusterJob(host.id, "expiration job not available")
+			results[i].JobId = jobs[host.id]
+		}
+	}
+
+	clusters = append(clusters, results...)
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].ClusterId < clusters[j].ClusterId
+	})
+	job := &entities.ExpirationJob{
+		OrganizationId: id.OrganizationId,
+		JobId:          id.JobId,
+		Clusters:       clusters,
+	}
+	job.SummarizeClusters()
+	return job, nil
+}
+
+// clusterJob returns the progress of the job of a cluster
+func clusterJob(clusterId string, job *entities.ExpirationJob) *entities.ClusterExpirationJob {
+	return &entities.ClusterExpirationJob{
+		ClusterId: clusterId,
+		JobId:     job.JobId,
+		State:     job.State,
+		Deleted:   job.Deleted,
+		Total:     job.Total,
+		Failures:  job.Failures,
+	}
+}
+
+// untrackedClusterJob returns the progress of a cluster that started the deletion without a job
+func untrackedClusterJob(clusterId string) *entities.ClusterExpirationJob {
+	return &entities.ClusterExpirationJob{
+		ClusterId: clusterId,
+		JobId:     entities.UntrackedClusterJob,
+		State:     entities.ExpirationCompleted,
+	}
+}
+
+// failedClusterJob returns the progress of a cluster whose job failed
+func failedClusterJob(clusterId string, failure string) *entities.ClusterExpirationJob {
+	return &entities.ClusterExpirationJob{
+		ClusterId: clusterId,
+		State:     entities.ExpirationFailed,
+		Failures:  []string{failure},
+	}
+}
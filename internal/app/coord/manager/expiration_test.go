@@ -0,0 +1,205 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// mockupExpirationJobs keeps the jobs of a cluster, which run until they are completed
+type mockupExpirationJobs struct {
+	sync.Mutex
+	jobs map[string]*entities.ExpirationJob
+	// unimplemented clusters do not run jobs, as if their API did not forward them
+	unimplemented bool
+	// expired is the number of expirations started without a job
+	expired int
+}
+
+func (e *mockupExpirationJobs) Expire(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*grpc_common_go.Success, derrors.Error) {
+	e.Lock()
+	defer e.Unlock()
+	e.expired++
+	return &grpc_common_go.Success{}, nil
+}
+
+func (e *mockupExpirationJobs) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, derrors.Error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.unimplemented {
+		return nil, derrors.NewUnimplementedError("unknown service unified_logging.Expiration")
+	}
+	job := &entities.ExpirationJob{
+		OrganizationId: request.OrganizationId,
+		JobId:          fmt.Sprintf("job-%d", len(e.jobs)+1),
+		State:          entities.ExpirationRunning,
+	}
+	e.jobs[job.JobId] = job
+	return job, nil
+}
+
+func (e *mockupExpirationJobs) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, derrors.Error) {
+	e.Lock()
+	defer e.Unlock()
+	job, exists := e.jobs[id.JobId]
+	if !exists {
+		return nil, derrors.NewNotFoundError("expiration job not found").WithParams(id.JobId)
+	}
+	copied := *job
+	return &copied, nil
+}
+
+// complete completes all the jobs, deleting deleted entries each
+func (e *mockupExpirationJobs) complete(deleted int64) {
+	e.Lock()
+	defer e.Unlock()
+	for _, job := range e.jobs {
+		job.State = entities.ExpirationCompleted
+		job.Deleted = deleted
+		job.Total = deleted
+	}
+}
+
+// newMockupExpirationManager returns a coordinator manager starting the jobs in mockup clusters,
+// or failing to for the clusters without jobs
+func newMockupExpirationManager(clusters map[string]*mockupExpirationJobs) *Manager {
+	ids := make([]string, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	factory := func(address string, params *client.LoggingClientParams) (client.LoggingClient, error) {
+		for id, jobs := range clusters {
+			if address == fmt.Sprintf("%s:%d", id, 443) {
+				if jobs == nil {
+					return &mockupLoggingClient{}, nil
+				}
+				return &mockupLoggingClient{expiration: jobs}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown cluster %s", address)
+	}
+	executor := NewLoggingExecutor(factory, &client.LoggingClientParams{}, 2, time.Second)
+	return NewManager(nil, &mockupClustersClient{clusters: ids}, executor, "", 443, time.Second)
+}
+
+var _ = ginkgo.Describe("Expiration", func() {
+	request := &grpc_unified_logging_go.ExpirationRequest{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}
+
+	ginkgo.It("should report the progress of the job in every cluster", func() {
+		clusters := map[string]*mockupExpirationJobs{
+			"cluster-1": {jobs: make(map[string]*entities.ExpirationJob)},
+			"cluster-2": {jobs: make(map[string]*entities.ExpirationJob)},
+			"cluster-3": nil,
+		}
+		manager := newMockupExpirationManager(clusters)
+
+		job, derr := manager.StartExpiration(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(job.State).Should(gomega.Equal(entities.ExpirationRunning))
+		gomega.Expect(job.Clusters).Should(gomega.HaveLen(3))
+		gomega.Expect(job.Failures).Should(gomega.HaveLen(1))
+
+		id := &entities.ExpirationJobId{OrganizationId: OrganizationId, JobId: job.JobId}
+		status, derr := manager.GetExpirationJob(context.Background(), id)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationRunning))
+		states := make(map[string]entities.ExpirationState)
+		for _, cluster := range status.Clusters {
+			states[cluster.ClusterId] = cluster.State
+		}
+		gomega.Expect(states).Should(gomega.Equal(map[string]entities.ExpirationState{
+			"cluster-1": entities.ExpirationRunning,
+			"cluster-2": entities.ExpirationRunning,
+			"cluster-3": entities.ExpirationFailed,
+		}))
+
+		clusters["cluster-1"].complete(2)
+		clusters["cluster-2"].complete(3)
+		status, derr = manager.GetExpirationJob(context.Background(), id)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationFailed))
+		gomega.Expect(status.Deleted).Should(gomega.Equal(int64(5)))
+		gomega.Expect(status.Failures).Should(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should complete once every cluster completes", func() {
+		clusters := map[string]*mockupExpirationJobs{
+			"cluster-1": {jobs: make(map[string]*entities.ExpirationJob)},
+		}
+		manager := newMockupExpirationManager(clusters)
+		job, derr := manager.StartExpiration(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+
+		clusters["cluster-1"].complete(1)
+		status, derr := manager.GetExpirationJob(context.Background(), &entities.ExpirationJobId{OrganizationId: OrganizationId, JobId: job.JobId})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationCompleted))
+		gomega.Expect(status.Clusters[0].JobId).Should(gomega.Equal("job-1"))
+	})
+
+	ginkgo.It("should expire without jobs", func() {
+		clusters := map[string]*mockupExpirationJobs{
+			"cluster-1": {jobs: make(map[string]*entities.ExpirationJob)},
+		}
+		manager := newMockupExpirationManager(clusters)
+		_, derr := manager.Expire(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(clusters["cluster-1"].expired).Should(gomega.Equal(1))
+		gomega.Expect(clusters["cluster-1"].jobs).Should(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should start the deletion without jobs in the clusters that do not run them", func() {
+		clusters := map[string]*mockupExpirationJobs{
+			"cluster-1": {jobs: make(map[string]*entities.ExpirationJob)},
+			"cluster-2": {jobs: make(map[string]*entities.ExpirationJob), unimplemented: true},
+		}
+		manager := newMockupExpirationManager(clusters)
+		job, derr := manager.StartExpiration(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(job.Failures).Should(gomega.BeEmpty())
+		gomega.Expect(clusters["cluster-2"].expired).Should(gomega.Equal(1))
+
+		clusters["cluster-1"].complete(1)
+		status, derr := manager.GetExpirationJob(context.Background(), &entities.ExpirationJobId{OrganizationId: OrganizationId, JobId: job.JobId})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationCompleted))
+		gomega.Expect(status.Clusters[1].JobId).Should(gomega.Equal(entities.UntrackedClusterJob))
+	})
+
+	ginkgo.It("should fail to expire only when the failure policy does", func() {
+		manager := newMockupExpirationManager(map[string]*mockupExpirationJobs{"cluster-1": nil})
+		_, derr := manager.Expire(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		manager.FailurePolicy = entities.FailurePolicy{MaxFailedClusters: 0}
+		_, derr = manager.Expire(context.Background(), request)
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+
+		_, derr = manager.GetExpirationJob(context.Background(), &entities.ExpirationJobId{OrganizationId: OrganizationId, JobId: "not a job"})
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.InvalidArgument))
+	})
+})
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Health of the application clusters
+
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultFailureThreshold is the number of consecutive failures that open the circuit of a cluster
+const DefaultFailureThreshold = 3
+
+// DefaultBackoff is the time the circuit of a cluster is first kept open
+const DefaultBackoff = time.Second * 10
+
+// DefaultMaxBackoff is the maximum time the circuit of a cluster is kept open
+const DefaultMaxBackoff = time.Minute * 5
+
+// CircuitState is the state of the circuit breaker of a cluster
+type CircuitState int
+
+const (
+	// CircuitClosed clusters receive every request
+	CircuitClosed CircuitState = iota
+	// CircuitOpen clusters are skipped until their backoff passes
+	CircuitOpen
+	// CircuitHalfOpen clusters receive a single request, probing whether they recovered
+	CircuitHalfOpen
+)
+
+var circuitStateNames = map[CircuitState]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half-open",
+}
+
+func (s CircuitState) String() string {
+	name, exists := circuitStateNames[s]
+	if !exists {
+		return "unknown"
+	}
+	return name
+}
+
+// ClusterHealth is the health of a cluster as seen by the requests of the coordinator
+type ClusterHealth struct {
+	State CircuitState
+	// ConsecutiveFailures is the number of requests failed since the last one that succeeded
+	ConsecutiveFailures int
+	// LastError is the error of the last request failed
+	LastError string
+	// Backoff is the time the circuit is kept open, doubled every time a probe fails
+	Backoff time.Duration
+	// OpenUntil is the time the circuit lets a probe through
+	OpenUntil time.Time
+}
+
+// HealthTracker keeps a circuit breaker per cluster. The circuit of a cluster opens after
+// threshold consecutive failures and lets a probe through when its backoff passes, closing
+// if it succeeds and opening for twice the backoff, up to maxBackoff, if it fails.
+type HealthTracker struct {
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// mutex protects clusters and probing
+	mutex    sync.Mutex
+	clusters map[string]*ClusterHealth
+	// probing are the half open clusters with a probe in progress
+	probing map[string]bool
+}
+
+func NewHealthTracker(threshold int, backoff time.Duration, maxBackoff time.Duration) *HealthTracker {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return &HealthTracker{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		clusters:   make(map[string]*ClusterHealth),
+		probing:    make(map[string]bool),
+	}
+}
+
+// Allow checks if a request can be sent to a cluster, returning why not otherwise. Allowing a
+// request to a cluster whose backoff passed makes it the probe of the cluster.
+func (h *HealthTracker) Allow(clusterId string) (bool, string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health, exists := h.clusters[clusterId]
+	if !exists || health.State == CircuitClosed {
+		return true, ""
+	}
+	if health.State == CircuitOpen && time.Now().Before(health.OpenUntil) {
+		return false, fmt.Sprintf("circuit open after %d consecutive failures until %s: %s",
+			health.ConsecutiveFailures, health.OpenUntil.Format(time.RFC3339), health.LastError)
+	}
+	if h.probing[clusterId] {
+		return false, fmt.Sprintf("circuit half-open, probe in progress: %s", health.LastError)
+	}
+	health.State = CircuitHalfOpen
+	h.probing[clusterId] = true
+	return true, ""
+}
+
+// Record updates the health of a cluster with the result of a request. Only the errors of
+// clusters not reachable or not answering in time count as failures.
+func (h *HealthTracker) Record(clusterId string, err error) {
+	if err != nil && !isClusterFailure(err) {
+		err = nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.probing, clusterId)
+
+	health, exists := h.clusters[clusterId]
+	if err == nil {
+		if exists && health.State != CircuitClosed {
+			log.Info().Str("clusterId", clusterId).Msg("cluster recovered, circuit closed")
+		}
+		delete(h.clusters, clusterId)
+		return
+	}
+
+	if !exists {
+		health = &ClusterHealth{State: CircuitClosed}
+		h.clusters[clusterId] = health
+	}
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	switch {
+	case health.State == CircuitHalfOpen:
+		health.Backoff *= 2
+		if health.Backoff > h.maxBackoff {
+			health.Backoff = h.maxBackoff
+		}
+	case health.State == CircuitClosed && health.ConsecutiveFailures >= h.threshold:
+		health.Backoff = h.backoff
+	default:
+		return
+	}
+	health.State = CircuitOpen
+	health.OpenUntil = time.Now().Add(health.Backoff)
+	log.Warn().Str("clusterId", clusterId).Int("failures", health.ConsecutiveFailures).
+		Str("backoff", health.Backoff.String()).Str("err", health.LastError).Msg("circuit opened")
+}
+
+// Release gives up the probe of a cluster whose request was cancelled, so the next request probes it
+func (h *HealthTracker) Release(clusterId string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.probing[clusterId] {
+		delete(h.probing, clusterId)
+		h.clusters[clusterId].State = CircuitOpen
+	}
+}
+
+// Health returns the health of a cluster
+func (h *HealthTracker) Health(clusterId string) ClusterHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	health, exists := h.clusters[clusterId]
+	if !exists {
+		return ClusterHealth{State: CircuitClosed}
+	}
+	return *health
+}
+
+// isClusterFailure checks if an error means the cluster is not reachable or not answering in time
+func isClusterFailure(err error) bool {
+	clusterStatus := errorStatus(err)
+	return clusterStatus != entities.ClusterStorageError && clusterStatus != entities.ClusterCoordinatorError
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("Health tracker", func() {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	ginkgo.It("should open the circuit after consecutive failures", func() {
+		health := NewHealthTracker(2, time.Minute, time.Hour)
+		tests := []struct {
+			err      error
+			expected CircuitState
+		}{
+			{unavailable, CircuitClosed},
+			// Clusters answering with errors are reachable
+			{status.Error(codes.InvalidArgument, "invalid request"), CircuitClosed},
+			{unavailable, CircuitClosed},
+			{fmt.Errorf("cannot connect"), CircuitOpen},
+		}
+		for _, test := range tests {
+			health.Record("cluster-1", test.err)
+			gomega.Expect(health.Health("cluster-1").State).Should(gomega.Equal(test.expected))
+		}
+
+		allowed, reason := health.Allow("cluster-1")
+		gomega.Expect(allowed).Should(gomega.BeFalse())
+		gomega.Expect(reason).Should(gomega.ContainSubstring("cannot connect"))
+		allowed, _ = health.Allow("cluster-2")
+		gomega.Expect(allowed).Should(gomega.BeTrue())
+	})
+
+	ginkgo.It("should probe the cluster when the backoff passes", func() {
+		health := NewHealthTracker(1, 50*time.Millisecond, 80*time.Millisecond)
+		health.Record("cluster-1", unavailable)
+		gomega.Expect(health.Health("cluster-1").Backoff).Should(gomega.Equal(50 * time.Millisecond))
+
+		// A failed probe doubles the backoff up to the maximum
+		time.Sleep(60 * time.Millisecond)
+		allowed, _ := health.Allow("cluster-1")
+		gomega.Expect(allowed).Should(gomega.BeTrue())
+		gomega.Expect(health.Health("cluster-1").State).Should(gomega.Equal(CircuitHalfOpen))
+		allowed, reason := health.Allow("cluster-1")
+		gomega.Expect(allowed).Should(gomega.BeFalse())
+		gomega.Expect(reason).Should(gomega.ContainSubstring("probe in progress"))
+		health.Record("cluster-1", unavailable)
+		gomega.Expect(health.Health("cluster-1").State).Should(gomega.Equal(CircuitOpen))
+		gomega.Expect(health.Health("cluster-1").Backoff).Should(gomega.Equal(80 * time.Millisecond))
+
+		// A cancelled probe lets the next request probe
+		time.Sleep(90 * time.Millisecond)
+		allowed, _ = health.Allow("cluster-1")
+		gomega.Expect(allowed).Should(gomega.BeTrue())
+		health.Release("cluster-1")
+		allowed, _ = health.Allow("cluster-1")
+		gomega.Expect(allowed).Should(gomega.BeTrue())
+
+		// A successful probe closes the circuit
+		health.Record("cluster-1", nil)
+		gomega.Expect(health.Health("cluster-1")).Should(gomega.Equal(ClusterHealth{State: CircuitClosed}))
+	})
+
+	ginkgo.It("should skip the clusters with the circuit open", func() {
+		connections := make(map[string]int)
+		factory := func(address string, params *client.LoggingClientParams) (client.LoggingClient, error) {
+			connections[address]++
+			if address == "cluster-b:443" {
+				return &flakyLoggingClient{err: unavailable, failures: 1}, nil
+			}
+			return &mockupLoggingClient{search: managers.NewMockupSearchManagerWithEntries(generateEntries("a", 10, 0))}, nil
+		}
+		// A single request at a time, so the connections can be counted safely
+		executor := NewLoggingExecutor(factory, &client.LoggingClientParams{}, 1, time.Second)
+		executor.Health = NewHealthTracker(2, time.Minute, time.Hour)
+		executor.Retry = RetryPolicy{Attempts: 1}
+		manager := NewManager(nil, &mockupClustersClient{clusters: []string{"cluster-a", "cluster-b"}}, executor, "", 443, time.Second)
+
+		request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId}
+		for i := 0; i < 4; i++ {
+			res, _, err := manager.Search(context.Background(), request, nil)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(responseTimestamps(res)).Should(gomega.HaveLen(10))
+			gomega.Expect(res.FailedClusterIds).Should(gomega.Equal([]string{"cluster-b"}))
+		}
+		gomega.Expect(connections).Should(gomega.Equal(map[string]int{"cluster-a:443": 4, "cluster-b:443": 2}))
+	})
+})
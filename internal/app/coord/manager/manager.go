@@ -23,20 +23,24 @@ import (
 	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-connectivity-manager-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
 	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"sort"
 	"time"
 
-	"github.com/nalej/grpc-app-cluster-api-go"
 	"github.com/nalej/grpc-application-go"
-	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-infrastructure-go"
-	"github.com/nalej/grpc-organization-go"
 	"github.com/nalej/grpc-organization-manager-go"
 	"github.com/nalej/grpc-unified-logging-go"
 )
 
+// defaultLogExpiration is the number of days the entries of an organization are kept when none of its
+// retention policies applies to them
 const defaultLogExpiration = 7
 
 type Manager struct {
@@ -44,18 +48,31 @@ type Manager struct {
 	ClustersClient     grpc_infrastructure_go.ClustersClient
 	OrgClient          grpc_organization_manager_go.OrganizationsClient
 	Executor           *LoggingExecutor
+	// Topology caches the clusters listed by ClustersClient
+	Topology *TopologyCache
+	// FailurePolicy decides if searches and expirations fail when some of their clusters fail
+	FailurePolicy entities.FailurePolicy
+	// Experimental enables the features the application cluster API does not forward yet
+	Experimental bool
 
 	appClusterPrefix string
 	appClusterPort   int
+	tailPollInterval time.Duration
 }
 
-func NewManager(apps grpc_application_go.ApplicationsClient, clusters grpc_infrastructure_go.ClustersClient, executor *LoggingExecutor, prefix string, port int) *Manager {
+func NewManager(apps grpc_application_go.ApplicationsClient, clusters grpc_infrastructure_go.ClustersClient, executor *LoggingExecutor, prefix string, port int, tailPollInterval time.Duration) *Manager {
+	if tailPollInterval <= 0 {
+		tailPollInterval = DefaultTailPollInterval
+	}
 	return &Manager{
 		ApplicationsClient: apps,
 		ClustersClient:     clusters,
 		Executor:           executor,
+		Topology:           NewTopologyCache(clusters, apps, DefaultTopologyTTL),
+		FailurePolicy:      entities.FailurePolicy{MaxFailedClusters: -1},
 		appClusterPrefix:   prefix,
 		appClusterPort:     port,
+		tailPollInterval:   tailPollInterval,
 	}
 }
 
@@ -64,16 +81,11 @@ type ClusterInfo struct {
 	id   string
 }
 
+// GetHosts returns the online clusters of the organization of fields
 func (m *Manager) GetHosts(ctx context.Context, fields *entities.FilterFields) ([]ClusterInfo, derrors.Error) {
-	// For now we just return all hosts for an organization
-	// TODO: filter out hosts for appinstanceid, servicegroupinstanceid, servicegroupid, serviceId, serviceinstanceid
-
-	org := &grpc_organization_go.OrganizationId{
-		OrganizationId: fields.OrganizationId,
-	}
-	clusters, err := m.ClustersClient.ListClusters(ctx, org)
-	if err != nil {
-		return nil, derrors.NewInternalError("error getting cluster list", err)
+	clusters, derr := m.Topology.GetClusters(ctx, fields.OrganizationId)
+	if derr != nil {
+		return nil, derr
 	}
 
 	prefix := m.appClusterPrefix
@@ -81,11 +93,10 @@ func (m *Manager) GetHosts(ctx context.Context, fields *entities.FilterFields) (
 		prefix = prefix + "."
 	}
 
-	clusterList := clusters.GetClusters()
 	hosts := make([]ClusterInfo, 0)
-	for _, cluster := range clusterList {
-		if cluster.ClusterStatus != grpc_connectivity_manager_go.ClusterStatus_OFFLINE && cluster.ClusterStatus != grpc_connectivity_manager_go.ClusterStatus_OFFLINE_CORDON {
-			host := fmt.Sprintf("%s%s:%d", prefix, cluster.GetHostname(), m.appClusterPort)
+	for _, cluster := range clusters {
+		if cluster.Status != grpc_connectivity_manager_go.ClusterStatus_OFFLINE && cluster.Status != grpc_connectivity_manager_go.ClusterStatus_OFFLINE_CORDON {
+			host := fmt.Sprintf("%s%s:%d", prefix, cluster.Hostname, m.appClusterPort)
 			hosts = append(hosts, ClusterInfo{host, cluster.ClusterId})
 		}
 	}
@@ -93,10 +104,71 @@ func (m *Manager) GetHosts(ctx context.Context, fields *entities.FilterFields) (
 	return hosts, nil
 }
 
+// GetSearchHosts returns the hosts of GetHosts that are searched for fields. When fields have an
+// application instance, only the clusters where it is deployed are returned, or all of them if
+// its placement cannot be resolved. Expirations and retention policies use GetHosts instead, as
+// the entries stay in the clusters the application instance is no longer deployed on.
+func (m *Manager) GetSearchHosts(ctx context.Context, fields *entities.FilterFields) ([]ClusterInfo, derrors.Error) {
+	hosts, derr := m.GetHosts(ctx, fields)
+	if derr != nil {
+		return nil, derr
+	}
+
+	placement, derr := m.placementClusters(ctx, fields)
+	if derr != nil {
+		log.Warn().Str("appInstanceId", fields.AppInstanceId).Str("err", derr.DebugReport()).
+			Msg("application placement not resolved, querying all the clusters")
+	}
+	if placement == nil {
+		return hosts, nil
+	}
+
+	placed := make([]ClusterInfo, 0, len(hosts))
+	for _, host := range hosts {
+		if placement[host.id] {
+			placed = append(placed, host)
+		}
+	}
+	return placed, nil
+}
+
+// execRequests executes f on the clusters of an organization whose circuit is not open, and
+// returns the outcome of every cluster, sorted by cluster. The clusters of the organization are
+// listed again in the next request if any of them is unavailable or not found, as they may have
+// changed; timeouts and storage errors do not tell the clusters changed.
+func (m *Manager) execRequests(ctx context.Context, organizationId string, hosts []ClusterInfo, f ExecFunc) entities.ClusterOutcomes {
+	admitted, indices, skipped := m.Executor.admit(hosts)
+	// Each host stores whether it was not found in its own position, so it's safe to fill it concurrently
+	notFound := make([]bool, len(admitted))
+	// f receives the index of the host in hosts
+	admittedFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		count, err := f(ctx, client, indices[i])
+		notFound[i] = status.Code(err) == codes.NotFound
+		return count, err
+	}
+	outcomes := m.Executor.ExecRequests(ctx, admitted, admittedFunc)
+	for i, outcome := range outcomes {
+		if outcome.Status == entities.ClusterUnavailable || notFound[i] {
+			m.Topology.Invalidate(organizationId)
+			break
+		}
+	}
+	outcomes = append(outcomes, skipped...)
+	outcomes.Sort()
+	return outcomes
+}
+
 // Search method that sends a Search message to all the clusters (logging-slave)
+func (m *Manager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions) (*grpc_unified_logging_go.LogResponseList, string, derrors.Error) {
+	list, next, _, err := m.SearchClusters(ctx, request, options)
+	return list, next, err
+}
+
+// SearchClusters searches the clusters as Search, returning the outcome of every cluster queried
+// even if the search fails because of the failure policy
 // TODO: the slaves returns a ReponseList. The ccoordinator has to convert this into an array log entries, order all the messages by timestamp and group again by identifiers.
 // we should change the slaves so that they return an array of logs
-func (m *Manager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest) (*grpc_unified_logging_go.LogResponseList, derrors.Error) {
+func (m *Manager) SearchClusters(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions) (*grpc_unified_logging_go.LogResponseList, string, entities.ClusterOutcomes, derrors.Error) {
 
 	// We have a verified request
 	fields := &entities.FilterFields{
@@ -109,128 +181,197 @@ func (m *Manager) Search(ctx context.Context, request *grpc_unified_logging_go.S
 		ServiceInstanceId:      request.ServiceInstanceId,
 	}
 
-	hosts, err := m.GetHosts(ctx, fields)
+	// The application cluster API does not forward the search options yet
+	if !m.Experimental {
+		options = nil
+	}
+
+	// The cursor holds the position of the search in every cluster
+	cursors, err := entities.DecodeClusterCursors(options.GetCursor())
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	// Every cluster is asked for the same limit and order, so the first entries of the merge are right
+	limit := options.GetLimit()
+	order := options.GetOrder(request.NFirst)
+
+	hosts, err := m.GetSearchHosts(ctx, fields)
 	if err != nil {
-		return nil, err
+		return nil, "", nil, err
 	}
 
-	// TODO: call to slave in different threads
-	out := make([]*grpc_unified_logging_go.LogResponseList, len(hosts))
+	// Clusters with no more entries are not queried again
+	pending := make([]ClusterInfo, 0, len(hosts))
+	for _, host := range hosts {
+		clusterCursor, exists := cursors[host.id]
+		if !exists {
+			clusterCursor = &entities.ClusterCursor{}
+			cursors[host.id] = clusterCursor
+		}
+		if !clusterCursor.Done {
+			pending = append(pending, host)
+		}
+	}
 
-	execFunc := func(ctx context.Context, client grpc_app_cluster_api_go.UnifiedLoggingClient, i int) (int, error) {
-		res, err := client.Search(ctx, request)
+	// Each host stores its result in its own position, so it's safe to fill it concurrently
+	out := make([]*grpc_unified_logging_go.LogResponseList, len(pending))
+	nextCursors := make([]string, len(pending))
+	skips := make([]int, len(pending))
+	for i, host := range pending {
+		skips[i] = cursors[host.id].Skip
+	}
+
+	// The cursor of every cluster is added to the options they all share
+	pairs := (&entities.SearchOptions{Limit: limit, Order: &order, MinLevel: options.GetMinLevel()}).MetadataPairs()
+	execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		ctx = metadata.AppendToOutgoingContext(ctx, pairs...)
+		if clusterCursor := cursors[pending[i].id].Cursor; clusterCursor != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, entities.CursorMetadataKey, clusterCursor)
+		}
+		var header metadata.MD
+		res, err := client.Search(ctx, request, grpc.Header(&header))
 		if err != nil {
 			return 0, err
 		}
 		out[i] = res
-		return len(out[i].Responses), nil
+		if values := header.Get(entities.NextCursorMetadataKey); len(values) > 0 {
+			nextCursors[i] = values[0]
+		}
+		return responseEntries(res), nil
 	}
 
-	total, errorIds, err := m.Executor.ExecRequests(ctx, hosts, execFunc)
-	// TODO: Do we return some logs when we have an error, or none?
+	outcomes := m.execRequests(ctx, fields.OrganizationId, pending, execFunc)
+	err = outcomes.CoordinatorError()
+	if err == nil {
+		err = m.FailurePolicy.Check(outcomes)
+	}
 	if err != nil {
-		return nil, err
+		return nil, "", outcomes, err
 	}
 
-	return m.mergeAllResponses(out, total, request, errorIds), nil
+	list, consumed, available := m.mergeAllResponses(out, skips, limit, order, request, outcomes.FailedClusterIds())
+	if !m.Experimental {
+		return list, "", outcomes, nil
+	}
+
+	return list, m.nextCursor(pending, cursors, out, nextCursors, consumed, available), outcomes, nil
 }
 
-func (m *Manager) mergeAllResponses(lists []*grpc_unified_logging_go.LogResponseList, total int, request *grpc_unified_logging_go.SearchRequest, errorIds []string) *grpc_unified_logging_go.LogResponseList {
-	// we need to get only the last limitPerSearch entry logs.
-	// 1) convert LogResponseList in []LogEntry
-	// 2) order by timestamp
-	// 3) get last or first limitPerSearch Log entries
-	// 4) and convert into LogResponseList again
+// responseEntries returns the number of log entries of a response
+func responseEntries(list *grpc_unified_logging_go.LogResponseList) int {
+	entries := 0
+	for _, response := range list.GetResponses() {
+		entries += len(response.GetEntries())
+	}
+	return entries
+}
 
-	// 1)
-	logEntries := make([]*entities.LogEntry, 0)
-	for _, logResponseList := range lists {
-		// if one of the slaves returns an error, logResponseList can be nil
-		if logResponseList == nil {
+// nextCursor updates the position of the search in every cluster with the entries returned in this page
+func (m *Manager) nextCursor(hosts []ClusterInfo, cursors entities.ClusterCursors, lists []*grpc_unified_logging_go.LogResponseList, nextCursors []string, consumed []int, available []int) string {
+	returned := 0
+	for i, host := range hosts {
+		// Failed clusters are asked for the same page again
+		if lists[i] == nil {
 			continue
 		}
-		for _, logResponse := range logResponseList.Responses {
-			for _, entry := range logResponse.Entries {
-				logEntries = append(logEntries, &entities.LogEntry{
-					Timestamp: time.Unix(0, entry.Timestamp),
-					Msg:       entry.Msg,
-					Kubernetes: entities.KubernetesEntry{
-						Labels: entities.KubernetesLabelsEntry{
-							OrganizationId:            logResponseList.OrganizationId,
-							AppDescriptorId:           logResponse.AppDescriptorId,
-							AppDescriptorName:         logResponse.AppDescriptorName,
-							AppInstanceId:             logResponse.AppInstanceId,
-							AppInstanceName:           logResponse.AppInstanceName,
-							AppServiceGroupId:         logResponse.ServiceGroupId,
-							AppServiceGroupName:       logResponse.ServiceGroupName,
-							AppServiceGroupInstanceId: logResponse.ServiceGroupInstanceId,
-							AppServiceId:              logResponse.ServiceId,
-							AppServiceName:            logResponse.ServiceName,
-							AppServiceInstanceId:      logResponse.ServiceInstanceId,
-						},
-					},
-				})
-			}
+		returned += consumed[i]
+		clusterCursor := cursors[host.id]
+		if consumed[i] < available[i] {
+			clusterCursor.Skip += consumed[i]
+		} else if nextCursors[i] == "" {
+			clusterCursor.Done = true
+		} else {
+			clusterCursor.Cursor = nextCursors[i]
+			clusterCursor.Skip = 0
 		}
 	}
-	// 2)
-	sort.SliceStable(logEntries, func(i, j int) bool {
-		return logEntries[i].Timestamp.Before(logEntries[j].Timestamp)
-	})
 
-	// 3)
-	if len(logEntries) > entities.LimitPerSearch {
-		if request.NFirst {
-			logEntries = logEntries[0:entities.LimitPerSearch]
-		} else {
-			logEntries = logEntries[len(logEntries)-entities.LimitPerSearch-1 : entities.LimitPerSearch]
+	// No next page when nothing was returned or every cluster is done
+	if returned == 0 {
+		return ""
+	}
+	for _, clusterCursor := range cursors {
+		if !clusterCursor.Done {
+			return cursors.Encode()
 		}
 	}
+	return ""
+}
 
-	// 4)
-	var from, to int64
-	from = request.From
-	to = request.To
-
-	if len(logEntries) > 0 {
-		from = logEntries[len(logEntries)-1].Timestamp.UnixNano()
-		to = logEntries[0].Timestamp.UnixNano()
-
-		if from > to {
-			aux := to
-			to = from
-			from = aux
+// clusterEntries converts the response of a cluster into log entries in the order they were
+// sorted by the slave, discarding the first skip entries
+func clusterEntries(logResponseList *grpc_unified_logging_go.LogResponseList, skip int, order entities.SortOrder) []*entities.LogEntry {
+	logEntries := make([]*entities.LogEntry, 0)
+	for _, logResponse := range logResponseList.Responses {
+		for _, entry := range logResponse.Entries {
+			logEntries = append(logEntries, &entities.LogEntry{
+				Timestamp: time.Unix(0, entry.Timestamp),
+				Msg:       entry.Msg,
+				Kubernetes: entities.KubernetesEntry{
+					Labels: entities.KubernetesLabelsEntry{
+						OrganizationId:            logResponseList.OrganizationId,
+						AppDescriptorId:           logResponse.AppDescriptorId,
+						AppDescriptorName:         logResponse.AppDescriptorName,
+						AppInstanceId:             logResponse.AppInstanceId,
+						AppInstanceName:           logResponse.AppInstanceName,
+						AppServiceGroupId:         logResponse.ServiceGroupId,
+						AppServiceGroupName:       logResponse.ServiceGroupName,
+						AppServiceGroupInstanceId: logResponse.ServiceGroupInstanceId,
+						AppServiceId:              logResponse.ServiceId,
+						AppServiceName:            logResponse.ServiceName,
+						AppServiceInstanceId:      logResponse.ServiceInstanceId,
+					},
+				},
+			})
 		}
 	}
 
-	list := entities.MergeLogEntries(request.OrganizationId, from, to, logEntries, errorIds)
-	return list
+	// The slave groups the entries, so we sort them again
+	sort.SliceStable(logEntries, func(i, j int) bool {
+		if order.ToAscending() {
+			return logEntries[i].Timestamp.Before(logEntries[j].Timestamp)
+		}
+		return logEntries[i].Timestamp.After(logEntries[j].Timestamp)
+	})
 
+	if skip >= len(logEntries) {
+		return []*entities.LogEntry{}
+	}
+	return logEntries[skip:]
 }
 
-func (m *Manager) Expire(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*grpc_common_go.Success, derrors.Error) {
-	// We have a verified request
-	fields := &entities.FilterFields{
-		OrganizationId: request.GetOrganizationId(),
-		AppInstanceId:  request.GetAppInstanceId(),
-	}
+// mergeAllResponses merges the responses of all the clusters, returning at most limit entries (all if
+// negative): the oldest ones for ascending order, the newest ones for descending order. It returns the
+// merged response, the number of entries of each cluster in it and the number of entries each cluster had available
+func (m *Manager) mergeAllResponses(lists []*grpc_unified_logging_go.LogResponseList, skips []int, limit int, order entities.SortOrder, request *grpc_unified_logging_go.SearchRequest, errorIds []string) (*grpc_unified_logging_go.LogResponseList, []int, []int) {
+	// 1) convert every LogResponseList into []LogEntry, sorted like the slave did
+	// 2) merge them in that order up to the limit
+	// 3) and convert into LogResponseList again
 
-	hosts, err := m.GetHosts(ctx, fields)
-	if err != nil {
-		return nil, err
+	// 1)
+	clusterLists := make([][]*entities.LogEntry, len(lists))
+	available := make([]int, len(lists))
+	for i, logResponseList := range lists {
+		// if one of the slaves returns an error, logResponseList can be nil
+		if logResponseList == nil {
+			continue
+		}
+		clusterLists[i] = clusterEntries(logResponseList, skips[i], order)
+		available[i] = len(clusterLists[i])
 	}
 
-	execFunc := func(ctx context.Context, client grpc_app_cluster_api_go.UnifiedLoggingClient, i int) (int, error) {
-		_, err := client.Expire(ctx, request)
-		return 0, err
-	}
-	_, errorIds, err := m.Executor.ExecRequests(ctx, hosts, execFunc)
-	// Even with error we'll have expired something maybe - what do we do here?
-	if err != nil {
-		return nil, err
-	}
+	// 2)
+	logEntries, consumed := mergeSorted(clusterLists, limit, order.ToAscending())
 
-	log.Debug().Interface("errors", errorIds).Msg("errors in search")
+	// 3)
+	// The response covers the time range of the entries returned
+	from, to, found := entities.LogEntries(logEntries).TimeRange()
+	if !found {
+		from = request.From
+		to = request.To
+	}
 
-	return &grpc_common_go.Success{}, nil
+	list := entities.MergeLogEntries(request.OrganizationId, from, to, logEntries, errorIds)
+	return list, consumed, available
 }
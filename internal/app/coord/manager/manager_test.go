@@ -0,0 +1,353 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-connectivity-manager-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	OrganizationId = "2a95fe95-eade-4622-836f-e85d789024bf"
+	AppInstanceId  = "e9e38334-1da1-4f51-8f18-2bd8e2470123"
+)
+
+var startTime = time.Unix(1550789643, 0).UTC()
+
+// mockupLoggingClient is an application cluster client backed by a search manager,
+// a retention manager and an expiration manager
+type mockupLoggingClient struct {
+	grpc_app_cluster_api_go.UnifiedLoggingClient
+	search     managers.Search
+	retention  managers.RetentionSync
+	expiration managers.ExpirationJobs
+}
+
+func (c *mockupLoggingClient) Search(ctx context.Context, in *grpc_unified_logging_go.SearchRequest, opts ...grpc.CallOption) (*grpc_unified_logging_go.LogResponseList, error) {
+	if c.search == nil {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	// Read the search options like the slave handler would
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := make(map[string]string)
+	for _, key := range entities.SearchOptionsMetadataKeys {
+		if value := md.Get(key); len(value) > 0 {
+			values[key] = value[0]
+		}
+	}
+	options, derr := entities.NewSearchOptions(values)
+	if derr != nil {
+		return nil, derr
+	}
+	res, _, err := c.search.Search(ctx, in, options)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *mockupLoggingClient) Expire(ctx context.Context, in *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	if c.expiration == nil {
+		return nil, fmt.Errorf("expiration not supported")
+	}
+	expire, ok := c.expiration.(managers.Expire)
+	if !ok {
+		return &grpc_common_go.Success{}, nil
+	}
+	res, err := expire.Expire(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *mockupLoggingClient) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	if c.retention == nil {
+		return nil, fmt.Errorf("retention policies not supported")
+	}
+	res, err := c.retention.SyncRetentionPolicies(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *mockupLoggingClient) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	if c.expiration == nil {
+		return nil, fmt.Errorf("expiration jobs not supported")
+	}
+	res, err := c.expiration.StartExpiration(ctx, request)
+	if err != nil {
+		if err.Type() == derrors.Unimplemented {
+			// As the application cluster APIs that do not forward the service
+			return nil, status.Error(codes.Unimplemented, err.Error())
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *mockupLoggingClient) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	if c.expiration == nil {
+		return nil, fmt.Errorf("expiration jobs not supported")
+	}
+	res, err := c.expiration.GetExpirationJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *mockupLoggingClient) Close() error {
+	return nil
+}
+
+// mockupClustersClient returns a fixed list of online clusters
+type mockupClustersClient struct {
+	grpc_infrastructure_go.ClustersClient
+	clusters []string
+}
+
+func (c *mockupClustersClient) ListClusters(ctx context.Context, in *grpc_organization_go.OrganizationId, opts ...grpc.CallOption) (*grpc_infrastructure_go.ClusterList, error) {
+	list := &grpc_infrastructure_go.ClusterList{}
+	for _, id := range c.clusters {
+		list.Clusters = append(list.Clusters, &grpc_infrastructure_go.Cluster{
+			OrganizationId: in.OrganizationId,
+			ClusterId:      id,
+			Hostname:       id,
+			ClusterStatus:  grpc_connectivity_manager_go.ClusterStatus_ONLINE,
+		})
+	}
+	return list, nil
+}
+
+// newMockupManager returns a coordinator manager querying a mockup search manager per cluster
+func newMockupManager(clusters map[string]managers.Search) *Manager {
+	ids := make([]string, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	factory := func(address string, params *client.LoggingClientParams) (client.LoggingClient, error) {
+		for id, search := range clusters {
+			if address == fmt.Sprintf("%s:%d", id, 443) {
+				return &mockupLoggingClient{search: search}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown cluster %s", address)
+	}
+	executor := NewLoggingExecutor(factory, &client.LoggingClientParams{}, 2, time.Second)
+	manager := NewManager(nil, &mockupClustersClient{clusters: ids}, executor, "", 443, time.Second)
+	manager.Experimental = true
+	return manager
+}
+
+// generateEntries returns num entries of a service instance, every two seconds starting at startTime plus offset
+func generateEntries(serviceInstanceId string, num int, offset time.Duration) entities.LogEntries {
+	entries := make(entities.LogEntries, num)
+	for i := 0; i < num; i++ {
+		entries[i] = &entities.LogEntry{
+			Timestamp: startTime.Add(offset + time.Duration(2*i)*time.Second),
+			Msg:       fmt.Sprintf("Log line %s %d", serviceInstanceId, i),
+			Kubernetes: entities.KubernetesEntry{
+				Labels: entities.KubernetesLabelsEntry{
+					OrganizationId:       OrganizationId,
+					AppInstanceId:        AppInstanceId,
+					AppServiceInstanceId: serviceInstanceId,
+				},
+			},
+		}
+	}
+	return entries
+}
+
+// responseTimestamps returns the timestamps of all the entries of a response
+func responseTimestamps(list *grpc_unified_logging_go.LogResponseList) []int64 {
+	timestamps := make([]int64, 0)
+	for _, response := range list.Responses {
+		for _, entry := range response.Entries {
+			timestamps = append(timestamps, entry.Timestamp)
+		}
+	}
+	return timestamps
+}
+
+var _ = ginkgo.Describe("Manager", func() {
+
+	ginkgo.Context("mergeSorted", func() {
+		ginkgo.It("should merge ascending lists up to the limit", func() {
+			a := generateEntries("a", 3, 0)
+			b := generateEntries("b", 3, time.Second)
+			merged, consumed := mergeSorted([][]*entities.LogEntry{a, b, {}}, 4, true)
+			gomega.Expect(merged).Should(gomega.Equal([]*entities.LogEntry{a[0], b[0], a[1], b[1]}))
+			gomega.Expect(consumed).Should(gomega.Equal([]int{2, 2, 0}))
+		})
+		ginkgo.It("should merge descending lists", func() {
+			a := generateEntries("a", 2, 0)
+			b := generateEntries("b", 2, time.Second)
+			merged, consumed := mergeSorted([][]*entities.LogEntry{{a[1], a[0]}, {b[1], b[0]}}, -1, false)
+			gomega.Expect(merged).Should(gomega.Equal([]*entities.LogEntry{b[1], a[1], b[0], a[0]}))
+			gomega.Expect(consumed).Should(gomega.Equal([]int{2, 2}))
+		})
+		ginkgo.It("should handle no entries", func() {
+			merged, consumed := mergeSorted([][]*entities.LogEntry{nil, nil}, 10, true)
+			gomega.Expect(merged).Should(gomega.BeEmpty())
+			gomega.Expect(consumed).Should(gomega.Equal([]int{0, 0}))
+		})
+	})
+
+	ginkgo.Context("Search", func() {
+		var manager *Manager
+
+		ginkgo.BeforeEach(func() {
+			// Two clusters with 1500 entries each, interleaved every second
+			manager = newMockupManager(map[string]managers.Search{
+				"cluster-a": managers.NewMockupSearchManagerWithEntries(generateEntries("a", 1500, 0)),
+				"cluster-b": managers.NewMockupSearchManagerWithEntries(generateEntries("b", 1500, time.Second)),
+			})
+		})
+
+		ginkgo.It("should return the oldest entries in ascending order with NFirst", func() {
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: true}
+			res, _, err := manager.Search(context.Background(), request, nil)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			timestamps := responseTimestamps(res)
+			gomega.Expect(timestamps).Should(gomega.HaveLen(entities.LimitPerSearch))
+			gomega.Expect(res.From).Should(gomega.Equal(startTime.UnixNano()))
+			gomega.Expect(res.To).Should(gomega.Equal(startTime.Add(999 * time.Second).UnixNano()))
+			gomega.Expect(res.FailedClusterIds).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should return the newest entries without NFirst", func() {
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: false}
+			res, _, err := manager.Search(context.Background(), request, nil)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			timestamps := responseTimestamps(res)
+			gomega.Expect(timestamps).Should(gomega.HaveLen(entities.LimitPerSearch))
+			gomega.Expect(res.From).Should(gomega.Equal(startTime.Add(2000 * time.Second).UnixNano()))
+			gomega.Expect(res.To).Should(gomega.Equal(startTime.Add(2999 * time.Second).UnixNano()))
+		})
+		ginkgo.It("should report the time range of the entries returned", func() {
+			request := &grpc_unified_logging_go.SearchRequest{
+				OrganizationId: OrganizationId,
+				From:           startTime.Add(10 * time.Second).UnixNano(),
+				To:             startTime.Add(20 * time.Second).UnixNano(),
+				NFirst:         true,
+			}
+			res, _, err := manager.Search(context.Background(), request, nil)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(responseTimestamps(res)).Should(gomega.HaveLen(11))
+			gomega.Expect(res.From).Should(gomega.Equal(request.From))
+			gomega.Expect(res.To).Should(gomega.Equal(request.To))
+		})
+		ginkgo.It("should honour the requested limit and sort order", func() {
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: true}
+			order := entities.Descending
+			res, _, err := manager.Search(context.Background(), request, &entities.SearchOptions{Limit: 10, Order: &order})
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			timestamps := responseTimestamps(res)
+			gomega.Expect(timestamps).Should(gomega.HaveLen(10))
+			gomega.Expect(res.From).Should(gomega.Equal(startTime.Add(2990 * time.Second).UnixNano()))
+			gomega.Expect(res.To).Should(gomega.Equal(startTime.Add(2999 * time.Second).UnixNano()))
+		})
+		ginkgo.It("should ignore the search options without the experimental features", func() {
+			manager.Experimental = false
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: true}
+			order := entities.Descending
+			res, _, err := manager.Search(context.Background(), request, &entities.SearchOptions{Limit: 10, Order: &order})
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(responseTimestamps(res)).Should(gomega.HaveLen(entities.LimitPerSearch))
+			gomega.Expect(res.From).Should(gomega.Equal(startTime.UnixNano()))
+		})
+		ginkgo.It("should cap the requested limit", func() {
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: true}
+			res, _, err := manager.Search(context.Background(), request, &entities.SearchOptions{Limit: 2 * entities.LimitPerSearch})
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(responseTimestamps(res)).Should(gomega.HaveLen(entities.LimitPerSearch))
+		})
+		ginkgo.It("should forward the minimum level to the clusters", func() {
+			entries := generateEntries("a", 4, 0)
+			for i, level := range []string{"debug", "error", "", "fatal"} {
+				entries[i].Level = level
+			}
+			manager := newMockupManager(map[string]managers.Search{
+				"cluster-a": managers.NewMockupSearchManagerWithEntries(entries),
+			})
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, NFirst: true}
+			res, _, err := manager.Search(context.Background(), request, &entities.SearchOptions{MinLevel: entities.ErrorLevel})
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(responseTimestamps(res)).Should(gomega.Equal([]int64{entries[1].Timestamp.UnixNano(), entries[3].Timestamp.UnixNano()}))
+		})
+		ginkgo.It("should tail the entries with the minimum level, keeping repeated lines", func() {
+			entries := generateEntries("a", 4, 0)
+			for i, level := range []string{"debug", "error", "", "fatal"} {
+				entries[i].Level = level
+			}
+			repeated := *entries[1]
+			entries = append(entries, &repeated)
+			manager := newMockupManager(map[string]managers.Search{
+				"cluster-a": managers.NewMockupSearchManagerWithEntries(entries),
+			})
+			// The tail ends after the first poll, as To is in the past
+			request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId, From: startTime.UnixNano(), To: startTime.Add(time.Minute).UnixNano()}
+			timestamps := make([]int64, 0)
+			err := manager.Tail(context.Background(), request, &entities.SearchOptions{MinLevel: entities.ErrorLevel}, func(list *grpc_unified_logging_go.LogResponseList) error {
+				timestamps = append(timestamps, responseTimestamps(list)...)
+				return nil
+			})
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(timestamps).Should(gomega.Equal([]int64{entries[1].Timestamp.UnixNano(), entries[1].Timestamp.UnixNano(), entries[3].Timestamp.UnixNano()}))
+
+			// A line repeated after the last poll is sent, and the ones already sent are not
+			state := &tailState{from: entries[1].Timestamp.UnixNano(), sent: map[string]int{}}
+			gomega.Expect(state.newEntries(entries[1:2])).Should(gomega.HaveLen(1))
+			gomega.Expect(state.newEntries([]*entities.LogEntry{entries[1], &repeated})).Should(gomega.HaveLen(1))
+			gomega.Expect(state.newEntries([]*entities.LogEntry{entries[1], &repeated})).Should(gomega.BeEmpty())
+		})
+		ginkgo.It("should return the requested time range when there are no entries", func() {
+			request := &grpc_unified_logging_go.SearchRequest{
+				OrganizationId: OrganizationId,
+				From:           startTime.Add(-20 * time.Second).UnixNano(),
+				To:             startTime.Add(-10 * time.Second).UnixNano(),
+			}
+			res, _, err := manager.Search(context.Background(), request, nil)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(res.Responses).Should(gomega.BeEmpty())
+			gomega.Expect(res.From).Should(gomega.Equal(request.From))
+			gomega.Expect(res.To).Should(gomega.Equal(request.To))
+		})
+	})
+})
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// K-way merge of the sorted log entries of the clusters
+
+package manager
+
+import (
+	"container/heap"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+)
+
+// mergeHead is the next entry of one of the lists being merged
+type mergeHead struct {
+	list     int
+	position int
+	entry    *entities.LogEntry
+}
+
+// mergeHeap is a heap of the next entry of every list, with the entry that goes first on top
+type mergeHeap struct {
+	heads     []*mergeHead
+	ascending bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.heads) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	if !a.entry.Timestamp.Equal(b.entry.Timestamp) {
+		if h.ascending {
+			return a.entry.Timestamp.Before(b.entry.Timestamp)
+		}
+		return a.entry.Timestamp.After(b.entry.Timestamp)
+	}
+	// Keep the merge deterministic for entries with the same timestamp
+	return a.list < b.list
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.heads = append(h.heads, x.(*mergeHead)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// mergeSorted merges lists sorted by timestamp in the same order (ascending or descending) into a
+// single list in that order with at most limit entries, or all of them if limit is negative.
+// It also returns how many entries of each list were taken, which is always a prefix of the list.
+func mergeSorted(lists [][]*entities.LogEntry, limit int, ascending bool) ([]*entities.LogEntry, []int) {
+	consumed := make([]int, len(lists))
+
+	h := &mergeHeap{
+		heads:     make([]*mergeHead, 0, len(lists)),
+		ascending: ascending,
+	}
+	size := 0
+	for i, list := range lists {
+		size += len(list)
+		if len(list) > 0 {
+			h.heads = append(h.heads, &mergeHead{list: i, position: 0, entry: list[0]})
+		}
+	}
+	heap.Init(h)
+
+	if limit < 0 || limit > size {
+		limit = size
+	}
+	result := make([]*entities.LogEntry, 0, limit)
+	for len(result) < limit {
+		head := h.heads[0]
+		result = append(result, head.entry)
+		consumed[head.list]++
+
+		head.position++
+		if head.position < len(lists[head.list]) {
+			head.entry = lists[head.list][head.position]
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+
+	return result, consumed
+}
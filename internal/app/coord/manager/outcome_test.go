@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("Cluster outcomes", func() {
+	ginkgo.It("should classify the errors of the clusters", func() {
+		tests := []struct {
+			err      error
+			expected entities.ClusterStatus
+		}{
+			{nil, entities.ClusterOK},
+			{context.DeadlineExceeded, entities.ClusterTimeout},
+			{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), entities.ClusterTimeout},
+			{status.Error(codes.Unavailable, "connection refused"), entities.ClusterUnavailable},
+			{status.Error(codes.Unavailable, "authentication handshake failed: x509: certificate signed by unknown authority"), entities.ClusterTLSError},
+			{coordinatorError{derrors.NewInternalError("Error loading client certificate")}, entities.ClusterCoordinatorError},
+			{fmt.Errorf("connection closed"), entities.ClusterUnavailable},
+			{status.Error(codes.Internal, "elastic: Error 500"), entities.ClusterStorageError},
+		}
+		for _, test := range tests {
+			gomega.Expect(errorStatus(test.err)).Should(gomega.Equal(test.expected), fmt.Sprintf("%v", test.err))
+		}
+	})
+
+	ginkgo.It("should report the outcome of every cluster of a search", func() {
+		// cluster-c is not reachable
+		manager := newMockupManager(map[string]managers.Search{
+			"cluster-a": managers.NewMockupSearchManagerWithEntries(generateEntries("a", 10, 0)),
+			"cluster-b": managers.NewMockupSearchManagerWithEntries(generateEntries("b", 5, 0)),
+			"cluster-c": nil,
+		})
+		manager.Executor.Retry = RetryPolicy{Attempts: 1}
+		request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId}
+
+		res, _, outcomes, derr := manager.SearchClusters(context.Background(), request, nil)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(res.FailedClusterIds).Should(gomega.Equal([]string{"cluster-c"}))
+		gomega.Expect(outcomes).Should(gomega.HaveLen(3))
+		expected := []struct {
+			status  entities.ClusterStatus
+			entries int
+		}{
+			{entities.ClusterOK, 10},
+			{entities.ClusterOK, 5},
+			{entities.ClusterUnavailable, 0},
+		}
+		for i, outcome := range outcomes {
+			gomega.Expect(outcome.Status).Should(gomega.Equal(expected[i].status), outcome.ClusterId)
+			gomega.Expect(outcome.Entries).Should(gomega.Equal(expected[i].entries), outcome.ClusterId)
+		}
+		gomega.Expect(outcomes[2].Error).Should(gomega.ContainSubstring("connection refused"))
+
+		// The outcomes are returned with the error of the failure policy
+		manager.FailurePolicy = entities.FailurePolicy{MaxFailedClusters: 0}
+		_, _, outcomes, derr = manager.SearchClusters(context.Background(), request, nil)
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+		gomega.Expect(outcomes.FailedClusterIds()).Should(gomega.Equal([]string{"cluster-c"}))
+	})
+
+	ginkgo.It("should fail with a coordinator error when the clients of the clusters cannot be created", func() {
+		// cluster-b is not known by the client factory
+		manager := newMockupManager(map[string]managers.Search{
+			"cluster-a": managers.NewMockupSearchManagerWithEntries(generateEntries("a", 10, 0)),
+		})
+		manager.Topology = NewTopologyCache(&mockupClustersClient{clusters: []string{"cluster-a", "cluster-b"}}, nil, time.Minute)
+		manager.Executor.Health = NewHealthTracker(1, time.Minute, time.Hour)
+		request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId}
+
+		for i := 0; i < 2; i++ {
+			_, _, outcomes, derr := manager.SearchClusters(context.Background(), request, nil)
+			gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Internal))
+			gomega.Expect(outcomes).Should(gomega.HaveLen(2))
+			gomega.Expect(outcomes[1].Status).Should(gomega.Equal(entities.ClusterCoordinatorError))
+			gomega.Expect(outcomes[1].Error).Should(gomega.ContainSubstring("unknown cluster"))
+		}
+		// The cluster is not blamed for the error of the coordinator
+		gomega.Expect(manager.Executor.Health.Health("cluster-b").State).Should(gomega.Equal(CircuitClosed))
+		gomega.Expect(manager.Topology.Stats().Organizations).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should report the outcome of every cluster of an expiration", func() {
+		manager := newMockupExpirationManager(map[string]*mockupExpirationJobs{
+			"cluster-1": {jobs: make(map[string]*entities.ExpirationJob)},
+			"cluster-2": nil,
+		})
+		request := &grpc_unified_logging_go.ExpirationRequest{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}
+
+		_, outcomes, derr := manager.ExpireClusters(context.Background(), request)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(outcomes.FailedClusterIds()).Should(gomega.Equal([]string{"cluster-2"}))
+
+		manager.FailurePolicy = entities.FailurePolicy{MaxFailedClusters: 0}
+		_, outcomes, derr = manager.ExpireClusters(context.Background(), request)
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+		gomega.Expect(outcomes).Should(gomega.HaveLen(2))
+	})
+})
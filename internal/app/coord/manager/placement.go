@@ -0,0 +1,61 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Clusters where the applications are deployed
+
+package manager
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+)
+
+// placementClusters returns the clusters where the service instances of the application instance
+// of fields are deployed, narrowed by the service group and service fields. It returns nil when
+// the clusters are not known: without application instance, or if it is not deployed anywhere.
+func (m *Manager) placementClusters(ctx context.Context, fields *entities.FilterFields) (map[string]bool, derrors.Error) {
+	if fields.AppInstanceId == "" {
+		return nil, nil
+	}
+	services, derr := m.Topology.GetPlacement(ctx, fields.OrganizationId, fields.AppInstanceId)
+	if derr != nil {
+		return nil, derr
+	}
+
+	clusters := make(map[string]bool)
+	for _, service := range services {
+		if !matchesField(fields.ServiceGroupInstanceId, service.ServiceGroupInstanceId) ||
+			!matchesField(fields.ServiceGroupId, service.ServiceGroupId) ||
+			!matchesField(fields.ServiceInstanceId, service.ServiceInstanceId) ||
+			!matchesField(fields.ServiceId, service.ServiceId) {
+			continue
+		}
+		if service.ClusterId != "" {
+			clusters[service.ClusterId] = true
+		}
+	}
+	if len(clusters) == 0 {
+		return nil, nil
+	}
+	return clusters, nil
+}
+
+// matchesField checks if a value matches a filter field, which matches anything if empty
+func matchesField(filter string, value string) bool {
+	return filter == "" || filter == value
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+// mockupApplicationsClient returns a fixed application instance, or fails if it has none
+type mockupApplicationsClient struct {
+	grpc_application_go.ApplicationsClient
+	instance *grpc_application_go.AppInstance
+}
+
+func (c *mockupApplicationsClient) GetAppInstance(ctx context.Context, in *grpc_application_go.AppInstanceId, opts ...grpc.CallOption) (*grpc_application_go.AppInstance, error) {
+	if c.instance == nil {
+		return nil, fmt.Errorf("application instance %s not found", in.AppInstanceId)
+	}
+	return c.instance, nil
+}
+
+// hostIds returns the sorted cluster identifiers of a list of hosts
+func hostIds(hosts []ClusterInfo) []string {
+	ids := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		ids = append(ids, host.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+var _ = ginkgo.Describe("Placement", func() {
+	clusters := []string{"cluster-1", "cluster-2", "cluster-3"}
+	instance := &grpc_application_go.AppInstance{
+		AppInstanceId: AppInstanceId,
+		Groups: []*grpc_application_go.ServiceGroupInstance{
+			{
+				ServiceGroupInstanceId: "sg-instance-1",
+				ServiceGroupId:         "sg-1",
+				ServiceInstances: []*grpc_application_go.ServiceInstance{
+					{ServiceId: "service-1", ServiceInstanceId: "service-instance-1", DeployedOnClusterId: "cluster-1"},
+					{ServiceId: "service-2", ServiceInstanceId: "service-instance-2", DeployedOnClusterId: "cluster-2"},
+				},
+			},
+			{
+				ServiceGroupInstanceId: "sg-instance-2",
+				ServiceGroupId:         "sg-2",
+				ServiceInstances: []*grpc_application_go.ServiceInstance{
+					{ServiceId: "service-3", ServiceInstanceId: "service-instance-3", DeployedOnClusterId: "cluster-4"},
+				},
+			},
+		},
+	}
+	newManager := func(apps grpc_application_go.ApplicationsClient) *Manager {
+		executor := NewLoggingExecutor(nil, &client.LoggingClientParams{}, 2, time.Second)
+		return NewManager(apps, &mockupClustersClient{clusters: clusters}, executor, "", 443, time.Second)
+	}
+
+	ginkgo.It("should only return the online clusters where the application is deployed", func() {
+		manager := newManager(&mockupApplicationsClient{instance: instance})
+		tests := []struct {
+			fields   entities.FilterFields
+			expected []string
+		}{
+			{entities.FilterFields{OrganizationId: OrganizationId}, clusters},
+			{entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}, []string{"cluster-1", "cluster-2"}},
+			{entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId, ServiceGroupId: "sg-1", ServiceId: "service-2"}, []string{"cluster-2"}},
+			{entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId, ServiceInstanceId: "service-instance-1"}, []string{"cluster-1"}},
+		}
+		for _, test := range tests {
+			fields := test.fields
+			hosts, derr := manager.GetSearchHosts(context.Background(), &fields)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			gomega.Expect(hostIds(hosts)).Should(gomega.Equal(test.expected))
+		}
+	})
+
+	ginkgo.It("should expire in every cluster of the organization", func() {
+		manager := newManager(&mockupApplicationsClient{instance: instance})
+		fields := &entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}
+		hosts, derr := manager.GetHosts(context.Background(), fields)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(hostIds(hosts)).Should(gomega.Equal(clusters))
+	})
+
+	ginkgo.It("should return all the clusters when the placement is not known", func() {
+		tests := []struct {
+			apps   grpc_application_go.ApplicationsClient
+			fields entities.FilterFields
+		}{
+			// The application instance cannot be read
+			{&mockupApplicationsClient{}, entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}},
+			// The services are not deployed in any cluster
+			{&mockupApplicationsClient{instance: instance}, entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId, ServiceId: "service-4"}},
+			// There is no applications client
+			{nil, entities.FilterFields{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId}},
+		}
+		for _, test := range tests {
+			fields := test.fields
+			hosts, derr := newManager(test.apps).GetSearchHosts(context.Background(), &fields)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			gomega.Expect(hostIds(hosts)).Should(gomega.Equal(clusters))
+		}
+	})
+})
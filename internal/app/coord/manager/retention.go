@@ -0,0 +1,303 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Retention policies for unified logging coordinator
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRetentionSyncInterval is the time between synchronizations of the retention policies with the clusters
+const DefaultRetentionSyncInterval = time.Minute * 10
+
+// RetentionManager keeps the retention policies of the organizations and sends them to
+// their clusters when they change, and periodically for the clusters that missed them.
+// The policies are kept in memory, or in a file of the replica, so every replica of the
+// coordinator has its own policies and they are not shared.
+type RetentionManager struct {
+	manager *Manager
+	// defaultDays is the number of days the entries of an organization without a policy are kept
+	defaultDays int
+	// path of the file where the policies are stored, empty to keep them in memory
+	path string
+
+	// mutex protects policies
+	mutex sync.Mutex
+	// policies of every organization. An organization whose last policy is removed is kept
+	// without policies until all its clusters receive them.
+	policies map[string][]*entities.RetentionPolicy
+}
+
+// NewRetentionManager creates a retention manager sending the policies through the clusters of
+// manager, loading the policies stored in path if it is not empty
+func NewRetentionManager(manager *Manager, defaultDays int, path string) (*RetentionManager, derrors.Error) {
+	if defaultDays <= 0 {
+		defaultDays = defaultLogExpiration
+	}
+	r := &RetentionManager{
+		manager:     manager,
+		defaultDays: defaultDays,
+		path:        path,
+		policies:    make(map[string][]*entities.RetentionPolicy),
+	}
+	derr := r.load()
+	if derr != nil {
+		return nil, derr
+	}
+	return r, nil
+}
+
+// SetRetentionPolicy creates or replaces the policy with the same scope and sends the policies
+// of the organization to its clusters
+func (r *RetentionManager) SetRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	list, derr := r.update(policy.OrganizationId, func(policies []*entities.RetentionPolicy) []*entities.RetentionPolicy {
+		stored := *policy
+		for i, existing := range policies {
+			if existing.SameScope(policy) {
+				policies[i] = &stored
+				return policies
+			}
+		}
+		return append(policies, &stored)
+	})
+	if derr != nil {
+		return nil, derr
+	}
+	r.sync(ctx, list)
+	return list, nil
+}
+
+// RemoveRetentionPolicy removes the policy with the same scope and sends the policies of the
+// organization to its clusters
+func (r *RetentionManager) RemoveRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	found := false
+	list, derr := r.update(policy.OrganizationId, func(policies []*entities.RetentionPolicy) []*entities.RetentionPolicy {
+		remaining := make([]*entities.RetentionPolicy, 0, len(policies))
+		for _, existing := range policies {
+			if existing.SameScope(policy) {
+				found = true
+				continue
+			}
+			remaining = append(remaining, existing)
+		}
+		return remaining
+	})
+	if derr != nil {
+		return nil, derr
+	}
+	if !found {
+		return nil, derrors.NewNotFoundError("retention policy not found").WithParams(policy.String())
+	}
+	r.sync(ctx, list)
+	return list, nil
+}
+
+// ListRetentionPolicies returns the policies of the organization of policy
+func (r *RetentionManager) ListRetentionPolicies(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.list(policy.OrganizationId), nil
+}
+
+// SyncLoop sends the policies of every organization to its clusters every interval until ctx is done
+func (r *RetentionManager) SyncLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRetentionSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.syncAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncAll sends the policies of every organization to its clusters, including the
+// organizations without policies that some cluster has not received yet
+func (r *RetentionManager) syncAll(ctx context.Context) {
+	r.mutex.Lock()
+	lists := make([]*entities.RetentionPolicyList, 0, len(r.policies))
+	for organizationId := range r.policies {
+		lists = append(lists, r.list(organizationId))
+	}
+	r.mutex.Unlock()
+
+	for _, list := range lists {
+		r.sync(ctx, list)
+	}
+}
+
+// sync sends the policies of an organization to its clusters. The clusters that fail
+// receive them in the next synchronization, so errors are only logged. Once all the
+// clusters of an organization without policies receive them, it is forgotten.
+func (r *RetentionManager) sync(ctx context.Context, list *entities.RetentionPolicyList) {
+	hosts, derr := r.manager.GetHosts(ctx, &entities.FilterFields{OrganizationId: list.OrganizationId})
+	if derr != nil {
+		log.Warn().Str("organizationId", list.OrganizationId).Str("err", derr.DebugReport()).Msg("cannot synchronize retention policies")
+		return
+	}
+
+	execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+		_, err := client.SyncRetentionPolicies(ctx, list)
+		return 0, err
+	}
+	errorIds := r.manager.execRequests(ctx, list.OrganizationId, hosts, execFunc).FailedClusterIds()
+	if len(errorIds) > 0 {
+		log.Warn().Str("organizationId", list.OrganizationId).Interface("errors", errorIds).Msg("retention policies not synchronized")
+		return
+	}
+	if len(list.Policies) == 0 {
+		r.forget(list.OrganizationId)
+	}
+}
+
+// forget removes an organization that has no policies, storing the rest if there is a path
+func (r *RetentionManager) forget(organizationId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	policies, exists := r.policies[organizationId]
+	// Policies may have been set while the clusters were synchronized
+	if !exists || len(policies) > 0 {
+		return
+	}
+	delete(r.policies, organizationId)
+	derr := r.save()
+	if derr != nil {
+		// It is synchronized again, and forgotten once it can be stored
+		r.policies[organizationId] = policies
+		log.Warn().Str("organizationId", organizationId).Str("err", derr.DebugReport()).Msg("cannot forget retention policies")
+	}
+}
+
+// update applies change to the policies of an organization, storing them if there is a path,
+// and returns the resulting list
+func (r *RetentionManager) update(organizationId string, change func([]*entities.RetentionPolicy) []*entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous, existed := r.policies[organizationId]
+	policies := change(append([]*entities.RetentionPolicy{}, previous...))
+	if !existed && len(policies) == 0 {
+		return r.list(organizationId), nil
+	}
+	// The organization is kept without policies until its clusters receive them
+	r.policies[organizationId] = policies
+
+	derr := r.save()
+	if derr != nil {
+		// Keep the stored and the current policies the same
+		if !existed {
+			delete(r.policies, organizationId)
+		} else {
+			r.policies[organizationId] = previous
+		}
+		return nil, derr
+	}
+	return r.list(organizationId), nil
+}
+
+// list returns the policies of an organization, sorted by scope. The mutex must be held.
+func (r *RetentionManager) list(organizationId string) *entities.RetentionPolicyList {
+	policies := make([]*entities.RetentionPolicy, 0, len(r.policies[organizationId]))
+	for _, policy := range r.policies[organizationId] {
+		copied := *policy
+		policies = append(policies, &copied)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Scope() != policies[j].Scope() {
+			return policies[i].Scope() < policies[j].Scope()
+		}
+		if policies[i].AppDescriptorId != policies[j].AppDescriptorId {
+			return policies[i].AppDescriptorId < policies[j].AppDescriptorId
+		}
+		return policies[i].AppInstanceId < policies[j].AppInstanceId
+	})
+	return &entities.RetentionPolicyList{
+		OrganizationId: organizationId,
+		DefaultDays:    int32(r.defaultDays),
+		Policies:       policies,
+	}
+}
+
+// load reads the policies stored in the file, if it exists
+func (r *RetentionManager) load() derrors.Error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return derrors.NewInternalError("cannot read retention policies", err).WithParams(r.path)
+	}
+	err = json.Unmarshal(data, &r.policies)
+	if err != nil {
+		return derrors.NewInternalError("cannot decode retention policies", err).WithParams(r.path)
+	}
+	for organizationId, policies := range r.policies {
+		derr := (&entities.RetentionPolicyList{OrganizationId: organizationId, Policies: policies}).Validate()
+		if derr != nil {
+			return derr
+		}
+	}
+	log.Info().Str("path", r.path).Int("organizations", len(r.policies)).Msg("retention policies loaded")
+	return nil
+}
+
+// save writes the policies to the file, replacing it only once they are written. The mutex must be held.
+func (r *RetentionManager) save() derrors.Error {
+	if r.path == "" {
+		return nil
+	}
+	// Marshalling our own structures cannot fail
+	data, _ := json.MarshalIndent(r.policies, "", "  ")
+	file, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return derrors.NewInternalError("cannot write retention policies", err).WithParams(r.path)
+	}
+	_, err = file.Write(data)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), r.path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return derrors.NewInternalError("cannot write retention policies", err).WithParams(r.path)
+	}
+	return nil
+}
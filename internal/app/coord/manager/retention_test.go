@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// mockupRetentionSync keeps the last retention policies received by a cluster
+type mockupRetentionSync struct {
+	sync.Mutex
+	lists map[string]*entities.RetentionPolicyList
+	// unavailable clusters fail to receive the policies
+	unavailable bool
+}
+
+func (s *mockupRetentionSync) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList) (*entities.RetentionPolicyList, derrors.Error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.unavailable {
+		return nil, derrors.NewUnavailableError("cluster unavailable")
+	}
+	s.lists[list.OrganizationId] = list
+	return list, nil
+}
+
+func (s *mockupRetentionSync) setUnavailable(unavailable bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.unavailable = unavailable
+}
+
+// received checks if the cluster received the policies of the organization, and forgets them
+func (s *mockupRetentionSync) received(organizationId string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, exists := s.lists[organizationId]
+	delete(s.lists, organizationId)
+	return exists
+}
+
+func (s *mockupRetentionSync) policies(organizationId string) []*entities.RetentionPolicy {
+	s.Lock()
+	defer s.Unlock()
+	list, exists := s.lists[organizationId]
+	if !exists {
+		return nil
+	}
+	return list.Policies
+}
+
+// newMockupRetentionManager returns a retention manager sending the policies to mockup clusters
+func newMockupRetentionManager(clusters map[string]*mockupRetentionSync, path string) *RetentionManager {
+	ids := make([]string, 0, len(clusters))
+	for id := range clusters {
+		ids = append(ids, id)
+	}
+	factory := func(address string, params *client.LoggingClientParams) (client.LoggingClient, error) {
+		for id, retention := range clusters {
+			if address == fmt.Sprintf("%s:%d", id, 443) {
+				return &mockupLoggingClient{retention: retention}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown cluster %s", address)
+	}
+	executor := NewLoggingExecutor(factory, &client.LoggingClientParams{}, 2, time.Second)
+	manager := NewManager(nil, &mockupClustersClient{clusters: ids}, executor, "", 443, time.Second)
+	retention, derr := NewRetentionManager(manager, 0, path)
+	gomega.Expect(derr).Should(gomega.Succeed())
+	return retention
+}
+
+var _ = ginkgo.Describe("Retention", func() {
+	var clusters map[string]*mockupRetentionSync
+	var retention *RetentionManager
+	var dir string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "retention")
+		gomega.Expect(err).Should(gomega.Succeed())
+		clusters = map[string]*mockupRetentionSync{
+			"cluster-1": {lists: make(map[string]*entities.RetentionPolicyList)},
+			"cluster-2": {lists: make(map[string]*entities.RetentionPolicyList)},
+		}
+		retention = newMockupRetentionManager(clusters, filepath.Join(dir, "policies.json"))
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(dir)).Should(gomega.Succeed())
+	})
+
+	appPolicy := &entities.RetentionPolicy{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId, Days: 1}
+	orgPolicy := &entities.RetentionPolicy{OrganizationId: OrganizationId, Days: 30}
+
+	ginkgo.It("should send the policies of an organization to its clusters when they change", func() {
+		list, derr := retention.SetRetentionPolicy(context.Background(), appPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(list.DefaultDays).Should(gomega.Equal(int32(defaultLogExpiration)))
+		_, derr = retention.SetRetentionPolicy(context.Background(), orgPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		for _, cluster := range clusters {
+			gomega.Expect(cluster.policies(OrganizationId)).Should(gomega.Equal([]*entities.RetentionPolicy{orgPolicy, appPolicy}))
+		}
+
+		list, derr = retention.RemoveRetentionPolicy(context.Background(), &entities.RetentionPolicy{OrganizationId: OrganizationId})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(list.Policies).Should(gomega.Equal([]*entities.RetentionPolicy{appPolicy}))
+		for _, cluster := range clusters {
+			gomega.Expect(cluster.policies(OrganizationId)).Should(gomega.Equal([]*entities.RetentionPolicy{appPolicy}))
+		}
+	})
+
+	ginkgo.It("should replace the policy of the same scope", func() {
+		_, derr := retention.SetRetentionPolicy(context.Background(), orgPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		_, derr = retention.SetRetentionPolicy(context.Background(), &entities.RetentionPolicy{OrganizationId: OrganizationId, Days: 10})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		list, derr := retention.ListRetentionPolicies(context.Background(), &entities.RetentionPolicy{OrganizationId: OrganizationId})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(list.Policies).Should(gomega.HaveLen(1))
+		gomega.Expect(list.Policies[0].Days).Should(gomega.Equal(int32(10)))
+	})
+
+	ginkgo.It("should fail removing a policy that does not exist", func() {
+		_, derr := retention.RemoveRetentionPolicy(context.Background(), appPolicy)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.NotFound))
+	})
+
+	ginkgo.It("should load the stored policies and send them periodically", func() {
+		_, derr := retention.SetRetentionPolicy(context.Background(), appPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+
+		for id := range clusters {
+			clusters[id] = &mockupRetentionSync{lists: make(map[string]*entities.RetentionPolicyList)}
+		}
+		restarted := newMockupRetentionManager(clusters, filepath.Join(dir, "policies.json"))
+		restarted.syncAll(context.Background())
+		for _, cluster := range clusters {
+			gomega.Expect(cluster.policies(OrganizationId)).Should(gomega.Equal([]*entities.RetentionPolicy{appPolicy}))
+		}
+	})
+
+	ginkgo.It("should send the removal of the last policy until every cluster receives it", func() {
+		_, derr := retention.SetRetentionPolicy(context.Background(), appPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		clusters["cluster-2"].setUnavailable(true)
+		list, derr := retention.RemoveRetentionPolicy(context.Background(), appPolicy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(list.Policies).Should(gomega.BeEmpty())
+		gomega.Expect(clusters["cluster-1"].policies(OrganizationId)).Should(gomega.BeEmpty())
+		gomega.Expect(clusters["cluster-2"].policies(OrganizationId)).Should(gomega.Equal([]*entities.RetentionPolicy{appPolicy}))
+
+		// The pending removal is stored, so a restarted coordinator still sends it
+		restarted := newMockupRetentionManager(clusters, filepath.Join(dir, "policies.json"))
+		restarted.syncAll(context.Background())
+		gomega.Expect(clusters["cluster-2"].policies(OrganizationId)).Should(gomega.Equal([]*entities.RetentionPolicy{appPolicy}))
+
+		clusters["cluster-2"].setUnavailable(false)
+		restarted.syncAll(context.Background())
+		gomega.Expect(clusters["cluster-2"].policies(OrganizationId)).Should(gomega.BeEmpty())
+
+		// Once every cluster received it, the organization is forgotten
+		for _, cluster := range clusters {
+			gomega.Expect(cluster.received(OrganizationId)).Should(gomega.BeTrue())
+		}
+		restarted.syncAll(context.Background())
+		for _, cluster := range clusters {
+			gomega.Expect(cluster.received(OrganizationId)).Should(gomega.BeFalse())
+		}
+	})
+})
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Retried and hedged requests to the application clusters
+
+package manager
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRetryAttempts is the number of times an idempotent request is sent to a cluster
+const DefaultRetryAttempts = 3
+
+// DefaultRetryBackoff is the time waited before retrying a request the first time
+const DefaultRetryBackoff = time.Millisecond * 100
+
+// latencySamples is the number of latencies of a cluster kept to compute the hedging delay
+const latencySamples = 100
+
+// minLatencySamples is the number of latencies of a cluster needed before hedging its requests
+const minLatencySamples = 20
+
+// RetryPolicy decides how the idempotent requests to a cluster, the searches and the progress of
+// the expiration jobs, are retried and hedged. The requests changing the clusters are sent once.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a request is sent, 1 to not retry
+	Attempts int
+	// Backoff is the time waited before the first retry, doubled for every other and jittered
+	Backoff time.Duration
+	// HedgePercentile is the percentile of the latencies of a cluster after which a second
+	// attempt is sent if the first one has not answered, 0 to not hedge
+	HedgePercentile float64
+}
+
+// DefaultRetryPolicy retries the requests without hedging them
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: DefaultRetryAttempts,
+	Backoff:  DefaultRetryBackoff,
+}
+
+// enabled checks if the policy retries or hedges the requests
+func (p RetryPolicy) enabled() bool {
+	return p.Attempts > 1 || p.HedgePercentile > 0
+}
+
+// isRetryable checks if a request failed with an error that may not happen again
+func isRetryable(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// latencies keeps the latest latencies of the requests answered by every cluster
+type latencies struct {
+	// mutex protects byHost
+	mutex  sync.Mutex
+	byHost map[string][]time.Duration
+}
+
+func newLatencies() *latencies {
+	return &latencies{byHost: make(map[string][]time.Duration)}
+}
+
+// add adds the latency of a request answered by a cluster, dropping the oldest one
+func (l *latencies) add(host string, latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	samples := append(l.byHost[host], latency)
+	if len(samples) > latencySamples {
+		samples = samples[1:]
+	}
+	l.byHost[host] = samples
+}
+
+// percentile returns the latency of a cluster at a percentile, false if there are not enough samples
+func (l *latencies) percentile(host string, percentile float64) (time.Duration, bool) {
+	l.mutex.Lock()
+	samples := append([]time.Duration{}, l.byHost[host]...)
+	l.mutex.Unlock()
+	if len(samples) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	index := int(math.Ceil(percentile*float64(len(samples)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(samples) {
+		index = len(samples) - 1
+	}
+	return samples[index], true
+}
+
+// retryingClient retries and hedges the idempotent requests of a client according to a policy
+type retryingClient struct {
+	client.LoggingClient
+	host      string
+	policy    RetryPolicy
+	latencies *latencies
+}
+
+// callFunc sends a request with the given call options
+type callFunc func(ctx context.Context, opts []grpc.CallOption) (interface{}, error)
+
+func (c *retryingClient) Search(ctx context.Context, in *grpc_unified_logging_go.SearchRequest, opts ...grpc.CallOption) (*grpc_unified_logging_go.LogResponseList, error) {
+	res, err := c.retry(ctx, opts, func(ctx context.Context, opts []grpc.CallOption) (interface{}, error) {
+		return c.LoggingClient.Search(ctx, in, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*grpc_unified_logging_go.LogResponseList), nil
+}
+
+func (c *retryingClient) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	res, err := c.retry(ctx, opts, func(ctx context.Context, opts []grpc.CallOption) (interface{}, error) {
+		return c.LoggingClient.GetExpirationJob(ctx, id, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*entities.ExpirationJob), nil
+}
+
+// retry sends a request until it succeeds, fails with an error that is not retryable, reaches
+// the attempts of the policy or the next attempt would not start before the deadline of ctx
+func (c *retryingClient) retry(ctx context.Context, opts []grpc.CallOption, call callFunc) (interface{}, error) {
+	backoff := c.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		res, err := c.hedge(ctx, opts, call)
+		if err == nil || attempt >= c.policy.Attempts || !isRetryable(err) {
+			return res, err
+		}
+
+		// The jitter spreads the retries of the coordinator replicas
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		backoff *= 2
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+		log.Debug().Str("host", c.host).Int("attempt", attempt).Str("wait", wait.String()).Err(err).Msg("retrying request")
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		}
+	}
+}
+
+// attemptResult is the result of an attempt of a hedged request
+type attemptResult struct {
+	res     interface{}
+	err     error
+	latency time.Duration
+	// header and trailer are the metadata received by the attempt
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+// hedge sends a request, and a second attempt if the first one has not answered by the hedging
+// percentile of the latencies of the cluster, returning the first answer that succeeds
+func (c *retryingClient) hedge(ctx context.Context, opts []grpc.CallOption, call callFunc) (interface{}, error) {
+	delay, hedged := time.Duration(0), false
+	if c.policy.HedgePercentile > 0 {
+		delay, hedged = c.latencies.percentile(c.host, c.policy.HedgePercentile)
+	}
+	if !hedged {
+		started := time.Now()
+		res, err := call(ctx, opts)
+		if err == nil {
+			c.latencies.add(c.host, time.Since(started))
+		}
+		return res, err
+	}
+
+	// The attempt that loses is cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan *attemptResult, 2)
+	launch := func() {
+		go func() {
+			// Every attempt receives its own metadata, so they are not written concurrently
+			result := &attemptResult{}
+			attemptOpts := make([]grpc.CallOption, 0, len(opts))
+			for _, opt := range opts {
+				switch opt.(type) {
+				case grpc.HeaderCallOption:
+					opt = grpc.Header(&result.header)
+				case grpc.TrailerCallOption:
+					opt = grpc.Trailer(&result.trailer)
+				}
+				attemptOpts = append(attemptOpts, opt)
+			}
+			started := time.Now()
+			result.res, result.err = call(ctx, attemptOpts)
+			result.latency = time.Since(started)
+			results <- result
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	launched, answered := 1, 0
+	for {
+		select {
+		case <-timer.C:
+			log.Debug().Str("host", c.host).Str("delay", delay.String()).Msg("hedging request")
+			launch()
+			launched++
+		case result := <-results:
+			answered++
+			// A failed attempt waits for the other one if it was sent
+			if result.err != nil && answered < launched {
+				continue
+			}
+			if result.err == nil {
+				c.latencies.add(c.host, result.latency)
+				copyMetadata(opts, result)
+			}
+			return result.res, result.err
+		}
+	}
+}
+
+// copyMetadata copies the metadata received by an attempt to the call options of the request
+func copyMetadata(opts []grpc.CallOption, result *attemptResult) {
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = result.header
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = result.trailer
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// flakyLoggingClient fails the first requests with err, and answers the others after their delay
+type flakyLoggingClient struct {
+	mockupLoggingClient
+	sync.Mutex
+	err      error
+	failures int
+	delays   []time.Duration
+	requests int
+}
+
+func (c *flakyLoggingClient) next() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.requests++
+	if c.requests <= c.failures {
+		return c.requests, c.err
+	}
+	return c.requests, nil
+}
+
+func (c *flakyLoggingClient) Search(ctx context.Context, in *grpc_unified_logging_go.SearchRequest, opts ...grpc.CallOption) (*grpc_unified_logging_go.LogResponseList, error) {
+	request, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	if request <= len(c.delays) {
+		select {
+		case <-time.After(c.delays[request-1]):
+		case <-ctx.Done():
+			return nil, status.Error(codes.Canceled, ctx.Err().Error())
+		}
+	}
+	for _, opt := range opts {
+		if header, ok := opt.(grpc.HeaderCallOption); ok {
+			*header.HeaderAddr = metadata.Pairs(entities.NextCursorMetadataKey, "attempt")
+		}
+	}
+	return &grpc_unified_logging_go.LogResponseList{OrganizationId: OrganizationId, From: int64(request)}, nil
+}
+
+func (c *flakyLoggingClient) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	_, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	return &entities.ExpirationJob{OrganizationId: request.OrganizationId}, nil
+}
+
+var _ = ginkgo.Describe("Retry policy", func() {
+	unavailable := status.Error(codes.Unavailable, "connection reset")
+	request := &grpc_unified_logging_go.SearchRequest{OrganizationId: OrganizationId}
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+
+	ginkgo.It("should retry the idempotent requests failing with retryable errors", func() {
+		tests := []struct {
+			err      error
+			failures int
+			requests int
+			fails    bool
+		}{
+			{unavailable, 2, 3, false},
+			{unavailable, 3, 3, true},
+			{status.Error(codes.InvalidArgument, "invalid request"), 1, 1, true},
+		}
+		for _, test := range tests {
+			flaky := &flakyLoggingClient{err: test.err, failures: test.failures}
+			retrying := &retryingClient{LoggingClient: flaky, host: "cluster-1", policy: policy, latencies: newLatencies()}
+			_, err := retrying.Search(context.Background(), request)
+			gomega.Expect(err != nil).Should(gomega.Equal(test.fails), test.err.Error())
+			gomega.Expect(flaky.requests).Should(gomega.Equal(test.requests), test.err.Error())
+		}
+
+		// Requests that change the cluster are not retried
+		flaky := &flakyLoggingClient{err: unavailable, failures: 1}
+		retrying := &retryingClient{LoggingClient: flaky, host: "cluster-1", policy: policy, latencies: newLatencies()}
+		_, err := retrying.StartExpiration(context.Background(), &grpc_unified_logging_go.ExpirationRequest{OrganizationId: OrganizationId})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+		gomega.Expect(flaky.requests).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should not retry after the deadline", func() {
+		flaky := &flakyLoggingClient{err: unavailable, failures: 3}
+		retrying := &retryingClient{LoggingClient: flaky, host: "cluster-1", policy: RetryPolicy{Attempts: 3, Backoff: time.Second}, latencies: newLatencies()}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := retrying.Search(ctx, request)
+		gomega.Expect(status.Code(err)).Should(gomega.Equal(codes.Unavailable))
+		gomega.Expect(flaky.requests).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should hedge the requests slower than the latency percentile", func() {
+		hedging := RetryPolicy{Attempts: 1, HedgePercentile: 0.9}
+		latencies := newLatencies()
+		for i := 0; i < minLatencySamples; i++ {
+			latencies.add("cluster-1", 10*time.Millisecond)
+		}
+		percentile, ok := latencies.percentile("cluster-1", hedging.HedgePercentile)
+		gomega.Expect(ok).Should(gomega.BeTrue())
+		gomega.Expect(percentile).Should(gomega.Equal(10 * time.Millisecond))
+		_, ok = latencies.percentile("cluster-2", hedging.HedgePercentile)
+		gomega.Expect(ok).Should(gomega.BeFalse())
+
+		// The first attempt takes too long, so the answer of the second one is used
+		flaky := &flakyLoggingClient{delays: []time.Duration{time.Second, 0}}
+		retrying := &retryingClient{LoggingClient: flaky, host: "cluster-1", policy: hedging, latencies: latencies}
+		var header metadata.MD
+		started := time.Now()
+		res, err := retrying.Search(context.Background(), request, grpc.Header(&header))
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(time.Since(started)).Should(gomega.BeNumerically("<", 500*time.Millisecond))
+		gomega.Expect(res.From).Should(gomega.Equal(int64(2)))
+		gomega.Expect(header.Get(entities.NextCursorMetadataKey)).Should(gomega.Equal([]string{"attempt"}))
+	})
+})
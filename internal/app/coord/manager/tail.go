@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Tail for unified logging coordinator
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultTailPollInterval is the time between searches for new log entries in the clusters
+const DefaultTailPollInterval = time.Second * 5
+
+// tailState is the position of a tail in a cluster
+type tailState struct {
+	// from is the timestamp of the newest entry sent
+	from int64
+	// sent counts the entries sent with timestamp from by key, as they will be returned again
+	sent map[string]int
+}
+
+// Tail multiplexes the new log entries of all the clusters of the organization. Every cluster
+// is polled with a moving From and the new entries of all of them are sent sorted by timestamp.
+// The clusters are polled with Search instead of forwarding their Tail streams, as the application
+// cluster API only forwards the unified logging service, so new entries are sent every poll interval.
+func (m *Manager) Tail(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions, send managers.TailSender) derrors.Error {
+	fields := &entities.FilterFields{
+		OrganizationId:         request.GetOrganizationId(),
+		AppDescriptorId:        request.GetAppDescriptorId(),
+		AppInstanceId:          request.GetAppInstanceId(),
+		ServiceGroupInstanceId: request.GetServiceGroupInstanceId(),
+		ServiceGroupId:         request.ServiceGroupId,
+		ServiceId:              request.ServiceId,
+		ServiceInstanceId:      request.ServiceInstanceId,
+	}
+
+	from := request.From
+	if from == 0 {
+		from = time.Now().UnixNano()
+	}
+	states := make(map[string]*tailState)
+	// Only the minimum level applies, as the tail sets its own order and moves through the entries
+	pairs := (&entities.SearchOptions{MinLevel: options.GetMinLevel()}).MetadataPairs()
+
+	ticker := time.NewTicker(m.tailPollInterval)
+	defer ticker.Stop()
+	for {
+		// Clusters can join or leave while tailing
+		hosts, err := m.GetSearchHosts(ctx, fields)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, host := range hosts {
+			if _, exists := states[host.id]; !exists {
+				states[host.id] = &tailState{from: from, sent: make(map[string]int)}
+			}
+		}
+
+		out := make([]*grpc_unified_logging_go.LogResponseList, len(hosts))
+		execFunc := func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+			if len(pairs) > 0 {
+				ctx = metadata.AppendToOutgoingContext(ctx, pairs...)
+			}
+			res, err := client.Search(ctx, tailRequest(request, states[hosts[i].id].from))
+			if err != nil {
+				return 0, err
+			}
+			out[i] = res
+			return responseEntries(res), nil
+		}
+		errorIds := m.execRequests(ctx, fields.OrganizationId, hosts, execFunc).FailedClusterIds()
+
+		logEntries := make([]*entities.LogEntry, 0)
+		for i, host := range hosts {
+			if out[i] == nil {
+				continue
+			}
+			logEntries = append(logEntries, states[host.id].newEntries(clusterEntries(out[i], 0, entities.Ascending))...)
+		}
+
+		if len(logEntries) > 0 {
+			sort.SliceStable(logEntries, func(i, j int) bool {
+				return logEntries[i].Timestamp.Before(logEntries[j].Timestamp)
+			})
+			list := entities.MergeLogEntries(request.OrganizationId, logEntries[0].Timestamp.UnixNano(),
+				logEntries[len(logEntries)-1].Timestamp.UnixNano(), logEntries, errorIds)
+			serr := send(list)
+			if serr != nil {
+				log.Debug().Err(serr).Msg("tail stream closed")
+				return nil
+			}
+		}
+
+		if request.To != 0 && time.Now().UnixNano() > request.To {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// tailRequest returns the search request for the entries of a cluster from a timestamp
+func tailRequest(request *grpc_unified_logging_go.SearchRequest, from int64) *grpc_unified_logging_go.SearchRequest {
+	return &grpc_unified_logging_go.SearchRequest{
+		OrganizationId:         request.OrganizationId,
+		AppDescriptorId:        request.AppDescriptorId,
+		AppInstanceId:          request.AppInstanceId,
+		ServiceGroupId:         request.ServiceGroupId,
+		ServiceGroupInstanceId: request.ServiceGroupInstanceId,
+		ServiceId:              request.ServiceId,
+		ServiceInstanceId:      request.ServiceInstanceId,
+		MsgQueryFilter:         request.MsgQueryFilter,
+		From:                   from,
+		To:                     request.To,
+		NFirst:                 true,
+	}
+}
+
+// newEntries returns the entries of a sorted list of the cluster that were not sent yet and moves
+// the state forward. Entries are identified by timestamp, service instance and message, and a line
+// repeated with the same timestamp is skipped only as many times as it was sent.
+func (s *tailState) newEntries(entries []*entities.LogEntry) []*entities.LogEntry {
+	result := make([]*entities.LogEntry, 0, len(entries))
+	// seen counts the entries of the list with timestamp from by key
+	seen := make(map[string]int)
+	for _, entry := range entries {
+		timestamp := entry.Timestamp.UnixNano()
+		if timestamp < s.from {
+			continue
+		}
+		if timestamp > s.from {
+			s.from = timestamp
+			s.sent = make(map[string]int)
+			seen = make(map[string]int)
+		}
+		key := fmt.Sprintf("%s#%s", entry.Kubernetes.Labels.AppServiceInstanceId, entry.Msg)
+		seen[key]++
+		if seen[key] <= s.sent[key] {
+			continue
+		}
+		s.sent[key]++
+		result = append(result, entry)
+	}
+	return result
+}
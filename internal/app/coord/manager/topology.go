@@ -0,0 +1,360 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cache of the clusters of the organizations and of the placement of their applications
+
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-connectivity-manager-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultTopologyTTL is the time the clusters of an organization and the placement of an
+// application instance are cached
+const DefaultTopologyTTL = time.Minute
+
+// ClusterTopology is a cluster of an organization as known by the system model
+type ClusterTopology struct {
+	ClusterId string
+	Hostname  string
+	Status    grpc_connectivity_manager_go.ClusterStatus
+}
+
+// ServicePlacement is the cluster where a service instance of an application instance is deployed
+type ServicePlacement struct {
+	ServiceGroupInstanceId string
+	ServiceGroupId         string
+	ServiceInstanceId      string
+	ServiceId              string
+	ClusterId              string
+}
+
+// TopologyStats are the counters of a topology cache
+type TopologyStats struct {
+	// Hits and Misses are the requests answered with and without the cache
+	Hits   int64
+	Misses int64
+	// Refreshes and Errors are the background refreshes and the ones that failed
+	Refreshes int64
+	Errors    int64
+	// Organizations and Applications are the number of organizations and application instances cached
+	Organizations int
+	Applications  int
+}
+
+type organizationTopology struct {
+	clusters []ClusterTopology
+	// fetched is the time the clusters were listed
+	fetched time.Time
+	// used is set when the clusters are requested, so the ones not requested since the
+	// previous refresh are evicted instead of refreshed
+	used bool
+}
+
+type placementKey struct {
+	organizationId string
+	appInstanceId  string
+}
+
+type applicationPlacement struct {
+	services []ServicePlacement
+	// fetched and used are kept as in organizationTopology
+	fetched time.Time
+	used    bool
+}
+
+// TopologyCache keeps the clusters of every organization, and the placement of every application
+// instance, for ttl. The ones in use are refreshed in the background before they expire, and the
+// ones of an organization are invalidated when its clusters fail.
+type TopologyCache struct {
+	client grpc_infrastructure_go.ClustersClient
+	apps   grpc_application_go.ApplicationsClient
+	ttl    time.Duration
+
+	// mutex protects organizations, placements and stats
+	mutex         sync.Mutex
+	organizations map[string]*organizationTopology
+	placements    map[placementKey]*applicationPlacement
+	stats         TopologyStats
+}
+
+func NewTopologyCache(client grpc_infrastructure_go.ClustersClient, apps grpc_application_go.ApplicationsClient, ttl time.Duration) *TopologyCache {
+	if ttl <= 0 {
+		ttl = DefaultTopologyTTL
+	}
+	return &TopologyCache{
+		client:        client,
+		apps:          apps,
+		ttl:           ttl,
+		organizations: make(map[string]*organizationTopology),
+		placements:    make(map[placementKey]*applicationPlacement),
+	}
+}
+
+// GetClusters returns the clusters of an organization, listing them if they are not cached
+// or expired
+func (t *TopologyCache) GetClusters(ctx context.Context, organizationId string) ([]ClusterTopology, derrors.Error) {
+	t.mutex.Lock()
+	cached, exists := t.organizations[organizationId]
+	if exists && time.Since(cached.fetched) < t.ttl {
+		cached.used = true
+		t.stats.Hits++
+		t.mutex.Unlock()
+		return cached.clusters, nil
+	}
+	t.stats.Misses++
+	t.mutex.Unlock()
+
+	clusters, derr := t.list(ctx, organizationId)
+	if derr != nil {
+		t.Invalidate(organizationId)
+		return nil, derr
+	}
+	t.store(organizationId, clusters, true)
+	return clusters, nil
+}
+
+// GetPlacement returns where the services of an application instance are deployed, reading it
+// if it is not cached or expired. It returns nil if there is no applications client.
+func (t *TopologyCache) GetPlacement(ctx context.Context, organizationId string, appInstanceId string) ([]ServicePlacement, derrors.Error) {
+	if t.apps == nil {
+		return nil, nil
+	}
+	key := placementKey{organizationId, appInstanceId}
+	t.mutex.Lock()
+	cached, exists := t.placements[key]
+	if exists && time.Since(cached.fetched) < t.ttl {
+		cached.used = true
+		t.stats.Hits++
+		t.mutex.Unlock()
+		return cached.services, nil
+	}
+	t.stats.Misses++
+	t.mutex.Unlock()
+
+	services, derr := t.place(ctx, key)
+	if derr != nil {
+		t.mutex.Lock()
+		delete(t.placements, key)
+		t.mutex.Unlock()
+		return nil, derr
+	}
+	t.storePlacement(key, services, true)
+	return services, nil
+}
+
+// Invalidate removes the clusters of an organization and the placement of its application
+// instances, so they are read in the next request
+func (t *TopologyCache) Invalidate(organizationId string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.organizations, organizationId)
+	for key := range t.placements {
+		if key.organizationId == organizationId {
+			delete(t.placements, key)
+		}
+	}
+}
+
+// Stats returns the counters of the cache
+func (t *TopologyCache) Stats() TopologyStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := t.stats
+	stats.Organizations = len(t.organizations)
+	stats.Applications = len(t.placements)
+	return stats
+}
+
+// RefreshLoop refreshes the organizations and application instances in use every half ttl until ctx is done, so the
+// requests do not wait for the system model
+func (t *TopologyCache) RefreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(t.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.refresh(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh lists again the clusters of the organizations requested since the previous refresh,
+// evicting the others and the ones that cannot be listed. The organizations invalidated or
+// listed by a request while they are refreshed keep that state.
+func (t *TopologyCache) refresh(ctx context.Context) {
+	t.mutex.Lock()
+	refreshed := make(map[string]*organizationTopology, len(t.organizations))
+	for organizationId, cached := range t.organizations {
+		if !cached.used {
+			delete(t.organizations, organizationId)
+			continue
+		}
+		cached.used = false
+		refreshed[organizationId] = cached
+	}
+	t.mutex.Unlock()
+
+	for organizationId, previous := range refreshed {
+		clusters, derr := t.list(ctx, organizationId)
+		t.mutex.Lock()
+		t.stats.Refreshes++
+		if derr != nil {
+			t.stats.Errors++
+		}
+		if t.organizations[organizationId] == previous {
+			if derr != nil {
+				delete(t.organizations, organizationId)
+			} else {
+				t.organizations[organizationId] = &organizationTopology{
+					clusters: clusters,
+					fetched:  time.Now(),
+					used:     previous.used,
+				}
+			}
+		}
+		t.mutex.Unlock()
+		if derr != nil {
+			log.Warn().Str("organizationId", organizationId).Str("err", derr.DebugReport()).Msg("cannot refresh clusters")
+		}
+	}
+	t.refreshPlacements(ctx)
+
+	stats := t.Stats()
+	log.Debug().Int64("hits", stats.Hits).Int64("misses", stats.Misses).Int64("refreshErrors", stats.Errors).
+		Int("organizations", stats.Organizations).Int("applications", stats.Applications).Msg("cluster topology cache")
+}
+
+// refreshPlacements reads again the placement of the application instances requested since the
+// previous refresh, as refresh does with the clusters of the organizations
+func (t *TopologyCache) refreshPlacements(ctx context.Context) {
+	t.mutex.Lock()
+	refreshed := make(map[placementKey]*applicationPlacement, len(t.placements))
+	for key, cached := range t.placements {
+		if !cached.used {
+			delete(t.placements, key)
+			continue
+		}
+		cached.used = false
+		refreshed[key] = cached
+	}
+	t.mutex.Unlock()
+
+	for key, previous := range refreshed {
+		services, derr := t.place(ctx, key)
+		t.mutex.Lock()
+		t.stats.Refreshes++
+		if derr != nil {
+			t.stats.Errors++
+		}
+		if t.placements[key] == previous {
+			if derr != nil {
+				delete(t.placements, key)
+			} else {
+				t.placements[key] = &applicationPlacement{
+					services: services,
+					fetched:  time.Now(),
+					used:     previous.used,
+				}
+			}
+		}
+		t.mutex.Unlock()
+		if derr != nil {
+			log.Warn().Str("appInstanceId", key.appInstanceId).Str("err", derr.DebugReport()).Msg("cannot refresh application placement")
+		}
+	}
+}
+
+// list asks the system model for the clusters of an organization
+func (t *TopologyCache) list(ctx context.Context, organizationId string) ([]ClusterTopology, derrors.Error) {
+	list, err := t.client.ListClusters(ctx, &grpc_organization_go.OrganizationId{OrganizationId: organizationId})
+	if err != nil {
+		return nil, derrors.NewInternalError("error getting cluster list", err).WithParams(organizationId)
+	}
+	clusters := make([]ClusterTopology, 0, len(list.GetClusters()))
+	for _, cluster := range list.GetClusters() {
+		clusters = append(clusters, ClusterTopology{
+			ClusterId: cluster.GetClusterId(),
+			Hostname:  cluster.GetHostname(),
+			Status:    cluster.GetClusterStatus(),
+		})
+	}
+	return clusters, nil
+}
+
+// store caches the clusters of an organization, keeping whether they were requested since
+// the previous refresh
+func (t *TopologyCache) store(organizationId string, clusters []ClusterTopology, used bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if previous, exists := t.organizations[organizationId]; exists {
+		used = used || previous.used
+	}
+	t.organizations[organizationId] = &organizationTopology{
+		clusters: clusters,
+		fetched:  time.Now(),
+		used:     used,
+	}
+}
+
+// place asks the system model where the services of an application instance are deployed
+func (t *TopologyCache) place(ctx context.Context, key placementKey) ([]ServicePlacement, derrors.Error) {
+	instance, err := t.apps.GetAppInstance(ctx, &grpc_application_go.AppInstanceId{
+		OrganizationId: key.organizationId,
+		AppInstanceId:  key.appInstanceId,
+	})
+	if err != nil {
+		return nil, derrors.NewUnavailableError("error getting application instance", err).WithParams(key.appInstanceId)
+	}
+	services := make([]ServicePlacement, 0)
+	for _, group := range instance.GetGroups() {
+		for _, service := range group.GetServiceInstances() {
+			services = append(services, ServicePlacement{
+				ServiceGroupInstanceId: group.GetServiceGroupInstanceId(),
+				ServiceGroupId:         group.GetServiceGroupId(),
+				ServiceInstanceId:      service.GetServiceInstanceId(),
+				ServiceId:              service.GetServiceId(),
+				ClusterId:              service.GetDeployedOnClusterId(),
+			})
+		}
+	}
+	return services, nil
+}
+
+// storePlacement caches the placement of an application instance as store does with the clusters
+func (t *TopologyCache) storePlacement(key placementKey, services []ServicePlacement, used bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if previous, exists := t.placements[key]; exists {
+		used = used || previous.used
+	}
+	t.placements[key] = &applicationPlacement{
+		services: services,
+		fetched:  time.Now(),
+		used:     used,
+	}
+}
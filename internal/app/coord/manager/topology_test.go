@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/unified-logging/internal/pkg/client"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// countingClustersClient counts the requests to a mockup clusters client, failing them while fail is set
+type countingClustersClient struct {
+	mockupClustersClient
+	sync.Mutex
+	requests int
+	fail     bool
+	// listing is called while the clusters are listed, if set
+	listing func()
+}
+
+func (c *countingClustersClient) ListClusters(ctx context.Context, in *grpc_organization_go.OrganizationId, opts ...grpc.CallOption) (*grpc_infrastructure_go.ClusterList, error) {
+	if c.listing != nil {
+		c.listing()
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.requests++
+	if c.fail {
+		return nil, fmt.Errorf("system model not available")
+	}
+	return c.mockupClustersClient.ListClusters(ctx, in, opts...)
+}
+
+func (c *countingClustersClient) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.requests
+}
+
+func (c *countingClustersClient) setFail(fail bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.fail = fail
+}
+
+// countingApplicationsClient counts the requests to a mockup applications client
+type countingApplicationsClient struct {
+	mockupApplicationsClient
+	sync.Mutex
+	requests int
+}
+
+func (c *countingApplicationsClient) GetAppInstance(ctx context.Context, in *grpc_application_go.AppInstanceId, opts ...grpc.CallOption) (*grpc_application_go.AppInstance, error) {
+	c.Lock()
+	c.requests++
+	c.Unlock()
+	return c.mockupApplicationsClient.GetAppInstance(ctx, in, opts...)
+}
+
+func (c *countingApplicationsClient) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.requests
+}
+
+var _ = ginkgo.Describe("Topology cache", func() {
+	var clustersClient *countingClustersClient
+
+	ginkgo.BeforeEach(func() {
+		clustersClient = &countingClustersClient{mockupClustersClient: mockupClustersClient{clusters: []string{"cluster-1", "cluster-2"}}}
+	})
+
+	ginkgo.It("should list the clusters of an organization once per ttl", func() {
+		cache := NewTopologyCache(clustersClient, nil, 100*time.Millisecond)
+		for i := 0; i < 3; i++ {
+			clusters, derr := cache.GetClusters(context.Background(), OrganizationId)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			gomega.Expect(clusters).Should(gomega.HaveLen(2))
+			gomega.Expect(clusters[0].Hostname).Should(gomega.Equal("cluster-1"))
+		}
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(1))
+		gomega.Expect(cache.Stats()).Should(gomega.Equal(TopologyStats{Hits: 2, Misses: 1, Organizations: 1}))
+
+		time.Sleep(150 * time.Millisecond)
+		_, derr := cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(2))
+	})
+
+	ginkgo.It("should list the clusters again after an error", func() {
+		cache := NewTopologyCache(clustersClient, nil, time.Minute)
+		clustersClient.setFail(true)
+		_, derr := cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Internal))
+		gomega.Expect(cache.Stats().Organizations).Should(gomega.Equal(0))
+
+		clustersClient.setFail(false)
+		_, derr = cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		cache.Invalidate(OrganizationId)
+		_, derr = cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(3))
+	})
+
+	ginkgo.It("should refresh the organizations in use and evict the others", func() {
+		cache := NewTopologyCache(clustersClient, nil, time.Minute)
+		_, derr := cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+
+		// The first refresh lists the organization again, the second evicts it as it was not requested
+		cache.refresh(context.Background())
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(2))
+		gomega.Expect(cache.Stats().Organizations).Should(gomega.Equal(1))
+		cache.refresh(context.Background())
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(2))
+		gomega.Expect(cache.Stats().Organizations).Should(gomega.Equal(0))
+
+		// Organizations that cannot be refreshed are evicted
+		_, derr = cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		clustersClient.setFail(true)
+		cache.refresh(context.Background())
+		stats := cache.Stats()
+		gomega.Expect(stats.Refreshes).Should(gomega.Equal(int64(2)))
+		gomega.Expect(stats.Errors).Should(gomega.Equal(int64(1)))
+		gomega.Expect(stats.Organizations).Should(gomega.Equal(0))
+	})
+
+	ginkgo.It("should keep the organizations invalidated while they are refreshed", func() {
+		cache := NewTopologyCache(clustersClient, nil, time.Minute)
+		_, derr := cache.GetClusters(context.Background(), OrganizationId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+
+		clustersClient.listing = func() {
+			cache.Invalidate(OrganizationId)
+		}
+		cache.refresh(context.Background())
+		gomega.Expect(clustersClient.count()).Should(gomega.Equal(2))
+		gomega.Expect(cache.Stats().Organizations).Should(gomega.Equal(0))
+	})
+
+	ginkgo.It("should cache the placement of the application instances as the clusters", func() {
+		apps := &countingApplicationsClient{mockupApplicationsClient: mockupApplicationsClient{
+			instance: &grpc_application_go.AppInstance{
+				AppInstanceId: AppInstanceId,
+				Groups: []*grpc_application_go.ServiceGroupInstance{{
+					ServiceGroupInstanceId: "sg-instance-1",
+					ServiceInstances: []*grpc_application_go.ServiceInstance{
+						{ServiceInstanceId: "service-instance-1", DeployedOnClusterId: "cluster-1"},
+					},
+				}},
+			},
+		}}
+		cache := NewTopologyCache(clustersClient, apps, time.Minute)
+		for i := 0; i < 2; i++ {
+			services, derr := cache.GetPlacement(context.Background(), OrganizationId, AppInstanceId)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			gomega.Expect(services).Should(gomega.Equal([]ServicePlacement{
+				{ServiceGroupInstanceId: "sg-instance-1", ServiceInstanceId: "service-instance-1", ClusterId: "cluster-1"},
+			}))
+		}
+		gomega.Expect(apps.count()).Should(gomega.Equal(1))
+		gomega.Expect(cache.Stats().Applications).Should(gomega.Equal(1))
+
+		// Placements are refreshed while in use and invalidated with their organization
+		cache.refresh(context.Background())
+		gomega.Expect(apps.count()).Should(gomega.Equal(2))
+		cache.Invalidate(OrganizationId)
+		gomega.Expect(cache.Stats().Applications).Should(gomega.Equal(0))
+
+		// Placements that cannot be read are not cached
+		apps.instance = nil
+		_, derr := cache.GetPlacement(context.Background(), OrganizationId, AppInstanceId)
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+		gomega.Expect(cache.Stats().Applications).Should(gomega.Equal(0))
+	})
+
+	ginkgo.It("should invalidate an organization when its clusters are unavailable or not found", func() {
+		manager := newMockupExpirationManager(map[string]*mockupExpirationJobs{"cluster-1": nil, "cluster-2": nil})
+		manager.Topology = NewTopologyCache(clustersClient, nil, time.Minute)
+		manager.Executor.Health = nil
+		hosts, derr := manager.GetHosts(context.Background(), &entities.FilterFields{OrganizationId: OrganizationId})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(manager.Topology.Stats().Organizations).Should(gomega.Equal(1))
+
+		tests := []struct {
+			err         error
+			invalidated bool
+		}{
+			{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), false},
+			{status.Error(codes.Internal, "elastic: Error 500"), false},
+			{status.Error(codes.Unavailable, "connection refused"), true},
+			{status.Error(codes.NotFound, "unknown host"), true},
+		}
+		for _, test := range tests {
+			_, derr = manager.GetHosts(context.Background(), &entities.FilterFields{OrganizationId: OrganizationId})
+			gomega.Expect(derr).Should(gomega.Succeed())
+			outcomes := manager.execRequests(context.Background(), OrganizationId, hosts, func(ctx context.Context, client client.LoggingClient, i int) (int, error) {
+				if i == 1 {
+					return 0, test.err
+				}
+				return 0, nil
+			})
+			gomega.Expect(outcomes.FailedClusterIds()).Should(gomega.Equal([]string{"cluster-2"}))
+			gomega.Expect(manager.Topology.Stats().Organizations == 0).Should(gomega.Equal(test.invalidated), test.err.Error())
+		}
+	})
+})
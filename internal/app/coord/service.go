@@ -17,6 +17,7 @@
 package coord
 
 import (
+	"context"
 	"fmt"
 	"net"
 
@@ -24,6 +25,7 @@ import (
 
 	"github.com/nalej/unified-logging/internal/pkg/client"
 	"github.com/nalej/unified-logging/internal/pkg/handler"
+	"github.com/nalej/unified-logging/pkg/entities"
 
 	"github.com/nalej/unified-logging/internal/app/coord/manager"
 
@@ -79,15 +81,50 @@ func (s *Service) Run() derrors.Error {
 		CACertPath:               s.Configuration.CACertPath,
 		ClientCertPath:           s.Configuration.ClientCertPath,
 	}
-	executor := manager.NewLoggingExecutor(client.NewGRPCLoggingClient, params)
+	// Connections to the application clusters are reused between requests
+	pool := client.NewConnectionPool(s.Configuration.ConnectionIdleTimeout)
+	defer pool.Close()
+	cleanupCtx, cancelCleanup := context.WithCancel(context.Background())
+	defer cancelCleanup()
+	go pool.CleanupLoop(cleanupCtx)
+	executor := manager.NewLoggingExecutor(pool.GetClient, params, s.Configuration.MaxConcurrentRequests, s.Configuration.ClusterTimeout)
+	executor.Health = manager.NewHealthTracker(s.Configuration.ClusterFailureThreshold, s.Configuration.ClusterBackoff, s.Configuration.ClusterMaxBackoff)
+	executor.Retry = manager.RetryPolicy{
+		Attempts:        s.Configuration.RetryAttempts,
+		Backoff:         s.Configuration.RetryBackoff,
+		HedgePercentile: s.Configuration.HedgePercentile,
+	}
 
 	// Create managers and handler
-	clientManager := manager.NewManager(appsClient, clustersClient, executor, s.Configuration.AppClusterPrefix, s.Configuration.AppClusterPort)
-	handler := handler.NewHandler(clientManager, clientManager)
+	clientManager := manager.NewManager(appsClient, clustersClient, executor, s.Configuration.AppClusterPrefix, s.Configuration.AppClusterPort, s.Configuration.TailPollInterval)
+	clientManager.Experimental = s.Configuration.Experimental
+	clientManager.Topology = manager.NewTopologyCache(clustersClient, appsClient, s.Configuration.TopologyTTL)
+	clientManager.FailurePolicy = entities.FailurePolicy{MaxFailedClusters: s.Configuration.MaxFailedClusters}
+	topologyCtx, cancelTopology := context.WithCancel(context.Background())
+	defer cancelTopology()
+	go clientManager.Topology.RefreshLoop(topologyCtx)
+	coordHandler := handler.NewHandler(clientManager, clientManager)
 
 	// Create server and register handler
 	server := grpc.NewServer()
-	grpc_unified_logging_go.RegisterCoordinatorServer(server, handler)
+	grpc_unified_logging_go.RegisterCoordinatorServer(server, coordHandler)
+	// Tail, the retention policies and the expiration jobs are not part of the protos yet, so
+	// they are experimental
+	if s.Configuration.Experimental {
+		handler.RegisterTailServer(server, handler.NewTailHandler(clientManager))
+		handler.RegisterExpirationServer(server, handler.NewExpirationHandler(clientManager))
+
+		retentionManager, derr := manager.NewRetentionManager(clientManager, s.Configuration.DefaultRetentionDays, s.Configuration.RetentionPoliciesPath)
+		if derr != nil {
+			return derr
+		}
+		handler.RegisterRetentionServer(server, handler.NewRetentionHandler(retentionManager))
+
+		// The clusters that missed a change of the retention policies receive them periodically
+		syncCtx, cancelSync := context.WithCancel(context.Background())
+		defer cancelSync()
+		go retentionManager.SyncLoop(syncCtx, s.Configuration.RetentionSyncInterval)
+	}
 
 	reflection.Register(server)
 	log.Info().Int("port", s.Configuration.Port).Msg("Launching gRPC server")
@@ -19,7 +19,11 @@
 package slave
 
 import (
+	"time"
+
 	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/internal/app/slave/expire"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
 	"github.com/rs/zerolog/log"
 )
 
@@ -27,10 +31,63 @@ import (
 type Config struct {
 	// Port where the API service will listen requests.
 	Port int
+	// StorageBackend is the name of the logging storage provider
+	StorageBackend string
+	// StorageAddress with host:port of the storage server, ElasticAddress if empty
+	StorageAddress string
 	// Address with host:port of the ElasticSearch server
 	ElasticAddress string
 	// ExpireLogs flag to indicate if logs have to expire
 	ExpireLogs bool
+	// ExpireInterval is the time between passes enforcing the retention of the logs
+	ExpireInterval time.Duration
+	// LogTTL is the number of days the logs without retention policies are kept
+	LogTTL int
+	// DryRun only logs the logs and indices that would expire, without removing them
+	DryRun bool
+	// IndexInclude are the globs of the indices removed by the expiration, all if empty
+	IndexInclude []string
+	// IndexExclude are the globs of the indices never removed by the expiration
+	IndexExclude []string
+	// IndexLayouts are the layouts of the dates in the names of the removed indices
+	IndexLayouts []string
+	// MaxIndexSize is the size in bytes of the log indices over which the oldest ones are removed, 0 for no limit
+	MaxIndexSize int64
+	// DiskWatermark is the percentage of the storage disk in use over which the oldest log indices are removed, 0 for no limit
+	DiskWatermark float64
+	// SizeCheckInterval is the time between checks of the size of the log indices
+	SizeCheckInterval time.Duration
+	// ElasticSniff enables the discovery of the ElasticSearch cluster nodes
+	ElasticSniff bool
+	// ElasticHealthcheckInterval is the time between health checks of ElasticSearch, 0 disables them
+	ElasticHealthcheckInterval time.Duration
+	// ElasticMaxRetries is the number of times a failed ElasticSearch request is retried
+	ElasticMaxRetries int
+	// ElasticRetryBackoff is the wait before the first retry of an ElasticSearch request
+	ElasticRetryBackoff time.Duration
+	// ElasticMaxRetryBackoff is the maximum wait between retries of an ElasticSearch request
+	ElasticMaxRetryBackoff time.Duration
+	// ElasticRequestTimeout is the timeout of a single ElasticSearch request
+	ElasticRequestTimeout time.Duration
+	// ILMPolicy is the name of the index lifecycle policy, template and rollover alias installed in
+	// ElasticSearch, empty to remove the indices by date
+	ILMPolicy string
+	// ILMRolloverSize is the size in bytes of the primary shards over which the index is rolled over, 0 for no limit
+	ILMRolloverSize int64
+	// ILMRolloverAge is the age after which the index is rolled over, 0 for no limit
+	ILMRolloverAge time.Duration
+	// TailPollInterval is the time between searches for new log entries when tailing
+	TailPollInterval time.Duration
+	// Experimental enables the services the application cluster API does not forward yet
+	Experimental bool
+	// LocalDir is the directory of the local storage
+	LocalDir string
+	// LocalSegmentSize is the size in bytes of the segment files of the local storage
+	LocalSegmentSize int64
+	// LocalLogPath is the pattern of the container log files ingested by the local storage, empty to disable ingestion
+	LocalLogPath string
+	// LocalPollInterval is the time between reads of the container log files
+	LocalPollInterval time.Duration
 }
 
 // Validate the configuration.
@@ -38,8 +95,68 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.Port <= 0 {
 		return derrors.NewInvalidArgumentError("port must be specified")
 	}
-	if conf.ElasticAddress == "" {
-		return derrors.NewInvalidArgumentError("elasticAddress is required")
+	if conf.ElasticAddress == "" && conf.StorageAddress == "" {
+		return derrors.NewInvalidArgumentError("elasticAddress or storageAddress is required")
+	}
+	if !isProvider(conf.StorageBackend) {
+		return derrors.NewInvalidArgumentError("unknown storageBackend").WithParams(conf.StorageBackend, loggingstorage.ProviderNames())
+	}
+	if conf.ExpireInterval <= 0 {
+		return derrors.NewInvalidArgumentError("expireInterval must be positive")
+	}
+	if conf.LogTTL <= 0 {
+		return derrors.NewInvalidArgumentError("logTTL must be positive")
+	}
+	derr := conf.IndexNaming().Validate()
+	if derr != nil {
+		return derr
+	}
+	if conf.StorageBackend == loggingstorage.ElasticSearchBackend || conf.StorageBackend == loggingstorage.OpenSearchBackend {
+		derr = conf.IndexNaming().ValidatePatterns()
+		if derr != nil {
+			return derr
+		}
+	}
+	if conf.MaxIndexSize < 0 {
+		return derrors.NewInvalidArgumentError("maxIndexSize cannot be negative")
+	}
+	if conf.DiskWatermark < 0 || conf.DiskWatermark >= 100 {
+		return derrors.NewInvalidArgumentError("diskWatermark must be a percentage below 100").WithParams(conf.DiskWatermark)
+	}
+	if conf.SizeCheckInterval <= 0 {
+		return derrors.NewInvalidArgumentError("sizeCheckInterval must be positive")
+	}
+	if conf.ILMPolicy != "" {
+		derr = conf.LifecyclePolicy().Validate()
+		if derr != nil {
+			return derr
+		}
+	}
+	if conf.ElasticHealthcheckInterval < 0 {
+		return derrors.NewInvalidArgumentError("elasticHealthcheckInterval cannot be negative")
+	}
+	if conf.ElasticMaxRetries < 0 {
+		return derrors.NewInvalidArgumentError("elasticMaxRetries cannot be negative")
+	}
+	if conf.ElasticRetryBackoff < 0 || conf.ElasticMaxRetryBackoff < conf.ElasticRetryBackoff {
+		return derrors.NewInvalidArgumentError("elasticMaxRetryBackoff must be greater than elasticRetryBackoff")
+	}
+	if conf.ElasticRequestTimeout < 0 {
+		return derrors.NewInvalidArgumentError("elasticRequestTimeout cannot be negative")
+	}
+	if conf.TailPollInterval <= 0 {
+		return derrors.NewInvalidArgumentError("tailPollInterval must be positive")
+	}
+	if conf.StorageBackend == loggingstorage.LocalBackend {
+		if conf.LocalDir == "" {
+			return derrors.NewInvalidArgumentError("localDir is required")
+		}
+		if conf.LocalSegmentSize <= 0 {
+			return derrors.NewInvalidArgumentError("localSegmentSize must be positive")
+		}
+		if conf.LocalPollInterval <= 0 {
+			return derrors.NewInvalidArgumentError("localPollInterval must be positive")
+		}
 	}
 	return nil
 }
@@ -47,6 +164,125 @@ func (conf *Config) Validate() derrors.Error {
 // Print the current API configuration to the log.
 func (conf *Config) Print() {
 	log.Info().Int("port", conf.Port).Msg("gRPC port")
-	log.Info().Str("URL", conf.ElasticAddress).Msg("ElasticSearch")
-	log.Info().Bool("ExpireLogs", conf.ExpireLogs).Msg("ExpireLogs")
+	log.Info().Str("backend", conf.StorageBackend).Str("URL", conf.storageAddress()).Msg("Storage")
+	log.Info().Bool("ExpireLogs", conf.ExpireLogs).Str("interval", conf.ExpireInterval.String()).
+		Int("logTTL", conf.LogTTL).Bool("dryRun", conf.DryRun).Msg("ExpireLogs")
+	if conf.ILMPolicy != "" {
+		log.Info().Str("policy", conf.ILMPolicy).Int64("rolloverSize", conf.ILMRolloverSize).
+			Str("rolloverAge", conf.ILMRolloverAge.String()).Msg("Index lifecycle management")
+	}
+	log.Info().Strs("include", conf.IndexInclude).Strs("exclude", conf.IndexExclude).
+		Strs("layouts", conf.IndexLayouts).Msg("Expired indices")
+	log.Info().Int64("maxIndexSize", conf.MaxIndexSize).Float64("diskWatermark", conf.DiskWatermark).
+		Str("checkInterval", conf.SizeCheckInterval.String()).Msg("Size policy")
+	log.Info().Bool("sniff", conf.ElasticSniff).Str("healthcheckInterval", conf.ElasticHealthcheckInterval.String()).
+		Int("maxRetries", conf.ElasticMaxRetries).Str("retryBackoff", conf.ElasticRetryBackoff.String()).
+		Str("maxRetryBackoff", conf.ElasticMaxRetryBackoff.String()).Str("requestTimeout", conf.ElasticRequestTimeout.String()).
+		Msg("ElasticSearch client")
+	log.Info().Str("interval", conf.TailPollInterval.String()).Msg("TailPollInterval")
+	log.Info().Bool("experimental", conf.Experimental).Msg("experimental features")
+	if conf.StorageBackend == loggingstorage.LocalBackend {
+		log.Info().Str("dir", conf.LocalDir).Int64("segmentSize", conf.LocalSegmentSize).
+			Str("logPath", conf.LocalLogPath).Str("pollInterval", conf.LocalPollInterval.String()).
+			Msg("Local storage")
+	}
+}
+
+// ExpireOptions returns the options of the expire manager
+func (conf *Config) ExpireOptions() *expire.Options {
+	options := &expire.Options{
+		Interval:   conf.ExpireInterval,
+		TTL:        conf.LogTTL,
+		DryRun:     conf.DryRun,
+		Naming:     conf.IndexNaming(),
+		SizePolicy: conf.SizePolicy(),
+	}
+	if conf.ILMPolicy != "" {
+		options.Lifecycle = conf.LifecyclePolicy()
+	}
+	return options
+}
+
+// LifecyclePolicy returns the index lifecycle policy, deleting the indices after the log TTL
+// until the retention policies say otherwise
+func (conf *Config) LifecyclePolicy() *loggingstorage.LifecyclePolicy {
+	return &loggingstorage.LifecyclePolicy{
+		Name:          conf.ILMPolicy,
+		RolloverBytes: conf.ILMRolloverSize,
+		RolloverAge:   conf.ILMRolloverAge,
+		DeleteAfter:   time.Hour * 24 * time.Duration(conf.LogTTL),
+	}
+}
+
+// IndexNaming returns the naming of the indices removed by the expiration
+func (conf *Config) IndexNaming() *expire.IndexNaming {
+	layouts := make([]expire.DateLayout, 0, len(conf.IndexLayouts))
+	for _, layout := range conf.IndexLayouts {
+		layouts = append(layouts, expire.DateLayout(layout))
+	}
+	return &expire.IndexNaming{
+		Include: conf.IndexInclude,
+		Exclude: conf.IndexExclude,
+		Layouts: layouts,
+	}
+}
+
+// SizePolicy returns the policy removing the oldest log indices when the storage grows too much
+func (conf *Config) SizePolicy() *expire.SizePolicy {
+	return &expire.SizePolicy{
+		MaxIndexBytes: conf.MaxIndexSize,
+		DiskWatermark: conf.DiskWatermark,
+		CheckInterval: conf.SizeCheckInterval,
+	}
+}
+
+// ElasticSearchOptions returns the options of the ElasticSearch client
+func (conf *Config) ElasticSearchOptions() *loggingstorage.ElasticSearchOptions {
+	return &loggingstorage.ElasticSearchOptions{
+		Sniff:               conf.ElasticSniff,
+		HealthcheckInterval: conf.ElasticHealthcheckInterval,
+		MaxRetries:          conf.ElasticMaxRetries,
+		InitialRetryBackoff: conf.ElasticRetryBackoff,
+		MaxRetryBackoff:     conf.ElasticMaxRetryBackoff,
+		RequestTimeout:      conf.ElasticRequestTimeout,
+	}
+}
+
+// ProviderConfig returns the configuration of the logging storage provider
+func (conf *Config) ProviderConfig() *loggingstorage.ProviderConfig {
+	return &loggingstorage.ProviderConfig{
+		Address:        conf.storageAddress(),
+		RequestTimeout: conf.ElasticRequestTimeout,
+		ElasticSearch:  conf.ElasticSearchOptions(),
+		Local:          conf.LocalOptions(),
+		ExpireIndices:  conf.IndexNaming().Patterns(),
+	}
+}
+
+// LocalOptions returns the options of the local storage
+func (conf *Config) LocalOptions() *loggingstorage.LocalOptions {
+	return &loggingstorage.LocalOptions{
+		Dir:          conf.LocalDir,
+		SegmentSize:  conf.LocalSegmentSize,
+		LogPath:      conf.LocalLogPath,
+		PollInterval: conf.LocalPollInterval,
+	}
+}
+
+// storageAddress returns the address of the storage server
+func (conf *Config) storageAddress() string {
+	if conf.StorageAddress != "" {
+		return conf.StorageAddress
+	}
+	return conf.ElasticAddress
+}
+
+// isProvider checks if a logging storage provider is registered with the given name
+func isProvider(name string) bool {
+	for _, provider := range loggingstorage.ProviderNames() {
+		if provider == name {
+			return true
+		}
+	}
+	return false
 }
@@ -22,7 +22,7 @@ import (
 	"context"
 	"github.com/nalej/unified-logging/internal/pkg/utils"
 	"github.com/rs/zerolog/log"
-	"regexp"
+	"sync"
 	"time"
 
 	"github.com/nalej/derrors"
@@ -34,106 +34,405 @@ import (
 	grpc "github.com/nalej/grpc-unified-logging-go"
 )
 
-// expire logs timer
+// LoopSleep is the default time between expiration passes
 const LoopSleep = time.Minute * 60 * 24
 
-// DefaultLogEntryTTL number of days the logs will be alive in the system, then they will be deleted
+// DefaultLogEntryTTL number of days the logs will be alive in the system, then they will be deleted,
+// unless a retention policy of their organization, application descriptor or instance says otherwise
 const DefaultLogEntryTTL = 7
 
-// indexPattern is a regular expression to find the date in the index name "YYYY.MM.DD"
-const indexPattern = "\\d{4}.\\d{2}.\\d{2}$"
+// DefaultSizeCheckInterval is the time between checks of the size of the storage
+const DefaultSizeCheckInterval = time.Minute * 5
+
+// SizePolicy removes the oldest indices, whatever their age, when they grow over a maximum size
+// or the disk of the storage is used over a watermark
+type SizePolicy struct {
+	// MaxIndexBytes is the maximum size of all the dated indices, 0 for no limit
+	MaxIndexBytes int64
+	// DiskWatermark is the maximum percentage of the disk in use, 0 for no limit
+	DiskWatermark float64
+	// CheckInterval is the time between checks of the size of the storage
+	CheckInterval time.Duration
+}
+
+// enabled checks if the policy has any limit
+func (p *SizePolicy) enabled() bool {
+	return p != nil && (p.MaxIndexBytes > 0 || p.DiskWatermark > 0)
+}
+
+// SizeReport is the result of enforcing the size policy
+type SizeReport struct {
+	// Removed are the indices removed, or that would be in dry run mode, oldest first
+	Removed []string
+	// ReclaimedBytes is the size of the removed indices
+	ReclaimedBytes int64
+	// IndexBytes is the size of the dated indices once removed
+	IndexBytes int64
+	// Disk is the expected usage of the disk once removed, nil if the provider does not know it
+	Disk *loggingstorage.DiskUsage
+}
 
 type Manager struct {
 	Provider loggingstorage.Provider
+	// interval is the time between expiration passes
+	interval time.Duration
+	// ttl is the number of days the entries of organizations without retention policies are kept
+	ttl int
+	// dryRun only logs the entries and indices that would be removed
+	dryRun bool
+	// naming selects the indices the manager removes
+	naming *IndexNaming
+	// sizePolicy is nil when the indices are only removed by date
+	sizePolicy *SizePolicy
+	// lifecycle is nil when the storage does not roll over and delete the indices
+	lifecycle *loggingstorage.LifecyclePolicy
+	// lifecycleActive is true while the storage manages the indices of the lifecycle, so they are
+	// not removed by date. Only used by the expiration passes.
+	lifecycleActive bool
+
+	// retentionMutex protects retention
+	retentionMutex sync.Mutex
+	// retention are the retention policies of every organization, sent by the coordinator
+	retention map[string]*entities.RetentionPolicyList
+
+	// jobs are the expiration jobs started by the coordinator
+	jobs *jobs
+}
+
+// Options are the settings of the expire manager. Zero values take the defaults.
+type Options struct {
+	// Interval is the time between expiration passes, LoopSleep if not positive
+	Interval time.Duration
+	// TTL is the number of days the entries without retention policies are kept, DefaultLogEntryTTL if not positive
+	TTL int
+	// DryRun only logs the entries and indices that would be removed
+	DryRun bool
+	// Naming selects the removed indices, DefaultIndexNaming if nil
+	Naming *IndexNaming
+	// SizePolicy removes the oldest indices when the storage grows too much, nil to only remove them by date
+	SizePolicy *SizePolicy
+	// Lifecycle is left to the storage to roll over and delete its indices, nil to remove them by date.
+	// Its deletion age is set by the retention.
+	Lifecycle *loggingstorage.LifecyclePolicy
 }
 
-func NewManager(provider loggingstorage.Provider) *Manager {
+// NewManager creates the expire manager of provider with options, or the default ones if nil
+func NewManager(provider loggingstorage.Provider, options *Options) *Manager {
+	if options == nil {
+		options = &Options{}
+	}
+	interval := options.Interval
+	if interval <= 0 {
+		interval = LoopSleep
+	}
+	ttl := options.TTL
+	if ttl <= 0 {
+		ttl = DefaultLogEntryTTL
+	}
+	naming := options.Naming
+	if naming == nil {
+		naming = DefaultIndexNaming()
+	}
+	var policy *SizePolicy
+	if options.SizePolicy.enabled() {
+		copied := *options.SizePolicy
+		if copied.CheckInterval <= 0 {
+			copied.CheckInterval = DefaultSizeCheckInterval
+		}
+		policy = &copied
+	}
 	return &Manager{
-		Provider: provider,
+		Provider:   provider,
+		interval:   interval,
+		ttl:        ttl,
+		dryRun:     options.DryRun,
+		naming:     naming,
+		sizePolicy: policy,
+		lifecycle:  options.Lifecycle,
+		retention:  make(map[string]*entities.RetentionPolicyList),
+		jobs:       newJobs(),
 	}
 }
 
-func (m *Manager) Expire(ctx context.Context, request *grpc.ExpirationRequest) (*grpc_common_go.Success, derrors.Error) {
-	// We have a verified request - translate to entities.SearchRequest and execute
-	fields := entities.FilterFields{
-		OrganizationId: request.GetOrganizationId(),
-		AppInstanceId:  request.GetAppInstanceId(),
+// SyncRetentionPolicies replaces the retention policies of an organization. The entries of
+// organizations without policies are kept the ttl of the manager.
+func (m *Manager) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList) (*entities.RetentionPolicyList, derrors.Error) {
+	m.retentionMutex.Lock()
+	defer m.retentionMutex.Unlock()
+
+	if len(list.Policies) == 0 {
+		delete(m.retention, list.OrganizationId)
+	} else {
+		m.retention[list.OrganizationId] = list
 	}
+	log.Debug().Str("organizationId", list.OrganizationId).Int("policies", len(list.Policies)).
+		Int32("defaultDays", list.DefaultDays).Msg("retention policies synchronized")
 
-	search := &entities.SearchRequest{
-		Filters:       fields.ToFilters(),
-		IsUnionFilter: false,
+	return list, nil
+}
+
+// retentionPlan returns the plan enforcing the current retention policies at now
+func (m *Manager) retentionPlan(now time.Time) *entities.RetentionPlan {
+	m.retentionMutex.Lock()
+	defer m.retentionMutex.Unlock()
+
+	lists := make([]*entities.RetentionPolicyList, 0, len(m.retention))
+	for _, list := range m.retention {
+		lists = append(lists, list)
 	}
+	return entities.NewRetentionPlan(lists, m.ttl, now)
+}
 
-	err := m.Provider.Expire(ctx, search)
-	if err != nil {
-		return nil, err
+// enforceRetention deletes the entries of the scopes kept less than the longest policy, and
+// then the indices older than it, or leaves them to the lifecycle of the storage
+func (m *Manager) enforceRetention(ctx context.Context) {
+	plan := m.retentionPlan(time.Now())
+	log.Debug().Int("requests", len(plan.Requests)).Int("indexDays", plan.IndexDays).Msg("Enforce retention")
+
+	for _, request := range plan.Requests {
+		if m.dryRun {
+			log.Info().Interface("filters", request.Filters).Time("to", time.Unix(0, request.To)).
+				Msg("dry run, entries would be deleted by retention policy")
+			continue
+		}
+		expireCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+		err := m.Provider.Expire(expireCtx, request)
+		cancel()
+		if err != nil {
+			log.Warn().Interface("filters", request.Filters).Str("err", err.DebugReport()).Msg("error enforcing retention policy")
+		}
 	}
 
-	return &grpc_common_go.Success{}, nil
+	m.lifecycleActive = m.reconcileLifecycle(ctx, plan.IndexDays)
+	m.deleteIndex(ctx, plan.IndexDays)
 }
 
-// check if the index must be deleted
-func (m *Manager) checkRemoveIndex(index string) (bool, derrors.Error) {
+// reconcileLifecycle reconciles the lifecycle of the storage, deleting the indices after days,
+// and returns whether the storage manages them
+func (m *Manager) reconcileLifecycle(ctx context.Context, days int) bool {
+	if m.lifecycle == nil {
+		return false
+	}
+	manager, ok := m.Provider.(loggingstorage.LifecycleManager)
+	if !ok {
+		log.Warn().Msg("the storage provider has no index lifecycle management, indices are removed by date")
+		return false
+	}
+	policy := *m.lifecycle
+	policy.DeleteAfter = time.Hour * 24 * time.Duration(days)
+	if m.dryRun {
+		log.Info().Str("policy", policy.Name).Int("days", days).Msg("dry run, lifecycle policy would be reconciled")
+		return false
+	}
 
-	// the index name is like "filebeat-6.6.0-2020.01.17", we need to find the date of the end
-	re := regexp.MustCompile(indexPattern)
-	ind := re.FindStringSubmatch(index)
-	if len(ind) <= 0 {
-		return false, derrors.NewInternalError("error parsing the index").WithParams(index)
+	lifecycleCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+	defer cancel()
+	changed, err := manager.ReconcileLifecycle(lifecycleCtx, &policy)
+	if err != nil {
+		if err.Type() == derrors.Unimplemented {
+			log.Warn().Str("policy", policy.Name).Msg("index lifecycle management unavailable, indices are removed by date")
+		} else {
+			log.Warn().Str("policy", policy.Name).Str("err", err.DebugReport()).Msg("error reconciling lifecycle policy, indices are removed by date")
+		}
+		return false
 	}
+	log.Debug().Str("policy", policy.Name).Bool("changed", changed).Int("days", days).Msg("lifecycle policy reconciled")
+	return true
+}
 
-	indexDate := ind[0]
-	date, err := time.Parse("2006.01.02", indexDate)
+// Expire deletes the entries of the request, returning once they are deleted
+func (m *Manager) Expire(ctx context.Context, request *grpc.ExpirationRequest) (*grpc_common_go.Success, derrors.Error) {
+	err := m.Provider.Expire(ctx, expireRequest(request))
 	if err != nil {
-		return false, derrors.NewInternalError("error checking the index")
+		return nil, err
 	}
-	limitDate := time.Now().AddDate(0, 0, -1*(DefaultLogEntryTTL+1)) // I need to sum one day because I am comparing now with time and the index date without it
-	if limitDate.After(date) {
-		return true, nil
+
+	return &grpc_common_go.Success{}, nil
+}
+
+// ownedIndices returns the indices among names owned by the manager, oldest first
+func (m *Manager) ownedIndices(ctx context.Context, names []string) []ownedIndex {
+	var created map[string]time.Time
+	if m.naming.usesCreationDates() {
+		reporter, ok := m.Provider.(loggingstorage.IndexCreationReporter)
+		if !ok {
+			log.Warn().Msg("the storage provider does not report the creation date of the indices, rollover indices are kept")
+		} else {
+			createdCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+			dates, err := reporter.GetIndexCreationDates(createdCtx)
+			cancel()
+			if err != nil {
+				log.Warn().Str("err", err.DebugReport()).Msg("error getting the creation date of the indices, rollover indices are kept")
+			}
+			created = dates
+		}
 	}
-	return false, nil
+	return m.naming.ownedIndices(names, created)
 }
 
-// deleteIndex gets all the indexes and removes the old ones
-func (m *Manager) deleteIndex() {
+// deleteIndex gets all the owned indexes and removes the ones without entries newer than days,
+// returning the removed ones, or the ones that would be in dry run mode
+func (m *Manager) deleteIndex(ctx context.Context, days int) []string {
 	log.Debug().Msg("Delete Index")
 
-	listCtx, listCancel := utils.GetContext()
+	listCtx, listCancel := context.WithTimeout(ctx, utils.DefaultTimeout)
 	defer listCancel()
 	indexList, err := m.Provider.GetIndexList(listCtx)
 	if err != nil {
 		log.Warn().Str("err", err.DebugReport()).Msg("error cleaning index")
-		return
+		return nil
 	}
 
-	for _, index := range indexList {
-		remove, err := m.checkRemoveIndex(index)
+	limit := time.Now().AddDate(0, 0, -days)
+	removed := make([]string, 0)
+	for _, owned := range m.ownedIndices(ctx, indexList) {
+		index := owned.name
+		if m.lifecycleActive && matchesAny([]string{m.lifecycle.IndexPattern()}, index) {
+			continue
+		}
+		// The index being written has no end
+		remove := !owned.end.IsZero() && owned.end.Before(limit)
+		log.Debug().Str("index", index).Bool("remove", remove).Msg("checking the index")
+		if !remove {
+			continue
+		}
+		if m.dryRun {
+			log.Info().Str("index", index).Int("days", days).Msg("dry run, index would be removed")
+			removed = append(removed, index)
+			continue
+		}
+		removeCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+		err := m.Provider.RemoveIndex(removeCtx, index)
+		cancel()
 		if err != nil {
-			log.Warn().Str("index", index).Msg("error checking the index")
+			log.Warn().Str("index", index).Str("err", err.DebugReport()).Msg("error cleaning index")
+			continue
+		}
+		removed = append(removed, index)
+	}
+	return removed
+}
+
+// overSize returns the reason to remove more indices, empty if the storage is within the size policy
+func (m *Manager) overSize(indexBytes int64, disk *loggingstorage.DiskUsage) string {
+	if m.sizePolicy.MaxIndexBytes > 0 && indexBytes > m.sizePolicy.MaxIndexBytes {
+		return "maxIndexSize"
+	}
+	if m.sizePolicy.DiskWatermark > 0 && disk != nil && disk.Percent() > m.sizePolicy.DiskWatermark {
+		return "diskWatermark"
+	}
+	return ""
+}
+
+// enforceSize removes the oldest owned indices while they are over the maximum size or the disk
+// is over the watermark. The newest index and the rollover indices being written are never
+// removed, as they receive the new entries.
+func (m *Manager) enforceSize(ctx context.Context) *SizeReport {
+	reporter, ok := m.Provider.(loggingstorage.StatsReporter)
+	if !ok {
+		log.Warn().Msg("the storage provider does not report its size, the size policy cannot be enforced")
+		return nil
+	}
+
+	statsCtx, statsCancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+	defer statsCancel()
+	stats, err := reporter.GetStorageStats(statsCtx)
+	if err != nil {
+		log.Warn().Str("err", err.DebugReport()).Msg("error getting the size of the indices")
+		return nil
+	}
+
+	report := &SizeReport{
+		Removed: make([]string, 0),
+	}
+	if stats.Disk != nil {
+		disk := *stats.Disk
+		report.Disk = &disk
+	}
+	names := make([]string, 0, len(stats.Indices))
+	sizes := make(map[string]loggingstorage.IndexStats, len(stats.Indices))
+	for _, index := range stats.Indices {
+		names = append(names, index.Name)
+		sizes[index.Name] = index
+	}
+	// Other indices, like the ones of kibana, are not log entries
+	owned := m.ownedIndices(ctx, names)
+	for _, index := range owned {
+		report.IndexBytes += sizes[index.name].SizeBytes
+	}
+
+	for i := 0; i < len(owned)-1; i++ {
+		reason := m.overSize(report.IndexBytes, report.Disk)
+		if reason == "" {
+			break
+		}
+		if owned[i].end.IsZero() {
+			continue
+		}
+		index := sizes[owned[i].name]
+		if m.dryRun {
+			log.Info().Str("index", index.Name).Str("reason", reason).Int64("bytes", index.SizeBytes).
+				Int64("documents", index.Documents).Msg("dry run, index would be removed over size")
 		} else {
-			log.Debug().Str("index", index).Bool("remove", remove).Msg("checking the index")
-			if remove {
-				ctx, cancel := utils.GetContext()
-				defer cancel()
-				err = m.Provider.RemoveIndex(ctx, index)
-				if err != nil {
-					log.Warn().Str("index", index).Str("err", err.DebugReport()).Msg("error cleaning index")
-				}
+			removeCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+			err = m.Provider.RemoveIndex(removeCtx, index.Name)
+			cancel()
+			if err != nil {
+				log.Warn().Str("index", index.Name).Str("err", err.DebugReport()).Msg("error removing index over size")
+				continue
 			}
+			log.Info().Str("index", index.Name).Str("reason", reason).Int64("bytes", index.SizeBytes).
+				Int64("documents", index.Documents).Msg("index removed over size")
+		}
+		report.Removed = append(report.Removed, index.Name)
+		report.ReclaimedBytes += index.SizeBytes
+		report.IndexBytes -= index.SizeBytes
+		if report.Disk != nil {
+			report.Disk.UsedBytes -= index.SizeBytes
 		}
+	}
 
+	event := log.Debug()
+	if len(report.Removed) > 0 {
+		event = log.Info()
+	}
+	if report.Disk != nil {
+		event = event.Float64("diskPercent", report.Disk.Percent())
 	}
+	event.Bool("dryRun", m.dryRun).Strs("removed", report.Removed).Int64("reclaimedBytes", report.ReclaimedBytes).
+		Int64("indexBytes", report.IndexBytes).Msg("size policy enforced")
+	if reason := m.overSize(report.IndexBytes, report.Disk); reason != "" {
+		log.Warn().Str("reason", reason).Int64("indexBytes", report.IndexBytes).
+			Msg("storage still over the size policy, only the newest index is left")
+	}
+	return report
 }
 
-// DeleteIndexLoop Loop to remove old indexes
-func (m *Manager) DeleteIndexLoop() {
-	log.Debug().Msg("Delete Index Loop Begins")
-	ticker := time.NewTicker(LoopSleep)
+// DeleteIndexLoop enforces the retention policies and removes old indexes right away and then
+// every interval, and removes the oldest indexes when the storage is over the size policy, until
+// ctx is done
+func (m *Manager) DeleteIndexLoop(ctx context.Context) {
+	log.Info().Str("interval", m.interval.String()).Int("ttl", m.ttl).Bool("dryRun", m.dryRun).Msg("Delete Index Loop Begins")
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	// A nil channel never fires, so without size policy only the retention is enforced
+	var sizeChecks <-chan time.Time
+	if m.sizePolicy != nil {
+		sizeTicker := time.NewTicker(m.sizePolicy.CheckInterval)
+		defer sizeTicker.Stop()
+		sizeChecks = sizeTicker.C
+		m.enforceSize(ctx)
+	}
+	m.enforceRetention(ctx)
 	for {
 		select {
 		case <-ticker.C:
-			m.deleteIndex()
+			m.enforceRetention(ctx)
+		case <-sizeChecks:
+			m.enforceSize(ctx)
+		case <-ctx.Done():
+			log.Info().Msg("Delete Index Loop stopped")
+			return
 		}
 	}
 }
@@ -24,6 +24,9 @@ package expire
 import (
 	"context"
 	"os"
+	"time"
+
+	"github.com/nalej/derrors"
 
 	"github.com/nalej/grpc-unified-logging-go"
 	"github.com/nalej/grpc-utils/pkg/test"
@@ -66,7 +69,7 @@ var _ = ginkgo.Describe("Expire", func() {
 		prefix := "expire"
 
 		// Create Elastic IT provider
-		elasticProvider := loggingstorage.NewElasticSearch(elasticAddress)
+		elasticProvider := loggingstorage.NewElasticSearch(elasticAddress, nil)
 		provider = &loggingstorage.ElasticSearchIT{elasticProvider, prefix}
 
 		// Initialize template
@@ -93,7 +96,7 @@ var _ = ginkgo.Describe("Expire", func() {
 		gomega.Expect(err).To(gomega.Succeed())
 
 		// Create and register manager and handler
-		expireManager := NewManager(provider)
+		expireManager := NewManager(provider, nil)
 		h := handler.NewHandler(nil, expireManager)
 		grpc_unified_logging_go.RegisterSlaveServer(server, h)
 
@@ -131,7 +134,7 @@ var _ = ginkgo.Describe("Expire", func() {
 			_, err := client.Expire(context.Background(), req)
 			gomega.Expect(err).Should(gomega.Succeed())
 
-			// Check we have expired data
+			// Check we have expired data, once the expiration task completes
 			filters := &entities.FilterFields{
 				OrganizationId: req.OrganizationId,
 				AppInstanceId:  req.AppInstanceId,
@@ -139,7 +142,9 @@ var _ = ginkgo.Describe("Expire", func() {
 			sreq := &entities.SearchRequest{
 				Filters: filters.ToFilters(),
 			}
-			gomega.Expect(provider.Search(context.Background(), sreq, -1)).Should(gomega.HaveLen(0))
+			gomega.Eventually(func() (entities.LogEntries, derrors.Error) {
+				return provider.Search(context.Background(), sreq, -1)
+			}, time.Minute).Should(gomega.HaveLen(0))
 
 			// Check we have the other data still
 			filters = &entities.FilterFields{
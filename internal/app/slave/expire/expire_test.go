@@ -0,0 +1,319 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package expire
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func testEntry(appInstanceId string, timestamp time.Time) *entities.LogEntry {
+	return &entities.LogEntry{
+		Timestamp: timestamp,
+		Msg:       "Log line",
+		Kubernetes: entities.KubernetesEntry{
+			Labels: entities.KubernetesLabelsEntry{
+				OrganizationId: "org",
+				AppInstanceId:  appInstanceId,
+			},
+		},
+	}
+}
+
+// lifecycleProvider is a memory provider whose storage manages the lifecycle of the indices, unless it fails
+type lifecycleProvider struct {
+	*loggingstorage.Memory
+	policies []loggingstorage.LifecyclePolicy
+	err      derrors.Error
+}
+
+func (p *lifecycleProvider) ReconcileLifecycle(ctx context.Context, policy *loggingstorage.LifecyclePolicy) (bool, derrors.Error) {
+	if p.err != nil {
+		return false, p.err
+	}
+	p.policies = append(p.policies, *policy)
+	return true, nil
+}
+
+// taskProvider is a memory provider whose storage deletes the expired entries in a task
+type taskProvider struct {
+	*loggingstorage.Memory
+	requests []*entities.SearchRequest
+	task     *loggingstorage.ExpireTask
+}
+
+func (p *taskProvider) StartExpire(ctx context.Context, request *entities.SearchRequest) (string, derrors.Error) {
+	p.requests = append(p.requests, request)
+	return "node:1", nil
+}
+
+func (p *taskProvider) GetExpireTask(ctx context.Context, taskId string) (*loggingstorage.ExpireTask, derrors.Error) {
+	if p.task == nil {
+		return nil, derrors.NewNotFoundError("task not found").WithParams(taskId)
+	}
+	return p.task, nil
+}
+
+var _ = ginkgo.Describe("Expire", func() {
+	var provider *loggingstorage.Memory
+	var manager *Manager
+	now := time.Now()
+
+	ginkgo.BeforeEach(func() {
+		provider = loggingstorage.NewMemory()
+		provider.Add(testEntry("app-1", now), testEntry("app-2", now))
+		manager = NewManager(provider, nil)
+	})
+
+	count := func() int {
+		entries, err := provider.Search(context.Background(), &entities.SearchRequest{}, -1)
+		gomega.Expect(err).Should(gomega.Succeed())
+		return len(entries)
+	}
+
+	ginkgo.It("should delete the logs of an application instance", func() {
+		_, err := manager.Expire(context.Background(), &grpc_unified_logging_go.ExpirationRequest{
+			OrganizationId: "org",
+			AppInstanceId:  "app-1",
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(count()).Should(gomega.Equal(1))
+	})
+
+	ginkgo.It("should delete the logs of an application instance in a job", func() {
+		job, err := manager.StartExpiration(context.Background(), &grpc_unified_logging_go.ExpirationRequest{
+			OrganizationId: "org",
+			AppInstanceId:  "app-1",
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(job.JobId).ShouldNot(gomega.BeEmpty())
+		id := &entities.ExpirationJobId{OrganizationId: "org", JobId: job.JobId}
+		gomega.Eventually(func() entities.ExpirationState {
+			status, err := manager.GetExpirationJob(context.Background(), id)
+			gomega.Expect(err).Should(gomega.Succeed())
+			return status.State
+		}).Should(gomega.Equal(entities.ExpirationCompleted))
+		gomega.Expect(count()).Should(gomega.Equal(1))
+
+		_, err = manager.GetExpirationJob(context.Background(), &entities.ExpirationJobId{OrganizationId: "other", JobId: job.JobId})
+		gomega.Expect(err.Type()).Should(gomega.Equal(derrors.NotFound))
+
+		manager.Close()
+	})
+
+	ginkgo.It("should follow the expiration tasks of the storage", func() {
+		storage := &taskProvider{Memory: provider, task: &loggingstorage.ExpireTask{Total: 2, Deleted: 1}}
+		manager = NewManager(storage, nil)
+		job, err := manager.StartExpiration(context.Background(), &grpc_unified_logging_go.ExpirationRequest{OrganizationId: "org"})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(storage.requests).Should(gomega.HaveLen(1))
+
+		id := &entities.ExpirationJobId{OrganizationId: "org", JobId: job.JobId}
+		status, err := manager.GetExpirationJob(context.Background(), id)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationRunning))
+		gomega.Expect(status.Deleted).Should(gomega.Equal(int64(1)))
+
+		storage.task = &loggingstorage.ExpireTask{Completed: true, Total: 2, Deleted: 1, Failures: []string{"version conflict"}}
+		status, err = manager.GetExpirationJob(context.Background(), id)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(status.State).Should(gomega.Equal(entities.ExpirationFailed))
+		gomega.Expect(status.Failures).Should(gomega.Equal([]string{"version conflict"}))
+
+		// Finished jobs do not ask the storage again
+		storage.task = nil
+		_, err = manager.GetExpirationJob(context.Background(), id)
+		gomega.Expect(err).Should(gomega.Succeed())
+	})
+
+	ginkgo.It("should remove the indices older than the retention", func() {
+		old := now.AddDate(0, 0, -(DefaultLogEntryTTL + 2))
+		provider.Add(testEntry("app-1", old))
+		provider.AddIndex("not-dated")
+
+		manager.deleteIndex(context.Background(), DefaultLogEntryTTL)
+		indices, err := provider.GetIndexList(context.Background())
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(indices).Should(gomega.ConsistOf(loggingstorage.MemoryIndexName(now), "not-dated"))
+		gomega.Expect(count()).Should(gomega.Equal(2))
+	})
+
+	ginkgo.It("should enforce the retention policies", func() {
+		provider.Add(testEntry("app-1", now.AddDate(0, 0, -2)), testEntry("app-2", now.AddDate(0, 0, -2)),
+			testEntry("app-2", now.AddDate(0, 0, -(DefaultLogEntryTTL+2))))
+		_, err := manager.SyncRetentionPolicies(context.Background(), &entities.RetentionPolicyList{
+			OrganizationId: "org",
+			Policies: []*entities.RetentionPolicy{
+				{OrganizationId: "org", Days: 30},
+				{OrganizationId: "org", AppInstanceId: "app-1", Days: 1},
+			},
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+
+		manager.enforceRetention(context.Background())
+		gomega.Expect(count()).Should(gomega.Equal(4))
+
+		// Without policies, the organization is kept the default days
+		_, err = manager.SyncRetentionPolicies(context.Background(), &entities.RetentionPolicyList{OrganizationId: "org"})
+		gomega.Expect(err).Should(gomega.Succeed())
+		manager.enforceRetention(context.Background())
+		gomega.Expect(count()).Should(gomega.Equal(3))
+	})
+
+	ginkgo.It("should only remove the owned indices", func() {
+		old := now.AddDate(0, 0, -(DefaultLogEntryTTL + 2))
+		provider.Add(testEntry("app-1", old))
+		provider.SetIndexCreationDate("logs-000001", old)
+		provider.SetIndexCreationDate("logs-000002", old.AddDate(0, 0, 1))
+		provider.SetIndexCreationDate("logs-000003", now)
+		provider.SetIndexCreationDate(".kibana-000001", old)
+
+		manager = NewManager(provider, &Options{Naming: &IndexNaming{
+			Include: []string{"logs-*"},
+			Layouts: []DateLayout{RolloverLayout},
+		}})
+		gomega.Expect(manager.deleteIndex(context.Background(), DefaultLogEntryTTL)).Should(
+			gomega.Equal([]string{"logs-000001"}))
+		indices, err := provider.GetIndexList(context.Background())
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(indices).Should(gomega.ConsistOf(".kibana-000001", loggingstorage.MemoryIndexName(now),
+			loggingstorage.MemoryIndexName(old), "logs-000002", "logs-000003"))
+	})
+
+	ginkgo.It("should leave the indices to the lifecycle of the storage while it is available", func() {
+		old := now.AddDate(0, 0, -(DefaultLogEntryTTL + 2))
+		provider.SetIndexCreationDate("logs-000001", old)
+		provider.SetIndexCreationDate("logs-000002", old.AddDate(0, 0, 1))
+		storage := &lifecycleProvider{Memory: provider}
+		manager = NewManager(storage, &Options{
+			Naming:    &IndexNaming{Layouts: []DateLayout{RolloverLayout}},
+			Lifecycle: &loggingstorage.LifecyclePolicy{Name: "logs", RolloverAge: time.Hour * 24},
+		})
+
+		manager.enforceRetention(context.Background())
+		gomega.Expect(storage.policies).Should(gomega.HaveLen(1))
+		gomega.Expect(storage.policies[0].DeleteAfter).Should(gomega.Equal(time.Hour * 24 * DefaultLogEntryTTL))
+		indices, err := provider.GetIndexList(context.Background())
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(indices).Should(gomega.ContainElement("logs-000001"))
+
+		storage.err = derrors.NewUnimplementedError("index lifecycle management is not available")
+		manager.enforceRetention(context.Background())
+		indices, err = provider.GetIndexList(context.Background())
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(indices).ShouldNot(gomega.ContainElement("logs-000001"))
+	})
+
+	ginkgo.It("should keep the entries without policies the configured ttl", func() {
+		provider.Add(testEntry("app-1", now.AddDate(0, 0, -3)))
+		manager = NewManager(provider, &Options{TTL: 1})
+		manager.enforceRetention(context.Background())
+		gomega.Expect(count()).Should(gomega.Equal(2))
+	})
+
+	ginkgo.It("should only report what would be removed in dry run mode", func() {
+		old := now.AddDate(0, 0, -(DefaultLogEntryTTL + 2))
+		provider.Add(testEntry("app-1", old), testEntry("app-1", now.AddDate(0, 0, -2)))
+		manager = NewManager(provider, &Options{DryRun: true, SizePolicy: &SizePolicy{MaxIndexBytes: 1}})
+		_, err := manager.SyncRetentionPolicies(context.Background(), &entities.RetentionPolicyList{
+			OrganizationId: "org",
+			Policies:       []*entities.RetentionPolicy{{OrganizationId: "org", AppInstanceId: "app-1", Days: 1}},
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+
+		manager.enforceRetention(context.Background())
+		gomega.Expect(manager.deleteIndex(context.Background(), DefaultLogEntryTTL)).Should(
+			gomega.Equal([]string{loggingstorage.MemoryIndexName(old)}))
+		gomega.Expect(manager.enforceSize(context.Background()).Removed).Should(gomega.HaveLen(2))
+		gomega.Expect(count()).Should(gomega.Equal(4))
+	})
+
+	ginkgo.It("should expire right away and stop with its context", func() {
+		old := now.AddDate(0, 0, -(DefaultLogEntryTTL + 2))
+		provider.Add(testEntry("app-1", old))
+		manager = NewManager(provider, &Options{Interval: time.Hour})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			manager.DeleteIndexLoop(ctx)
+			close(done)
+		}()
+		gomega.Eventually(count).Should(gomega.Equal(2))
+		cancel()
+		gomega.Eventually(done).Should(gomega.BeClosed())
+	})
+
+	ginkgo.Context("with a size policy", func() {
+		var oldest, older string
+		var sizes map[string]int64
+
+		ginkgo.BeforeEach(func() {
+			oldest = loggingstorage.MemoryIndexName(now.AddDate(0, 0, -2))
+			older = loggingstorage.MemoryIndexName(now.AddDate(0, 0, -1))
+			provider.Add(testEntry("app-1", now.AddDate(0, 0, -2)), testEntry("app-1", now.AddDate(0, 0, -1)))
+			provider.AddIndex("not-dated")
+
+			stats, err := provider.GetStorageStats(context.Background())
+			gomega.Expect(err).Should(gomega.Succeed())
+			sizes = make(map[string]int64)
+			for _, index := range stats.Indices {
+				sizes[index.Name] = index.SizeBytes
+			}
+		})
+
+		indices := func() []string {
+			list, err := provider.GetIndexList(context.Background())
+			gomega.Expect(err).Should(gomega.Succeed())
+			return list
+		}
+		today := loggingstorage.MemoryIndexName(now)
+
+		ginkgo.It("should remove the oldest indices over the maximum size", func() {
+			manager = NewManager(provider, &Options{SizePolicy: &SizePolicy{MaxIndexBytes: sizes[older] + sizes[today]}})
+			report := manager.enforceSize(context.Background())
+			gomega.Expect(report.Removed).Should(gomega.Equal([]string{oldest}))
+			gomega.Expect(report.ReclaimedBytes).Should(gomega.Equal(sizes[oldest]))
+			gomega.Expect(report.IndexBytes).Should(gomega.Equal(sizes[older] + sizes[today]))
+			gomega.Expect(indices()).Should(gomega.ConsistOf(older, today, "not-dated"))
+
+			// Within the limit, nothing else is removed
+			gomega.Expect(manager.enforceSize(context.Background()).Removed).Should(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should remove the oldest indices over the disk watermark but the newest", func() {
+			provider.SetDiskSize(sizes[oldest] + sizes[older] + sizes[today])
+			manager = NewManager(provider, &Options{SizePolicy: &SizePolicy{DiskWatermark: 1}})
+			report := manager.enforceSize(context.Background())
+			gomega.Expect(report.Removed).Should(gomega.Equal([]string{oldest, older}))
+			gomega.Expect(report.Disk.UsedBytes).Should(gomega.Equal(sizes[today]))
+			gomega.Expect(indices()).Should(gomega.ConsistOf(today, "not-dated"))
+		})
+
+		ginkgo.It("should be disabled without limits", func() {
+			manager = NewManager(provider, &Options{SizePolicy: &SizePolicy{CheckInterval: time.Minute}})
+			gomega.Expect(manager.sizePolicy).Should(gomega.BeNil())
+		})
+	})
+})
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Expiration jobs of the slave
+
+package expire
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/utils"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/rs/zerolog/log"
+)
+
+// JobRetention is the time the jobs are kept after they finish, so their result can be asked for
+const JobRetention = time.Hour * 24
+
+// expirationJob is an expiration running in the storage, if it has a task, or in the slave
+type expirationJob struct {
+	status *entities.ExpirationJob
+	// taskId is the task of the storage deleting the entries, empty if the slave deletes them
+	taskId string
+	// started and finished are the times the job started and finished, finished is zero while it runs
+	started  time.Time
+	finished time.Time
+}
+
+// jobs are the expiration jobs of a manager
+type jobs struct {
+	// ctx is done when the manager is closed, stopping the jobs run by the slave
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running are the jobs run by the slave
+	running sync.WaitGroup
+
+	// mutex protects byId
+	mutex sync.Mutex
+	byId  map[string]*expirationJob
+}
+
+func newJobs() *jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobs{
+		ctx:    ctx,
+		cancel: cancel,
+		byId:   make(map[string]*expirationJob),
+	}
+}
+
+// newJobId returns a random job identifier
+func newJobId() (string, derrors.Error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", derrors.NewInternalError("cannot create job identifier", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// expireRequest returns the request of the entries of an expiration
+func expireRequest(request *grpc_unified_logging_go.ExpirationRequest) *entities.SearchRequest {
+	fields := entities.FilterFields{
+		OrganizationId: request.GetOrganizationId(),
+		AppInstanceId:  request.GetAppInstanceId(),
+	}
+	return &entities.SearchRequest{
+		Filters:       fields.ToFilters(),
+		IsUnionFilter: false,
+	}
+}
+
+// StartExpiration starts deleting the entries of the request. The storage deletes them in a task
+// if it can, otherwise the slave deletes them in the background until the manager is closed.
+func (m *Manager) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, derrors.Error) {
+	jobId, derr := newJobId()
+	if derr != nil {
+		return nil, derr
+	}
+	job := &expirationJob{
+		status: &entities.ExpirationJob{
+			OrganizationId: request.GetOrganizationId(),
+			AppInstanceId:  request.GetAppInstanceId(),
+			JobId:          jobId,
+			State:          entities.ExpirationRunning,
+		},
+		started: time.Now(),
+	}
+	search := expireRequest(request)
+
+	if expirer, ok := m.Provider.(loggingstorage.AsyncExpirer); ok {
+		startCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+		defer cancel()
+		taskId, derr := expirer.StartExpire(startCtx, search)
+		if derr != nil {
+			return nil, derr
+		}
+		job.taskId = taskId
+		m.jobs.add(job)
+	} else {
+		m.jobs.add(job)
+		m.jobs.running.Add(1)
+		go m.runExpiration(job, search)
+	}
+	log.Info().Str("jobId", jobId).Str("organizationId", request.GetOrganizationId()).
+		Str("appInstanceId", request.GetAppInstanceId()).Str("taskId", job.taskId).Msg("expiration started")
+
+	return m.jobs.status(job), nil
+}
+
+// runExpiration deletes the entries of a job run by the slave
+func (m *Manager) runExpiration(job *expirationJob, search *entities.SearchRequest) {
+	defer m.jobs.running.Done()
+	derr := m.Provider.Expire(m.jobs.ctx, search)
+
+	m.jobs.mutex.Lock()
+	defer m.jobs.mutex.Unlock()
+	job.finished = time.Now()
+	if derr != nil {
+		log.Warn().Str("jobId", job.status.JobId).Str("err", derr.DebugReport()).Msg("expiration failed")
+		job.status.State = entities.ExpirationFailed
+		job.status.Failures = append(job.status.Failures, derr.Error())
+		return
+	}
+	log.Info().Str("jobId", job.status.JobId).Msg("expiration completed")
+	job.status.State = entities.ExpirationCompleted
+}
+
+// GetExpirationJob returns the progress of a job of the organization, asking the storage for the
+// progress of its task while it runs
+func (m *Manager) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, derrors.Error) {
+	m.jobs.mutex.Lock()
+	job, exists := m.jobs.byId[id.JobId]
+	running := exists && job.finished.IsZero()
+	m.jobs.mutex.Unlock()
+	// Jobs of other organizations are not found either
+	if !exists || job.status.OrganizationId != id.OrganizationId {
+		return nil, derrors.NewNotFoundError("expiration job not found").WithParams(id.JobId)
+	}
+
+	if running && job.taskId != "" {
+		taskCtx, cancel := context.WithTimeout(ctx, utils.DefaultTimeout)
+		defer cancel()
+		// Only providers with tasks give jobs a task
+		task, derr := m.Provider.(loggingstorage.AsyncExpirer).GetExpireTask(taskCtx, job.taskId)
+		if derr != nil {
+			return nil, derr
+		}
+		m.jobs.update(job, task)
+	}
+
+	return m.jobs.status(job), nil
+}
+
+// Close stops the jobs run by the slave and waits for them to finish
+func (m *Manager) Close() {
+	m.jobs.cancel()
+	m.jobs.running.Wait()
+}
+
+// add adds a job, removing the ones finished more than JobRetention ago. The jobs of the storage
+// that were not asked for are removed JobRetention after they started.
+func (j *jobs) add(job *expirationJob) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	expired := time.Now().Add(-JobRetention)
+	for id, existing := range j.byId {
+		if (!existing.finished.IsZero() && existing.finished.Before(expired)) ||
+			(existing.taskId != "" && existing.started.Before(expired)) {
+			delete(j.byId, id)
+		}
+	}
+	j.byId[job.status.JobId] = job
+}
+
+// update sets the progress of a job from the progress of its task
+func (j *jobs) update(job *expirationJob, task *loggingstorage.ExpireTask) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	job.status.Deleted = task.Deleted
+	job.status.Total = task.Total
+	job.status.Failures = task.Failures
+	if !task.Completed || !job.finished.IsZero() {
+		return
+	}
+	job.finished = time.Now()
+	job.status.State = entities.ExpirationCompleted
+	if len(task.Failures) > 0 {
+		job.status.State = entities.ExpirationFailed
+	}
+	log.Info().Str("jobId", job.status.JobId).Str("state", job.status.State.String()).
+		Int64("deleted", task.Deleted).Int("failures", len(task.Failures)).Msg("expiration finished")
+}
+
+// status returns a copy of the progress of a job
+func (j *jobs) status(job *expirationJob) *entities.ExpirationJob {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	status := *job.status
+	status.Failures = append([]string{}, job.status.Failures...)
+	return &status
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Names of the indices owned by the expire manager
+
+package expire
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// DateLayout is the way the period of the entries of an index is found from its name
+type DateLayout string
+
+const (
+	// DailyLayout indices end with the day of their entries, as "filebeat-6.6.0-2020.01.17"
+	DailyLayout DateLayout = "daily"
+	// WeeklyLayout indices end with the ISO year and week of their entries, as "filebeat-6.6.0-2020.03"
+	WeeklyLayout DateLayout = "weekly"
+	// MonthlyLayout indices end with the month of their entries, as "filebeat-6.6.0-2020.01"
+	MonthlyLayout DateLayout = "monthly"
+	// RolloverLayout indices end with the generation of an ILM rollover, as "filebeat-7.5.0-000001".
+	// Their entries are the ones from their creation to the creation of the next generation.
+	RolloverLayout DateLayout = "rollover"
+)
+
+// dateLayouts are all the layouts, in the order they are documented
+var dateLayouts = []DateLayout{DailyLayout, WeeklyLayout, MonthlyLayout, RolloverLayout}
+
+var (
+	dailyPattern    = regexp.MustCompile(`\d{4}\.\d{2}\.\d{2}$`)
+	periodPattern   = regexp.MustCompile(`(\d{4})\.(\d{2})$`)
+	rolloverPattern = regexp.MustCompile(`^(.+)-(\d{6,})$`)
+)
+
+// DateLayoutNames returns the names of the date layouts
+func DateLayoutNames() []string {
+	names := make([]string, 0, len(dateLayouts))
+	for _, layout := range dateLayouts {
+		names = append(names, string(layout))
+	}
+	return names
+}
+
+// IndexNaming selects the indices the expire manager owns, and the layouts of their names
+type IndexNaming struct {
+	// Include are the globs of the owned indices, all if empty
+	Include []string
+	// Exclude are the globs of the indices never owned, even if included
+	Exclude []string
+	// Layouts are tried in order until one matches the name of an index. The indices none of
+	// them matches are not owned.
+	Layouts []DateLayout
+}
+
+// DefaultIndexNaming returns the naming of the indices with their day at the end of their name,
+// except the hidden and system ones
+func DefaultIndexNaming() *IndexNaming {
+	return &IndexNaming{
+		Exclude: []string{".*"},
+		Layouts: []DateLayout{DailyLayout},
+	}
+}
+
+// Validate checks the globs and the layouts
+func (n *IndexNaming) Validate() derrors.Error {
+	for _, globs := range [][]string{n.Include, n.Exclude} {
+		for _, glob := range globs {
+			_, err := path.Match(glob, "")
+			if err != nil {
+				return derrors.NewInvalidArgumentError("invalid index glob", err).WithParams(glob)
+			}
+		}
+	}
+	if len(n.Layouts) == 0 {
+		return derrors.NewInvalidArgumentError("at least one index layout is required")
+	}
+	for _, layout := range n.Layouts {
+		known := false
+		for _, existing := range dateLayouts {
+			known = known || layout == existing
+		}
+		if !known {
+			return derrors.NewInvalidArgumentError("unknown index layout").WithParams(layout, DateLayoutNames())
+		}
+	}
+	return nil
+}
+
+// ValidatePatterns checks the globs can be written in the multi-target syntax of ElasticSearch
+// and OpenSearch, which only has the * wildcard
+func (n *IndexNaming) ValidatePatterns() derrors.Error {
+	for _, globs := range [][]string{n.Include, n.Exclude} {
+		for _, glob := range globs {
+			if glob == "" || strings.ContainsAny(glob, "?[\\,") || strings.HasPrefix(glob, "-") {
+				return derrors.NewInvalidArgumentError("index glob cannot be used to delete entries by query").WithParams(glob)
+			}
+		}
+	}
+	return nil
+}
+
+// Patterns returns the owned indices in the multi-target syntax of ElasticSearch and OpenSearch:
+// the included globs, or all the indices, followed by the excluded ones
+func (n *IndexNaming) Patterns() []string {
+	patterns := make([]string, 0, len(n.Include)+len(n.Exclude)+1)
+	if len(n.Include) == 0 {
+		patterns = append(patterns, "*")
+	}
+	patterns = append(patterns, n.Include...)
+	for _, glob := range n.Exclude {
+		patterns = append(patterns, "-"+glob)
+	}
+	return patterns
+}
+
+// matchesAny checks if the index matches any of the globs
+func matchesAny(globs []string, index string) bool {
+	for _, glob := range globs {
+		// The globs are validated, so they cannot fail
+		if matched, _ := path.Match(glob, index); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// owns checks if the index is included and not excluded
+func (n *IndexNaming) owns(index string) bool {
+	if len(n.Include) > 0 && !matchesAny(n.Include, index) {
+		return false
+	}
+	return !matchesAny(n.Exclude, index)
+}
+
+// usesCreationDates checks if the creation date of the indices is needed to find their period
+func (n *IndexNaming) usesCreationDates() bool {
+	for _, layout := range n.Layouts {
+		if layout == RolloverLayout {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedIndex is an owned index and the period of its entries
+type ownedIndex struct {
+	name string
+	// start is the time of its oldest entries
+	start time.Time
+	// end is the time after which it receives no entries, zero while it is being written
+	end time.Time
+}
+
+// rolloverGeneration is an index named by rollover
+type rolloverGeneration struct {
+	ownedIndex
+	generation int64
+}
+
+// ownedIndices returns the owned indices among names with a known period, oldest first. created
+// is the creation time of the indices, only needed by the rollover layout.
+func (n *IndexNaming) ownedIndices(names []string, created map[string]time.Time) []ownedIndex {
+	indices := make([]ownedIndex, 0, len(names))
+	// generations of the rollover indices, by their name without generation
+	rollovers := make(map[string][]rolloverGeneration)
+	for _, name := range names {
+		if !n.owns(name) {
+			continue
+		}
+		for _, layout := range n.Layouts {
+			if layout == RolloverLayout {
+				match := rolloverPattern.FindStringSubmatch(name)
+				if match == nil {
+					continue
+				}
+				start, exists := created[name]
+				if !exists {
+					break
+				}
+				generation, err := strconv.ParseInt(match[2], 10, 64)
+				if err != nil {
+					break
+				}
+				rollovers[match[1]] = append(rollovers[match[1]], rolloverGeneration{
+					ownedIndex: ownedIndex{name: name, start: start},
+					generation: generation,
+				})
+				break
+			}
+			start, end, ok := periodOf(layout, name)
+			if ok {
+				indices = append(indices, ownedIndex{name: name, start: start, end: end})
+				break
+			}
+		}
+	}
+
+	// Every generation ends when the next one is created, and the last one is being written
+	for _, generations := range rollovers {
+		sort.Slice(generations, func(i, j int) bool {
+			return generations[i].generation < generations[j].generation
+		})
+		for i, generation := range generations {
+			if i < len(generations)-1 {
+				generation.end = generations[i+1].start
+			}
+			indices = append(indices, generation.ownedIndex)
+		}
+	}
+
+	sort.Slice(indices, func(i, j int) bool {
+		if !indices[i].start.Equal(indices[j].start) {
+			return indices[i].start.Before(indices[j].start)
+		}
+		return indices[i].name < indices[j].name
+	})
+	return indices
+}
+
+// periodOf returns the period of the entries of an index named with a date layout
+func periodOf(layout DateLayout, name string) (time.Time, time.Time, bool) {
+	switch layout {
+	case DailyLayout:
+		start, err := time.Parse("2006.01.02", dailyPattern.FindString(name))
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		return start, start.AddDate(0, 0, 1), true
+	case MonthlyLayout:
+		start, err := time.Parse("2006.01", periodPattern.FindString(name))
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		return start, start.AddDate(0, 1, 0), true
+	case WeeklyLayout:
+		match := periodPattern.FindStringSubmatch(name)
+		if match == nil {
+			return time.Time{}, time.Time{}, false
+		}
+		// The patterns only match digits
+		year, _ := strconv.Atoi(match[1])
+		week, _ := strconv.Atoi(match[2])
+		start := isoWeekStart(year, week)
+		if startYear, startWeek := start.ISOWeek(); startYear != year || startWeek != week {
+			return time.Time{}, time.Time{}, false
+		}
+		return start, start.AddDate(0, 0, 7), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// isoWeekStart returns the monday of an ISO week
+func isoWeekStart(year int, week int) time.Time {
+	// January 4th is always in the first week
+	january4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+	sinceMonday := (int(january4.Weekday()) + 6) % 7
+	return january4.AddDate(0, 0, (week-1)*7-sinceMonday)
+}
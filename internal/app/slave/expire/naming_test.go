@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package expire
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type namingTest struct {
+	index string
+	start time.Time
+	end   time.Time
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+var _ = ginkgo.Describe("Index naming", func() {
+	created := map[string]time.Time{
+		"filebeat-7.5.0-000001": date(2020, 1, 1).Add(time.Hour),
+		"filebeat-7.5.0-000002": date(2020, 1, 10),
+		"filebeat-7.5.0-000010": date(2020, 1, 20),
+		"logs-000001":           date(2020, 1, 5),
+	}
+
+	ginkgo.It("should find the period of the indices of every layout", func() {
+		naming := &IndexNaming{Layouts: []DateLayout{DailyLayout, RolloverLayout, WeeklyLayout}}
+		tests := []namingTest{
+			{"filebeat-6.6.0-2020.01.17", date(2020, 1, 17), date(2020, 1, 18)},
+			// Weeks start on monday, and the first one has January 4th
+			{"filebeat-6.6.0-2020.01", date(2019, 12, 30), date(2020, 1, 6)},
+			{"filebeat-6.6.0-2020.53", date(2020, 12, 28), date(2021, 1, 4)},
+			// Generations end when the next one is created, and the last one is written
+			{"filebeat-7.5.0-000001", created["filebeat-7.5.0-000001"], date(2020, 1, 10)},
+			{"filebeat-7.5.0-000002", date(2020, 1, 10), date(2020, 1, 20)},
+			{"filebeat-7.5.0-000010", date(2020, 1, 20), time.Time{}},
+			{"logs-000001", date(2020, 1, 5), time.Time{}},
+		}
+		names := []string{"filebeat-6.6.0-2020.54", "not-dated", "filebeat-7.5.0-000003"}
+		for _, test := range tests {
+			names = append(names, test.index)
+		}
+
+		indices := naming.ownedIndices(names, created)
+		gomega.Expect(indices).Should(gomega.HaveLen(len(tests)))
+		for _, test := range tests {
+			gomega.Expect(indices).Should(gomega.ContainElement(ownedIndex{name: test.index, start: test.start, end: test.end}), test.index)
+		}
+		for i := 1; i < len(indices); i++ {
+			gomega.Expect(indices[i-1].start.After(indices[i].start)).Should(gomega.BeFalse())
+		}
+	})
+
+	ginkgo.It("should try the layouts in order", func() {
+		monthly := (&IndexNaming{Layouts: []DateLayout{MonthlyLayout, WeeklyLayout}}).ownedIndices([]string{"logs-2020.02"}, nil)
+		gomega.Expect(monthly).Should(gomega.Equal([]ownedIndex{{name: "logs-2020.02", start: date(2020, 2, 1), end: date(2020, 3, 1)}}))
+		weekly := (&IndexNaming{Layouts: []DateLayout{WeeklyLayout, MonthlyLayout}}).ownedIndices([]string{"logs-2020.02"}, nil)
+		gomega.Expect(weekly).Should(gomega.Equal([]ownedIndex{{name: "logs-2020.02", start: date(2020, 1, 6), end: date(2020, 1, 13)}}))
+	})
+
+	ginkgo.It("should only own the included indices that are not excluded", func() {
+		naming := &IndexNaming{
+			Include: []string{"filebeat-*", "logs-*"},
+			Exclude: []string{"logs-audit-*"},
+			Layouts: []DateLayout{DailyLayout},
+		}
+		indices := naming.ownedIndices([]string{"filebeat-2020.01.01", "logs-2020.01.01", "logs-audit-2020.01.01",
+			"metricbeat-2020.01.01"}, nil)
+		gomega.Expect(indices).Should(gomega.HaveLen(2))
+		gomega.Expect(indices[0].name).Should(gomega.Equal("filebeat-2020.01.01"))
+		gomega.Expect(indices[1].name).Should(gomega.Equal("logs-2020.01.01"))
+
+		gomega.Expect(DefaultIndexNaming().owns(".kibana-2020.01.01")).Should(gomega.BeFalse())
+	})
+
+	ginkgo.It("should validate the globs and layouts", func() {
+		gomega.Expect(DefaultIndexNaming().Validate()).Should(gomega.Succeed())
+		gomega.Expect((&IndexNaming{Include: []string{"filebeat-["}, Layouts: []DateLayout{DailyLayout}}).Validate()).ShouldNot(gomega.Succeed())
+		gomega.Expect((&IndexNaming{}).Validate()).ShouldNot(gomega.Succeed())
+		gomega.Expect((&IndexNaming{Layouts: []DateLayout{"hourly"}}).Validate()).ShouldNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should write the owned indices as multi-target patterns", func() {
+		gomega.Expect(DefaultIndexNaming().Patterns()).Should(gomega.Equal([]string{"*", "-.*"}))
+		naming := &IndexNaming{Include: []string{"filebeat-*", "logs-*"}, Exclude: []string{"logs-audit-*"}}
+		gomega.Expect(naming.ValidatePatterns()).Should(gomega.Succeed())
+		gomega.Expect(naming.Patterns()).Should(gomega.Equal([]string{"filebeat-*", "logs-*", "-logs-audit-*"}))
+		gomega.Expect((&IndexNaming{Include: []string{"filebeat-?"}}).ValidatePatterns()).ShouldNot(gomega.Succeed())
+		gomega.Expect((&IndexNaming{Exclude: []string{"logs-[ab]*"}}).ValidatePatterns()).ShouldNot(gomega.Succeed())
+	})
+})
@@ -19,10 +19,39 @@
 package search
 
 import (
+	"github.com/nalej/derrors"
 	grpc "github.com/nalej/grpc-unified-logging-go"
 	"github.com/nalej/unified-logging/pkg/entities"
 )
 
+// EntitiesSearchRequest translates a gRPC search request into a storage provider search request,
+// parsing the message filter as a query
+func EntitiesSearchRequest(request *grpc.SearchRequest) (*entities.SearchRequest, derrors.Error) {
+	query, err := entities.ParseQuery(request.GetMsgQueryFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	fields := entities.FilterFields{
+		OrganizationId:         request.GetOrganizationId(),
+		AppDescriptorId:        request.GetAppDescriptorId(),
+		AppInstanceId:          request.GetAppInstanceId(),
+		ServiceGroupId:         request.ServiceGroupId,
+		ServiceGroupInstanceId: request.GetServiceGroupInstanceId(),
+		ServiceId:              request.ServiceId,
+		ServiceInstanceId:      request.ServiceInstanceId,
+	}
+
+	return &entities.SearchRequest{
+		Filters:       fields.ToFilters(),
+		IsUnionFilter: false,
+		Query:         query,
+		From:          request.From,
+		To:            request.To,
+		Order:         entities.SortOrderFromNFirst(request.NFirst),
+	}, nil
+}
+
 func GRPCEntries(entries entities.LogEntries) []*grpc.LogEntry {
 	result := make([]*grpc.LogEntry, len(entries))
 	for i, e := range entries {
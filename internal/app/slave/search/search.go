@@ -36,45 +36,46 @@ func NewManager(provider loggingstorage.Provider) *Manager {
 	}
 }
 
-func (m *Manager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest) (*grpc_unified_logging_go.LogResponseList, derrors.Error) {
+func (m *Manager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions) (*grpc_unified_logging_go.LogResponseList, string, derrors.Error) {
 
 	// We have a verified request - translate to entities.SearchRequest and execute
-	fields := entities.FilterFields{
-		OrganizationId:         request.GetOrganizationId(),
-		AppDescriptorId:        request.GetAppDescriptorId(),
-		AppInstanceId:          request.GetAppInstanceId(),
-		ServiceGroupId:         request.ServiceGroupId,
-		ServiceGroupInstanceId: request.GetServiceGroupInstanceId(),
-		ServiceId:              request.ServiceId,
-		ServiceInstanceId:      request.ServiceInstanceId,
+	search, err := EntitiesSearchRequest(request)
+	if err != nil {
+		return nil, "", err
 	}
+	search.Order = options.GetOrder(request.NFirst)
+	search.MinLevel = options.GetMinLevel()
 
-	search := &entities.SearchRequest{
-		Filters:       fields.ToFilters(),
-		IsUnionFilter: true,
-		MsgFilter:     request.GetMsgQueryFilter(),
-		From:          request.From,
-		To:            request.To,
-		NFirst:        request.NFirst,
+	if cursor := options.GetCursor(); cursor != "" {
+		after, err := entities.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		search.After = after
 	}
 
-	result, err := m.Provider.Search(ctx, search, -1 /* No limit */)
+	limit := options.GetLimit()
+	result, err := m.Provider.Search(ctx, search, limit)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	// Assuming the entries are sorted, we can get the timestamp of
-	// the first and last entry to get the whole range
-	from := request.From
-	to := request.To
-	if len(result) > 0 {
-		from = result[0].Timestamp.UnixNano()
-		to = result[len(result)-1].Timestamp.UnixNano()
+	// A full page means there may be more entries after the last one
+	next := ""
+	if len(result) == limit && result[len(result)-1].Cursor != nil {
+		next = result[len(result)-1].Cursor.Encode()
+	}
 
+	// The response covers the time range of the entries returned
+	from, to, found := result.TimeRange()
+	if !found {
+		from = request.From
+		to = request.To
 	}
 
 	// Create GRPC response
-	list := entities.MergeLogEntries(request.OrganizationId, from, to, result, []string{""})
+	// A slave only searches its own cluster
+	list := entities.MergeLogEntries(request.OrganizationId, from, to, result, nil)
 
-	return list, nil
+	return list, next, nil
 }
@@ -71,7 +71,7 @@ var _ = ginkgo.Describe("Search", func() {
 		prefix := "search"
 
 		// Create Elastic IT provider
-		elasticProvider := loggingstorage.NewElasticSearch(elasticAddress)
+		elasticProvider := loggingstorage.NewElasticSearch(elasticAddress, nil)
 		provider = &loggingstorage.ElasticSearchIT{elasticProvider, prefix}
 
 		// Initialize template
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package search
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// startTime is the timestamp of the first test entry
+var startTime = time.Date(2020, 1, 17, 10, 0, 0, 0, time.UTC)
+
+// newTestProvider returns a provider with 10 entries for each service group instance, 10 seconds apart
+func newTestProvider() *loggingstorage.Memory {
+	provider := loggingstorage.NewMemory()
+	for _, sg := range []string{"sg-1", "sg-2"} {
+		for i := 0; i < 10; i++ {
+			provider.Add(&entities.LogEntry{
+				Timestamp: startTime.Add(time.Duration(i) * time.Second * 10),
+				Msg:       fmt.Sprintf("Log line %s %d", sg, i),
+				Kubernetes: entities.KubernetesEntry{
+					Labels: entities.KubernetesLabelsEntry{
+						OrganizationId:            "org",
+						AppInstanceId:             "app",
+						AppServiceGroupInstanceId: sg,
+						AppServiceInstanceId:      sg,
+					},
+				},
+			})
+		}
+	}
+	return provider
+}
+
+// messages returns the messages of all the responses
+func messages(list *grpc_unified_logging_go.LogResponseList) []string {
+	result := make([]string, 0)
+	for _, response := range list.Responses {
+		for _, entry := range response.Entries {
+			result = append(result, entry.Msg)
+		}
+	}
+	return result
+}
+
+var _ = ginkgo.Describe("Search", func() {
+	var manager *Manager
+
+	ginkgo.BeforeEach(func() {
+		manager = NewManager(newTestProvider())
+	})
+
+	ginkgo.It("should retrieve the logs of a service group instance", func() {
+		list, next, err := manager.Search(context.Background(), &grpc_unified_logging_go.SearchRequest{
+			OrganizationId:         "org",
+			AppInstanceId:          "app",
+			ServiceGroupInstanceId: "sg-2",
+			NFirst:                 true,
+		}, nil)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(next).Should(gomega.BeEmpty())
+		gomega.Expect(list.From).Should(gomega.Equal(startTime.UnixNano()))
+		gomega.Expect(list.To).Should(gomega.Equal(startTime.Add(time.Second * 90).UnixNano()))
+		gomega.Expect(messages(list)).Should(gomega.HaveLen(10))
+		gomega.Expect(messages(list)[0]).Should(gomega.Equal("Log line sg-2 0"))
+	})
+
+	ginkgo.It("should retrieve the logs of a time range matching a query", func() {
+		list, _, err := manager.Search(context.Background(), &grpc_unified_logging_go.SearchRequest{
+			OrganizationId: "org",
+			AppInstanceId:  "app",
+			MsgQueryFilter: "sg-1 OR 9",
+			From:           startTime.Add(time.Second * 80).UnixNano(),
+			To:             startTime.Add(time.Second * 90).UnixNano(),
+		}, nil)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(messages(list)).Should(gomega.ConsistOf("Log line sg-1 8", "Log line sg-1 9", "Log line sg-2 9"))
+	})
+
+	ginkgo.It("should return an empty result for an unknown application instance", func() {
+		from := startTime.UnixNano()
+		list, next, err := manager.Search(context.Background(), &grpc_unified_logging_go.SearchRequest{
+			OrganizationId: "org",
+			AppInstanceId:  "other",
+			From:           from,
+		}, nil)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(next).Should(gomega.BeEmpty())
+		gomega.Expect(list.Responses).Should(gomega.BeEmpty())
+		gomega.Expect(list.From).Should(gomega.Equal(from))
+	})
+
+	ginkgo.It("should page the results with the cursor", func() {
+		request := &grpc_unified_logging_go.SearchRequest{OrganizationId: "org", AppInstanceId: "app"}
+		options := &entities.SearchOptions{Limit: 8}
+		pages := 0
+		all := make([]string, 0)
+		for {
+			list, next, err := manager.Search(context.Background(), request, options)
+			gomega.Expect(err).Should(gomega.Succeed())
+			all = append(all, messages(list)...)
+			pages++
+			if next == "" {
+				break
+			}
+			options.Cursor = next
+		}
+		gomega.Expect(pages).Should(gomega.Equal(3))
+		gomega.Expect(all).Should(gomega.HaveLen(20))
+	})
+
+	ginkgo.It("should reject invalid queries", func() {
+		_, _, err := manager.Search(context.Background(), &grpc_unified_logging_go.SearchRequest{
+			OrganizationId: "org",
+			MsgQueryFilter: "(unbalanced",
+		}, nil)
+		gomega.Expect(err).ShouldNot(gomega.Succeed())
+	})
+})
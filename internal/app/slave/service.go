@@ -17,8 +17,13 @@
 package slave
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/nalej/derrors"
 
@@ -28,6 +33,7 @@ import (
 
 	"github.com/nalej/unified-logging/internal/app/slave/expire"
 	"github.com/nalej/unified-logging/internal/app/slave/search"
+	"github.com/nalej/unified-logging/internal/app/slave/tail"
 
 	"github.com/nalej/grpc-unified-logging-go"
 
@@ -56,8 +62,20 @@ func NewService(conf *Config) (*Service, derrors.Error) {
 
 // Run the service, launch the REST service handler.
 func (s *Service) Run() derrors.Error {
-	// Create ElasticSearch provider
-	elasticProvider := loggingstorage.NewElasticSearch(s.Configuration.ElasticAddress)
+	// Create the storage provider, starting its background tasks
+	provider, derr := loggingstorage.NewProvider(s.Configuration.StorageBackend, s.Configuration.ProviderConfig())
+	if derr != nil {
+		return derr
+	}
+	if closer, ok := provider.(loggingstorage.Closer); ok {
+		defer closer.Close()
+	}
+	// The background tasks are stopped with the service
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if starter, ok := provider.(loggingstorage.Starter); ok {
+		starter.Start(ctx)
+	}
 
 	// Start listening
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Configuration.Port))
@@ -66,19 +84,53 @@ func (s *Service) Run() derrors.Error {
 	}
 
 	// Create managers and handler
-	searchManager := search.NewManager(elasticProvider)
-	expireManager := expire.NewManager(elasticProvider)
-	handler := handler.NewHandler(searchManager, expireManager)
+	searchManager := search.NewManager(provider)
+	expireManager := expire.NewManager(provider, s.Configuration.ExpireOptions())
+	// Stop the expiration jobs before closing the provider
+	defer expireManager.Close()
+	tailManager := tail.NewManager(provider, s.Configuration.TailPollInterval)
+	slaveHandler := handler.NewHandler(searchManager, expireManager)
 
 	if s.Configuration.ExpireLogs {
-		go expireManager.DeleteIndexLoop()
+		var expiring sync.WaitGroup
+		expiring.Add(1)
+		go func() {
+			defer expiring.Done()
+			expireManager.DeleteIndexLoop(ctx)
+		}()
+		// Let the running pass finish before closing the provider
+		defer func() {
+			cancel()
+			expiring.Wait()
+		}()
 	}
 
 	// Create server and register handler
 	server := grpc.NewServer()
-	grpc_unified_logging_go.RegisterSlaveServer(server, handler)
+	grpc_unified_logging_go.RegisterSlaveServer(server, slaveHandler)
+	// Tail, the retention synchronization and the expiration jobs are not part of the protos
+	// yet, so they are experimental
+	if s.Configuration.Experimental {
+		handler.RegisterTailServer(server, handler.NewTailHandler(tailManager))
+		handler.RegisterRetentionSyncServer(server, handler.NewRetentionSyncHandler(expireManager))
+		handler.RegisterExpirationServer(server, handler.NewExpirationHandler(expireManager))
+	}
 
 	reflection.Register(server)
+
+	// Stop the server on termination, so Run returns and stops the background tasks
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Info().Str("signal", sig.String()).Msg("Stopping gRPC server")
+			server.GracefulStop()
+		case <-ctx.Done():
+		}
+	}()
+
 	log.Info().Int("port", s.Configuration.Port).Msg("Launching gRPC server")
 	if err := server.Serve(lis); err != nil {
 		return derrors.NewUnavailableError("failed to serve", err)
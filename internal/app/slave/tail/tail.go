@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Tail manager for unified logging slave
+
+package tail
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/app/slave/search"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultPollInterval is the time between searches for new log entries
+const DefaultPollInterval = time.Second * 2
+
+type Manager struct {
+	Provider     loggingstorage.Provider
+	pollInterval time.Duration
+}
+
+func NewManager(provider loggingstorage.Provider, pollInterval time.Duration) *Manager {
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	return &Manager{
+		Provider:     provider,
+		pollInterval: pollInterval,
+	}
+}
+
+// Tail polls the provider for entries newer than the last one sent. It starts at request.From,
+// or now if not set, and ends when ctx is done, send fails or request.To is reached.
+func (m *Manager) Tail(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions, send managers.TailSender) derrors.Error {
+	searchRequest, err := search.EntitiesSearchRequest(request)
+	if err != nil {
+		return err
+	}
+	searchRequest.MinLevel = options.GetMinLevel()
+	// We always move forward in time
+	searchRequest.Order = entities.Ascending
+	searchRequest.To = 0
+	if searchRequest.From == 0 {
+		searchRequest.From = time.Now().UnixNano()
+	}
+
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+	for {
+		result, err := m.Provider.Search(ctx, searchRequest, entities.LimitPerSearch)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		found := len(result)
+		if found > 0 {
+			last := result[found-1]
+			if request.To != 0 {
+				result = entriesUntil(result, request.To)
+			}
+			if len(result) > 0 {
+				list := entities.MergeLogEntries(request.OrganizationId, result[0].Timestamp.UnixNano(), result[len(result)-1].Timestamp.UnixNano(), result, []string{})
+				serr := send(list)
+				if serr != nil {
+					log.Debug().Err(serr).Msg("tail stream closed")
+					return nil
+				}
+			}
+
+			// Continue after the last entry
+			if last.Cursor != nil {
+				searchRequest.After = last.Cursor
+			} else {
+				searchRequest.From = last.Timestamp.UnixNano() + 1
+			}
+			if request.To != 0 && last.Timestamp.UnixNano() > request.To {
+				return nil
+			}
+			// A full page means we are behind, so we don't wait
+			if found == entities.LimitPerSearch {
+				continue
+			}
+		}
+
+		if request.To != 0 && time.Now().UnixNano() > request.To {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// entriesUntil returns the entries of a sorted list up to a timestamp
+func entriesUntil(entries entities.LogEntries, to int64) entities.LogEntries {
+	for i, entry := range entries {
+		if entry.Timestamp.UnixNano() > to {
+			return entries[:i]
+		}
+	}
+	return entries
+}
@@ -19,11 +19,22 @@
 package client
 
 import (
+	"context"
+
 	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"google.golang.org/grpc"
 )
 
 type LoggingClient interface {
 	grpc_app_cluster_api_go.UnifiedLoggingClient
+	// SyncRetentionPolicies sends the retention policies of an organization to the slave
+	SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error)
+	// StartExpiration starts an expiration job in the slave
+	StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error)
+	// GetExpirationJob returns the progress of an expiration job of the slave
+	GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error)
 	Close() error
 }
 
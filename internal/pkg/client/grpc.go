@@ -19,11 +19,15 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/handler"
+	"github.com/nalej/unified-logging/pkg/entities"
 	"io/ioutil"
 	"strings"
 
@@ -38,6 +42,34 @@ type GRPCLoggingClient struct {
 }
 
 func NewGRPCLoggingClient(address string, params *LoggingClientParams) (LoggingClient, error) {
+	conn, err := dial(address, params)
+	if err != nil {
+		return nil, err
+	}
+
+	client := grpc_app_cluster_api_go.NewUnifiedLoggingClient(conn)
+
+	return &GRPCLoggingClient{client, conn}, nil
+}
+
+func (c *GRPCLoggingClient) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	return handler.SyncRetentionPolicies(ctx, c.conn, list, opts...)
+}
+
+func (c *GRPCLoggingClient) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	return handler.StartExpiration(ctx, c.conn, request, opts...)
+}
+
+func (c *GRPCLoggingClient) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	return handler.GetExpirationJob(ctx, c.conn, id, opts...)
+}
+
+func (c *GRPCLoggingClient) Close() error {
+	return c.conn.Close()
+}
+
+// dial creates a new connection to address, loading the certificates in params if TLS is used
+func dial(address string, params *LoggingClientParams) (*grpc.ClientConn, error) {
 	var options []grpc.DialOption
 	var hostname string
 
@@ -101,18 +133,7 @@ func NewGRPCLoggingClient(address string, params *LoggingClientParams) (LoggingC
 		options = append(options, grpc.WithInsecure())
 	}
 
-	conn, err := grpc.Dial(address, options...)
-	if err != nil {
-		return nil, err
-	}
-
-	client := grpc_app_cluster_api_go.NewUnifiedLoggingClient(conn)
-
-	return &GRPCLoggingClient{client, conn}, nil
-}
-
-func (c *GRPCLoggingClient) Close() error {
-	return c.conn.Close()
+	return grpc.Dial(address, options...)
 }
 
 func addCert(pool *x509.CertPool, cert string) error {
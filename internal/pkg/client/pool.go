@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Pool of long-lived connections to application clusters
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-app-cluster-api-go"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/handler"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// DefaultIdleTimeout is the time an unused connection is kept in the pool
+const DefaultIdleTimeout = time.Minute * 10
+
+type pooledConnection struct {
+	conn *grpc.ClientConn
+	// inUse is the number of clients using the connection
+	inUse int
+	// lastUsed is the last time a client released the connection
+	lastUsed time.Time
+	// certVersion is the modification time of the certificates the connection was created with
+	certVersion time.Time
+	// retired connections are no longer in the pool and are closed once released
+	retired bool
+}
+
+// ConnectionPool keeps one connection per application cluster address. Connections are
+// reused between requests, evicted when idle and recreated when they are unhealthy or
+// the certificates on disk change.
+type ConnectionPool struct {
+	sync.Mutex
+	connections map[string]*pooledConnection
+	idleTimeout time.Duration
+}
+
+func NewConnectionPool(idleTimeout time.Duration) *ConnectionPool {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	return &ConnectionPool{
+		connections: make(map[string]*pooledConnection),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// PooledLoggingClient is a LoggingClient using a pooled connection. Closing it
+// returns the connection to the pool.
+type PooledLoggingClient struct {
+	grpc_app_cluster_api_go.UnifiedLoggingClient
+	pool       *ConnectionPool
+	connection *pooledConnection
+	closed     bool
+}
+
+func (c *PooledLoggingClient) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	return handler.SyncRetentionPolicies(ctx, c.connection.conn, list, opts...)
+}
+
+func (c *PooledLoggingClient) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	return handler.StartExpiration(ctx, c.connection.conn, request, opts...)
+}
+
+func (c *PooledLoggingClient) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	return handler.GetExpirationJob(ctx, c.connection.conn, id, opts...)
+}
+
+func (c *PooledLoggingClient) Close() error {
+	c.pool.Lock()
+	defer c.pool.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.pool.release(c.connection)
+}
+
+// GetClient returns a client for address using a pooled connection. It implements LoggingClientFactory.
+func (p *ConnectionPool) GetClient(address string, params *LoggingClientParams) (LoggingClient, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	version := certVersion(params)
+
+	connection, exists := p.connections[address]
+	if exists && !p.isHealthy(connection, version) {
+		log.Debug().Str("address", address).Str("state", connection.conn.GetState().String()).Msg("recreating connection")
+		p.retire(address, connection)
+		exists = false
+	}
+
+	if !exists {
+		conn, err := dial(address, params)
+		if err != nil {
+			return nil, err
+		}
+		connection = &pooledConnection{
+			conn:        conn,
+			certVersion: version,
+		}
+		p.connections[address] = connection
+	}
+
+	connection.inUse++
+	return &PooledLoggingClient{
+		UnifiedLoggingClient: grpc_app_cluster_api_go.NewUnifiedLoggingClient(connection.conn),
+		pool:                 p,
+		connection:           connection,
+	}, nil
+}
+
+// CleanupLoop periodically evicts idle and unhealthy connections until ctx is done
+func (p *ConnectionPool) CleanupLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evict()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes all the connections of the pool
+func (p *ConnectionPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+
+	for address, connection := range p.connections {
+		p.retire(address, connection)
+	}
+}
+
+// evict retires the connections that are not in use and have been idle for too long or are unhealthy
+func (p *ConnectionPool) evict() {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for address, connection := range p.connections {
+		if connection.inUse > 0 {
+			continue
+		}
+		state := connection.conn.GetState()
+		if now.Sub(connection.lastUsed) > p.idleTimeout || state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			log.Debug().Str("address", address).Str("state", state.String()).Msg("evicting connection")
+			p.retire(address, connection)
+		}
+	}
+}
+
+// isHealthy checks the connection can be handed out
+func (p *ConnectionPool) isHealthy(connection *pooledConnection, version time.Time) bool {
+	if !connection.certVersion.Equal(version) {
+		return false
+	}
+	state := connection.conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+// retire removes the connection from the pool, closing it if nobody uses it
+func (p *ConnectionPool) retire(address string, connection *pooledConnection) {
+	delete(p.connections, address)
+	connection.retired = true
+	if connection.inUse == 0 {
+		err := connection.conn.Close()
+		if err != nil {
+			log.Warn().Str("address", address).Err(err).Msg("failed closing connection")
+		}
+	}
+}
+
+// release returns a connection to the pool
+func (p *ConnectionPool) release(connection *pooledConnection) error {
+	connection.inUse--
+	connection.lastUsed = time.Now()
+	if connection.retired && connection.inUse == 0 {
+		return connection.conn.Close()
+	}
+	return nil
+}
+
+// certVersion returns the latest modification time of the certificates in params
+func certVersion(params *LoggingClientParams) time.Time {
+	var version time.Time
+	if !params.UseTLS {
+		return version
+	}
+
+	files := make([]string, 0)
+	if params.CACertPath != "" {
+		files = append(files, params.CACertPath)
+	}
+	if params.ClientCertPath != "" {
+		files = append(files, fmt.Sprintf("%s/tls.crt", params.ClientCertPath), fmt.Sprintf("%s/tls.key", params.ClientCertPath))
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			// We'll fail when loading the certificate
+			continue
+		}
+		if info.ModTime().After(version) {
+			version = info.ModTime()
+		}
+	}
+	return version
+}
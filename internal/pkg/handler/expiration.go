@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Handler for the expiration job RPCs, served by both the coordinator and the
+// slaves. The service is not part of the unified logging protos yet, so its
+// descriptor is declared here with the entities messages.
+
+package handler
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+const (
+	// ExpirationServiceName is the full name of the expiration service
+	ExpirationServiceName = "unified_logging.Expiration"
+	// StartExpirationMethod is the full name of the StartExpiration method
+	StartExpirationMethod = "/" + ExpirationServiceName + "/StartExpiration"
+	// GetExpirationJobMethod is the full name of the GetExpirationJob method
+	GetExpirationJobMethod = "/" + ExpirationServiceName + "/GetExpirationJob"
+)
+
+// ExpirationServer is the server API for the Expiration service
+type ExpirationServer interface {
+	StartExpiration(context.Context, *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, error)
+	GetExpirationJob(context.Context, *entities.ExpirationJobId) (*entities.ExpirationJob, error)
+}
+
+func startExpirationHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(grpc_unified_logging_go.ExpirationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExpirationServer).StartExpiration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StartExpirationMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExpirationServer).StartExpiration(ctx, req.(*grpc_unified_logging_go.ExpirationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func getExpirationJobHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(entities.ExpirationJobId)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExpirationServer).GetExpirationJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GetExpirationJobMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExpirationServer).GetExpirationJob(ctx, req.(*entities.ExpirationJobId))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var expirationServiceDesc = grpc.ServiceDesc{
+	ServiceName: ExpirationServiceName,
+	HandlerType: (*ExpirationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartExpiration",
+			Handler:    startExpirationHandler,
+		},
+		{
+			MethodName: "GetExpirationJob",
+			Handler:    getExpirationJobHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// RegisterExpirationServer registers the Expiration service on a gRPC server
+func RegisterExpirationServer(s *grpc.Server, srv ExpirationServer) {
+	s.RegisterService(&expirationServiceDesc, srv)
+}
+
+// StartExpiration starts an expiration job in the server on conn
+func StartExpiration(ctx context.Context, conn *grpc.ClientConn, request *grpc_unified_logging_go.ExpirationRequest, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	out := new(entities.ExpirationJob)
+	err := conn.Invoke(ctx, StartExpirationMethod, request, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetExpirationJob returns the progress of an expiration job of the server on conn
+func GetExpirationJob(ctx context.Context, conn *grpc.ClientConn, id *entities.ExpirationJobId, opts ...grpc.CallOption) (*entities.ExpirationJob, error) {
+	out := new(entities.ExpirationJob)
+	err := conn.Invoke(ctx, GetExpirationJobMethod, id, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type ExpirationHandler struct {
+	expirationManager managers.ExpirationJobs
+}
+
+func NewExpirationHandler(expiration managers.ExpirationJobs) *ExpirationHandler {
+	return &ExpirationHandler{
+		expirationManager: expiration,
+	}
+}
+
+// StartExpiration starts deleting the logs of a given application, returning the job doing it
+func (h *ExpirationHandler) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, error) {
+	// Validate request
+	err := validateExpire(request)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid request")
+		return nil, err
+	}
+
+	// Execute request on manager
+	res, err := h.expirationManager.StartExpiration(ctx, request)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error starting expiration")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetExpirationJob returns the progress of an expiration job
+func (h *ExpirationHandler) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, error) {
+	// Validate request
+	err := id.Validate()
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid request")
+		return nil, err
+	}
+
+	// Execute request on manager
+	res, err := h.expirationManager.GetExpirationJob(ctx, id)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error getting expiration job")
+		return nil, err
+	}
+
+	return res, nil
+}
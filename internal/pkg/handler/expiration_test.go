@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/grpc-utils/pkg/test"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// mockupExpiration keeps a single job, failed in a cluster
+type mockupExpiration struct {
+	job *entities.ExpirationJob
+}
+
+func (e *mockupExpiration) StartExpiration(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*entities.ExpirationJob, derrors.Error) {
+	e.job = &entities.ExpirationJob{
+		OrganizationId: request.OrganizationId,
+		AppInstanceId:  request.AppInstanceId,
+		JobId:          "job-1",
+		State:          entities.ExpirationFailed,
+		Failures:       []string{"cluster-1: timeout"},
+		Clusters: []*entities.ClusterExpirationJob{
+			{ClusterId: "cluster-1", State: entities.ExpirationFailed, Failures: []string{"timeout"}},
+		},
+	}
+	return e.job, nil
+}
+
+func (e *mockupExpiration) GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, derrors.Error) {
+	if e.job == nil || e.job.JobId != id.JobId {
+		return nil, derrors.NewNotFoundError("expiration job not found")
+	}
+	return e.job, nil
+}
+
+var _ = ginkgo.Describe("Expiration handler", func() {
+	var server *grpc.Server
+	var listener *bufconn.Listener
+	var conn *grpc.ClientConn
+
+	ginkgo.BeforeEach(func() {
+		listener = test.GetDefaultListener()
+		server = grpc.NewServer()
+		RegisterExpirationServer(server, NewExpirationHandler(&mockupExpiration{}))
+		test.LaunchServer(server, listener)
+
+		var err error
+		conn, err = test.GetConn(*listener)
+		gomega.Expect(err).Should(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(conn.Close()).Should(gomega.Succeed())
+		server.Stop()
+		gomega.Expect(listener.Close()).Should(gomega.Succeed())
+	})
+
+	ginkgo.It("should start an expiration job and return its progress", func() {
+		job, err := StartExpiration(context.Background(), conn, ValidExpirationRequest)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(job.State).Should(gomega.Equal(entities.ExpirationFailed))
+
+		status, err := GetExpirationJob(context.Background(), conn, &entities.ExpirationJobId{OrganizationId: OrganizationId, JobId: job.JobId})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(status).Should(gomega.Equal(job))
+	})
+
+	ginkgo.It("should reject invalid expiration requests", func() {
+		_, err := StartExpiration(context.Background(), conn, &grpc_unified_logging_go.ExpirationRequest{})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+		_, err = GetExpirationJob(context.Background(), conn, &entities.ExpirationJobId{OrganizationId: OrganizationId})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+	})
+})
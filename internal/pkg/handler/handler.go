@@ -23,10 +23,14 @@ package handler
 import (
 	"context"
 
+	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-unified-logging-go"
 	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type Handler struct {
@@ -50,16 +54,68 @@ func (h *Handler) Search(ctx context.Context, request *grpc_unified_logging_go.S
 		return nil, err
 	}
 
-	// Execute request on manager
-	res, err := h.searchManager.Search(ctx, request)
+	options, err := getSearchOptions(ctx)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid search options")
+		return nil, err
+	}
+
+	// Execute request on manager, with the outcome of every cluster if it queries several
+	var res *grpc_unified_logging_go.LogResponseList
+	var next string
+	if clusterSearch, ok := h.searchManager.(managers.ClusterSearch); ok {
+		var outcomes entities.ClusterOutcomes
+		res, next, outcomes, err = clusterSearch.SearchClusters(ctx, request, options)
+		sendOutcomes(ctx, outcomes)
+	} else {
+		res, next, err = h.searchManager.Search(ctx, request, options)
+	}
 	if err != nil {
 		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error executing search")
 		return nil, err
 	}
 
+	// The cursor of the next page is sent back as a header
+	if next != "" {
+		herr := grpc.SetHeader(ctx, metadata.Pairs(entities.NextCursorMetadataKey, next))
+		if herr != nil {
+			log.Warn().Err(herr).Msg("error sending next cursor")
+		}
+	}
+
 	return res, nil
 }
 
+// sendOutcomes sends the outcome of the clusters of a request as a header, also when the request fails
+func sendOutcomes(ctx context.Context, outcomes entities.ClusterOutcomes) {
+	if outcomes == nil {
+		return
+	}
+	herr := grpc.SetHeader(ctx, metadata.Pairs(entities.ClusterOutcomesMetadataKey, outcomes.Encode()))
+	if herr != nil {
+		log.Warn().Err(herr).Msg("error sending cluster outcomes")
+	}
+}
+
+// getSearchOptions returns the options of a search from the request metadata
+func getSearchOptions(ctx context.Context) (*entities.SearchOptions, derrors.Error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := make(map[string]string, len(entities.SearchOptionsMetadataKeys))
+	for _, key := range entities.SearchOptionsMetadataKeys {
+		values[key] = getMetadata(md, key)
+	}
+	return entities.NewSearchOptions(values)
+}
+
+// getMetadata returns the first value of key in md, empty if not found
+func getMetadata(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 // Expire the logs of a given application.
 func (h *Handler) Expire(ctx context.Context, request *grpc_unified_logging_go.ExpirationRequest) (*grpc_common_go.Success, error) {
 	// Validate request
@@ -69,8 +125,15 @@ func (h *Handler) Expire(ctx context.Context, request *grpc_unified_logging_go.E
 		return nil, err
 	}
 
-	// Execute request on manager
-	res, err := h.expireManager.Expire(ctx, request)
+	// Execute request on manager, with the outcome of every cluster if it expires in several
+	var res *grpc_common_go.Success
+	if clusterExpire, ok := h.expireManager.(managers.ClusterExpire); ok {
+		var outcomes entities.ClusterOutcomes
+		res, outcomes, err = clusterExpire.ExpireClusters(ctx, request)
+		sendOutcomes(ctx, outcomes)
+	} else {
+		res, err = h.expireManager.Expire(ctx, request)
+	}
 	if err != nil {
 		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error executing search")
 		return nil, err
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Handlers for the retention policy RPCs: the coordinator manages the policies
+// and the slaves receive them. The services are not part of the unified logging
+// protos yet, so their descriptors are declared here with the entities messages.
+
+package handler
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+const (
+	// RetentionServiceName is the full name of the coordinator retention service
+	RetentionServiceName = "unified_logging.Retention"
+	// SetRetentionPolicyMethod is the full name of the SetRetentionPolicy method
+	SetRetentionPolicyMethod = "/" + RetentionServiceName + "/SetRetentionPolicy"
+	// RemoveRetentionPolicyMethod is the full name of the RemoveRetentionPolicy method
+	RemoveRetentionPolicyMethod = "/" + RetentionServiceName + "/RemoveRetentionPolicy"
+	// ListRetentionPoliciesMethod is the full name of the ListRetentionPolicies method
+	ListRetentionPoliciesMethod = "/" + RetentionServiceName + "/ListRetentionPolicies"
+
+	// RetentionSyncServiceName is the full name of the slave retention service
+	RetentionSyncServiceName = "unified_logging.RetentionSync"
+	// SyncRetentionPoliciesMethod is the full name of the SyncRetentionPolicies method
+	SyncRetentionPoliciesMethod = "/" + RetentionSyncServiceName + "/SyncRetentionPolicies"
+)
+
+// RetentionServer is the server API for the Retention service
+type RetentionServer interface {
+	SetRetentionPolicy(context.Context, *entities.RetentionPolicy) (*entities.RetentionPolicyList, error)
+	RemoveRetentionPolicy(context.Context, *entities.RetentionPolicy) (*entities.RetentionPolicyList, error)
+	ListRetentionPolicies(context.Context, *entities.RetentionPolicy) (*entities.RetentionPolicyList, error)
+}
+
+// RetentionSyncServer is the server API for the RetentionSync service
+type RetentionSyncServer interface {
+	SyncRetentionPolicies(context.Context, *entities.RetentionPolicyList) (*entities.RetentionPolicyList, error)
+}
+
+// policyMethod returns the handler of a method of the Retention service
+func policyMethod(fullMethod string, call func(RetentionServer, context.Context, *entities.RetentionPolicy) (*entities.RetentionPolicyList, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := new(entities.RetentionPolicy)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(RetentionServer), ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fullMethod,
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(RetentionServer), ctx, req.(*entities.RetentionPolicy))
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+func syncRetentionPoliciesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(entities.RetentionPolicyList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RetentionSyncServer).SyncRetentionPolicies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncRetentionPoliciesMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RetentionSyncServer).SyncRetentionPolicies(ctx, req.(*entities.RetentionPolicyList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var retentionServiceDesc = grpc.ServiceDesc{
+	ServiceName: RetentionServiceName,
+	HandlerType: (*RetentionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SetRetentionPolicy",
+			Handler:    policyMethod(SetRetentionPolicyMethod, RetentionServer.SetRetentionPolicy),
+		},
+		{
+			MethodName: "RemoveRetentionPolicy",
+			Handler:    policyMethod(RemoveRetentionPolicyMethod, RetentionServer.RemoveRetentionPolicy),
+		},
+		{
+			MethodName: "ListRetentionPolicies",
+			Handler:    policyMethod(ListRetentionPoliciesMethod, RetentionServer.ListRetentionPolicies),
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+var retentionSyncServiceDesc = grpc.ServiceDesc{
+	ServiceName: RetentionSyncServiceName,
+	HandlerType: (*RetentionSyncServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SyncRetentionPolicies",
+			Handler:    syncRetentionPoliciesHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// RegisterRetentionServer registers the Retention service on a gRPC server
+func RegisterRetentionServer(s *grpc.Server, srv RetentionServer) {
+	s.RegisterService(&retentionServiceDesc, srv)
+}
+
+// RegisterRetentionSyncServer registers the RetentionSync service on a gRPC server
+func RegisterRetentionSyncServer(s *grpc.Server, srv RetentionSyncServer) {
+	s.RegisterService(&retentionSyncServiceDesc, srv)
+}
+
+// RetentionClient is the client API for the Retention service
+type RetentionClient struct {
+	conn *grpc.ClientConn
+}
+
+func NewRetentionClient(conn *grpc.ClientConn) *RetentionClient {
+	return &RetentionClient{
+		conn: conn,
+	}
+}
+
+func (c *RetentionClient) invoke(ctx context.Context, method string, policy *entities.RetentionPolicy, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	out := new(entities.RetentionPolicyList)
+	err := c.conn.Invoke(ctx, method, policy, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *RetentionClient) SetRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	return c.invoke(ctx, SetRetentionPolicyMethod, policy, opts...)
+}
+
+func (c *RetentionClient) RemoveRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	return c.invoke(ctx, RemoveRetentionPolicyMethod, policy, opts...)
+}
+
+func (c *RetentionClient) ListRetentionPolicies(ctx context.Context, policy *entities.RetentionPolicy, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	return c.invoke(ctx, ListRetentionPoliciesMethod, policy, opts...)
+}
+
+// SyncRetentionPolicies sends the retention policies of an organization to the slave on conn
+func SyncRetentionPolicies(ctx context.Context, conn *grpc.ClientConn, list *entities.RetentionPolicyList, opts ...grpc.CallOption) (*entities.RetentionPolicyList, error) {
+	out := new(entities.RetentionPolicyList)
+	err := conn.Invoke(ctx, SyncRetentionPoliciesMethod, list, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type RetentionHandler struct {
+	retentionManager managers.Retention
+}
+
+func NewRetentionHandler(retention managers.Retention) *RetentionHandler {
+	return &RetentionHandler{
+		retentionManager: retention,
+	}
+}
+
+// SetRetentionPolicy creates or replaces the retention policy of a scope
+func (h *RetentionHandler) SetRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, error) {
+	return h.execute(ctx, "set", policy, policy.Validate, h.retentionManager.SetRetentionPolicy)
+}
+
+// RemoveRetentionPolicy removes the retention policy of a scope, whose entries are kept as the wider scopes
+func (h *RetentionHandler) RemoveRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, error) {
+	return h.execute(ctx, "remove", policy, policy.ValidateScope, h.retentionManager.RemoveRetentionPolicy)
+}
+
+// ListRetentionPolicies returns the retention policies of an organization
+func (h *RetentionHandler) ListRetentionPolicies(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, error) {
+	validate := func() derrors.Error {
+		if policy.OrganizationId == "" {
+			return derrors.NewInvalidArgumentError(emptyOrganizationId)
+		}
+		return nil
+	}
+	return h.execute(ctx, "list", policy, validate, h.retentionManager.ListRetentionPolicies)
+}
+
+func (h *RetentionHandler) execute(ctx context.Context, operation string, policy *entities.RetentionPolicy, validate func() derrors.Error,
+	call func(context.Context, *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error)) (*entities.RetentionPolicyList, error) {
+	// Validate request
+	err := validate()
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid request")
+		return nil, err
+	}
+
+	// Execute request on manager
+	res, err := call(ctx, policy)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Str("operation", operation).Msg("error executing retention policy request")
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type RetentionSyncHandler struct {
+	syncManager managers.RetentionSync
+}
+
+func NewRetentionSyncHandler(sync managers.RetentionSync) *RetentionSyncHandler {
+	return &RetentionSyncHandler{
+		syncManager: sync,
+	}
+}
+
+// SyncRetentionPolicies replaces the retention policies of an organization enforced by the slave
+func (h *RetentionSyncHandler) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList) (*entities.RetentionPolicyList, error) {
+	// Validate request
+	err := list.Validate()
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid request")
+		return nil, err
+	}
+
+	// Execute request on manager
+	res, err := h.syncManager.SyncRetentionPolicies(ctx, list)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error executing retention policy sync")
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handler
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-utils/pkg/test"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// mockupRetention keeps the policies of a single organization
+type mockupRetention struct {
+	list *entities.RetentionPolicyList
+}
+
+func (r *mockupRetention) SetRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	r.list.Policies = append(r.list.Policies, policy)
+	return r.list, nil
+}
+
+func (r *mockupRetention) RemoveRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	return nil, derrors.NewNotFoundError("retention policy not found")
+}
+
+func (r *mockupRetention) ListRetentionPolicies(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error) {
+	return r.list, nil
+}
+
+func (r *mockupRetention) SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList) (*entities.RetentionPolicyList, derrors.Error) {
+	r.list = list
+	return list, nil
+}
+
+var _ = ginkgo.Describe("Retention handler", func() {
+	var server *grpc.Server
+	var listener *bufconn.Listener
+	var conn *grpc.ClientConn
+	var client *RetentionClient
+	var retention *mockupRetention
+
+	ginkgo.BeforeEach(func() {
+		listener = test.GetDefaultListener()
+		server = grpc.NewServer()
+		retention = &mockupRetention{list: &entities.RetentionPolicyList{OrganizationId: OrganizationId}}
+		RegisterRetentionServer(server, NewRetentionHandler(retention))
+		RegisterRetentionSyncServer(server, NewRetentionSyncHandler(retention))
+		test.LaunchServer(server, listener)
+
+		var err error
+		conn, err = test.GetConn(*listener)
+		gomega.Expect(err).Should(gomega.Succeed())
+		client = NewRetentionClient(conn)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(conn.Close()).Should(gomega.Succeed())
+		server.Stop()
+		gomega.Expect(listener.Close()).Should(gomega.Succeed())
+	})
+
+	policy := &entities.RetentionPolicy{OrganizationId: OrganizationId, AppInstanceId: AppInstanceId, Days: 3}
+
+	ginkgo.It("should set and list retention policies", func() {
+		_, err := client.SetRetentionPolicy(context.Background(), policy)
+		gomega.Expect(err).Should(gomega.Succeed())
+		list, err := client.ListRetentionPolicies(context.Background(), &entities.RetentionPolicy{OrganizationId: OrganizationId})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(list.Policies).Should(gomega.Equal([]*entities.RetentionPolicy{policy}))
+	})
+
+	ginkgo.It("should reject invalid retention policies", func() {
+		_, err := client.SetRetentionPolicy(context.Background(), &entities.RetentionPolicy{OrganizationId: OrganizationId})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+		_, err = client.ListRetentionPolicies(context.Background(), &entities.RetentionPolicy{})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+		_, err = client.RemoveRetentionPolicy(context.Background(), policy)
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should synchronize the retention policies of the slaves", func() {
+		list := &entities.RetentionPolicyList{OrganizationId: OrganizationId, DefaultDays: 7, Policies: []*entities.RetentionPolicy{policy}}
+		_, err := SyncRetentionPolicies(context.Background(), conn, list)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(retention.list).Should(gomega.Equal(list))
+
+		list.Policies = append(list.Policies, &entities.RetentionPolicy{OrganizationId: "other", Days: 1})
+		_, err = SyncRetentionPolicies(context.Background(), conn, list)
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+	})
+})
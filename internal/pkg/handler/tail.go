@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Handler for the Tail server-streaming RPC, for both slave and coord.
+// The service is not part of the unified logging protos yet, so its
+// descriptor is declared here with the existing request and response messages.
+
+package handler
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/internal/pkg/managers"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+const (
+	// TailServiceName is the full name of the Tail gRPC service
+	TailServiceName = "unified_logging.Tail"
+	// TailMethod is the full name of the Tail method
+	TailMethod = "/" + TailServiceName + "/Tail"
+)
+
+// TailServer is the server API for the Tail service
+type TailServer interface {
+	Tail(*grpc_unified_logging_go.SearchRequest, grpc.ServerStream) error
+}
+
+var tailServiceDesc = grpc.ServiceDesc{
+	ServiceName: TailServiceName,
+	HandlerType: (*TailServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Tail",
+			Handler:       tailStreamHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+func tailStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	request := new(grpc_unified_logging_go.SearchRequest)
+	if err := stream.RecvMsg(request); err != nil {
+		return err
+	}
+	return srv.(TailServer).Tail(request, stream)
+}
+
+// RegisterTailServer registers the Tail service on a gRPC server
+func RegisterTailServer(s *grpc.Server, srv TailServer) {
+	s.RegisterService(&tailServiceDesc, srv)
+}
+
+// Tail opens a Tail stream on conn. Received messages are *grpc_unified_logging_go.LogResponseList.
+func Tail(ctx context.Context, conn *grpc.ClientConn, request *grpc_unified_logging_go.SearchRequest) (grpc.ClientStream, error) {
+	stream, err := conn.NewStream(ctx, &tailServiceDesc.Streams[0], TailMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(request); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+type TailHandler struct {
+	tailManager managers.Tail
+}
+
+func NewTailHandler(tail managers.Tail) *TailHandler {
+	return &TailHandler{
+		tailManager: tail,
+	}
+}
+
+// Tail sends the new log entries matching a query as they are indexed.
+func (h *TailHandler) Tail(request *grpc_unified_logging_go.SearchRequest, stream grpc.ServerStream) error {
+	// Validate request
+	err := validateSearch(request)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid request")
+		return err
+	}
+	options, err := getSearchOptions(stream.Context())
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("invalid search options")
+		return err
+	}
+
+	// Execute request on manager until the client goes away
+	send := func(list *grpc_unified_logging_go.LogResponseList) error {
+		return stream.SendMsg(list)
+	}
+	err = h.tailManager.Tail(stream.Context(), request, options, send)
+	if err != nil {
+		log.Info().Str("err", err.DebugReport()).Err(err).Msg("error executing tail")
+		return err
+	}
+
+	return nil
+}
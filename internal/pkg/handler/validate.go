@@ -22,6 +22,7 @@ import (
 	"github.com/nalej/derrors"
 
 	grpc "github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/rs/zerolog/log"
 )
 
@@ -46,7 +47,14 @@ func validate(request LoggingRequest) derrors.Error {
 }
 
 func validateSearch(request *grpc.SearchRequest) derrors.Error {
-	return validate(request)
+	err := validate(request)
+	if err != nil {
+		return err
+	}
+
+	// The message filter is a query
+	_, err = entities.ParseQuery(request.GetMsgQueryFilter())
+	return err
 }
 
 func validateExpire(request *grpc.ExpirationRequest) derrors.Error {
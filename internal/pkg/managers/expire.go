@@ -23,9 +23,24 @@ import (
 
 	"github.com/nalej/grpc-common-go"
 	grpc "github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
 )
 
 // Interface for Expire Manager
 type Expire interface {
 	Expire(context.Context, *grpc.ExpirationRequest) (*grpc_common_go.Success, derrors.Error)
 }
+
+// Interface for the Expire Managers expiring in several application clusters
+type ClusterExpire interface {
+	// ExpireClusters expires as Expire, also returning the outcome of every cluster, even if the expiration fails
+	ExpireClusters(ctx context.Context, request *grpc.ExpirationRequest) (*grpc_common_go.Success, entities.ClusterOutcomes, derrors.Error)
+}
+
+// Interface for the expiration jobs of the slave and the coordinator
+type ExpirationJobs interface {
+	// StartExpiration starts deleting the entries of the request, returning the job doing it
+	StartExpiration(ctx context.Context, request *grpc.ExpirationRequest) (*entities.ExpirationJob, derrors.Error)
+	// GetExpirationJob returns the progress of a job started by StartExpiration
+	GetExpirationJob(ctx context.Context, id *entities.ExpirationJobId) (*entities.ExpirationJob, derrors.Error)
+}
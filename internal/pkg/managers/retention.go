@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+)
+
+// Interface for the Retention Manager of the coordinator. Every method returns the
+// policies of the organization after the call.
+type Retention interface {
+	// SetRetentionPolicy creates or replaces the policy with the same scope
+	SetRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error)
+	// RemoveRetentionPolicy removes the policy with the same scope
+	RemoveRetentionPolicy(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error)
+	// ListRetentionPolicies returns the policies of the organization of the policy
+	ListRetentionPolicies(ctx context.Context, policy *entities.RetentionPolicy) (*entities.RetentionPolicyList, derrors.Error)
+}
+
+// Interface for the Retention Manager of the slave
+type RetentionSync interface {
+	// SyncRetentionPolicies replaces the policies of an organization, returning the ones enforced
+	SyncRetentionPolicies(ctx context.Context, list *entities.RetentionPolicyList) (*entities.RetentionPolicyList, derrors.Error)
+}
@@ -22,9 +22,18 @@ import (
 	"github.com/nalej/derrors"
 
 	grpc "github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
 )
 
 // Interface for Search Manager
 type Search interface {
-	Search(context.Context, *grpc.SearchRequest) (*grpc.LogResponseList, derrors.Error)
+	// Search returns a page of log entries starting at the cursor of the options (empty for the
+	// first page) and the cursor of the next page (empty if there are no more entries)
+	Search(ctx context.Context, request *grpc.SearchRequest, options *entities.SearchOptions) (*grpc.LogResponseList, string, derrors.Error)
+}
+
+// Interface for the Search Managers querying several application clusters
+type ClusterSearch interface {
+	// SearchClusters searches as Search, also returning the outcome of every cluster, even if the search fails
+	SearchClusters(ctx context.Context, request *grpc.SearchRequest, options *entities.SearchOptions) (*grpc.LogResponseList, string, entities.ClusterOutcomes, derrors.Error)
 }
@@ -18,25 +18,72 @@ package managers
 
 import (
 	"context"
+	"sort"
 
 	"github.com/nalej/derrors"
 
 	"github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
 )
 
 type MockupSearchManager struct {
+	// Entries returned by the searches, like a slave would
+	Entries entities.LogEntries
 }
 
 func NewMockupSearchManager() *MockupSearchManager {
 	return &MockupSearchManager{}
 }
 
-func (m *MockupSearchManager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest) (*grpc_unified_logging_go.LogResponseList, derrors.Error) {
-	response := &grpc_unified_logging_go.LogResponseList{
-		OrganizationId: request.GetOrganizationId(),
-		From:           request.GetFrom(),
-		To:             request.GetTo(),
-		Responses:      []*grpc_unified_logging_go.LogResponse{},
+// NewMockupSearchManagerWithEntries returns a manager that searches entries by time range,
+// sorted and limited like a slave
+func NewMockupSearchManagerWithEntries(entries entities.LogEntries) *MockupSearchManager {
+	return &MockupSearchManager{
+		Entries: entries,
 	}
-	return response, nil
+}
+
+func (m *MockupSearchManager) Search(ctx context.Context, request *grpc_unified_logging_go.SearchRequest, options *entities.SearchOptions) (*grpc_unified_logging_go.LogResponseList, string, derrors.Error) {
+	if len(m.Entries) == 0 {
+		response := &grpc_unified_logging_go.LogResponseList{
+			OrganizationId: request.GetOrganizationId(),
+			From:           request.GetFrom(),
+			To:             request.GetTo(),
+			Responses:      []*grpc_unified_logging_go.LogResponse{},
+		}
+		return response, "", nil
+	}
+
+	result := make(entities.LogEntries, 0)
+	minLevel := options.GetMinLevel()
+	for _, entry := range m.Entries {
+		timestamp := entry.Timestamp.UnixNano()
+		if (request.From != 0 && timestamp < request.From) || (request.To != 0 && timestamp > request.To) {
+			continue
+		}
+		if minLevel != entities.UnknownLevel {
+			level, err := entities.ParseLevel(entry.Level)
+			if err != nil || level < minLevel {
+				continue
+			}
+		}
+		result = append(result, entry)
+	}
+	ascending := options.GetOrder(request.NFirst).ToAscending()
+	sort.SliceStable(result, func(i, j int) bool {
+		if ascending {
+			return result[i].Timestamp.Before(result[j].Timestamp)
+		}
+		return result[i].Timestamp.After(result[j].Timestamp)
+	})
+	if limit := options.GetLimit(); len(result) > limit {
+		result = result[:limit]
+	}
+
+	from, to, found := result.TimeRange()
+	if !found {
+		from = request.From
+		to = request.To
+	}
+	return entities.MergeLogEntries(request.OrganizationId, from, to, result, []string{}), "", nil
 }
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+
+	"github.com/nalej/derrors"
+
+	grpc "github.com/nalej/grpc-unified-logging-go"
+	"github.com/nalej/unified-logging/pkg/entities"
+)
+
+// TailSender sends a batch of new log entries to the client
+type TailSender func(*grpc.LogResponseList) error
+
+// Interface for Tail Manager
+type Tail interface {
+	// Tail sends the new log entries matching request and the minimum level of options until ctx is done or send fails
+	Tail(ctx context.Context, request *grpc.SearchRequest, options *entities.SearchOptions, send TailSender) derrors.Error
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Continuation tokens for paginated searches
+
+package entities
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/nalej/derrors"
+)
+
+const (
+	// CursorMetadataKey is the gRPC metadata key with the cursor of the requested page
+	CursorMetadataKey = "cursor"
+	// NextCursorMetadataKey is the gRPC header key with the cursor of the next page.
+	// It is not sent when there are no more entries.
+	NextCursorMetadataKey = "next-cursor"
+)
+
+// Cursor points to the last log entry returned by a storage provider, using the sort values of the entry
+type Cursor struct {
+	// Timestamp is the sort value of the entry timestamp
+	Timestamp int64 `json:"t"`
+	// Tiebreaker is a unique value to sort entries with the same timestamp
+	Tiebreaker string `json:"i"`
+}
+
+// Encode returns the opaque token of the cursor
+func (c *Cursor) Encode() string {
+	return encodeToken(c)
+}
+
+// DecodeCursor returns the cursor of an opaque token
+func DecodeCursor(token string) (*Cursor, derrors.Error) {
+	cursor := &Cursor{}
+	err := decodeToken(token, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// ClusterCursor is the position of a coordinator search in an application cluster
+type ClusterCursor struct {
+	// Cursor is the slave cursor of the page being returned, empty for the first page
+	Cursor string `json:"c,omitempty"`
+	// Skip is the number of entries of that page already returned
+	Skip int `json:"s,omitempty"`
+	// Done is set once all the entries of the cluster have been returned
+	Done bool `json:"d,omitempty"`
+}
+
+// ClusterCursors is the cursor of a coordinator search, indexed by cluster identifier
+type ClusterCursors map[string]*ClusterCursor
+
+// Encode returns the opaque token of the cursors
+func (c ClusterCursors) Encode() string {
+	return encodeToken(c)
+}
+
+// DecodeClusterCursors returns the cluster cursors of an opaque token. An empty token
+// returns empty cursors, that is, the first page.
+func DecodeClusterCursors(token string) (ClusterCursors, derrors.Error) {
+	cursors := make(ClusterCursors)
+	if token == "" {
+		return cursors, nil
+	}
+	err := decodeToken(token, &cursors)
+	if err != nil {
+		return nil, err
+	}
+	for clusterId, cursor := range cursors {
+		if cursor == nil {
+			return nil, derrors.NewInvalidArgumentError("malformed cursor").WithParams(clusterId)
+		}
+		if cursor.Skip < 0 {
+			return nil, derrors.NewInvalidArgumentError("malformed cursor: negative skip").WithParams(clusterId, cursor.Skip)
+		}
+	}
+	return cursors, nil
+}
+
+func encodeToken(value interface{}) string {
+	// Marshalling our own structures cannot fail
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeToken(token string, value interface{}) derrors.Error {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return derrors.NewInvalidArgumentError("malformed cursor", err)
+	}
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		return derrors.NewInvalidArgumentError("malformed cursor", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"encoding/base64"
+
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Cursor", func() {
+	ginkgo.It("should decode the cursors it encodes", func() {
+		cursors := ClusterCursors{
+			"c1": {Cursor: (&Cursor{Timestamp: 1, Tiebreaker: "a"}).Encode(), Skip: 2},
+			"c2": {Done: true},
+		}
+		decoded, err := DecodeClusterCursors(cursors.Encode())
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(decoded).Should(gomega.Equal(cursors))
+
+		cursor, err := DecodeCursor(decoded["c1"].Cursor)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(cursor).Should(gomega.Equal(&Cursor{Timestamp: 1, Tiebreaker: "a"}))
+	})
+
+	ginkgo.It("should decode an empty token as the first page", func() {
+		decoded, err := DecodeClusterCursors("")
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(decoded).Should(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should reject malformed cluster cursors", func() {
+		tokens := []string{
+			"not base64!",
+			base64.RawURLEncoding.EncodeToString([]byte(`[1,2]`)),
+			base64.RawURLEncoding.EncodeToString([]byte(`{"c1":null}`)),
+			base64.RawURLEncoding.EncodeToString([]byte(`{"c1":{"s":-1}}`)),
+		}
+		for _, token := range tokens {
+			_, err := DecodeClusterCursors(token)
+			gomega.Expect(err).Should(gomega.HaveOccurred(), token)
+			gomega.Expect(err.Type()).Should(gomega.Equal(derrors.InvalidArgument), token)
+		}
+	})
+})
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Expiration jobs deleting the log entries of an application
+//
+// The jobs are not part of the unified logging protos yet, so they are
+// declared here with protobuf tags to be sent as gRPC messages.
+
+package entities
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+)
+
+// ExpirationState is the state of an expiration job
+type ExpirationState int32
+
+const (
+	// ExpirationRunning jobs are still deleting entries
+	ExpirationRunning ExpirationState = iota
+	// ExpirationCompleted jobs deleted all their entries
+	ExpirationCompleted
+	// ExpirationFailed jobs finished with failures
+	ExpirationFailed
+)
+
+var expirationStateNames = map[ExpirationState]string{
+	ExpirationRunning:   "running",
+	ExpirationCompleted: "completed",
+	ExpirationFailed:    "failed",
+}
+
+func (s ExpirationState) String() string {
+	name, exists := expirationStateNames[s]
+	if !exists {
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+	return name
+}
+
+// ExpirationJobId identifies an expiration job of an organization
+type ExpirationJobId struct {
+	OrganizationId string `protobuf:"bytes,1,opt,name=organization_id,json=organizationId,proto3" json:"organization_id,omitempty"`
+	JobId          string `protobuf:"bytes,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+}
+
+func (i *ExpirationJobId) Reset()         { *i = ExpirationJobId{} }
+func (i *ExpirationJobId) String() string { return proto.CompactTextString(i) }
+func (*ExpirationJobId) ProtoMessage()    {}
+
+// Validate checks the organization and the job are set
+func (i *ExpirationJobId) Validate() derrors.Error {
+	if i.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError("organization_id is required")
+	}
+	if i.JobId == "" {
+		return derrors.NewInvalidArgumentError("job_id is required")
+	}
+	return nil
+}
+
+// ClusterExpirationJob is the progress of an expiration job in an application cluster
+type ClusterExpirationJob struct {
+	ClusterId string          `protobuf:"bytes,1,opt,name=cluster_id,json=clusterId,proto3" json:"cluster_id,omitempty"`
+	JobId     string          `protobuf:"bytes,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	State     ExpirationState `protobuf:"varint,3,opt,name=state,proto3" json:"state,omitempty"`
+	Deleted   int64           `protobuf:"varint,4,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	Total     int64           `protobuf:"varint,5,opt,name=total,proto3" json:"total,omitempty"`
+	Failures  []string        `protobuf:"bytes,6,rep,name=failures,proto3" json:"failures,omitempty"`
+}
+
+func (j *ClusterExpirationJob) Reset()         { *j = ClusterExpirationJob{} }
+func (j *ClusterExpirationJob) String() string { return proto.CompactTextString(j) }
+func (*ClusterExpirationJob) ProtoMessage()    {}
+
+// ExpirationJob is the progress of the deletion of the entries of an expiration request. Deleted
+// and Total are only known when the storage deletes the entries in a task. The jobs of the
+// coordinator have the progress of every cluster.
+type ExpirationJob struct {
+	OrganizationId string                  `protobuf:"bytes,1,opt,name=organization_id,json=organizationId,proto3" json:"organization_id,omitempty"`
+	AppInstanceId  string                  `protobuf:"bytes,2,opt,name=app_instance_id,json=appInstanceId,proto3" json:"app_instance_id,omitempty"`
+	JobId          string                  `protobuf:"bytes,3,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	State          ExpirationState         `protobuf:"varint,4,opt,name=state,proto3" json:"state,omitempty"`
+	Deleted        int64                   `protobuf:"varint,5,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	Total          int64                   `protobuf:"varint,6,opt,name=total,proto3" json:"total,omitempty"`
+	Failures       []string                `protobuf:"bytes,7,rep,name=failures,proto3" json:"failures,omitempty"`
+	Clusters       []*ClusterExpirationJob `protobuf:"bytes,8,rep,name=clusters,proto3" json:"clusters,omitempty"`
+}
+
+func (j *ExpirationJob) Reset()         { *j = ExpirationJob{} }
+func (j *ExpirationJob) String() string { return proto.CompactTextString(j) }
+func (*ExpirationJob) ProtoMessage()    {}
+
+// SummarizeClusters sets the progress of the job from the progress of its clusters: it runs while
+// any cluster runs, and fails if any cluster failed
+func (j *ExpirationJob) SummarizeClusters() {
+	j.State = ExpirationCompleted
+	j.Deleted = 0
+	j.Total = 0
+	j.Failures = make([]string, 0)
+	failed := false
+	for _, cluster := range j.Clusters {
+		j.Deleted += cluster.Deleted
+		j.Total += cluster.Total
+		for _, failure := range cluster.Failures {
+			j.Failures = append(j.Failures, fmt.Sprintf("%s: %s", cluster.ClusterId, failure))
+		}
+		switch cluster.State {
+		case ExpirationRunning:
+			j.State = ExpirationRunning
+		case ExpirationFailed:
+			failed = true
+		}
+	}
+	if failed && j.State != ExpirationRunning {
+		j.State = ExpirationFailed
+	}
+}
+
+// UntrackedClusterJob is the job of the clusters that do not run expiration jobs, where the
+// deletion was started with Expire and its progress cannot be followed
+const UntrackedClusterJob = "untracked"
+
+// ClusterJobs are the jobs of a coordinator expiration in every cluster, indexed by cluster
+// identifier. The clusters where it could not start have no job.
+type ClusterJobs map[string]string
+
+// Encode returns the opaque identifier of the coordinator job
+func (c ClusterJobs) Encode() string {
+	return encodeToken(c)
+}
+
+// DecodeClusterJobs returns the cluster jobs of an opaque coordinator job identifier
+func DecodeClusterJobs(token string) (ClusterJobs, derrors.Error) {
+	jobs := make(ClusterJobs)
+	err := decodeToken(token, &jobs)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("malformed expiration job identifier").WithParams(token)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type summaryTest struct {
+	states []ExpirationState
+	state  ExpirationState
+}
+
+var _ = ginkgo.Describe("Expiration", func() {
+	ginkgo.It("should summarize the progress of the clusters", func() {
+		tests := []summaryTest{
+			{[]ExpirationState{}, ExpirationCompleted},
+			{[]ExpirationState{ExpirationCompleted, ExpirationCompleted}, ExpirationCompleted},
+			{[]ExpirationState{ExpirationCompleted, ExpirationRunning}, ExpirationRunning},
+			{[]ExpirationState{ExpirationFailed, ExpirationRunning}, ExpirationRunning},
+			{[]ExpirationState{ExpirationFailed, ExpirationCompleted}, ExpirationFailed},
+		}
+		for _, test := range tests {
+			job := &ExpirationJob{}
+			for i, state := range test.states {
+				job.Clusters = append(job.Clusters, &ClusterExpirationJob{State: state, Deleted: int64(i + 1), Total: 2})
+			}
+			job.SummarizeClusters()
+			gomega.Expect(job.State).Should(gomega.Equal(test.state), test.state.String())
+			gomega.Expect(job.Total).Should(gomega.Equal(int64(2 * len(test.states))))
+		}
+
+		job := &ExpirationJob{Clusters: []*ClusterExpirationJob{
+			{ClusterId: "cluster-1", State: ExpirationFailed, Failures: []string{"timeout"}},
+		}}
+		job.SummarizeClusters()
+		gomega.Expect(job.Failures).Should(gomega.Equal([]string{"cluster-1: timeout"}))
+	})
+
+	ginkgo.It("should encode the jobs of every cluster in the job identifier", func() {
+		jobs := ClusterJobs{"cluster-1": "job-1", "cluster-2": ""}
+		decoded, derr := DecodeClusterJobs(jobs.Encode())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(decoded).Should(gomega.Equal(jobs))
+
+		_, derr = DecodeClusterJobs("not a job")
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should be sent as a protobuf message", func() {
+		job := &ExpirationJob{
+			OrganizationId: "org-1",
+			JobId:          "job-1",
+			State:          ExpirationFailed,
+			Deleted:        3,
+			Failures:       []string{"cluster-1: timeout"},
+			Clusters:       []*ClusterExpirationJob{{ClusterId: "cluster-1", State: ExpirationFailed, Failures: []string{"timeout"}}},
+		}
+		data, err := proto.Marshal(job)
+		gomega.Expect(err).Should(gomega.Succeed())
+		received := &ExpirationJob{}
+		gomega.Expect(proto.Unmarshal(data, received)).Should(gomega.Succeed())
+		gomega.Expect(received).Should(gomega.Equal(job))
+	})
+})
@@ -40,6 +40,9 @@ const (
 	AppInstanceNameField     Field = "kubernetes.labels." + NALEJ_ANNOTATION_APP_NAME
 	AppServiceGroupNameField Field = "kubernetes.labels." + NALEJ_ANNOTATION_SERVICE_GROUP_NAME
 	AppServiceNameField      Field = "kubernetes.labels." + NALEJ_ANNOTATION_SERVICE_NAME
+	// added by the ingest pipeline of the slave
+	LevelField    Field = "level"
+	SeverityField Field = "severity"
 )
 
 func (f Field) String() string {
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Severity levels of log entries
+
+package entities
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/nalej/derrors"
+)
+
+// Level is the severity of a log entry, from least to most severe
+type Level int
+
+const (
+	// UnknownLevel is the level of entries without a recognized severity
+	UnknownLevel Level = iota
+	TraceLevel
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+)
+
+// levelNames are the canonical names of the levels, indexed by level
+var levelNames = []string{"unknown", "trace", "debug", "info", "warn", "error", "fatal"}
+
+// levelAliases are the lowercase names used by common logging libraries for each level:
+// JSON and logrus names, zerolog console abbreviations and glog prefixes
+var levelAliases = map[string]Level{
+	"trace":    TraceLevel,
+	"trc":      TraceLevel,
+	"debug":    DebugLevel,
+	"dbg":      DebugLevel,
+	"info":     InfoLevel,
+	"inf":      InfoLevel,
+	"i":        InfoLevel,
+	"warn":     WarnLevel,
+	"warning":  WarnLevel,
+	"wrn":      WarnLevel,
+	"w":        WarnLevel,
+	"error":    ErrorLevel,
+	"err":      ErrorLevel,
+	"e":        ErrorLevel,
+	"fatal":    FatalLevel,
+	"ftl":      FatalLevel,
+	"f":        FatalLevel,
+	"panic":    FatalLevel,
+	"pnc":      FatalLevel,
+	"critical": FatalLevel,
+	"crit":     FatalLevel,
+}
+
+// LevelPatterns find the level in a message, in order: JSON, logrus text, zerolog console and
+// glog formats. The level is captured by their only group.
+var LevelPatterns = []string{
+	`"level"\s*:\s*"(?P<level>[A-Za-z]+)"`,
+	`level=(?P<level>[A-Za-z]+)`,
+	`^\S+\s+(?P<level>TRC|DBG|INF|WRN|ERR|FTL|PNC)\s`,
+	`^(?P<level>[IWEF])\d{4} \d{2}:\d{2}:\d{2}`,
+}
+
+var levelExpressions = compileLevelPatterns()
+
+func compileLevelPatterns() []*regexp.Regexp {
+	expressions := make([]*regexp.Regexp, len(LevelPatterns))
+	for i, pattern := range LevelPatterns {
+		expressions[i] = regexp.MustCompile(pattern)
+	}
+	return expressions
+}
+
+// DetectLevel returns the level found in a message with the first matching pattern, as the
+// ingest pipeline of ElasticSearch does, or UnknownLevel
+func DetectLevel(message string) Level {
+	for _, expression := range levelExpressions {
+		match := expression.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		// Only the first matching pattern is used, even with an unknown level
+		level, _ := ParseLevel(match[1])
+		return level
+	}
+	return UnknownLevel
+}
+
+// String returns the canonical name of the level
+func (l Level) String() string {
+	if l < UnknownLevel || int(l) >= len(levelNames) {
+		return levelNames[UnknownLevel]
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with a canonical name or alias, case insensitive
+func ParseLevel(name string) (Level, derrors.Error) {
+	level, exists := levelAliases[strings.ToLower(name)]
+	if !exists {
+		return UnknownLevel, derrors.NewInvalidArgumentError("unknown log level").WithParams(name)
+	}
+	return level, nil
+}
+
+// LevelNames returns the canonical names of the levels, indexed by level
+func LevelNames() []string {
+	names := make([]string, len(levelNames))
+	copy(names, levelNames)
+	return names
+}
+
+// LevelAliases returns the level of every known level name
+func LevelAliases() map[string]Level {
+	aliases := make(map[string]Level, len(levelAliases))
+	for name, level := range levelAliases {
+		aliases[name] = level
+	}
+	return aliases
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Level", func() {
+	ginkgo.It("should parse names and aliases", func() {
+		for name, expected := range map[string]Level{"trace": TraceLevel, "DBG": DebugLevel, "I": InfoLevel,
+			"Warning": WarnLevel, "err": ErrorLevel, "panic": FatalLevel} {
+			level, err := ParseLevel(name)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(level).Should(gomega.Equal(expected), name)
+		}
+	})
+	ginkgo.It("should reject unknown names", func() {
+		_, err := ParseLevel("unknown")
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+	})
+	ginkgo.It("should return canonical names", func() {
+		level, err := ParseLevel("WRN")
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(level.String()).Should(gomega.Equal("warn"))
+		gomega.Expect(Level(100).String()).Should(gomega.Equal("unknown"))
+	})
+	ginkgo.It("should be ordered by severity", func() {
+		gomega.Expect(LevelNames()).Should(gomega.Equal([]string{"unknown", "trace", "debug", "info", "warn", "error", "fatal"}))
+		gomega.Expect(ErrorLevel > WarnLevel).Should(gomega.BeTrue())
+	})
+	ginkgo.It("should detect the level of messages", func() {
+		for message, expected := range map[string]Level{
+			`{"level":"warn","message":"slow request"}`:             WarnLevel,
+			`time="2020-01-17T10:00:00Z" level=error msg="failed"`:  ErrorLevel,
+			`10:00AM DBG starting component=api`:                    DebugLevel,
+			`E0117 10:00:00.000000    1 main.go:10] cannot connect`: ErrorLevel,
+			`{"level":"verbose"} level=error`:                       UnknownLevel,
+			`plain message`:                                         UnknownLevel,
+		} {
+			gomega.Expect(DetectLevel(message)).Should(gomega.Equal(expected), message)
+		}
+	})
+})
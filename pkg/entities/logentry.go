@@ -49,6 +49,26 @@ type LogEntry struct {
 	Timestamp  time.Time       `json:"@timestamp"`
 	Msg        string          `json:"message"`
 	Kubernetes KubernetesEntry `json:"kubernetes"`
+	// Level is the canonical name of the severity of the entry, empty if unknown
+	Level string `json:"level,omitempty"`
+	// Cursor to continue a search after this entry, if the provider supports it
+	Cursor *Cursor `json:"-"`
+}
+
+// TimeRange returns the timestamps of the oldest and newest entries in Unixnano time format,
+// whatever the order of the entries. found is false if there are no entries.
+func (l LogEntries) TimeRange() (from int64, to int64, found bool) {
+	for _, entry := range l {
+		timestamp := entry.Timestamp.UnixNano()
+		if !found || timestamp < from {
+			from = timestamp
+		}
+		if !found || timestamp > to {
+			to = timestamp
+		}
+		found = true
+	}
+	return from, to, found
 }
 
 func getLogEntryPK(entry LogEntry) string {
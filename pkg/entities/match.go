@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Evaluation of search requests on log entries, for providers without a query engine
+
+package entities
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// FieldValue returns the value of a field of the entry, empty if the entry does not have it
+func (e *LogEntry) FieldValue(field Field) string {
+	labels := e.Kubernetes.Labels
+	switch field {
+	case MessageField:
+		return e.Msg
+	case LevelField:
+		return e.Level
+	case NamespaceField:
+		return e.Kubernetes.Namespace
+	case OrganizationIdField:
+		return labels.OrganizationId
+	case AppDescriptorField:
+		return labels.AppDescriptorId
+	case AppDescriptorNameField:
+		return labels.AppDescriptorName
+	case AppInstanceIdField:
+		return labels.AppInstanceId
+	case AppInstanceNameField:
+		return labels.AppInstanceName
+	case ServiceGroupIdField:
+		return labels.AppServiceGroupId
+	case AppServiceGroupNameField:
+		return labels.AppServiceGroupName
+	case ServiceGroupInstanceIdField:
+		return labels.AppServiceGroupInstanceId
+	case ServiceIdField:
+		return labels.AppServiceId
+	case AppServiceNameField:
+		return labels.AppServiceName
+	case ServiceInstanceIdField:
+		return labels.AppServiceInstanceId
+	}
+	return ""
+}
+
+// Matches checks if an entry matches the filters, minimum level, query and time range of the request
+func (e *SearchRequest) Matches(entry *LogEntry) bool {
+	if !e.MatchesFilters(entry) || !e.MatchesTime(entry) {
+		return false
+	}
+	return e.Query == nil || MatchQuery(e.Query, entry)
+}
+
+// MatchesExpire checks if an entry matches the filters and query of the request and is not newer
+// than To, the entries that Expire deletes
+func (e *SearchRequest) MatchesExpire(entry *LogEntry) bool {
+	if !e.MatchesFilters(entry) {
+		return false
+	}
+	if e.To != 0 && entry.Timestamp.UnixNano() > e.To {
+		return false
+	}
+	return e.Query == nil || MatchQuery(e.Query, entry)
+}
+
+// MatchesFilters checks if an entry matches the filters and the minimum level of the request
+func (e *SearchRequest) MatchesFilters(entry *LogEntry) bool {
+	// Entries without a known level are excluded
+	if e.MinLevel != UnknownLevel {
+		level, err := ParseLevel(entry.Level)
+		if err != nil || level < e.MinLevel {
+			return false
+		}
+	}
+
+	clauses := 0
+	for field, values := range e.Filters {
+		if len(values) == 0 {
+			continue
+		}
+		clauses++
+		matched := false
+		value := entry.FieldValue(field)
+		for _, v := range values {
+			if v == value {
+				matched = true
+				break
+			}
+		}
+		if matched && e.IsUnionFilter {
+			return true
+		}
+		if !matched && !e.IsUnionFilter {
+			return false
+		}
+	}
+	// A union matches if any filter matched, or if there are none
+	return !e.IsUnionFilter || clauses == 0
+}
+
+// MatchesTime checks if the entry is within the time range of the request, both ends included
+func (e *SearchRequest) MatchesTime(entry *LogEntry) bool {
+	timestamp := entry.Timestamp.UnixNano()
+	if e.From != 0 && timestamp < e.From {
+		return false
+	}
+	return e.To == 0 || timestamp <= e.To
+}
+
+// MatchQuery checks if an entry matches a query. Messages are matched word by word, ignoring
+// case, and the other fields by their whole value, as ElasticSearch does, except for words
+// without a field, which are found anywhere in the names.
+func MatchQuery(node QueryNode, entry *LogEntry) bool {
+	switch n := node.(type) {
+	case *QueryAnd:
+		for _, operand := range n.Operands {
+			if !MatchQuery(operand, entry) {
+				return false
+			}
+		}
+		return true
+	case *QueryOr:
+		for _, operand := range n.Operands {
+			if MatchQuery(operand, entry) {
+				return true
+			}
+		}
+		return false
+	case *QueryNot:
+		return !MatchQuery(n.Operand, entry)
+	case *QueryTerm:
+		if n.Field != "" {
+			return matchField(n.Field, n, entry)
+		}
+		for _, field := range DefaultQueryFields {
+			if matchDefaultField(field, n, entry) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// matchDefaultField checks if a term without a field matches one of the default fields of the
+// entry. Words are found anywhere in the names, as they are not split in words.
+func matchDefaultField(field Field, term *QueryTerm, entry *LogEntry) bool {
+	if term.Kind == WordMatch && field != MessageField {
+		return strings.Contains(entry.FieldValue(field), term.Value)
+	}
+	return matchField(field, term, entry)
+}
+
+// matchField checks if a term matches a field of the entry
+func matchField(field Field, term *QueryTerm, entry *LogEntry) bool {
+	value := entry.FieldValue(field)
+	if field != MessageField {
+		switch term.Kind {
+		case RegexMatch:
+			return matchRegex(term.Value, value)
+		case WildcardMatch:
+			return matchRegex(wildcardRegex(term.Value), value)
+		}
+		return value == term.Value
+	}
+
+	words := textWords(value)
+	switch term.Kind {
+	case RegexMatch, WildcardMatch:
+		// Analyzed fields are matched word by word, and store lowercase words
+		expression := term.Value
+		if term.Kind == WildcardMatch {
+			expression = wildcardRegex(strings.ToLower(term.Value))
+		}
+		for _, word := range words {
+			if matchRegex(expression, word) {
+				return true
+			}
+		}
+		return false
+	case PhraseMatch:
+		return containsPhrase(words, textWords(term.Value))
+	}
+	// All the words of the term must be in the field
+	for _, wanted := range textWords(term.Value) {
+		if !containsPhrase(words, []string{wanted}) {
+			return false
+		}
+	}
+	return true
+}
+
+// textWords splits a text into lowercase words, as the standard ElasticSearch analyzer does
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsPhrase checks if the words contain the words of the phrase, in the same order
+func containsPhrase(words []string, phrase []string) bool {
+	if len(phrase) == 0 {
+		return false
+	}
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		matched := true
+		for j, word := range phrase {
+			if words[i+j] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRegex checks if the whole value matches a regular expression. Invalid expressions match nothing.
+func matchRegex(expression string, value string) bool {
+	re, err := regexp.Compile("^(?:" + expression + ")$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// wildcardRegex returns the regular expression of a pattern with * and ? wildcards
+func wildcardRegex(pattern string) string {
+	quoted := regexp.QuoteMeta(pattern)
+	return strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(quoted)
+}
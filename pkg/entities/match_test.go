@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Match", func() {
+	entry := &LogEntry{
+		Timestamp: time.Unix(0, 1000),
+		Msg:       "Connection refused by backend-server: retrying",
+		Level:     "error",
+		Kubernetes: KubernetesEntry{
+			Namespace: "ns",
+			Labels: KubernetesLabelsEntry{
+				OrganizationId: "org",
+				AppInstanceId:  "app",
+				AppServiceName: "api-gateway",
+			},
+		},
+	}
+
+	match := func(query string) bool {
+		node, err := ParseQuery(query)
+		gomega.Expect(err).Should(gomega.Succeed())
+		return MatchQuery(node, entry)
+	}
+
+	ginkgo.It("should match the words of the message, ignoring case", func() {
+		gomega.Expect(match("connection")).Should(gomega.BeTrue())
+		gomega.Expect(match("backend")).Should(gomega.BeTrue())
+		gomega.Expect(match("message:back")).Should(gomega.BeFalse())
+		gomega.Expect(match(`"refused by backend"`)).Should(gomega.BeTrue())
+		gomega.Expect(match(`"backend refused"`)).Should(gomega.BeFalse())
+		gomega.Expect(match("retr*")).Should(gomega.BeTrue())
+		gomega.Expect(match("/retr(y|ies)ing/")).Should(gomega.BeTrue())
+	})
+	ginkgo.It("should match the whole value of the other fields, and words anywhere in the names", func() {
+		gomega.Expect(match("api-gateway")).Should(gomega.BeTrue())
+		gomega.Expect(match("gateway")).Should(gomega.BeTrue())
+		gomega.Expect(match("gateways")).Should(gomega.BeFalse())
+		gomega.Expect(match("service_name:api")).Should(gomega.BeFalse())
+		gomega.Expect(match("service_name:api*")).Should(gomega.BeTrue())
+		gomega.Expect(match("level:error namespace:ns")).Should(gomega.BeTrue())
+	})
+	ginkgo.It("should combine terms", func() {
+		gomega.Expect(match("timeout OR refused")).Should(gomega.BeTrue())
+		gomega.Expect(match("connection -refused")).Should(gomega.BeFalse())
+		gomega.Expect(match("NOT (timeout OR level:warn)")).Should(gomega.BeTrue())
+	})
+	ginkgo.It("should match the filters, level and time range of requests", func() {
+		request := &SearchRequest{
+			Filters:  SearchFilter{AppInstanceIdField: {"other", "app"}, OrganizationIdField: {"org"}},
+			MinLevel: WarnLevel,
+			From:     1000,
+			To:       2000,
+		}
+		gomega.Expect(request.Matches(entry)).Should(gomega.BeTrue())
+
+		request.Filters[OrganizationIdField] = []string{"other"}
+		gomega.Expect(request.Matches(entry)).Should(gomega.BeFalse())
+		request.IsUnionFilter = true
+		gomega.Expect(request.Matches(entry)).Should(gomega.BeTrue())
+
+		request.MinLevel = FatalLevel
+		gomega.Expect(request.Matches(entry)).Should(gomega.BeFalse())
+		request.MinLevel = UnknownLevel
+
+		request.From = 1001
+		gomega.Expect(request.Matches(entry)).Should(gomega.BeFalse())
+		gomega.Expect(request.MatchesExpire(entry)).Should(gomega.BeTrue())
+
+		request.Query = &QueryNot{Operand: &QueryTerm{Field: AppInstanceIdField, Value: "app"}}
+		gomega.Expect(request.MatchesExpire(entry)).Should(gomega.BeFalse())
+	})
+})
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Search options sent along with a search request
+
+package entities
+
+import (
+	"strconv"
+
+	"github.com/nalej/derrors"
+)
+
+const (
+	// LimitMetadataKey is the gRPC metadata key with the maximum number of entries to return
+	LimitMetadataKey = "limit"
+	// SortOrderMetadataKey is the gRPC metadata key with the sort order of the entries
+	SortOrderMetadataKey = "sort-order"
+	// MinLevelMetadataKey is the gRPC metadata key with the minimum severity of the entries
+	MinLevelMetadataKey = "min-level"
+)
+
+// SearchOptionsMetadataKeys are the gRPC metadata keys of the search options
+var SearchOptionsMetadataKeys = []string{CursorMetadataKey, LimitMetadataKey, SortOrderMetadataKey, MinLevelMetadataKey}
+
+// SearchOptions are the search parameters that are not part of the gRPC search request.
+// They are sent as request metadata.
+type SearchOptions struct {
+	// Cursor is the token of the requested page, empty for the first page
+	Cursor string
+	// Limit is the maximum number of entries to return, 0 for the server default
+	Limit int
+	// Order is the requested sort order, nil to sort according to the NFirst flag of the request
+	Order *SortOrder
+	// MinLevel is the minimum severity of the entries, UnknownLevel to include all of them
+	MinLevel Level
+}
+
+// NewSearchOptions parses the search options from their metadata values, indexed by metadata key.
+// Missing and empty values are not set.
+func NewSearchOptions(values map[string]string) (*SearchOptions, derrors.Error) {
+	options := &SearchOptions{
+		Cursor: values[CursorMetadataKey],
+	}
+	if limit := values[LimitMetadataKey]; limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return nil, derrors.NewInvalidArgumentError("limit must be a non-negative integer").WithParams(limit)
+		}
+		options.Limit = value
+	}
+	if order := values[SortOrderMetadataKey]; order != "" {
+		value, err := ParseSortOrder(order)
+		if err != nil {
+			return nil, err
+		}
+		options.Order = &value
+	}
+	if level := values[MinLevelMetadataKey]; level != "" {
+		value, err := ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		options.MinLevel = value
+	}
+	return options, nil
+}
+
+// GetCursor returns the cursor of the requested page
+func (o *SearchOptions) GetCursor() string {
+	if o == nil {
+		return ""
+	}
+	return o.Cursor
+}
+
+// GetLimit returns the number of entries to return, capped to LimitPerSearch
+func (o *SearchOptions) GetLimit() int {
+	if o == nil || o.Limit <= 0 || o.Limit > LimitPerSearch {
+		return LimitPerSearch
+	}
+	return o.Limit
+}
+
+// GetOrder returns the requested sort order, or the order implied by nFirst if none was requested
+func (o *SearchOptions) GetOrder(nFirst bool) SortOrder {
+	if o == nil || o.Order == nil {
+		return SortOrderFromNFirst(nFirst)
+	}
+	return *o.Order
+}
+
+// GetMinLevel returns the minimum severity of the entries
+func (o *SearchOptions) GetMinLevel() Level {
+	if o == nil {
+		return UnknownLevel
+	}
+	return o.MinLevel
+}
+
+// MetadataPairs returns the limit, sort order and minimum level as gRPC metadata key-value pairs. The cursor
+// is not included, as it depends on the receiver of the request.
+func (o *SearchOptions) MetadataPairs() []string {
+	pairs := make([]string, 0, 6)
+	if o == nil {
+		return pairs
+	}
+	if o.Limit > 0 {
+		pairs = append(pairs, LimitMetadataKey, strconv.Itoa(o.Limit))
+	}
+	if o.Order != nil {
+		pairs = append(pairs, SortOrderMetadataKey, o.Order.String())
+	}
+	if o.MinLevel != UnknownLevel {
+		pairs = append(pairs, MinLevelMetadataKey, o.MinLevel.String())
+	}
+	return pairs
+}
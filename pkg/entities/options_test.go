@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("SearchOptions", func() {
+	ginkgo.It("should use the defaults when not set", func() {
+		options, err := NewSearchOptions(map[string]string{})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(options.GetLimit()).Should(gomega.Equal(LimitPerSearch))
+		gomega.Expect(options.GetOrder(true)).Should(gomega.Equal(Ascending))
+		gomega.Expect(options.GetOrder(false)).Should(gomega.Equal(Descending))
+		gomega.Expect(options.MetadataPairs()).Should(gomega.BeEmpty())
+	})
+	ginkgo.It("should parse the limit and sort order", func() {
+		options, err := NewSearchOptions(map[string]string{
+			CursorMetadataKey:    "cursor",
+			LimitMetadataKey:     "10",
+			SortOrderMetadataKey: "desc",
+			MinLevelMetadataKey:  "WARNING",
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(options.GetCursor()).Should(gomega.Equal("cursor"))
+		gomega.Expect(options.GetLimit()).Should(gomega.Equal(10))
+		gomega.Expect(options.GetOrder(true)).Should(gomega.Equal(Descending))
+		gomega.Expect(options.GetMinLevel()).Should(gomega.Equal(WarnLevel))
+		gomega.Expect(options.MetadataPairs()).Should(gomega.Equal([]string{LimitMetadataKey, "10", SortOrderMetadataKey, "desc", MinLevelMetadataKey, "warn"}))
+	})
+	ginkgo.It("should cap the limit", func() {
+		options := &SearchOptions{Limit: LimitPerSearch + 1}
+		gomega.Expect(options.GetLimit()).Should(gomega.Equal(LimitPerSearch))
+	})
+	ginkgo.It("should reject invalid values", func() {
+		for key, value := range map[string]string{
+			LimitMetadataKey:     "-1",
+			SortOrderMetadataKey: "newest",
+			MinLevelMetadataKey:  "loud",
+		} {
+			_, err := NewSearchOptions(map[string]string{key: value})
+			gomega.Expect(err).Should(gomega.HaveOccurred(), key)
+		}
+		_, err := NewSearchOptions(map[string]string{LimitMetadataKey: "ten"})
+		gomega.Expect(err).Should(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Outcome of the application clusters of a coordinator request
+
+package entities
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// ClusterOutcomesMetadataKey is the gRPC header key with the outcome of every application
+// cluster of a coordinator search or expiration
+const ClusterOutcomesMetadataKey = "cluster-outcomes"
+
+// ClusterStatus is how an application cluster answered a request
+type ClusterStatus int32
+
+const (
+	// ClusterOK clusters answered the request
+	ClusterOK ClusterStatus = iota
+	// ClusterTimeout clusters did not answer in time
+	ClusterTimeout
+	// ClusterUnavailable clusters could not be reached, or were skipped as they kept failing
+	ClusterUnavailable
+	// ClusterTLSError clusters could not be reached because of their certificates
+	ClusterTLSError
+	// ClusterStorageError clusters answered with an error
+	ClusterStorageError
+	// ClusterCoordinatorError clusters were not queried because of an error of the coordinator,
+	// as loading its certificates
+	ClusterCoordinatorError
+)
+
+var clusterStatusNames = map[ClusterStatus]string{
+	ClusterOK:               "ok",
+	ClusterTimeout:          "timeout",
+	ClusterUnavailable:      "unavailable",
+	ClusterTLSError:         "tls_error",
+	ClusterStorageError:     "storage_error",
+	ClusterCoordinatorError: "coordinator_error",
+}
+
+func (s ClusterStatus) String() string {
+	name, exists := clusterStatusNames[s]
+	if !exists {
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+	return name
+}
+
+// MarshalText returns the name of the status, so the outcomes are readable
+func (s ClusterStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses the name of a status
+func (s *ClusterStatus) UnmarshalText(text []byte) error {
+	for status, name := range clusterStatusNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown cluster status %s", text)
+}
+
+// ClusterOutcome is the outcome of a request in an application cluster
+type ClusterOutcome struct {
+	ClusterId string        `json:"cluster_id"`
+	Status    ClusterStatus `json:"status"`
+	// Error is the error of the cluster, empty if it answered the request
+	Error string `json:"error,omitempty"`
+	// Latency is the time the cluster took to answer, zero if it was skipped
+	Latency time.Duration `json:"latency_ns,omitempty"`
+	// Entries is the number of log entries the cluster returned
+	Entries int `json:"entries,omitempty"`
+}
+
+// Failed checks if the cluster did not answer the request
+func (o *ClusterOutcome) Failed() bool {
+	return o.Status != ClusterOK
+}
+
+// ClusterOutcomes are the outcomes of a request in every application cluster
+type ClusterOutcomes []*ClusterOutcome
+
+// FailedClusterIds returns the clusters that did not answer the request
+func (o ClusterOutcomes) FailedClusterIds() []string {
+	failed := make([]string, 0)
+	for _, outcome := range o {
+		if outcome.Failed() {
+			failed = append(failed, outcome.ClusterId)
+		}
+	}
+	return failed
+}
+
+// Entries returns the number of log entries returned by all the clusters
+func (o ClusterOutcomes) Entries() int {
+	entries := 0
+	for _, outcome := range o {
+		entries += outcome.Entries
+	}
+	return entries
+}
+
+// Sort sorts the outcomes by cluster identifier
+func (o ClusterOutcomes) Sort() {
+	sort.Slice(o, func(i, j int) bool {
+		return o[i].ClusterId < o[j].ClusterId
+	})
+}
+
+// Encode returns the outcomes as a gRPC header value
+func (o ClusterOutcomes) Encode() string {
+	return encodeToken(o)
+}
+
+// DecodeClusterOutcomes returns the outcomes of a gRPC header value
+func DecodeClusterOutcomes(value string) (ClusterOutcomes, derrors.Error) {
+	outcomes := make(ClusterOutcomes, 0)
+	err := decodeToken(value, &outcomes)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("malformed cluster outcomes", err)
+	}
+	return outcomes, nil
+}
+
+// CoordinatorError returns an error if any cluster was not queried because of an error of the
+// coordinator, which is not a failure of the clusters
+func (o ClusterOutcomes) CoordinatorError() derrors.Error {
+	errors := make([]string, 0)
+	for _, outcome := range o {
+		if outcome.Status == ClusterCoordinatorError {
+			errors = append(errors, fmt.Sprintf("%s: %s", outcome.ClusterId, outcome.Error))
+		}
+	}
+	if len(errors) == 0 {
+		return nil
+	}
+	return derrors.NewInternalError("application clusters cannot be queried by the coordinator").WithParams(errors)
+}
+
+// FailurePolicy decides if a request fails when some of its clusters fail
+type FailurePolicy struct {
+	// MaxFailedClusters is the number of clusters that can fail without failing the request,
+	// negative to never fail it
+	MaxFailedClusters int
+}
+
+// Check returns an error if more clusters than allowed failed
+func (p FailurePolicy) Check(outcomes ClusterOutcomes) derrors.Error {
+	failed := outcomes.FailedClusterIds()
+	if p.MaxFailedClusters < 0 || len(failed) <= p.MaxFailedClusters {
+		return nil
+	}
+	return derrors.NewUnavailableError(fmt.Sprintf("%d application clusters failed, %d allowed", len(failed), p.MaxFailedClusters)).
+		WithParams(failed)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Cluster outcomes", func() {
+	outcomes := ClusterOutcomes{
+		{ClusterId: "cluster-1", Status: ClusterOK, Latency: time.Millisecond, Entries: 10},
+		{ClusterId: "cluster-2", Status: ClusterTimeout, Error: "deadline exceeded", Latency: time.Second},
+		{ClusterId: "cluster-3", Status: ClusterTLSError, Error: "x509: certificate signed by unknown authority"},
+	}
+
+	ginkgo.It("should encode the outcomes as a header value", func() {
+		decoded, derr := DecodeClusterOutcomes(outcomes.Encode())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(decoded).Should(gomega.Equal(outcomes))
+		gomega.Expect(decoded.FailedClusterIds()).Should(gomega.Equal([]string{"cluster-2", "cluster-3"}))
+		gomega.Expect(decoded.Entries()).Should(gomega.Equal(10))
+
+		_, derr = DecodeClusterOutcomes("not outcomes")
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.InvalidArgument))
+	})
+
+	ginkgo.It("should fail when more clusters than allowed fail", func() {
+		tests := []struct {
+			maxFailed int
+			fails     bool
+		}{
+			{-1, false},
+			{0, true},
+			{1, true},
+			{2, false},
+		}
+		for _, test := range tests {
+			derr := FailurePolicy{MaxFailedClusters: test.maxFailed}.Check(outcomes)
+			if test.fails {
+				gomega.Expect(derr).ShouldNot(gomega.Succeed(), "max failed %d", test.maxFailed)
+				gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+			} else {
+				gomega.Expect(derr).Should(gomega.Succeed(), "max failed %d", test.maxFailed)
+			}
+		}
+	})
+})
@@ -0,0 +1,428 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Query language to search log entries
+//
+// A query is a list of terms, all of which must match. A term is a word, a "quoted phrase"
+// or a /regular expression/, optionally preceded by a field name and a colon, as in
+// service_name:api. Terms without a field match the message and the application names.
+// Terms can be combined with AND, OR and parentheses, and negated with NOT or a leading dash.
+// Words with * or ? match them as wildcards.
+
+package entities
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/nalej/derrors"
+)
+
+// MaxQueryLength is the maximum length of a query
+const MaxQueryLength = 4096
+
+// QueryFields are the names of the fields that can be used in a query
+var QueryFields = map[string]Field{
+	"message":                   MessageField,
+	"level":                     LevelField,
+	"namespace":                 NamespaceField,
+	"organization_id":           OrganizationIdField,
+	"app_descriptor_id":         AppDescriptorField,
+	"app_descriptor_name":       AppDescriptorNameField,
+	"app_instance_id":           AppInstanceIdField,
+	"app_instance_name":         AppInstanceNameField,
+	"service_group_id":          ServiceGroupIdField,
+	"service_group_instance_id": ServiceGroupInstanceIdField,
+	"service_group_name":        AppServiceGroupNameField,
+	"service_id":                ServiceIdField,
+	"service_instance_id":       ServiceInstanceIdField,
+	"service_name":              AppServiceNameField,
+}
+
+// DefaultQueryFields are the fields matched by terms without a field
+var DefaultQueryFields = []Field{
+	MessageField,
+	AppDescriptorNameField,
+	AppInstanceNameField,
+	AppServiceGroupNameField,
+	AppServiceNameField,
+}
+
+// MatchKind is the way the value of a term is matched
+type MatchKind int
+
+const (
+	// WordMatch matches a word
+	WordMatch MatchKind = iota
+	// PhraseMatch matches a sequence of words
+	PhraseMatch
+	// WildcardMatch matches a word with * and ? wildcards
+	WildcardMatch
+	// RegexMatch matches a regular expression
+	RegexMatch
+)
+
+// QueryNode is a node of the syntax tree of a query
+type QueryNode interface {
+	// String returns the query of the node, as accepted by ParseQuery
+	String() string
+	queryNode()
+}
+
+// QueryAnd matches when all its operands match
+type QueryAnd struct {
+	Operands []QueryNode
+}
+
+// QueryOr matches when any of its operands match
+type QueryOr struct {
+	Operands []QueryNode
+}
+
+// QueryNot matches when its operand does not match
+type QueryNot struct {
+	Operand QueryNode
+}
+
+// QueryTerm matches a value in a field
+type QueryTerm struct {
+	// Field to match, empty for the DefaultQueryFields
+	Field Field
+	Value string
+	Kind  MatchKind
+}
+
+func (q *QueryAnd) queryNode()  {}
+func (q *QueryOr) queryNode()   {}
+func (q *QueryNot) queryNode()  {}
+func (q *QueryTerm) queryNode() {}
+
+func (q *QueryAnd) String() string {
+	return joinNodes(q.Operands, " AND ")
+}
+
+func (q *QueryOr) String() string {
+	return joinNodes(q.Operands, " OR ")
+}
+
+func (q *QueryNot) String() string {
+	return fmt.Sprintf("NOT %s", q.Operand.String())
+}
+
+func (q *QueryTerm) String() string {
+	var value string
+	switch q.Kind {
+	case PhraseMatch:
+		value = fmt.Sprintf("\"%s\"", strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(q.Value))
+	case RegexMatch:
+		value = fmt.Sprintf("/%s/", strings.Replace(q.Value, "/", "\\/", -1))
+	default:
+		value = q.Value
+	}
+	if q.Field == "" {
+		return value
+	}
+	for name, field := range QueryFields {
+		if field == q.Field {
+			return fmt.Sprintf("%s:%s", name, value)
+		}
+	}
+	return fmt.Sprintf("%s:%s", q.Field, value)
+}
+
+func joinNodes(nodes []QueryNode, separator string) string {
+	values := make([]string, len(nodes))
+	for i, node := range nodes {
+		values[i] = node.String()
+	}
+	return fmt.Sprintf("(%s)", strings.Join(values, separator))
+}
+
+// ParseQuery returns the syntax tree of a query, or nil if the query is empty
+func ParseQuery(query string) (QueryNode, derrors.Error) {
+	if len(query) > MaxQueryLength {
+		return nil, derrors.NewInvalidArgumentError("query is too long").WithParams(len(query))
+	}
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	parser := &queryParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		return nil, parser.error("unexpected %s", parser.peek().text)
+	}
+	return node, nil
+}
+
+type queryTokenType int
+
+const (
+	tokenWord queryTokenType = iota
+	tokenPhrase
+	tokenRegex
+	tokenField
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	tokenType queryTokenType
+	text      string
+	position  int
+}
+
+// lexQuery splits a query into tokens
+func lexQuery(query string) ([]queryToken, derrors.Error) {
+	tokens := make([]queryToken, 0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{tokenOpen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{tokenClose, ")", i})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && startsTerm(tokens):
+			tokens = append(tokens, queryToken{tokenNot, "-", i})
+			i++
+		case r == '"' || r == '/':
+			text, end, err := lexQuoted(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokenType := tokenPhrase
+			if r == '/' {
+				tokenType = tokenRegex
+			}
+			tokens = append(tokens, queryToken{tokenType, text, i})
+			i = end
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != '"' {
+				// A known field name followed by a colon starts a field term
+				if runes[i] == ':' {
+					if _, exists := QueryFields[string(runes[start:i])]; exists {
+						break
+					}
+				}
+				i++
+			}
+			word := string(runes[start:i])
+			if i < len(runes) && runes[i] == ':' {
+				tokens = append(tokens, queryToken{tokenField, word, start})
+				i++
+				continue
+			}
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{tokenAnd, word, start})
+			case "OR":
+				tokens = append(tokens, queryToken{tokenOr, word, start})
+			case "NOT":
+				tokens = append(tokens, queryToken{tokenNot, word, start})
+			default:
+				tokens = append(tokens, queryToken{tokenWord, word, start})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// startsTerm checks if the next token starts a new term, so a dash negates it
+func startsTerm(tokens []queryToken) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1].tokenType
+	return last != tokenField
+}
+
+// lexQuoted returns the unescaped text between the delimiter at start and the next unescaped one,
+// and the position after it
+func lexQuoted(runes []rune, start int) (string, int, derrors.Error) {
+	delimiter := runes[start]
+	var text strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 < len(runes) && (runes[i+1] == delimiter || (delimiter == '"' && runes[i+1] == '\\')) {
+				i++
+			} else if delimiter == '"' {
+				continue
+			}
+			text.WriteRune(runes[i])
+		case delimiter:
+			return text.String(), i + 1, nil
+		default:
+			text.WriteRune(runes[i])
+		}
+	}
+	return "", 0, derrors.NewInvalidArgumentError("invalid query: unterminated quote").WithParams(start)
+}
+
+// queryParser is a recursive descent parser for the grammar:
+//
+//	or   = and { "OR" and }
+//	and  = not { ["AND"] not }
+//	not  = ("NOT" | "-") not | atom
+//	atom = "(" or ")" | [field ":"] (word | phrase | regex)
+type queryParser struct {
+	tokens  []queryToken
+	current int
+}
+
+func (p *queryParser) done() bool {
+	return p.current >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.current]
+}
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[p.current]
+	p.current++
+	return token
+}
+
+func (p *queryParser) error(format string, args ...interface{}) derrors.Error {
+	position := -1
+	if !p.done() {
+		position = p.peek().position
+	}
+	return derrors.NewInvalidArgumentError(fmt.Sprintf("invalid query: "+format, args...)).WithParams(position)
+}
+
+func (p *queryParser) parseOr() (QueryNode, derrors.Error) {
+	operands := make([]QueryNode, 0, 1)
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, node)
+		if p.done() || p.peek().tokenType != tokenOr {
+			break
+		}
+		p.next()
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &QueryOr{Operands: operands}, nil
+}
+
+func (p *queryParser) parseAnd() (QueryNode, derrors.Error) {
+	operands := make([]QueryNode, 0, 1)
+	for {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, node)
+		if p.done() {
+			break
+		}
+		tokenType := p.peek().tokenType
+		if tokenType == tokenAnd {
+			p.next()
+		} else if tokenType == tokenOr || tokenType == tokenClose {
+			break
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &QueryAnd{Operands: operands}, nil
+}
+
+func (p *queryParser) parseNot() (QueryNode, derrors.Error) {
+	if !p.done() && p.peek().tokenType == tokenNot {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNot{Operand: node}, nil
+	}
+	return p.parseAtom()
+}
+
+func (p *queryParser) parseAtom() (QueryNode, derrors.Error) {
+	if p.done() {
+		return nil, p.error("unexpected end of query")
+	}
+	token := p.next()
+	switch token.tokenType {
+	case tokenOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek().tokenType != tokenClose {
+			return nil, p.error("missing closing parenthesis")
+		}
+		p.next()
+		return node, nil
+	case tokenField:
+		if p.done() {
+			return nil, p.error("missing value for field %s", token.text)
+		}
+		term, err := p.parseValue(p.next())
+		if err != nil {
+			return nil, err
+		}
+		term.Field = QueryFields[token.text]
+		return term, nil
+	default:
+		return p.parseValue(token)
+	}
+}
+
+func (p *queryParser) parseValue(token queryToken) (*QueryTerm, derrors.Error) {
+	switch token.tokenType {
+	case tokenWord:
+		kind := WordMatch
+		if strings.ContainsAny(token.text, "*?") {
+			kind = WildcardMatch
+		}
+		return &QueryTerm{Value: token.text, Kind: kind}, nil
+	case tokenPhrase:
+		return &QueryTerm{Value: token.text, Kind: PhraseMatch}, nil
+	case tokenRegex:
+		if token.text == "" {
+			return nil, derrors.NewInvalidArgumentError("invalid query: empty regular expression").WithParams(token.position)
+		}
+		return &QueryTerm{Value: token.text, Kind: RegexMatch}, nil
+	}
+	p.current--
+	return nil, p.error("unexpected %s", token.text)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"strings"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Query", func() {
+	ginkgo.Context("ParseQuery", func() {
+		ginkgo.It("should return nil for an empty query", func() {
+			node, err := ParseQuery("  ")
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node).Should(gomega.BeNil())
+		})
+		ginkgo.It("should parse a word", func() {
+			node, err := ParseQuery("error")
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node).Should(gomega.Equal(&QueryTerm{Value: "error", Kind: WordMatch}))
+		})
+		ginkgo.It("should parse field terms", func() {
+			node, err := ParseQuery(`service_name:api message:"connection refused" message:/time(d|out)/ message:warn*`)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node).Should(gomega.Equal(&QueryAnd{Operands: []QueryNode{
+				&QueryTerm{Field: AppServiceNameField, Value: "api", Kind: WordMatch},
+				&QueryTerm{Field: MessageField, Value: "connection refused", Kind: PhraseMatch},
+				&QueryTerm{Field: MessageField, Value: "time(d|out)", Kind: RegexMatch},
+				&QueryTerm{Field: MessageField, Value: "warn*", Kind: WildcardMatch},
+			}}))
+		})
+		ginkgo.It("should give AND precedence over OR", func() {
+			node, err := ParseQuery("a b OR c AND NOT d")
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node.String()).Should(gomega.Equal("((a AND b) OR (c AND NOT d))"))
+		})
+		ginkgo.It("should parse parentheses and negations", func() {
+			node, err := ParseQuery(`-(a OR "b c") NOT -d`)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node.String()).Should(gomega.Equal(`(NOT (a OR "b c") AND NOT NOT d)`))
+		})
+		ginkgo.It("should keep colons and dashes inside words", func() {
+			node, err := ParseQuery("http://host 10:30 a-b")
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node.String()).Should(gomega.Equal("(http://host AND 10:30 AND a-b)"))
+		})
+		ginkgo.It("should unescape quotes", func() {
+			node, err := ParseQuery(`"say \"hi\"" /a\/b/`)
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node).Should(gomega.Equal(&QueryAnd{Operands: []QueryNode{
+				&QueryTerm{Value: `say "hi"`, Kind: PhraseMatch},
+				&QueryTerm{Value: "a/b", Kind: RegexMatch},
+			}}))
+		})
+		ginkgo.It("should not interpret raw Lucene syntax", func() {
+			node, err := ParseQuery("message:* _exists_:x")
+			gomega.Expect(err).Should(gomega.Succeed())
+			gomega.Expect(node).Should(gomega.Equal(&QueryAnd{Operands: []QueryNode{
+				&QueryTerm{Field: MessageField, Value: "*", Kind: WildcardMatch},
+				&QueryTerm{Value: "_exists_:x", Kind: WordMatch},
+			}}))
+		})
+		ginkgo.It("should reject malformed queries", func() {
+			for _, query := range []string{`"open`, "/open", "(a OR b", "a)", "a OR", "AND a", "NOT", "message:", "//", strings.Repeat("a", MaxQueryLength+1)} {
+				_, err := ParseQuery(query)
+				gomega.Expect(err).Should(gomega.HaveOccurred(), query)
+			}
+		})
+	})
+})
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Retention policies of the log entries
+//
+// The policies are not part of the unified logging protos yet, so they are
+// declared here with protobuf tags to be sent as gRPC messages.
+
+package entities
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nalej/derrors"
+)
+
+// RetentionScope is the set of log entries a retention policy applies to
+type RetentionScope int
+
+const (
+	// OrganizationScope are the entries of an organization
+	OrganizationScope RetentionScope = iota
+	// AppDescriptorScope are the entries of the instances of an application descriptor
+	AppDescriptorScope
+	// AppInstanceScope are the entries of an application instance
+	AppInstanceScope
+)
+
+// RetentionPolicy is the number of days the log entries of an organization, application
+// descriptor or application instance are kept. The most specific policy applies.
+type RetentionPolicy struct {
+	OrganizationId  string `protobuf:"bytes,1,opt,name=organization_id,json=organizationId,proto3" json:"organization_id,omitempty"`
+	AppDescriptorId string `protobuf:"bytes,2,opt,name=app_descriptor_id,json=appDescriptorId,proto3" json:"app_descriptor_id,omitempty"`
+	AppInstanceId   string `protobuf:"bytes,3,opt,name=app_instance_id,json=appInstanceId,proto3" json:"app_instance_id,omitempty"`
+	Days            int32  `protobuf:"varint,4,opt,name=days,proto3" json:"days,omitempty"`
+}
+
+func (p *RetentionPolicy) Reset()         { *p = RetentionPolicy{} }
+func (p *RetentionPolicy) String() string { return proto.CompactTextString(p) }
+func (*RetentionPolicy) ProtoMessage()    {}
+
+// RetentionPolicyList are the retention policies of an organization, and the number of days
+// the entries of the organization without a policy are kept, 0 for the default of the slaves
+type RetentionPolicyList struct {
+	OrganizationId string             `protobuf:"bytes,1,opt,name=organization_id,json=organizationId,proto3" json:"organization_id,omitempty"`
+	DefaultDays    int32              `protobuf:"varint,2,opt,name=default_days,json=defaultDays,proto3" json:"default_days,omitempty"`
+	Policies       []*RetentionPolicy `protobuf:"bytes,3,rep,name=policies,proto3" json:"policies,omitempty"`
+}
+
+func (l *RetentionPolicyList) Reset()         { *l = RetentionPolicyList{} }
+func (l *RetentionPolicyList) String() string { return proto.CompactTextString(l) }
+func (*RetentionPolicyList) ProtoMessage()    {}
+
+// Scope returns the scope of the policy
+func (p *RetentionPolicy) Scope() RetentionScope {
+	switch {
+	case p.AppInstanceId != "":
+		return AppInstanceScope
+	case p.AppDescriptorId != "":
+		return AppDescriptorScope
+	}
+	return OrganizationScope
+}
+
+// SameScope checks if both policies apply to the same entries
+func (p *RetentionPolicy) SameScope(other *RetentionPolicy) bool {
+	return p.OrganizationId == other.OrganizationId && p.AppDescriptorId == other.AppDescriptorId &&
+		p.AppInstanceId == other.AppInstanceId
+}
+
+// ValidateScope checks the policy has an organization and at most one application identifier
+func (p *RetentionPolicy) ValidateScope() derrors.Error {
+	if p.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError("organization_id is required")
+	}
+	if p.AppDescriptorId != "" && p.AppInstanceId != "" {
+		return derrors.NewInvalidArgumentError("app_descriptor_id and app_instance_id cannot be both set")
+	}
+	return nil
+}
+
+// Validate checks the scope and the number of days of the policy
+func (p *RetentionPolicy) Validate() derrors.Error {
+	derr := p.ValidateScope()
+	if derr != nil {
+		return derr
+	}
+	if p.Days <= 0 {
+		return derrors.NewInvalidArgumentError("days must be positive").WithParams(p.Days)
+	}
+	return nil
+}
+
+// Validate checks the policies of the list belong to its organization and have different scopes
+func (l *RetentionPolicyList) Validate() derrors.Error {
+	if l.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError("organization_id is required")
+	}
+	if l.DefaultDays < 0 {
+		return derrors.NewInvalidArgumentError("default_days cannot be negative").WithParams(l.DefaultDays)
+	}
+	for i, policy := range l.Policies {
+		derr := policy.Validate()
+		if derr != nil {
+			return derr
+		}
+		if policy.OrganizationId != l.OrganizationId {
+			return derrors.NewInvalidArgumentError("policy of another organization").WithParams(policy.OrganizationId)
+		}
+		for _, previous := range l.Policies[:i] {
+			if previous.SameScope(policy) {
+				return derrors.NewInvalidArgumentError("duplicated policy").WithParams(policy.String())
+			}
+		}
+	}
+	return nil
+}
+
+// RetentionPlan is the way a slave enforces the retention policies: the entries of the
+// policies shorter than the longest one are deleted by query, and whole indices are
+// removed when they are older than the longest policy
+type RetentionPlan struct {
+	// Requests are the expire requests of the scopes kept less than IndexDays
+	Requests []*SearchRequest
+	// IndexDays is the number of days after which whole indices are removed
+	IndexDays int
+}
+
+// NewRetentionPlan returns the plan enforcing the policies of the organizations at now. The
+// entries of an organization without a policy are kept its default days, or defaultDays if it
+// has none. Every request excludes the narrower policies of its scope, so an entry is only
+// deleted by the most specific policy that applies to it.
+func NewRetentionPlan(lists []*RetentionPolicyList, defaultDays int, now time.Time) *RetentionPlan {
+	// Sort the organizations, so the same policies always result in the same requests
+	sorted := make([]*RetentionPolicyList, len(lists))
+	copy(sorted, lists)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].OrganizationId < sorted[j].OrganizationId
+	})
+
+	longest := defaultDays
+	for _, list := range sorted {
+		if int(list.DefaultDays) > longest {
+			longest = int(list.DefaultDays)
+		}
+		for _, policy := range list.Policies {
+			if int(policy.Days) > longest {
+				longest = int(policy.Days)
+			}
+		}
+	}
+
+	plan := &RetentionPlan{
+		Requests:  make([]*SearchRequest, 0),
+		IndexDays: longest,
+	}
+	add := func(fields *FilterFields, days int, excluded []QueryNode) {
+		// Entries kept as long as the indices are removed with them
+		if days >= longest {
+			return
+		}
+		plan.Requests = append(plan.Requests, &SearchRequest{
+			Filters: fields.ToFilters(),
+			Query:   excludeQuery(excluded),
+			To:      now.AddDate(0, 0, -days).UnixNano(),
+		})
+	}
+
+	organizationTerms := make([]QueryNode, 0, len(sorted))
+	for _, list := range sorted {
+		organizationId := list.OrganizationId
+		organizationTerms = append(organizationTerms, scopeTerm(OrganizationIdField, organizationId))
+
+		organizationDays := defaultDays
+		if list.DefaultDays > 0 {
+			organizationDays = int(list.DefaultDays)
+		}
+		narrower := make([]QueryNode, 0)
+		instances := make([]QueryNode, 0)
+		for _, policy := range list.Policies {
+			switch policy.Scope() {
+			case OrganizationScope:
+				organizationDays = int(policy.Days)
+			case AppDescriptorScope:
+				narrower = append(narrower, scopeTerm(AppDescriptorField, policy.AppDescriptorId))
+			case AppInstanceScope:
+				term := scopeTerm(AppInstanceIdField, policy.AppInstanceId)
+				narrower = append(narrower, term)
+				instances = append(instances, term)
+			}
+		}
+		add(&FilterFields{OrganizationId: organizationId}, organizationDays, narrower)
+
+		// Policies of instances are not tied to a descriptor, so all of them are excluded
+		for _, policy := range list.Policies {
+			switch policy.Scope() {
+			case AppDescriptorScope:
+				add(&FilterFields{OrganizationId: organizationId, AppDescriptorId: policy.AppDescriptorId}, int(policy.Days), instances)
+			case AppInstanceScope:
+				add(&FilterFields{OrganizationId: organizationId, AppInstanceId: policy.AppInstanceId}, int(policy.Days), nil)
+			}
+		}
+	}
+	add(&FilterFields{}, defaultDays, organizationTerms)
+
+	return plan
+}
+
+// scopeTerm returns the term matching the identifier of a scope
+func scopeTerm(field Field, id string) *QueryTerm {
+	return &QueryTerm{Field: field, Value: id, Kind: WordMatch}
+}
+
+// excludeQuery returns a query matching the entries none of the nodes match, nil if there are none
+func excludeQuery(nodes []QueryNode) QueryNode {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return &QueryNot{Operand: nodes[0]}
+	}
+	return &QueryNot{Operand: &QueryOr{Operands: nodes}}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entities
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+type retentionTest struct {
+	organizationId  string
+	appDescriptorId string
+	appInstanceId   string
+	age             int
+	deleted         bool
+}
+
+var _ = ginkgo.Describe("Retention", func() {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	policies := []*RetentionPolicy{
+		{OrganizationId: "org-1", Days: 30},
+		{OrganizationId: "org-1", AppDescriptorId: "desc-1", Days: 3},
+		{OrganizationId: "org-1", AppInstanceId: "app-1", Days: 1},
+		{OrganizationId: "org-2", AppInstanceId: "app-2", Days: 60},
+	}
+	lists := []*RetentionPolicyList{
+		{OrganizationId: "org-2", DefaultDays: 5, Policies: policies[3:]},
+		{OrganizationId: "org-1", Policies: policies[:3]},
+	}
+
+	ginkgo.It("should only remove indices without policies", func() {
+		plan := NewRetentionPlan(nil, 7, now)
+		gomega.Expect(plan.Requests).Should(gomega.BeEmpty())
+		gomega.Expect(plan.IndexDays).Should(gomega.Equal(7))
+	})
+
+	ginkgo.It("should remove indices older than the longest policy", func() {
+		plan := NewRetentionPlan(lists, 7, now)
+		gomega.Expect(plan.IndexDays).Should(gomega.Equal(60))
+		// The instance kept 60 days needs no request
+		gomega.Expect(plan.Requests).Should(gomega.HaveLen(5))
+	})
+
+	ginkgo.It("should delete the entries with the most specific policy", func() {
+		tests := []retentionTest{
+			{"org-1", "desc-1", "app-1", 2, true},
+			{"org-1", "desc-1", "app-3", 2, false},
+			{"org-1", "desc-1", "app-3", 4, true},
+			{"org-1", "desc-2", "app-4", 20, false},
+			{"org-1", "desc-2", "app-4", 31, true},
+			{"org-2", "desc-3", "app-2", 59, false},
+			{"org-2", "desc-3", "app-5", 4, false},
+			{"org-2", "desc-3", "app-5", 6, true},
+			{"org-3", "desc-4", "app-6", 6, false},
+			{"org-3", "desc-4", "app-6", 8, true},
+		}
+
+		plan := NewRetentionPlan(lists, 7, now)
+		for _, test := range tests {
+			entry := &LogEntry{
+				Timestamp: now.AddDate(0, 0, -test.age).Add(-time.Hour),
+				Msg:       "message",
+				Kubernetes: KubernetesEntry{
+					Labels: KubernetesLabelsEntry{
+						OrganizationId:  test.organizationId,
+						AppDescriptorId: test.appDescriptorId,
+						AppInstanceId:   test.appInstanceId,
+					},
+				},
+			}
+			deleted := false
+			for _, request := range plan.Requests {
+				deleted = deleted || request.MatchesExpire(entry)
+			}
+			gomega.Expect(deleted).Should(gomega.Equal(test.deleted), "%s/%s/%s %d days", test.organizationId,
+				test.appDescriptorId, test.appInstanceId, test.age)
+		}
+	})
+
+	ginkgo.It("should validate policies", func() {
+		gomega.Expect((&RetentionPolicy{OrganizationId: "org-1", AppInstanceId: "app-1", Days: 1}).Validate()).Should(gomega.Succeed())
+		gomega.Expect((&RetentionPolicy{AppInstanceId: "app-1", Days: 1}).Validate()).ShouldNot(gomega.Succeed())
+		gomega.Expect((&RetentionPolicy{OrganizationId: "org-1", Days: 0}).Validate()).ShouldNot(gomega.Succeed())
+		gomega.Expect((&RetentionPolicy{OrganizationId: "org-1", AppDescriptorId: "desc-1", AppInstanceId: "app-1", Days: 1}).
+			Validate()).ShouldNot(gomega.Succeed())
+
+		list := &RetentionPolicyList{OrganizationId: "org-1", DefaultDays: 7, Policies: policies[:3]}
+		gomega.Expect(list.Validate()).Should(gomega.Succeed())
+		list.Policies = policies
+		gomega.Expect(list.Validate()).ShouldNot(gomega.Succeed())
+		list.Policies = []*RetentionPolicy{policies[0], {OrganizationId: "org-1", Days: 5}}
+		gomega.Expect(list.Validate()).ShouldNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should be sent as a protobuf message", func() {
+		list := &RetentionPolicyList{OrganizationId: "org-1", DefaultDays: 7, Policies: policies[:3]}
+		data, err := proto.Marshal(list)
+		gomega.Expect(err).Should(gomega.Succeed())
+		received := &RetentionPolicyList{}
+		gomega.Expect(proto.Unmarshal(data, received)).Should(gomega.Succeed())
+		gomega.Expect(received).Should(gomega.Equal(list))
+	})
+})
@@ -20,6 +20,8 @@ package entities
 
 import (
 	"fmt"
+
+	"github.com/nalej/derrors"
 )
 
 // SearchFilter is a mapping of keys to arrays of values - these will be used
@@ -44,22 +46,53 @@ func (s SortOrder) ToAscending() bool {
 	return false
 }
 
+// String returns the name of the sort order, as accepted by ParseSortOrder
+func (s SortOrder) String() string {
+	if s == Descending {
+		return "desc"
+	}
+	return "asc"
+}
+
+// ParseSortOrder returns the sort order with the given name, asc or desc
+func ParseSortOrder(name string) (SortOrder, derrors.Error) {
+	switch name {
+	case "asc":
+		return Ascending, nil
+	case "desc":
+		return Descending, nil
+	}
+	return Ascending, derrors.NewInvalidArgumentError("sort order must be asc or desc").WithParams(name)
+}
+
+// SortOrderFromNFirst returns the order of a search for the first entries (ascending) or the last ones (descending)
+func SortOrderFromNFirst(nFirst bool) SortOrder {
+	if nFirst {
+		return Ascending
+	}
+	return Descending
+}
+
 // SearchRequest is the structure that is used to describe the search query for the logging storage provider
 type SearchRequest struct {
 	// Filters is a map with all the fields that you want to include, the filter is a exact filter.
-	// More than one filter will result in a query that's the intersection
-	// of all the filters (AND)
+	// More than one value for a field matches any of them (OR). More than one filter will result
+	// in a query that's the intersection of all the filters (AND), unless IsUnionFilter is set
 	Filters SearchFilter
 	// Indicates to treat multiple filters as a union (OR) instead of intersection
 	IsUnionFilter bool
-	// MsgFilter is a string that filters the log entries by message text. It allows wildcards.
-	MsgFilter string
+	// Query filters the log entries by message text and labels, nil to match all the entries
+	Query QueryNode
 	// from is the beginning date in Unixnano time format.
 	From int64
 	// to is the ending date in Unixnano time format.
 	To int64
-	// NFirst flag to indicate the order
-	NFirst bool
+	// MinLevel is the minimum severity of the entries, UnknownLevel to include all of them
+	MinLevel Level
+	// Order of the entries: ascending returns the oldest entries first, descending the newest ones
+	Order SortOrder
+	// After is the cursor of the last entry of the previous page, nil for the first page
+	After *Cursor
 }
 
 // IsValid check if the search request is well-formed.
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Conformance test suite of the logging storage providers
+
+package conformance
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// Fixture is a provider under test
+type Fixture interface {
+	// Provider returns the provider, which must be empty when the fixture is created
+	Provider() loggingstorage.Provider
+	// Add stores entries, which can be searched as soon as it returns
+	Add(entries []*entities.LogEntry) derrors.Error
+	// Close removes the entries and releases the provider
+	Close()
+}
+
+// StartTime is the timestamp of the first test entry. All the entries are at whole seconds, so
+// providers can store timestamps with millisecond precision.
+var StartTime = time.Date(2020, 1, 17, 10, 0, 0, 0, time.UTC)
+
+// testEntry returns an entry of a service group instance
+func testEntry(org string, app string, sg string, offset time.Duration, message string, level entities.Level) *entities.LogEntry {
+	entry := &entities.LogEntry{
+		Timestamp: StartTime.Add(offset),
+		Msg:       message,
+		Kubernetes: entities.KubernetesEntry{
+			Namespace: org + "-" + app,
+			Labels: entities.KubernetesLabelsEntry{
+				OrganizationId:            org,
+				AppInstanceId:             app,
+				AppServiceGroupInstanceId: sg,
+			},
+		},
+	}
+	if level != entities.UnknownLevel {
+		entry.Level = level.String()
+	}
+	return entry
+}
+
+// TestEntries are the entries added to the providers, sorted by timestamp. The last one is on the next day.
+func TestEntries() []*entities.LogEntry {
+	return []*entities.LogEntry{
+		testEntry("org-1", "app-1", "sg-1", 0, "starting server", entities.InfoLevel),
+		testEntry("org-1", "app-1", "sg-2", time.Second*10, "connection refused by database", entities.ErrorLevel),
+		testEntry("org-1", "app-2", "sg-3", time.Second*20, "request served", entities.InfoLevel),
+		testEntry("org-2", "app-3", "sg-4", time.Second*30, "connection established", entities.DebugLevel),
+		testEntry("org-1", "app-1", "sg-1", time.Hour*24, "stopping server", entities.WarnLevel),
+	}
+}
+
+// DescribeProvider defines the tests every provider must pass, creating a fixture for each of them
+func DescribeProvider(name string, newFixture func() Fixture) bool {
+	return ginkgo.Describe(name+" conformance", func() {
+		var fixture Fixture
+		var provider loggingstorage.Provider
+
+		ginkgo.BeforeEach(func() {
+			fixture = newFixture()
+			provider = fixture.Provider()
+			derr := fixture.Add(TestEntries())
+			gomega.Expect(derr).Should(gomega.BeNil())
+		})
+
+		ginkgo.AfterEach(func() {
+			fixture.Close()
+		})
+
+		search := func(request *entities.SearchRequest, limit int) []string {
+			entries, derr := provider.Search(context.Background(), request, limit)
+			gomega.Expect(derr).Should(gomega.BeNil())
+			messages := make([]string, len(entries))
+			for i, entry := range entries {
+				messages[i] = entry.Msg
+			}
+			return messages
+		}
+
+		query := func(value string) entities.QueryNode {
+			node, derr := entities.ParseQuery(value)
+			gomega.Expect(derr).Should(gomega.BeNil())
+			return node
+		}
+
+		at := func(offset time.Duration) int64 {
+			return StartTime.Add(offset).UnixNano()
+		}
+
+		ginkgo.Context("filters", func() {
+			ginkgo.It("should return all the entries without filters", func() {
+				gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.HaveLen(len(TestEntries())))
+			})
+			ginkgo.It("should intersect the filters of different fields", func() {
+				gomega.Expect(search(&entities.SearchRequest{
+					Filters: entities.SearchFilter{
+						entities.OrganizationIdField: {"org-1"},
+						entities.AppInstanceIdField:  {"app-1"},
+					},
+				}, -1)).Should(gomega.Equal([]string{"starting server", "connection refused by database", "stopping server"}))
+			})
+			ginkgo.It("should match any of the values of a field", func() {
+				gomega.Expect(search(&entities.SearchRequest{
+					Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app-2", "app-3"}},
+				}, -1)).Should(gomega.Equal([]string{"request served", "connection established"}))
+			})
+			ginkgo.It("should unite the filters of different fields", func() {
+				gomega.Expect(search(&entities.SearchRequest{
+					Filters: entities.SearchFilter{
+						entities.AppInstanceIdField:          {"app-2"},
+						entities.ServiceGroupInstanceIdField: {"sg-4"},
+					},
+					IsUnionFilter: true,
+				}, -1)).Should(gomega.Equal([]string{"request served", "connection established"}))
+			})
+			ginkgo.It("should return no entries for unknown values", func() {
+				gomega.Expect(search(&entities.SearchRequest{
+					Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app-0"}},
+				}, -1)).Should(gomega.BeEmpty())
+			})
+			ginkgo.It("should filter by minimum level", func() {
+				gomega.Expect(search(&entities.SearchRequest{MinLevel: entities.WarnLevel}, -1)).Should(
+					gomega.Equal([]string{"connection refused by database", "stopping server"}))
+			})
+		})
+
+		ginkgo.Context("message", func() {
+			ginkgo.It("should match words", func() {
+				gomega.Expect(search(&entities.SearchRequest{Query: query("Connection")}, -1)).Should(
+					gomega.Equal([]string{"connection refused by database", "connection established"}))
+			})
+			ginkgo.It("should match phrases", func() {
+				gomega.Expect(search(&entities.SearchRequest{Query: query(`"refused by"`)}, -1)).Should(
+					gomega.Equal([]string{"connection refused by database"}))
+				gomega.Expect(search(&entities.SearchRequest{Query: query(`"by refused"`)}, -1)).Should(gomega.BeEmpty())
+			})
+			ginkgo.It("should combine terms and filters", func() {
+				gomega.Expect(search(&entities.SearchRequest{
+					Filters: entities.SearchFilter{entities.OrganizationIdField: {"org-1"}},
+					Query:   query("-connection OR refused"),
+				}, -1)).Should(gomega.Equal([]string{"starting server", "connection refused by database", "request served", "stopping server"}))
+				gomega.Expect(search(&entities.SearchRequest{Query: query("serv* AND NOT stopping")}, -1)).Should(
+					gomega.Equal([]string{"starting server", "request served"}))
+			})
+		})
+
+		ginkgo.Context("time range", func() {
+			ginkgo.It("should include both ends", func() {
+				gomega.Expect(search(&entities.SearchRequest{From: at(time.Second * 10), To: at(time.Second * 20)}, -1)).Should(
+					gomega.Equal([]string{"connection refused by database", "request served"}))
+			})
+			ginkgo.It("should accept open ranges", func() {
+				gomega.Expect(search(&entities.SearchRequest{From: at(time.Second * 30)}, -1)).Should(
+					gomega.Equal([]string{"connection established", "stopping server"}))
+				gomega.Expect(search(&entities.SearchRequest{To: at(time.Second * 10)}, -1)).Should(
+					gomega.Equal([]string{"starting server", "connection refused by database"}))
+			})
+		})
+
+		ginkgo.Context("order and limit", func() {
+			ginkgo.It("should return the first entries for NFirst", func() {
+				gomega.Expect(search(&entities.SearchRequest{Order: entities.SortOrderFromNFirst(true)}, 2)).Should(
+					gomega.Equal([]string{"starting server", "connection refused by database"}))
+			})
+			ginkgo.It("should return the last entries, newest first, otherwise", func() {
+				gomega.Expect(search(&entities.SearchRequest{Order: entities.SortOrderFromNFirst(false)}, 2)).Should(
+					gomega.Equal([]string{"stopping server", "connection established"}))
+			})
+			ginkgo.It("should continue after the cursor of the last entry", func() {
+				for _, order := range []entities.SortOrder{entities.Ascending, entities.Descending} {
+					request := &entities.SearchRequest{Order: order}
+					messages := make([]string, 0)
+					for {
+						entries, derr := provider.Search(context.Background(), request, 2)
+						gomega.Expect(derr).Should(gomega.BeNil())
+						if len(entries) == 0 {
+							break
+						}
+						for _, entry := range entries {
+							messages = append(messages, entry.Msg)
+						}
+						request.After = entries[len(entries)-1].Cursor
+						gomega.Expect(request.After).ShouldNot(gomega.BeNil())
+					}
+					gomega.Expect(messages).Should(gomega.Equal(search(&entities.SearchRequest{Order: order}, -1)))
+				}
+			})
+		})
+
+		ginkgo.Context("expire", func() {
+			ginkgo.It("should delete the entries of an application instance", func() {
+				derr := provider.Expire(context.Background(), &entities.SearchRequest{
+					Filters: entities.SearchFilter{
+						entities.OrganizationIdField: {"org-1"},
+						entities.AppInstanceIdField:  {"app-1"},
+					},
+				})
+				gomega.Expect(derr).Should(gomega.BeNil())
+				gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(
+					gomega.Equal([]string{"request served", "connection established"}))
+			})
+			ginkgo.It("should delete the entries of an organization until to", func() {
+				derr := provider.Expire(context.Background(), &entities.SearchRequest{
+					Filters: entities.SearchFilter{entities.OrganizationIdField: {"org-1"}},
+					To:      at(time.Second * 10),
+				})
+				gomega.Expect(derr).Should(gomega.BeNil())
+				gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(
+					gomega.Equal([]string{"request served", "connection established", "stopping server"}))
+			})
+			ginkgo.It("should keep the entries excluded by the query", func() {
+				derr := provider.Expire(context.Background(), &entities.SearchRequest{
+					Filters: entities.SearchFilter{entities.OrganizationIdField: {"org-1"}},
+					Query:   &entities.QueryNot{Operand: &entities.QueryTerm{Field: entities.AppInstanceIdField, Value: "app-2"}},
+					To:      at(time.Second * 30),
+				})
+				gomega.Expect(derr).Should(gomega.BeNil())
+				gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(
+					gomega.Equal([]string{"request served", "connection established", "stopping server"}))
+			})
+		})
+
+		ginkgo.Context("indices", func() {
+			// dayIndex returns the index of a day, which must end with it for the expire manager
+			dayIndex := func(day string) string {
+				indices, derr := provider.GetIndexList(context.Background())
+				gomega.Expect(derr).Should(gomega.BeNil())
+				for _, index := range indices {
+					if strings.HasSuffix(index, day) {
+						return index
+					}
+				}
+				return ""
+			}
+
+			ginkgo.It("should list an index for every day", func() {
+				gomega.Expect(dayIndex("2020.01.17")).ShouldNot(gomega.BeEmpty())
+				gomega.Expect(dayIndex("2020.01.18")).ShouldNot(gomega.BeEmpty())
+			})
+			ginkgo.It("should remove the entries of an index", func() {
+				index := dayIndex("2020.01.17")
+				derr := provider.RemoveIndex(context.Background(), index)
+				gomega.Expect(derr).Should(gomega.BeNil())
+				gomega.Expect(dayIndex("2020.01.17")).Should(gomega.BeEmpty())
+				gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal([]string{"stopping server"}))
+
+				// Removing it again is not an error
+				derr = provider.RemoveIndex(context.Background(), index)
+				gomega.Expect(derr).Should(gomega.BeNil())
+			})
+		})
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/internal/pkg/utils"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage"
+	"github.com/nalej/unified-logging/pkg/provider/loggingstorage/conformance"
+	"github.com/onsi/gomega"
+)
+
+type memoryFixture struct {
+	memory *loggingstorage.Memory
+}
+
+func (f *memoryFixture) Provider() loggingstorage.Provider {
+	return f.memory
+}
+
+func (f *memoryFixture) Add(entries []*entities.LogEntry) derrors.Error {
+	f.memory.Add(entries...)
+	return nil
+}
+
+func (f *memoryFixture) Close() {}
+
+var _ = conformance.DescribeProvider("Memory", func() conformance.Fixture {
+	return &memoryFixture{memory: loggingstorage.NewMemory()}
+})
+
+type localFixture struct {
+	dir   string
+	local *loggingstorage.Local
+}
+
+func (f *localFixture) Provider() loggingstorage.Provider {
+	return f.local
+}
+
+func (f *localFixture) Add(entries []*entities.LogEntry) derrors.Error {
+	return f.local.Append(entries)
+}
+
+func (f *localFixture) Close() {
+	f.local.Close()
+	os.RemoveAll(f.dir)
+}
+
+var _ = conformance.DescribeProvider("Local", func() conformance.Fixture {
+	dir, err := ioutil.TempDir("", "local-conformance")
+	gomega.Expect(err).Should(gomega.Succeed())
+	options := loggingstorage.DefaultLocalOptions()
+	options.Dir = dir
+	options.LogPath = ""
+	local, derr := loggingstorage.NewLocal(options)
+	gomega.Expect(derr).Should(gomega.BeNil())
+	return &localFixture{dir: dir, local: local}
+})
+
+/*
+RUN_INTEGRATION_TEST=true
+IT_ELASTIC_ADDRESS=localhost:9200
+*/
+
+type elasticFixture struct {
+	elastic *loggingstorage.ElasticSearchIT
+}
+
+func (f *elasticFixture) Provider() loggingstorage.Provider {
+	return f.elastic
+}
+
+func (f *elasticFixture) Add(entries []*entities.LogEntry) derrors.Error {
+	return f.elastic.AddEntries(entries)
+}
+
+func (f *elasticFixture) Close() {
+	_ = f.elastic.Clear()
+	f.elastic.Close()
+}
+
+var _ = func() bool {
+	if !utils.RunIntegrationTests() {
+		return false
+	}
+	// The cluster must not have other entries
+	elasticAddress := os.Getenv("IT_ELASTIC_ADDRESS")
+	return conformance.DescribeProvider("ElasticSearch", func() conformance.Fixture {
+		gomega.Expect(elasticAddress).ShouldNot(gomega.BeEmpty(), "missing environment variables")
+		provider := &loggingstorage.ElasticSearchIT{
+			ElasticSearch: loggingstorage.NewElasticSearch(elasticAddress, nil),
+			PrefixStr:     "conformance",
+		}
+		gomega.Expect(provider.InitEntriesTemplate()).Should(gomega.BeNil())
+		return &elasticFixture{elastic: provider}
+	})
+}()
@@ -19,45 +19,161 @@
 package loggingstorage
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/olivere/elastic"
 )
 
-func getLogEntries(searchResult *elastic.SearchResult) (entities.LogEntries, derrors.Error) {
-	num := searchResult.Hits.TotalHits
-	log.Debug().Int64("hits", num).Int("hits_len", len(searchResult.Hits.Hits)).Msg("matching log lines found")
+// tiebreakerField is a unique field to sort entries with the same timestamp, used by search_after.
+// It is written by the ingest pipeline, so entries indexed before it was installed have none.
+const tiebreakerField = "event_id"
 
-	result := make(entities.LogEntries, len(searchResult.Hits.Hits))
+// tiebreakerSort sorts on the tiebreaker field. Entries without it, or indices where it is not
+// mapped yet, sort with an empty tiebreaker instead of failing the search.
+func tiebreakerSort(ascending bool) elastic.SortInfo {
+	return elastic.SortInfo{
+		Field:        tiebreakerField,
+		Ascending:    ascending,
+		Missing:      "",
+		UnmappedType: "keyword",
+	}
+}
+
+// getLogEntries returns the log entries of the hits of a search
+func getLogEntries(hits []*elastic.SearchHit) (entities.LogEntries, derrors.Error) {
+	log.Debug().Int("hits_len", len(hits)).Msg("log lines returned")
 
-	for k, hit := range searchResult.Hits.Hits {
+	result := make(entities.LogEntries, len(hits))
+
+	for k, hit := range hits {
 		var entry entities.LogEntry
 		err := json.Unmarshal(*hit.Source, &entry)
 		if err != nil {
 			return nil, derrors.NewInternalError("elastic document deserialization error", err)
 		}
+		entry.Cursor = getCursor(hit)
 		result[k] = &entry
 	}
 
 	return result, nil
 }
 
-func createFilterQuery(filters entities.SearchFilter) *elastic.BoolQuery {
-	// Determine if we need one or all filters to match
+// getCursor returns the cursor of a hit from its sort values, or nil if it was not sorted as expected
+func getCursor(hit *elastic.SearchHit) *entities.Cursor {
+	if len(hit.Sort) != 2 {
+		return nil
+	}
+	var timestamp int64
+	switch value := hit.Sort[0].(type) {
+	case float64:
+		timestamp = int64(value)
+	case json.Number:
+		number, err := value.Int64()
+		if err != nil {
+			return nil
+		}
+		timestamp = number
+	default:
+		return nil
+	}
+	tiebreaker, ok := hit.Sort[1].(string)
+	if !ok {
+		return nil
+	}
+	return &entities.Cursor{
+		Timestamp:  timestamp,
+		Tiebreaker: tiebreaker,
+	}
+}
+
+// createFilterQuery returns a query matching the filters and minimum level of a request. A field
+// matches any of its values, and the fields are combined with OR for a union and with AND for an
+// intersection. The minimum level always applies.
+func createFilterQuery(request *entities.SearchRequest) *elastic.BoolQuery {
 	query := elastic.NewBoolQuery()
+	filters := request.Filters
+	isUnion := request.IsUnionFilter
+
+	// Sort the fields, so the same filters always result in the same query
+	fields := make([]entities.Field, 0, len(filters))
+	for field := range filters {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i] < fields[j]
+	})
 
 	// Build filter query
-	for k, values := range filters {
+	clauses := 0
+	for _, field := range fields {
+		values := filters[field]
 		if len(values) == 0 {
 			continue
 		}
+		fieldQuery := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
 		for _, v := range values {
-			query = query.Must(elastic.NewTermQuery(k.String(), v))
+			fieldQuery = fieldQuery.Should(elastic.NewTermQuery(field.String(), v))
+		}
+		// Determine if we need one or all filters to match
+		if isUnion {
+			query = query.Should(fieldQuery)
+		} else {
+			query = query.Must(fieldQuery)
 		}
+		clauses++
+	}
+
+	// Without clauses a minimum would match nothing
+	if isUnion && clauses > 0 {
+		query = query.MinimumNumberShouldMatch(1)
+	}
+
+	// Entries without a known level have no severity, so they are excluded
+	if request.MinLevel != entities.UnknownLevel {
+		query = query.Must(elastic.NewRangeQuery(entities.SeverityField.String()).Gte(int(request.MinLevel)))
+	}
+
+	return query
+}
+
+// createSearchQuery returns the query of a search request: its filters, query and time range
+func createSearchQuery(request *entities.SearchRequest) *elastic.BoolQuery {
+	query := createFilterQuery(request)
+
+	// Add the query on the log line and its labels
+	if request.Query != nil {
+		query = query.Must(createQuery(request.Query))
+	}
+
+	// Add time constraints
+	if request.From != 0 || request.To != 0 {
+		query = query.Must(createTimeQuery(request.From, request.To))
+	}
+
+	return query
+}
+
+// createExpireQuery returns the query of the entries to delete: the ones matching the filters and query until To
+func createExpireQuery(request *entities.SearchRequest) *elastic.BoolQuery {
+	query := createFilterQuery(request)
+
+	if request.Query != nil {
+		query = query.Must(createQuery(request.Query))
+	}
+
+	// Delete a specific time range (delete until to)
+	if request.To != 0 {
+		query = query.Must(createTimeQuery(0, request.To))
 	}
 
 	return query
@@ -75,6 +191,111 @@ func createTimeQuery(from, to int64) elastic.Query {
 	return query
 }
 
+// expireIndices returns the indices of the expirations in multi-target syntax, all if there are no patterns
+func expireIndices(patterns []string) string {
+	if len(patterns) == 0 {
+		return "_all"
+	}
+	return strings.Join(patterns, ",")
+}
+
+// parseBytes returns the number of bytes of a cat API size requested in bytes, 0 if there is none
+func parseBytes(value string) int64 {
+	bytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return bytes
+}
+
+// parseCount returns a cat API count, 0 if there is none
+func parseCount(value string) int64 {
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// diskUsage adds the disk usage of the nodes of the cluster, nil if none reports it
+func diskUsage(used []string, total []string) *DiskUsage {
+	usage := &DiskUsage{}
+	for i := range used {
+		usage.UsedBytes += parseBytes(used[i])
+		usage.TotalBytes += parseBytes(total[i])
+	}
+	if usage.TotalBytes == 0 {
+		return nil
+	}
+	return usage
+}
+
+// creationDateSetting is the index setting with its creation time, in milliseconds
+const creationDateSetting = "index.creation_date"
+
+// creationDates returns the creation time of the indices from their flat settings, skipping
+// the ones without it
+func creationDates(settings map[string]map[string]interface{}) map[string]time.Time {
+	dates := make(map[string]time.Time, len(settings))
+	for index, values := range settings {
+		value, ok := values[creationDateSetting].(string)
+		if !ok {
+			continue
+		}
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		dates[index] = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+	}
+	return dates
+}
+
+// expireTaskResponse is the response of the tasks API for a delete by query task
+type expireTaskResponse struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status struct {
+			Total   int64 `json:"total"`
+			Deleted int64 `json:"deleted"`
+		} `json:"status"`
+	} `json:"task"`
+	// Response is only set once the task is completed
+	Response *struct {
+		Total    int64             `json:"total"`
+		Deleted  int64             `json:"deleted"`
+		Failures []json.RawMessage `json:"failures"`
+	} `json:"response"`
+	// Error is only set if the task could not complete
+	Error *elastic.ErrorDetails `json:"error"`
+}
+
+// expireTask returns the progress of a delete by query task from the response of the tasks API
+func expireTask(body []byte) (*ExpireTask, derrors.Error) {
+	response := &expireTaskResponse{}
+	err := json.Unmarshal(body, response)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot decode expire task", err)
+	}
+	task := &ExpireTask{
+		Completed: response.Completed,
+		Total:     response.Task.Status.Total,
+		Deleted:   response.Task.Status.Deleted,
+		Failures:  make([]string, 0),
+	}
+	if response.Response != nil {
+		task.Total = response.Response.Total
+		task.Deleted = response.Response.Deleted
+		for _, failure := range response.Response.Failures {
+			task.Failures = append(task.Failures, string(failure))
+		}
+	}
+	if response.Error != nil {
+		task.Failures = append(task.Failures, fmt.Sprintf("%s: %s", response.Error.Type, response.Error.Reason))
+	}
+	return task, nil
+}
+
 // Debug output for query string
 func queryDebug(query elastic.Query) {
 	if d := log.Debug(); d.Enabled() {
@@ -87,3 +308,31 @@ func queryDebug(query elastic.Query) {
 		}
 	}
 }
+
+// elasticRetrier retries failed requests with exponential backoff up to a maximum number of retries
+type elasticRetrier struct {
+	maxRetries int
+	backoff    elastic.Backoff
+}
+
+func newElasticRetrier(maxRetries int, initial time.Duration, max time.Duration) *elasticRetrier {
+	return &elasticRetrier{
+		maxRetries: maxRetries,
+		backoff:    elastic.NewExponentialBackoff(initial, max),
+	}
+}
+
+func (r *elasticRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.maxRetries {
+		return 0, false, nil
+	}
+	wait, ok := r.backoff.Next(retry)
+	return wait, ok, nil
+}
+
+// elasticLogger sends the errors reported by the elastic client to our log
+type elasticLogger struct{}
+
+func (l elasticLogger) Printf(format string, v ...interface{}) {
+	log.Warn().Str("source", "elastic").Msg(fmt.Sprintf(format, v...))
+}
@@ -16,6 +16,15 @@
 
 package loggingstorage
 
+import (
+	"encoding/json"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/olivere/elastic"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
 const (
 	OrganizationId         = "77b5425b-4276-45b8-85f4-c01f74bbc376"
 	AppInstanceId          = "e5a51a0b-63ea-4736-8c1c-be3d423f28f0"
@@ -23,6 +32,151 @@ const (
 	ServiceGroupInstanceId = "413654be-3c62-48cd-beb5-86d09462a1dc"
 )
 
+// filterQueryTest is a createFilterQuery test case
+type filterQueryTest struct {
+	description string
+	filters     entities.SearchFilter
+	isUnion     bool
+	minLevel    entities.Level
+	expected    elastic.Query
+}
+
+// anyOf returns the query matching any of the values of a field
+func anyOf(field entities.Field, values ...string) *elastic.BoolQuery {
+	query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, value := range values {
+		query = query.Should(elastic.NewTermQuery(field.String(), value))
+	}
+	return query
+}
+
+var filterQueryTests = []filterQueryTest{
+	{
+		description: "an empty union",
+		filters:     entities.SearchFilter{},
+		isUnion:     true,
+		expected:    elastic.NewBoolQuery(),
+	},
+	{
+		description: "an empty intersection",
+		filters:     entities.SearchFilter{},
+		isUnion:     false,
+		expected:    elastic.NewBoolQuery(),
+	},
+	{
+		description: "a union",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField:         []string{OrganizationId},
+			entities.AppInstanceIdField:          []string{AppInstanceId},
+			entities.ServiceGroupInstanceIdField: []string{ServiceGroupInstanceId},
+		},
+		isUnion: true,
+		expected: elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+			anyOf(entities.AppInstanceIdField, AppInstanceId),
+			anyOf(entities.OrganizationIdField, OrganizationId),
+			anyOf(entities.ServiceGroupInstanceIdField, ServiceGroupInstanceId),
+		),
+	},
+	{
+		description: "an intersection",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField:         []string{OrganizationId},
+			entities.AppInstanceIdField:          []string{AppInstanceId},
+			entities.ServiceGroupInstanceIdField: []string{ServiceGroupInstanceId},
+		},
+		isUnion: false,
+		expected: elastic.NewBoolQuery().Must(
+			anyOf(entities.AppInstanceIdField, AppInstanceId),
+			anyOf(entities.OrganizationIdField, OrganizationId),
+			anyOf(entities.ServiceGroupInstanceIdField, ServiceGroupInstanceId),
+		),
+	},
+	{
+		description: "a union with multiple filter values",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField: []string{OrganizationId},
+			entities.AppInstanceIdField:  []string{AppInstanceId, AppInstanceId2},
+		},
+		isUnion: true,
+		expected: elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+			anyOf(entities.AppInstanceIdField, AppInstanceId, AppInstanceId2),
+			anyOf(entities.OrganizationIdField, OrganizationId),
+		),
+	},
+	{
+		description: "an intersection with multiple filter values",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField: []string{OrganizationId},
+			entities.AppInstanceIdField:  []string{AppInstanceId, AppInstanceId2},
+		},
+		isUnion: false,
+		expected: elastic.NewBoolQuery().Must(
+			anyOf(entities.AppInstanceIdField, AppInstanceId, AppInstanceId2),
+			anyOf(entities.OrganizationIdField, OrganizationId),
+		),
+	},
+	{
+		description: "a union with a minimum level",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField: []string{OrganizationId},
+			entities.AppInstanceIdField:  []string{AppInstanceId},
+		},
+		isUnion:  true,
+		minLevel: entities.WarnLevel,
+		expected: elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+			anyOf(entities.AppInstanceIdField, AppInstanceId),
+			anyOf(entities.OrganizationIdField, OrganizationId),
+		).Must(elastic.NewRangeQuery(entities.SeverityField.String()).Gte(int(entities.WarnLevel))),
+	},
+	{
+		description: "an intersection with a minimum level",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField: []string{OrganizationId},
+		},
+		isUnion:  false,
+		minLevel: entities.ErrorLevel,
+		expected: elastic.NewBoolQuery().Must(
+			anyOf(entities.OrganizationIdField, OrganizationId),
+			elastic.NewRangeQuery(entities.SeverityField.String()).Gte(int(entities.ErrorLevel)),
+		),
+	},
+	{
+		description: "an intersection skipping fields without values",
+		filters: entities.SearchFilter{
+			entities.OrganizationIdField: []string{OrganizationId},
+			entities.AppInstanceIdField:  []string{},
+		},
+		isUnion: false,
+		expected: elastic.NewBoolQuery().Must(
+			anyOf(entities.OrganizationIdField, OrganizationId),
+		),
+	},
+}
+
+var _ = ginkgo.Describe("createFilterQuery", func() {
+	for _, test := range filterQueryTests {
+		test := test
+		ginkgo.It("should create "+test.description, func() {
+			request := &entities.SearchRequest{
+				Filters:       test.filters,
+				IsUnionFilter: test.isUnion,
+				MinLevel:      test.minLevel,
+			}
+			q, err := createFilterQuery(request).Source()
+			gomega.Expect(err).Should(gomega.Succeed())
+			jsonQ, err := json.Marshal(q)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			expected, err := test.expected.Source()
+			gomega.Expect(err).Should(gomega.Succeed())
+			jsonE, err := json.Marshal(expected)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			gomega.Expect(jsonQ).Should(gomega.MatchJSON(jsonE))
+		})
+	}
+})
+
 /*
 var jsonResult = []byte(`
 {"took":4,"timed_out":false,"_shards":{"total":10,"successful":10,"skipped":0,"failed":0},"hits":{"total":15987,"max_score":1.0,"hits":[{"_index":"filebeat-6.6.0-2019.02.20","_type":"doc","_id":"fe8bDGkBNkPZggIxE_ej","_score":1.0,"_source":{"@timestamp":"2019-02-20T16:06:25.276Z","host":{"name":"filebeat-ltk7p"},"message":"Logline 1","stream":"stderr","kubernetes":{"namespace":"77b5425b-4276-45b8-85f4-c01f74bbc376-e5a51a0b-63ea-4736-8c1c-be","labels":{"nalej-service-group-id":"f15b707c-280f-4670-b502-903e59b6dcdd","nalej-stage-id":"f2a0d800-a65f-4067-93be-23ddbc2814df","nalej-organization":"77b5425b-4276-45b8-85f4-c01f74bbc376","app":"simple-mysql","nalej-service-id":"38d0328c-4d2b-4915-8aba-7bad6b374639","nalej-app-descriptor":"5500140c-72ff-41e3-8384-2ec7f7a6a601","nalej-service-instance-id":"f84a48f5-9d53-4fb1-916c-b3010a3496db","pod-template-hash":"d7674595c","component":"simple-app","nalej-service-group-instance-id":"413654be-3c62-48cd-beb5-86d09462a1dc","nalej-app-instance-id":"e5a51a0b-63ea-4736-8c1c-be3d423f28f0"}},"beat":{"hostname":"filebeat-ltk7p","version":"6.6.0","name":"filebeat-ltk7p"}}},{"_index":"filebeat-6.6.0-2019.02.20","_type":"doc","_id":"ge8bDGkBNkPZggIxE_ej","_score":1.0,"_source":{"@timestamp":"2019-02-20T16:06:25.278Z","beat":{"hostname":"filebeat-ltk7p","version":"6.6.0","name":"filebeat-ltk7p"},"host":{"name":"filebeat-ltk7p"},"message":"Logline 2","stream":"stderr","kubernetes":{"namespace":"77b5425b-4276-45b8-85f4-c01f74bbc376-e5a51a0b-63ea-4736-8c1c-be","labels":{"nalej-service-group-instance-id":"413654be-3c62-48cd-beb5-86d09462a1dc","nalej-organization":"77b5425b-4276-45b8-85f4-c01f74bbc376","component":"simple-app","nalej-app-descriptor":"5500140c-72ff-41e3-8384-2ec7f7a6a601","app":"simple-mysql","nalej-service-id":"38d0328c-4d2b-4915-8aba-7bad6b374639","nalej-service-group-id":"f15b707c-280f-4670-b502-903e59b6dcdd","nalej-stage-id":"f2a0d800-a65f-4067-93be-23ddbc2814df","nalej-service-instance-id":"f84a48f5-9d53-4fb1-916c-b3010a3496db","pod-template-hash":"d7674595c","nalej-app-instance-id":"e5a51a0b-63ea-4736-8c1c-be3d423f28f0"}}}}]}}
@@ -82,17 +236,17 @@ var _ = ginkgo.Describe("elastic_helpers", func() {
 
 	ginkgo.Context("getLogEntries", func() {
 		ginkgo.It("should convert elastic results into LogEntries", func() {
-			res, err := getLogEntries(validResult)
+			res, err := getLogEntries(validResult.Hits.Hits)
 			gomega.Expect(err).Should(gomega.Succeed())
 			gomega.Expect(res).Should(gomega.HaveLen(2))
 			gomega.Expect(res).Should(gomega.BeEquivalentTo(logEntries))
 		})
 		ginkgo.It("should error on malformed resulst", func() {
-			_, err := getLogEntries(badResult)
+			_, err := getLogEntries(badResult.Hits.Hits)
 			gomega.Expect(err).Should(gomega.HaveOccurred())
 		})
 		ginkgo.It("should handle empty result set", func() {
-			res, err := getLogEntries(emptyResult)
+			res, err := getLogEntries(emptyResult.Hits.Hits)
 			gomega.Expect(err).Should(gomega.Succeed())
 			gomega.Expect(res).Should(gomega.BeEmpty())
 		})
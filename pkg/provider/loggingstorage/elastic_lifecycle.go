@@ -0,0 +1,350 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Index lifecycle management of the log indices
+
+package loggingstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/olivere/elastic"
+	"github.com/rs/zerolog/log"
+)
+
+// lifecycleNameSetting and lifecycleAliasSetting are the index settings of the lifecycle policy
+const (
+	lifecycleNameSetting  = "index.lifecycle.name"
+	lifecycleAliasSetting = "index.lifecycle.rollover_alias"
+)
+
+// LifecyclePolicy is the lifecycle of the log indices written through a rollover alias: the
+// index being written is rolled over by size or age, and indices are deleted some time after
+type LifecyclePolicy struct {
+	// Name of the policy, of its index template and of the rollover alias the entries are written to
+	Name string
+	// RolloverBytes is the size of the primary shards over which the index is rolled over, 0 for no limit
+	RolloverBytes int64
+	// RolloverAge is the age after which the index is rolled over, 0 for no limit
+	RolloverAge time.Duration
+	// DeleteAfter is the time after the rollover at which an index is deleted
+	DeleteAfter time.Duration
+}
+
+// Validate checks the policy has a name, a rollover condition and a deletion age
+func (p *LifecyclePolicy) Validate() derrors.Error {
+	if p.Name == "" {
+		return derrors.NewInvalidArgumentError("lifecycle policy name is required")
+	}
+	if p.RolloverBytes < 0 || p.RolloverAge < 0 || (p.RolloverBytes == 0 && p.RolloverAge == 0) {
+		return derrors.NewInvalidArgumentError("lifecycle policy needs a rollover size or age").WithParams(p.Name)
+	}
+	if p.DeleteAfter <= 0 {
+		return derrors.NewInvalidArgumentError("lifecycle policy deletion age must be positive").WithParams(p.Name)
+	}
+	return nil
+}
+
+// IndexPattern returns the pattern of the indices of the policy
+func (p *LifecyclePolicy) IndexPattern() string {
+	return fmt.Sprintf("%s-*", p.Name)
+}
+
+// phases returns the phases of the policy
+func (p *LifecyclePolicy) phases() map[string]interface{} {
+	rollover := map[string]interface{}{}
+	if p.RolloverBytes > 0 {
+		rollover["max_size"] = elasticByteSize(p.RolloverBytes)
+	}
+	if p.RolloverAge > 0 {
+		rollover["max_age"] = elasticTimeValue(p.RolloverAge)
+	}
+	return map[string]interface{}{
+		"hot": map[string]interface{}{
+			"min_age": "0ms",
+			"actions": map[string]interface{}{"rollover": rollover},
+		},
+		"delete": map[string]interface{}{
+			"min_age": elasticTimeValue(p.DeleteAfter),
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		},
+	}
+}
+
+// elasticTimeValue returns a duration in the largest exact unit, as Elasticsearch keeps it
+func elasticTimeValue(duration time.Duration) string {
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", time.Hour * 24}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}}
+	for _, unit := range units {
+		if duration >= unit.size && duration%unit.size == 0 {
+			return fmt.Sprintf("%d%s", duration/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", duration/time.Millisecond)
+}
+
+// elasticByteSize returns a size in the largest exact unit, as Elasticsearch keeps it
+func elasticByteSize(bytes int64) string {
+	for _, suffix := range []string{"b", "kb", "mb", "gb", "tb"} {
+		if bytes%1024 != 0 || suffix == "tb" {
+			return fmt.Sprintf("%d%s", bytes, suffix)
+		}
+		bytes /= 1024
+	}
+	return ""
+}
+
+// parseElasticTimeValue returns the duration of an Elasticsearch time value, 0 if empty and
+// -1 if malformed
+func parseElasticTimeValue(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	// Longer suffixes first, as ms ends with s
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{{"nanos", time.Nanosecond}, {"micros", time.Microsecond}, {"ms", time.Millisecond},
+		{"s", time.Second}, {"m", time.Minute}, {"h", time.Hour}, {"d", time.Hour * 24}}
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, err := strconv.ParseInt(strings.TrimSuffix(value, unit.suffix), 10, 64)
+			if err != nil || number < 0 {
+				return -1
+			}
+			return time.Duration(number) * unit.size
+		}
+	}
+	return -1
+}
+
+// parseElasticByteSize returns the bytes of an Elasticsearch byte size, 0 if empty and -1 if malformed
+func parseElasticByteSize(value string) int64 {
+	if value == "" {
+		return 0
+	}
+	// Longer suffixes first, as kb ends with b
+	units := []struct {
+		suffix string
+		size   float64
+	}{{"pb", 1 << 50}, {"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"p", 1 << 50}, {"t", 1 << 40}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1}}
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, err := strconv.ParseFloat(strings.TrimSuffix(value, unit.suffix), 64)
+			if err != nil || number < 0 {
+				return -1
+			}
+			return int64(number * unit.size)
+		}
+	}
+	return -1
+}
+
+// lifecyclePolicyResponse is the part of a lifecycle policy returned by Elasticsearch that the
+// slave sets. Newer versions add fields, as delete_searchable_snapshot, that are not decoded.
+type lifecyclePolicyResponse struct {
+	Policy struct {
+		Phases struct {
+			Hot struct {
+				MinAge  string `json:"min_age"`
+				Actions struct {
+					Rollover *struct {
+						MaxSize string `json:"max_size"`
+						MaxAge  string `json:"max_age"`
+					} `json:"rollover"`
+				} `json:"actions"`
+			} `json:"hot"`
+			Delete struct {
+				MinAge  string `json:"min_age"`
+				Actions struct {
+					Delete *json.RawMessage `json:"delete"`
+				} `json:"actions"`
+			} `json:"delete"`
+		} `json:"phases"`
+	} `json:"policy"`
+}
+
+// matches checks if the installed policy rolls over and deletes the indices as policy does.
+// Sizes and durations are compared by value, as they can be written in other units.
+func (r *lifecyclePolicyResponse) matches(policy *LifecyclePolicy) bool {
+	phases := r.Policy.Phases
+	rollover := phases.Hot.Actions.Rollover
+	if rollover == nil || phases.Delete.Actions.Delete == nil {
+		return false
+	}
+	return parseElasticTimeValue(phases.Hot.MinAge) == 0 &&
+		parseElasticByteSize(rollover.MaxSize) == policy.RolloverBytes &&
+		parseElasticTimeValue(rollover.MaxAge) == policy.RolloverAge &&
+		parseElasticTimeValue(phases.Delete.MinAge) == policy.DeleteAfter
+}
+
+// ReconcileLifecycle installs the lifecycle policy, its index template and the first index of
+// its rollover alias, updating the policy and the template if they drifted. It returns whether
+// anything changed, and an unimplemented error if the cluster has no index lifecycle management,
+// like the OSS distribution.
+func (es *ElasticSearch) ReconcileLifecycle(ctx context.Context, policy *LifecyclePolicy) (bool, derrors.Error) {
+	derr := policy.Validate()
+	if derr != nil {
+		return false, derr
+	}
+	client, derr := es.Connect()
+	if derr != nil {
+		return false, derr
+	}
+
+	changed := false
+	steps := []func(context.Context, *elastic.Client, *LifecyclePolicy) (bool, derrors.Error){
+		es.reconcilePolicy, es.reconcileTemplate, es.bootstrapAlias,
+	}
+	for _, step := range steps {
+		stepChanged, derr := step(ctx, client, policy)
+		if derr != nil {
+			return changed, derr
+		}
+		changed = changed || stepChanged
+	}
+	return changed, nil
+}
+
+// reconcilePolicy creates the lifecycle policy, or updates it if its rollover or deletion are different
+func (es *ElasticSearch) reconcilePolicy(ctx context.Context, client *elastic.Client, policy *LifecyclePolicy) (bool, derrors.Error) {
+	path := fmt.Sprintf("/_ilm/policy/%s", policy.Name)
+	getCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	response, err := client.PerformRequest(getCtx, elastic.PerformRequestOptions{
+		Method:       http.MethodGet,
+		Path:         path,
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		// Clusters without lifecycle management have no handler for its endpoints
+		if elastic.IsStatusCode(err, http.StatusBadRequest) {
+			return false, derrors.NewUnimplementedError("index lifecycle management is not available", err)
+		}
+		return false, es.requestError("error getting lifecycle policy", err)
+	}
+
+	if response.StatusCode != http.StatusNotFound {
+		current := make(map[string]*lifecyclePolicyResponse)
+		err = json.Unmarshal(response.Body, &current)
+		if err != nil {
+			return false, derrors.NewInternalError("error decoding lifecycle policy", err).WithParams(policy.Name)
+		}
+		if installed, exists := current[policy.Name]; exists && installed.matches(policy) {
+			return false, nil
+		}
+	}
+
+	phases := policy.phases()
+	putCtx, putCancel := es.requestContext(ctx)
+	defer putCancel()
+	_, err = client.PerformRequest(putCtx, elastic.PerformRequestOptions{
+		Method: http.MethodPut,
+		Path:   path,
+		Body:   map[string]interface{}{"policy": map[string]interface{}{"phases": phases}},
+	})
+	if err != nil {
+		return false, es.requestError("error putting lifecycle policy", err)
+	}
+	log.Info().Str("policy", policy.Name).Interface("phases", phases).Msg("lifecycle policy installed")
+	return true, nil
+}
+
+// reconcileTemplate creates the index template applying the policy to its indices, or updates
+// it if its patterns or lifecycle settings are different
+func (es *ElasticSearch) reconcileTemplate(ctx context.Context, client *elastic.Client, policy *LifecyclePolicy) (bool, derrors.Error) {
+	getCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	templates, err := client.IndexGetTemplate(policy.Name).FlatSettings(true).Do(getCtx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return false, es.requestError("error getting index template", err)
+	}
+	if template, exists := templates[policy.Name]; exists &&
+		reflect.DeepEqual(template.IndexPatterns, []string{policy.IndexPattern()}) &&
+		template.Settings[lifecycleNameSetting] == policy.Name && template.Settings[lifecycleAliasSetting] == policy.Name {
+		return false, nil
+	}
+
+	putCtx, putCancel := es.requestContext(ctx)
+	defer putCancel()
+	_, err = client.IndexPutTemplate(policy.Name).BodyJson(map[string]interface{}{
+		"index_patterns": []string{policy.IndexPattern()},
+		"settings": map[string]interface{}{
+			lifecycleNameSetting:  policy.Name,
+			lifecycleAliasSetting: policy.Name,
+		},
+	}).Do(putCtx)
+	if err != nil {
+		return false, es.requestError("error putting index template", err)
+	}
+	log.Info().Str("template", policy.Name).Str("pattern", policy.IndexPattern()).Msg("lifecycle index template installed")
+	return true, nil
+}
+
+// bootstrapAlias creates the first index of the policy, with the rollover alias to write to it,
+// if the alias does not exist
+func (es *ElasticSearch) bootstrapAlias(ctx context.Context, client *elastic.Client, policy *LifecyclePolicy) (bool, derrors.Error) {
+	aliasCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	response, err := client.PerformRequest(aliasCtx, elastic.PerformRequestOptions{
+		Method:       http.MethodGet,
+		Path:         fmt.Sprintf("/_alias/%s", policy.Name),
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return false, es.requestError("error getting rollover alias", err)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		return false, nil
+	}
+
+	existsCtx, existsCancel := es.requestContext(ctx)
+	defer existsCancel()
+	exists, err := client.IndexExists(policy.Name).Do(existsCtx)
+	if err != nil {
+		return false, es.requestError("error checking rollover alias", err)
+	}
+	if exists {
+		return false, derrors.NewFailedPreconditionError("an index has the name of the rollover alias").WithParams(policy.Name)
+	}
+
+	index := fmt.Sprintf("%s-000001", policy.Name)
+	createCtx, createCancel := es.requestContext(ctx)
+	defer createCancel()
+	_, err = client.CreateIndex(index).BodyJson(map[string]interface{}{
+		"aliases": map[string]interface{}{
+			policy.Name: map[string]interface{}{"is_write_index": true},
+		},
+	}).Do(createCtx)
+	if err != nil {
+		return false, es.requestError("error creating the first index of the rollover alias", err)
+	}
+	log.Info().Str("index", index).Str("alias", policy.Name).Msg("rollover alias created")
+	return true, nil
+}
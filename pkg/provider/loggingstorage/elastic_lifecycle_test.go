@@ -0,0 +1,170 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// installedPolicy is the response of Elasticsearch with the policy of the tests
+const installedPolicy = `{"filebeat":{"version":1,"modified_date":"2020-01-01T00:00:00.000Z","policy":{"phases":{
+	"hot":{"min_age":"0ms","actions":{"rollover":{"max_size":"5gb","max_age":"1d"}}},
+	"delete":{"min_age":"7d","actions":{"delete":{}}}}}}}`
+
+// elastic7Policy is the response of an Elasticsearch 7 cluster with the policy of the tests, written
+// with other units by another tool, and the fields it adds
+const elastic7Policy = `{"filebeat":{"version":4,"modified_date":"2020-03-02T10:24:11.531Z","policy":{"phases":{
+	"hot":{"min_age":"0ms","actions":{"rollover":{"max_size":"5120mb","max_age":"24h"},"set_priority":{"priority":100}}},
+	"delete":{"min_age":"168h","actions":{"delete":{"delete_searchable_snapshot":true}}}}}}}`
+
+var _ = ginkgo.Describe("ElasticSearch lifecycle", func() {
+	var server *httptest.Server
+	var requests []storageRequest
+	var provider *ElasticSearch
+	policy := &LifecyclePolicy{
+		Name:          "filebeat",
+		RolloverBytes: 5 * 1024 * 1024 * 1024,
+		RolloverAge:   time.Hour * 24,
+		DeleteAfter:   time.Hour * 24 * 7,
+	}
+
+	start := func(storage *httptest.Server) {
+		server = storage
+		options := DefaultElasticSearchOptions()
+		options.HealthcheckInterval = 0
+		options.MaxRetries = 0
+		provider = NewElasticSearch(strings.TrimPrefix(server.URL, "http://"), options)
+	}
+
+	// changes returns the requests that are not reads
+	changes := func() []string {
+		result := make([]string, 0)
+		for _, request := range requests {
+			if request.method != http.MethodGet && request.method != http.MethodHead {
+				result = append(result, request.method+" "+request.path)
+			}
+		}
+		return result
+	}
+
+	ginkgo.BeforeEach(func() {
+		requests = []storageRequest{}
+	})
+
+	ginkgo.AfterEach(func() {
+		provider.Close()
+		server.Close()
+	})
+
+	ginkgo.It("should install the policy, the template and the first index", func() {
+		start(newStorageServer(map[string]string{
+			"PUT /_ilm/policy/filebeat": `{"acknowledged":true}`,
+			"PUT /_template/filebeat":   `{"acknowledged":true}`,
+			"PUT /filebeat-000001":      `{"acknowledged":true,"index":"filebeat-000001"}`,
+		}, &requests))
+		changed, derr := provider.ReconcileLifecycle(context.Background(), policy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(changed).Should(gomega.BeTrue())
+		gomega.Expect(changes()).Should(gomega.Equal([]string{
+			"PUT /_ilm/policy/filebeat", "PUT /_template/filebeat", "PUT /filebeat-000001",
+		}))
+		gomega.Expect(requests[1].body).Should(gomega.ContainSubstring(`"max_size":"5gb"`))
+		gomega.Expect(requests[3].body).Should(gomega.ContainSubstring(`"index.lifecycle.rollover_alias":"filebeat"`))
+		gomega.Expect(requests[len(requests)-1].body).Should(gomega.ContainSubstring(`"is_write_index":true`))
+	})
+
+	ginkgo.It("should only update what drifted", func() {
+		responses := map[string]string{
+			"GET /_ilm/policy/filebeat": installedPolicy,
+			"GET /_template/filebeat": `{"filebeat":{"order":0,"index_patterns":["filebeat-*"],"settings":{
+				"index.lifecycle.name":"filebeat","index.lifecycle.rollover_alias":"filebeat"},"mappings":{},"aliases":{}}}`,
+			"GET /_alias/filebeat":      `{"filebeat-000003":{"aliases":{"filebeat":{"is_write_index":true}}}}`,
+			"PUT /_ilm/policy/filebeat": `{"acknowledged":true}`,
+		}
+		start(newStorageServer(responses, &requests))
+		changed, derr := provider.ReconcileLifecycle(context.Background(), policy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(changed).Should(gomega.BeFalse())
+		gomega.Expect(changes()).Should(gomega.BeEmpty())
+
+		drifted := *policy
+		drifted.DeleteAfter = time.Hour * 24 * 30
+		changed, derr = provider.ReconcileLifecycle(context.Background(), &drifted)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(changed).Should(gomega.BeTrue())
+		gomega.Expect(changes()).Should(gomega.Equal([]string{"PUT /_ilm/policy/filebeat"}))
+	})
+
+	ginkgo.It("should compare the installed policy by value", func() {
+		responses := map[string]string{
+			"GET /_ilm/policy/filebeat": elastic7Policy,
+			"PUT /_ilm/policy/filebeat": `{"acknowledged":true}`,
+		}
+		start(newStorageServer(responses, &requests))
+		client, derr := provider.Connect()
+		gomega.Expect(derr).Should(gomega.Succeed())
+		changed, derr := provider.reconcilePolicy(context.Background(), client, policy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(changed).Should(gomega.BeFalse())
+
+		// A policy without rollover drifted
+		responses["GET /_ilm/policy/filebeat"] = strings.Replace(elastic7Policy, `"rollover"`, `"shrink"`, 1)
+		changed, derr = provider.reconcilePolicy(context.Background(), client, policy)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(changed).Should(gomega.BeTrue())
+		gomega.Expect(changes()).Should(gomega.Equal([]string{"PUT /_ilm/policy/filebeat"}))
+	})
+
+	ginkgo.It("should report clusters without lifecycle management", func() {
+		start(httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"no handler found for uri [/_ilm/policy/filebeat] and method [GET]","status":400}`))
+		})))
+		_, derr := provider.ReconcileLifecycle(context.Background(), policy)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unimplemented))
+	})
+
+	ginkgo.It("should write sizes and durations in their largest exact unit", func() {
+		gomega.Expect(elasticByteSize(5 * 1024 * 1024 * 1024)).Should(gomega.Equal("5gb"))
+		gomega.Expect(elasticByteSize(1536)).Should(gomega.Equal("1536b"))
+		gomega.Expect(elasticByteSize(2048 * 1024 * 1024 * 1024 * 1024)).Should(gomega.Equal("2048tb"))
+		gomega.Expect(elasticTimeValue(time.Hour * 48)).Should(gomega.Equal("2d"))
+		gomega.Expect(elasticTimeValue(time.Minute * 90)).Should(gomega.Equal("90m"))
+		gomega.Expect(elasticTimeValue(time.Millisecond * 1500)).Should(gomega.Equal("1500ms"))
+	})
+
+	ginkgo.It("should read sizes and durations in any unit", func() {
+		gomega.Expect(parseElasticByteSize("5gb")).Should(gomega.Equal(int64(5 * 1024 * 1024 * 1024)))
+		gomega.Expect(parseElasticByteSize("1.5KB")).Should(gomega.Equal(int64(1536)))
+		gomega.Expect(parseElasticByteSize("")).Should(gomega.Equal(int64(0)))
+		gomega.Expect(parseElasticByteSize("5 apples")).Should(gomega.Equal(int64(-1)))
+		gomega.Expect(parseElasticTimeValue("2d")).Should(gomega.Equal(time.Hour * 48))
+		gomega.Expect(parseElasticTimeValue("1500ms")).Should(gomega.Equal(time.Millisecond * 1500))
+		gomega.Expect(parseElasticTimeValue("0ms")).Should(gomega.Equal(time.Duration(0)))
+		gomega.Expect(parseElasticTimeValue("1w")).Should(gomega.Equal(time.Duration(-1)))
+	})
+})
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Ingest pipeline of the log entries
+
+package loggingstorage
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/olivere/elastic"
+	"github.com/rs/zerolog/log"
+)
+
+// PipelineName is the name of the ingest pipeline, and of the index template making it the
+// default pipeline of the Filebeat indices
+const PipelineName = "unified-logging"
+
+// PipelineIndexPattern is the pattern of the indices Filebeat writes to
+const PipelineIndexPattern = "filebeat-*"
+
+// defaultPipelineSetting is the index setting with the pipeline of the requests that name none
+const defaultPipelineSetting = "index.default_pipeline"
+
+// eventIdScript gives every entry a unique identifier, the tiebreaker of the searches. The
+// Filebeat template maps strings as keywords, which have doc values, so it sorts without fielddata.
+const eventIdScript = `if (ctx[params.field] == null) {
+  ctx[params.field] = UUID.randomUUID().toString();
+}`
+
+// pipelineRetryInterval is the time between attempts to install the ingest pipeline
+const pipelineRetryInterval = time.Second * 30
+
+// levelPatterns are the level patterns of the entities in grok syntax, which names groups without the P
+var levelPatterns = grokPatterns(entities.LevelPatterns)
+
+func grokPatterns(patterns []string) []string {
+	result := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		result[i] = strings.Replace(pattern, "(?P<", "(?<", -1)
+	}
+	return result
+}
+
+// levelScript normalizes the level found by the patterns and sets its severity. Unknown levels are removed.
+const levelScript = `if (ctx.level != null) {
+  def severity = params.levels.get(ctx.level.toLowerCase());
+  if (severity != null) {
+    ctx.level = params.names.get(severity);
+    ctx.severity = severity;
+  } else {
+    ctx.remove('level');
+  }
+}`
+
+// ingestPipeline returns the definition of the ingest pipeline. It never fails an entry.
+func ingestPipeline() string {
+	pipeline := map[string]interface{}{
+		"description": "Adds an identifier to log entries and extracts their level",
+		"processors": []interface{}{
+			map[string]interface{}{
+				"script": map[string]interface{}{
+					"lang":   "painless",
+					"source": eventIdScript,
+					"params": map[string]interface{}{
+						"field": tiebreakerField,
+					},
+					"ignore_failure": true,
+				},
+			},
+			map[string]interface{}{
+				"grok": map[string]interface{}{
+					"field":          entities.MessageField.String(),
+					"patterns":       levelPatterns,
+					"ignore_missing": true,
+					"ignore_failure": true,
+				},
+			},
+			map[string]interface{}{
+				"script": map[string]interface{}{
+					"lang":   "painless",
+					"source": levelScript,
+					"params": map[string]interface{}{
+						"levels": entities.LevelAliases(),
+						"names":  entities.LevelNames(),
+					},
+					"ignore_failure": true,
+				},
+			},
+		},
+	}
+	// Marshalling our own structures cannot fail
+	data, _ := json.Marshal(pipeline)
+	return string(data)
+}
+
+// pipelineTemplate returns the index template making the ingest pipeline the default one of the
+// Filebeat indices. It only sets that, so it merges with the template of Filebeat.
+func pipelineTemplate() map[string]interface{} {
+	return map[string]interface{}{
+		"index_patterns": []string{PipelineIndexPattern},
+		"settings":       pipelineSettings(),
+	}
+}
+
+// pipelineSettings returns the index settings making the ingest pipeline the default one
+func pipelineSettings() map[string]interface{} {
+	return map[string]interface{}{defaultPipelineSetting: PipelineName}
+}
+
+// InstallPipeline creates or updates the ingest pipeline of the log entries, and then makes it
+// the default pipeline of the new and existing Filebeat indices. Filebeat does not name the
+// pipeline, as entries naming a missing pipeline are rejected, so entries indexed before the
+// pipeline is installed have no identifier nor level.
+func (es *ElasticSearch) InstallPipeline(ctx context.Context) derrors.Error {
+	client, derr := es.Connect()
+	if derr != nil {
+		return derr
+	}
+
+	pipelineCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	_, err := client.IngestPutPipeline(PipelineName).BodyString(ingestPipeline()).Do(pipelineCtx)
+	if err != nil {
+		return es.requestError("elastic put pipeline failed", err)
+	}
+	log.Debug().Str("pipeline", PipelineName).Msg("installed")
+
+	templateCtx, templateCancel := es.requestContext(ctx)
+	defer templateCancel()
+	_, err = client.IndexPutTemplate(PipelineName).BodyJson(pipelineTemplate()).Do(templateCtx)
+	if err != nil {
+		return es.requestError("elastic put pipeline template failed", err)
+	}
+
+	settingsCtx, settingsCancel := es.requestContext(ctx)
+	defer settingsCancel()
+	_, err = client.IndexPutSettings(PipelineIndexPattern).BodyJson(pipelineSettings()).Do(settingsCtx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return es.requestError("elastic put pipeline settings failed", err)
+	}
+
+	return nil
+}
+
+// installPipelineLoop installs the ingest pipeline of the log entries as the default pipeline
+// of the Filebeat indices, retrying until it succeeds or ctx is done
+func installPipelineLoop(ctx context.Context, install func(ctx context.Context) derrors.Error) {
+	for {
+		err := install(ctx)
+		if err == nil {
+			log.Info().Str("pipeline", PipelineName).Msg("ingest pipeline installed")
+			return
+		}
+		log.Warn().Str("err", err.DebugReport()).Msg("cannot install ingest pipeline yet")
+		select {
+		case <-time.After(pipelineRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
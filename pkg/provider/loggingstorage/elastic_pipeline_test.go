@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"encoding/json"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("ingestPipeline", func() {
+	ginkgo.It("should set the tiebreaker of the entries", func() {
+		pipeline := struct {
+			Processors []struct {
+				Script *struct {
+					Source string                 `json:"source"`
+					Params map[string]interface{} `json:"params"`
+				} `json:"script"`
+			} `json:"processors"`
+		}{}
+		err := json.Unmarshal([]byte(ingestPipeline()), &pipeline)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(pipeline.Processors).Should(gomega.HaveLen(3))
+
+		script := pipeline.Processors[0].Script
+		gomega.Expect(script).ShouldNot(gomega.BeNil())
+		gomega.Expect(script.Source).Should(gomega.Equal(eventIdScript))
+		gomega.Expect(script.Params).Should(gomega.HaveKeyWithValue("field", tiebreakerField))
+	})
+
+	ginkgo.It("should map every level alias to its severity", func() {
+		pipeline := struct {
+			Processors []struct {
+				Grok *struct {
+					Patterns []string `json:"patterns"`
+				} `json:"grok"`
+				Script *struct {
+					Params struct {
+						Levels map[string]int `json:"levels"`
+						Names  []string       `json:"names"`
+					} `json:"params"`
+				} `json:"script"`
+			} `json:"processors"`
+		}{}
+		err := json.Unmarshal([]byte(ingestPipeline()), &pipeline)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(pipeline.Processors).Should(gomega.HaveLen(3))
+
+		gomega.Expect(pipeline.Processors[1].Grok).ShouldNot(gomega.BeNil())
+		gomega.Expect(pipeline.Processors[1].Grok.Patterns).Should(gomega.Equal(levelPatterns))
+
+		script := pipeline.Processors[2].Script
+		gomega.Expect(script).ShouldNot(gomega.BeNil())
+		gomega.Expect(script.Params.Levels).Should(gomega.HaveKeyWithValue("wrn", 4))
+		gomega.Expect(script.Params.Names[script.Params.Levels["wrn"]]).Should(gomega.Equal("warn"))
+	})
+})
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Translation of search queries into ElasticSearch queries
+
+package loggingstorage
+
+import (
+	"strings"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/olivere/elastic"
+)
+
+// textFields are the analyzed fields, matched by words instead of exact values
+var textFields = map[entities.Field]bool{
+	entities.MessageField: true,
+}
+
+// createQuery compiles the syntax tree of a search query into an ElasticSearch query
+func createQuery(node entities.QueryNode) elastic.Query {
+	switch n := node.(type) {
+	case *entities.QueryAnd:
+		query := elastic.NewBoolQuery()
+		for _, operand := range n.Operands {
+			query = query.Must(createQuery(operand))
+		}
+		return query
+	case *entities.QueryOr:
+		query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+		for _, operand := range n.Operands {
+			query = query.Should(createQuery(operand))
+		}
+		return query
+	case *entities.QueryNot:
+		return elastic.NewBoolQuery().MustNot(createQuery(n.Operand))
+	case *entities.QueryTerm:
+		if n.Field != "" {
+			return createFieldQuery(n.Field, n)
+		}
+		// Terms without a field match any of the default ones
+		query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+		for _, field := range entities.DefaultQueryFields {
+			query = query.Should(createDefaultFieldQuery(field, n))
+		}
+		return query
+	}
+	// Unknown nodes match nothing
+	return elastic.NewBoolQuery().MustNot(elastic.NewMatchAllQuery())
+}
+
+// createDefaultFieldQuery returns the query matching a term without a field in one of the default
+// fields. Words are matched anywhere in the names, as they are not analyzed.
+func createDefaultFieldQuery(field entities.Field, term *entities.QueryTerm) elastic.Query {
+	if term.Kind == entities.WordMatch && !textFields[field] {
+		return elastic.NewWildcardQuery(field.String(), "*"+wildcardEscaper.Replace(term.Value)+"*")
+	}
+	return createFieldQuery(field, term)
+}
+
+// wildcardEscaper escapes the characters of a value with a meaning in wildcard queries
+var wildcardEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`)
+
+// createFieldQuery returns the query matching a term in a field
+func createFieldQuery(field entities.Field, term *entities.QueryTerm) elastic.Query {
+	name := field.String()
+	switch term.Kind {
+	case entities.RegexMatch:
+		return elastic.NewRegexpQuery(name, term.Value)
+	case entities.WildcardMatch:
+		// Analyzed fields store lowercase words
+		if textFields[field] {
+			return elastic.NewWildcardQuery(name, strings.ToLower(term.Value))
+		}
+		return elastic.NewWildcardQuery(name, term.Value)
+	case entities.PhraseMatch:
+		if textFields[field] {
+			return elastic.NewMatchPhraseQuery(name, term.Value)
+		}
+		return elastic.NewTermQuery(name, term.Value)
+	default:
+		if textFields[field] {
+			return elastic.NewMatchQuery(name, term.Value).Operator("and")
+		}
+		return elastic.NewTermQuery(name, term.Value)
+	}
+}
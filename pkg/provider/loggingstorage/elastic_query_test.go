@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"encoding/json"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/olivere/elastic"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// anyDefaultField returns the query matching a word in the message or anywhere in the names
+func anyDefaultField(word string) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+		elastic.NewMatchQuery(entities.MessageField.String(), word).Operator("and"),
+		elastic.NewWildcardQuery(entities.AppDescriptorNameField.String(), "*"+word+"*"),
+		elastic.NewWildcardQuery(entities.AppInstanceNameField.String(), "*"+word+"*"),
+		elastic.NewWildcardQuery(entities.AppServiceGroupNameField.String(), "*"+word+"*"),
+		elastic.NewWildcardQuery(entities.AppServiceNameField.String(), "*"+word+"*"),
+	)
+}
+
+var queryTests = []struct {
+	query    string
+	expected elastic.Query
+}{
+	{
+		query:    "message:error",
+		expected: elastic.NewMatchQuery(entities.MessageField.String(), "error").Operator("and"),
+	},
+	{
+		query:    `message:"connection refused"`,
+		expected: elastic.NewMatchPhraseQuery(entities.MessageField.String(), "connection refused"),
+	},
+	{
+		query:    "message:Warn*",
+		expected: elastic.NewWildcardQuery(entities.MessageField.String(), "warn*"),
+	},
+	{
+		query:    "service_name:api",
+		expected: elastic.NewTermQuery(entities.AppServiceNameField.String(), "api"),
+	},
+	{
+		query:    `service_name:"api gateway"`,
+		expected: elastic.NewTermQuery(entities.AppServiceNameField.String(), "api gateway"),
+	},
+	{
+		query:    "service_name:/api-[0-9]+/",
+		expected: elastic.NewRegexpQuery(entities.AppServiceNameField.String(), "api-[0-9]+"),
+	},
+	{
+		query:    "error",
+		expected: anyDefaultField("error"),
+	},
+	{
+		query: "message:error OR NOT service_name:api",
+		expected: elastic.NewBoolQuery().MinimumNumberShouldMatch(1).Should(
+			elastic.NewMatchQuery(entities.MessageField.String(), "error").Operator("and"),
+			elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(entities.AppServiceNameField.String(), "api")),
+		),
+	},
+	{
+		query: "message:error service_name:api",
+		expected: elastic.NewBoolQuery().Must(
+			elastic.NewMatchQuery(entities.MessageField.String(), "error").Operator("and"),
+			elastic.NewTermQuery(entities.AppServiceNameField.String(), "api"),
+		),
+	},
+}
+
+var _ = ginkgo.Describe("createQuery", func() {
+	for _, test := range queryTests {
+		test := test
+		ginkgo.It("should translate "+test.query, func() {
+			node, derr := entities.ParseQuery(test.query)
+			gomega.Expect(derr).Should(gomega.Succeed())
+
+			q, err := createQuery(node).Source()
+			gomega.Expect(err).Should(gomega.Succeed())
+			jsonQ, err := json.Marshal(q)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			expected, err := test.expected.Source()
+			gomega.Expect(err).Should(gomega.Succeed())
+			jsonE, err := json.Marshal(expected)
+			gomega.Expect(err).Should(gomega.Succeed())
+
+			gomega.Expect(jsonQ).Should(gomega.MatchJSON(jsonE))
+		})
+	}
+})
@@ -21,84 +21,237 @@ package loggingstorage
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
 	"github.com/nalej/derrors"
-	"github.com/nalej/unified-logging/internal/pkg/utils"
 	"github.com/nalej/unified-logging/pkg/entities"
 	"github.com/olivere/elastic"
 	"github.com/rs/zerolog/log"
 )
 
+// ElasticSearchBackend is the name of the ElasticSearch provider
+const ElasticSearchBackend = "elasticsearch"
+
+func init() {
+	RegisterProvider(ElasticSearchBackend, func(config *ProviderConfig) (Provider, derrors.Error) {
+		provider := NewElasticSearch(config.Address, config.ElasticSearch)
+		provider.ExpireIndices = config.ExpireIndices
+		return provider, nil
+	})
+}
+
+// ElasticSearchOptions are the settings of the long-lived Elasticsearch client
+type ElasticSearchOptions struct {
+	// Sniff enables the discovery of the nodes of the Elasticsearch cluster
+	Sniff bool
+	// HealthcheckInterval is the time between health checks of the Elasticsearch nodes
+	HealthcheckInterval time.Duration
+	// MaxRetries is the number of times a failed request is retried
+	MaxRetries int
+	// InitialRetryBackoff is the wait before the first retry, doubled on every retry
+	InitialRetryBackoff time.Duration
+	// MaxRetryBackoff is the maximum wait between retries
+	MaxRetryBackoff time.Duration
+	// RequestTimeout is the maximum duration of a request, 0 means no timeout other than the caller's
+	RequestTimeout time.Duration
+}
+
+// DefaultElasticSearchOptions returns the options used when none are given
+func DefaultElasticSearchOptions() *ElasticSearchOptions {
+	return &ElasticSearchOptions{
+		Sniff:               false,
+		HealthcheckInterval: time.Minute,
+		MaxRetries:          3,
+		InitialRetryBackoff: time.Millisecond * 100,
+		MaxRetryBackoff:     time.Second * 5,
+		RequestTimeout:      time.Minute,
+	}
+}
+
 type ElasticSearch struct {
 	address string
+	options *ElasticSearchOptions
+	// ExpireIndices are the index patterns entries are deleted from, all if empty
+	ExpireIndices []string
+
+	// mutex protects client and available
+	mutex  sync.Mutex
+	client *elastic.Client
+	// available is false when the last request or health check could not reach Elasticsearch
+	available bool
 }
 
-func NewElasticSearch(address string) *ElasticSearch {
+func NewElasticSearch(address string, options *ElasticSearchOptions) *ElasticSearch {
+	if options == nil {
+		options = DefaultElasticSearchOptions()
+	}
 	return &ElasticSearch{
-		address: address,
+		address:   address,
+		options:   options,
+		available: true,
 	}
 }
 
+// Connect returns the client shared by all requests, creating it on first use
 func (es *ElasticSearch) Connect() (*elastic.Client, derrors.Error) {
-	// TODO: Create long-lived client if needed
-	client, err := elastic.NewSimpleClient(elastic.SetURL(fmt.Sprintf("http://%s", es.address)))
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if es.client != nil {
+		return es.client, nil
+	}
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(fmt.Sprintf("http://%s", es.address)),
+		elastic.SetSniff(es.options.Sniff),
+		elastic.SetHealthcheck(es.options.HealthcheckInterval > 0),
+		elastic.SetHealthcheckInterval(es.options.HealthcheckInterval),
+		elastic.SetRetrier(newElasticRetrier(es.options.MaxRetries, es.options.InitialRetryBackoff, es.options.MaxRetryBackoff)),
+		elastic.SetErrorLog(elasticLogger{}),
+	)
 	if err != nil {
+		es.setAvailable(false)
 		return nil, derrors.NewUnavailableError("elastic search connection has failed", err)
 	}
+	es.client = client
+	es.setAvailable(true)
 	return client, nil
 }
 
-func (es *ElasticSearch) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
-	log.Debug().Str("address", es.address).Msg("elastic search")
+// Start connects to Elasticsearch, and runs the health checks and the installation of the
+// ingest pipeline until ctx is done
+func (es *ElasticSearch) Start(ctx context.Context) {
+	_, derr := es.Connect()
+	if derr != nil {
+		// Not fatal, we'll connect on the first request
+		log.Warn().Str("err", derr.DebugReport()).Msg("cannot connect to ElasticSearch yet")
+	}
+	go es.MonitorLoop(ctx)
+	go installPipelineLoop(ctx, es.InstallPipeline)
+}
+
+// Close stops the background processes of the client
+func (es *ElasticSearch) Close() {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if es.client != nil {
+		es.client.Stop()
+		es.client = nil
+	}
+}
+
+// IsAvailable returns false if Elasticsearch could not be reached the last time we tried
+func (es *ElasticSearch) IsAvailable() bool {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	return es.available
+}
 
+// MonitorLoop checks periodically whether Elasticsearch is reachable and reports changes until ctx is done
+func (es *ElasticSearch) MonitorLoop(ctx context.Context) {
+	if es.options.HealthcheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(es.options.HealthcheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			es.ping(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (es *ElasticSearch) ping(ctx context.Context) {
 	client, derr := es.Connect()
 	if derr != nil {
-		return nil, derr
+		return
 	}
+	pingCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	_, _, err := client.Ping(fmt.Sprintf("http://%s", es.address)).Do(pingCtx)
 
-	query := createFilterQuery(request.Filters)
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.setAvailable(err == nil)
+}
 
-	// Add required filter for actual log line
-	if request.MsgFilter != "" {
-		subQuery := elastic.NewBoolQuery()
-		subQuery = subQuery.Should(elastic.NewQueryStringQuery(fmt.Sprintf("*%s*", request.MsgFilter)).
-			DefaultField(entities.MessageField.String()).AllowLeadingWildcard(true))
-		subQuery.Should(elastic.NewQueryStringQuery(fmt.Sprintf("*%s*", request.MsgFilter)).
-			DefaultField(entities.AppDescriptorNameField.String()).AllowLeadingWildcard(true))
-		subQuery.Should(elastic.NewQueryStringQuery(fmt.Sprintf("*%s*", request.MsgFilter)).
-			DefaultField(entities.AppInstanceNameField.String()).AllowLeadingWildcard(true))
-		subQuery.Should(elastic.NewQueryStringQuery(fmt.Sprintf("*%s*", request.MsgFilter)).
-			DefaultField(entities.AppServiceGroupNameField.String()).AllowLeadingWildcard(true))
-		subQuery.Should(elastic.NewQueryStringQuery(fmt.Sprintf("*%s*", request.MsgFilter)).
-			DefaultField(entities.AppServiceNameField.String()).AllowLeadingWildcard(true))
-		subQuery = subQuery.MinimumShouldMatch("1")
-		query = query.Must(subQuery)
+// setAvailable records the availability of Elasticsearch, logging any change. Must be called with the mutex held.
+func (es *ElasticSearch) setAvailable(available bool) {
+	if es.available == available {
+		return
 	}
+	es.available = available
+	if available {
+		log.Info().Str("address", es.address).Msg("elastic search is available")
+	} else {
+		log.Warn().Str("address", es.address).Msg("elastic search is unavailable")
+	}
+}
 
-	// Add time constraints
-	if request.From != 0 || request.To != 0 {
-		query = query.Must(createTimeQuery(request.From, request.To))
+// requestContext returns the context for a single request to Elasticsearch
+func (es *ElasticSearch) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if es.options.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, es.options.RequestTimeout)
 	}
+	return context.WithCancel(ctx)
+}
+
+// requestError converts an error returned by the client, keeping track of the availability of Elasticsearch
+func (es *ElasticSearch) requestError(msg string, err error) derrors.Error {
+	if elastic.IsConnErr(err) {
+		es.mutex.Lock()
+		es.setAvailable(false)
+		es.mutex.Unlock()
+		return derrors.NewUnavailableError(msg, err)
+	}
+	return derrors.NewInternalError(msg, err)
+}
+
+func (es *ElasticSearch) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
+	log.Debug().Str("address", es.address).Msg("elastic search")
+
+	client, derr := es.Connect()
+	if derr != nil {
+		return nil, derr
+	}
+
+	query := createSearchQuery(request)
 
 	// Output query string for debugging
 	queryDebug(query)
 
 	// If no limit, we set to the default maximum window
-	// TODO: use scroll API and pagination to retrieve results
 	if limit < 0 {
 		limit = entities.LimitPerSearch
 	}
 
+	// Sort on the timestamp and a unique field, so we can continue after the last entry with search_after
+	search := client.Search().Query(query).
+		Sort(entities.TimestampField.String(), request.Order.ToAscending()).
+		SortWithInfo(tiebreakerSort(request.Order.ToAscending())).
+		Size(limit)
+	if request.After != nil {
+		search = search.SearchAfter(request.After.Timestamp, request.After.Tiebreaker)
+	}
+
 	// Execute
-	searchResult, err := client.Search().Query(query).
-		Sort(entities.TimestampField.String(), request.NFirst). // sorting descending
-		Size(limit).
-		Do(ctx)
+	searchCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	searchResult, err := search.Do(searchCtx)
 	if err != nil {
-		return nil, derrors.NewInternalError("elastic search query has failed", err)
+		return nil, es.requestError("elastic search query has failed", err)
 	}
 
 	// Create result
-	return getLogEntries(searchResult)
+	log.Debug().Int64("hits", searchResult.Hits.TotalHits).Msg("matching log lines found")
+	return getLogEntries(searchResult.Hits.Hits)
 }
 
 func (es *ElasticSearch) Expire(ctx context.Context, request *entities.SearchRequest) derrors.Error {
@@ -109,52 +262,95 @@ func (es *ElasticSearch) Expire(ctx context.Context, request *entities.SearchReq
 		return derr
 	}
 
-	query := createFilterQuery(request.Filters)
-	query = query.MinimumShouldMatch("100%")
-
-	// Delete a specific time range (delete until to)
-	// Add time constraints
-	if request.To != 0 {
-		query = query.Must(createTimeQuery(0, request.To))
-	}
+	query := createExpireQuery(request)
 
 	// Output query string for debugging
 	queryDebug(query)
 
 	// Execute
+	expireCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	// Refresh, so the deleted entries are not found by the next searches
 	res, err := client.DeleteByQuery().
-		Query(query).Index("_all").
-		Do(ctx)
+		Query(query).Index(expireIndices(es.ExpireIndices)).Refresh("true").
+		IgnoreUnavailable(true).AllowNoIndices(true).
+		Do(expireCtx)
 	if err != nil {
-		return derrors.NewInternalError("elastic expire query failed", err)
+		return es.requestError("elastic expire query failed", err)
 	}
 	log.Debug().Int64("deleted", res.Deleted).Msg("expired entries")
 
 	// Flush deleted docs
-	_, err = elastic.NewIndicesFlushService(client).Do(ctx)
+	_, err = elastic.NewIndicesFlushService(client).Do(expireCtx)
 	if err != nil {
-		return derrors.NewInternalError("elastic flush query failed", err)
+		return es.requestError("elastic flush query failed", err)
 	}
 
 	return nil
 }
 
+// StartExpire starts a delete by query task with the entries Expire would delete. The deleted
+// entries are refreshed once the task completes, instead of flushed.
+func (es *ElasticSearch) StartExpire(ctx context.Context, request *entities.SearchRequest) (string, derrors.Error) {
+	client, derr := es.Connect()
+	if derr != nil {
+		return "", derr
+	}
+
+	query := createExpireQuery(request)
+	queryDebug(query)
+
+	expireCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	res, err := client.DeleteByQuery().
+		Query(query).Index(expireIndices(es.ExpireIndices)).Refresh("true").
+		IgnoreUnavailable(true).AllowNoIndices(true).
+		DoAsync(expireCtx)
+	if err != nil {
+		return "", es.requestError("elastic expire task failed to start", err)
+	}
+	log.Debug().Str("task", res.TaskId).Msg("expire task started")
+	return res.TaskId, nil
+}
+
+// GetExpireTask returns the progress of a delete by query task
+func (es *ElasticSearch) GetExpireTask(ctx context.Context, taskId string) (*ExpireTask, derrors.Error) {
+	client, derr := es.Connect()
+	if derr != nil {
+		return nil, derr
+	}
+
+	taskCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	response, err := client.PerformRequest(taskCtx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   fmt.Sprintf("/_tasks/%s", url.PathEscape(taskId)),
+	})
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, derrors.NewNotFoundError("expire task not found", err).WithParams(taskId)
+		}
+		return nil, es.requestError("error getting expire task", err)
+	}
+	return expireTask(response.Body)
+}
+
 func (es *ElasticSearch) RemoveIndex(ctx context.Context, index string) derrors.Error {
 
 	client, dErr := es.Connect()
 	if dErr != nil {
 		return dErr
 	}
-	exists, err := client.IndexExists(index).Do(ctx)
+	removeCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	exists, err := client.IndexExists(index).Do(removeCtx)
 	if err != nil {
-		return derrors.NewInternalError("elastic ask for an index query failed", err)
+		return es.requestError("elastic ask for an index query failed", err)
 	}
 	if exists {
-		delCtx, cancel := utils.GetContext()
-		defer cancel()
-		_, err := client.DeleteIndex(index).Do(delCtx)
+		_, err := client.DeleteIndex(index).Do(removeCtx)
 		if err != nil {
-			return derrors.NewInternalError("elastic remove index failed", err)
+			return es.requestError("elastic remove index failed", err)
 		}
 		log.Debug().Str("index", index).Msg("Removed")
 	} else {
@@ -171,9 +367,11 @@ func (es *ElasticSearch) GetIndexList(ctx context.Context) ([]string, derrors.Er
 		return nil, dErr
 	}
 
-	list, err := client.CatIndices().Do(ctx)
+	listCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	list, err := client.CatIndices().Do(listCtx)
 	if err != nil {
-		return nil, derrors.NewInternalError("error listing index")
+		return nil, es.requestError("error listing index", err)
 	}
 	indexList := make([]string, 0)
 	for _, index := range list {
@@ -181,3 +379,62 @@ func (es *ElasticSearch) GetIndexList(ctx context.Context) ([]string, derrors.Er
 	}
 	return indexList, nil
 }
+
+// GetStorageStats returns the size of the indices and the disk usage of the data nodes
+func (es *ElasticSearch) GetStorageStats(ctx context.Context) (*StorageStats, derrors.Error) {
+	client, dErr := es.Connect()
+	if dErr != nil {
+		return nil, dErr
+	}
+
+	statsCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	indices, err := client.CatIndices().Bytes("b").Do(statsCtx)
+	if err != nil {
+		return nil, es.requestError("error getting index stats", err)
+	}
+	stats := &StorageStats{
+		Indices: make([]IndexStats, 0, len(indices)),
+	}
+	for _, index := range indices {
+		stats.Indices = append(stats.Indices, IndexStats{
+			Name:      index.Index,
+			SizeBytes: parseBytes(index.StoreSize),
+			Documents: int64(index.DocsCount),
+		})
+	}
+
+	allocation, err := client.CatAllocation().Bytes("b").Do(statsCtx)
+	if err != nil {
+		return nil, es.requestError("error getting disk usage", err)
+	}
+	used := make([]string, len(allocation))
+	total := make([]string, len(allocation))
+	for i, node := range allocation {
+		used[i] = node.DiskUsed
+		total[i] = node.DiskTotal
+	}
+	stats.Disk = diskUsage(used, total)
+
+	return stats, nil
+}
+
+// GetIndexCreationDates returns the creation time of every index
+func (es *ElasticSearch) GetIndexCreationDates(ctx context.Context) (map[string]time.Time, derrors.Error) {
+	client, dErr := es.Connect()
+	if dErr != nil {
+		return nil, dErr
+	}
+
+	settingsCtx, cancel := es.requestContext(ctx)
+	defer cancel()
+	response, err := client.IndexGetSettings().Name(creationDateSetting).FlatSettings(true).Do(settingsCtx)
+	if err != nil {
+		return nil, es.requestError("error getting index settings", err)
+	}
+	settings := make(map[string]map[string]interface{}, len(response))
+	for index, indexSettings := range response {
+		settings[index] = indexSettings.Settings
+	}
+	return creationDates(settings), nil
+}
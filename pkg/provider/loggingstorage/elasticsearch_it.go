@@ -20,10 +20,12 @@ package loggingstorage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
 
 	"github.com/olivere/elastic"
 )
@@ -71,6 +73,44 @@ const templateJSON = `
 }
 `
 
+// entriesTemplateJSON maps the fields of the log entries as Filebeat and the level pipeline do
+const entriesTemplateJSON = `
+{
+  "index_patterns": [
+    "%s_*"
+  ],
+  "mappings": {
+    "doc": {
+      "dynamic_templates": [
+        {
+          "labels": {
+            "path_match": "kubernetes.*",
+            "match_mapping_type": "string",
+            "mapping": {
+              "type": "keyword"
+            }
+          }
+        }
+      ],
+      "properties": {
+        "@timestamp": {
+          "type": "date"
+        },
+        "message": {
+          "type": "text"
+        },
+        "level": {
+          "type": "keyword"
+        },
+        "severity": {
+          "type": "integer"
+        }
+      }
+    }
+  }
+}
+`
+
 // OrganizationID -> ApplicationInstanceID -> ServiceGroupInstanceId
 var instances = map[string]map[string][]string{
 	"org-id-1": map[string][]string{
@@ -134,6 +174,56 @@ func (es *ElasticSearchIT) InitTemplate() derrors.Error {
 
 }
 
+// InitEntriesTemplate adds the template of the indices of AddEntries
+func (es *ElasticSearchIT) InitEntriesTemplate() derrors.Error {
+	client, derr := es.Connect()
+	if derr != nil {
+		return derr
+	}
+
+	template := fmt.Sprintf(entriesTemplateJSON, es.PrefixStr)
+	_, err := client.IndexPutTemplate(es.Prefix(templateName)).BodyString(template).Do(context.Background())
+	if err != nil {
+		return derrors.NewInternalError("failed adding template", err)
+	}
+
+	return nil
+}
+
+// AddEntries adds log entries to an index per day, named as the Filebeat ones, with the severity
+// that the level pipeline sets
+func (es *ElasticSearchIT) AddEntries(entries []*entities.LogEntry) derrors.Error {
+	client, derr := es.Connect()
+	if derr != nil {
+		return derr
+	}
+
+	toAdd := client.Bulk().Type("doc")
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return derrors.NewInternalError("failed serializing entry", err)
+		}
+		doc := make(map[string]interface{})
+		err = json.Unmarshal(data, &doc)
+		if err != nil {
+			return derrors.NewInternalError("failed serializing entry", err)
+		}
+		if level, err := entities.ParseLevel(entry.Level); err == nil {
+			doc[entities.SeverityField.String()] = int(level)
+		}
+		index := es.Prefix("filebeat-6.6.0-" + entry.Timestamp.UTC().Format("2006.01.02"))
+		toAdd = toAdd.Add(elastic.NewBulkIndexRequest().Index(index).Doc(doc))
+	}
+
+	_, err := toAdd.Refresh("wait_for").Do(context.Background())
+	if err != nil {
+		return derrors.NewInternalError("failed adding entry", err)
+	}
+
+	return nil
+}
+
 func (es *ElasticSearchIT) Add(entries []*ElasticITEntry) derrors.Error {
 	client, derr := es.Connect()
 	if derr != nil {
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Client for the HTTP APIs of storage backends
+
+package loggingstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// maxErrorBody is the number of bytes of an error response included in the error
+const maxErrorBody = 512
+
+// httpClient sends requests with JSON bodies to the HTTP API of a storage backend
+type httpClient struct {
+	baseURL string
+	client  *http.Client
+	// header is added to every request
+	header http.Header
+	// timeout is the maximum duration of a request, 0 means no timeout other than the caller's
+	timeout time.Duration
+}
+
+// newHTTPClient returns a client for address, a host:port or a URL
+func newHTTPClient(address string, timeout time.Duration) *httpClient {
+	baseURL := address
+	if !strings.Contains(baseURL, "://") {
+		baseURL = fmt.Sprintf("http://%s", baseURL)
+	}
+	return &httpClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{},
+		header:  http.Header{},
+		timeout: timeout,
+	}
+}
+
+// do sends a request with body encoded as JSON, if not nil, and decodes the JSON response into
+// result, if not nil. Responses with a 404 status return a NotFound error.
+func (c *httpClient) do(ctx context.Context, method string, path string, params url.Values, body interface{}, result interface{}) derrors.Error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	address := c.baseURL + path
+	if len(params) > 0 {
+		address = fmt.Sprintf("%s?%s", address, params.Encode())
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return derrors.NewInternalError("cannot encode request", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, address, reader)
+	if err != nil {
+		return derrors.NewInternalError("cannot create request", err)
+	}
+	req = req.WithContext(ctx)
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return derrors.NewUnavailableError("storage request has failed", err).WithParams(method, path)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return derrors.NewNotFoundError("storage resource not found").WithParams(method, path)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return derrors.NewInternalError("storage request has failed").WithParams(method, path, resp.StatusCode, string(message))
+	}
+
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return derrors.NewInternalError("cannot decode storage response", err)
+		}
+	}
+	return nil
+}
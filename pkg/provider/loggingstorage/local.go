@@ -0,0 +1,431 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Embedded local logging storage provider implementation
+
+package loggingstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// LocalBackend is the name of the local provider
+const LocalBackend = "local"
+
+// localDayFormat is the format of the days of the segments, which are the names of the indices
+const localDayFormat = "2006.01.02"
+
+// localDayPattern matches the names of the indices
+var localDayPattern = regexp.MustCompile(`^\d{4}\.\d{2}\.\d{2}$`)
+
+func init() {
+	RegisterProvider(LocalBackend, func(config *ProviderConfig) (Provider, derrors.Error) {
+		return NewLocal(config.Local)
+	})
+}
+
+// LocalOptions are the settings of the local provider
+type LocalOptions struct {
+	// Dir is the directory of the segment files
+	Dir string
+	// SegmentSize is the size in bytes after which a new segment is started
+	SegmentSize int64
+	// LogPath is the pattern of the container log files to ingest, empty to disable ingestion
+	LogPath string
+	// PollInterval is the time between reads of the container log files
+	PollInterval time.Duration
+}
+
+// DefaultLocalOptions returns the options used when none are given
+func DefaultLocalOptions() *LocalOptions {
+	return &LocalOptions{
+		Dir:          "/var/lib/unified-logging",
+		SegmentSize:  64 * 1024 * 1024,
+		LogPath:      "/var/log/containers/*.log",
+		PollInterval: time.Second * 2,
+	}
+}
+
+// Local stores the log entries in append-only segment files on disk, one directory per day,
+// for clusters without ElasticSearch. It ingests the container log files itself.
+// Deleted entries are recorded next to their segment, and segments are removed when all
+// their entries are deleted or their day expires.
+type Local struct {
+	options *LocalOptions
+
+	// mutex protects segments
+	mutex sync.RWMutex
+	// segments are the segments of every day, sorted by sequence
+	segments map[string][]*localSegment
+}
+
+// NewLocal opens the segments in the directory of the options, creating it if needed
+func NewLocal(options *LocalOptions) (*Local, derrors.Error) {
+	if options == nil {
+		options = DefaultLocalOptions()
+	}
+	err := os.MkdirAll(options.Dir, 0755)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create storage directory", err).WithParams(options.Dir)
+	}
+
+	local := &Local{
+		options:  options,
+		segments: make(map[string][]*localSegment),
+	}
+	derr := local.open()
+	if derr != nil {
+		local.Close()
+		return nil, derr
+	}
+	return local, nil
+}
+
+// open opens the segments of every day directory
+func (l *Local) open() derrors.Error {
+	days, err := ioutil.ReadDir(l.options.Dir)
+	if err != nil {
+		return derrors.NewInternalError("cannot read storage directory", err).WithParams(l.options.Dir)
+	}
+	for _, day := range days {
+		if !day.IsDir() || !localDayPattern.MatchString(day.Name()) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(l.options.Dir, day.Name()))
+		if err != nil {
+			return derrors.NewInternalError("cannot read storage directory", err).WithParams(day.Name())
+		}
+		for _, file := range files {
+			sequence, ok := segmentSequence(file.Name())
+			if !ok {
+				continue
+			}
+			segment, derr := openSegment(l.options.Dir, day.Name(), sequence)
+			if derr != nil {
+				return derr
+			}
+			l.segments[day.Name()] = append(l.segments[day.Name()], segment)
+		}
+		sortSegments(l.segments[day.Name()])
+	}
+	log.Info().Str("dir", l.options.Dir).Int("days", len(l.segments)).Msg("local storage opened")
+	return nil
+}
+
+// Start ingests the container log files until ctx is done
+func (l *Local) Start(ctx context.Context) {
+	if l.options.LogPath == "" {
+		return
+	}
+	podLabels, derr := newKubernetesPodLabels()
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Msg("cannot ingest container logs without pod labels")
+		return
+	}
+	ingester := newLocalIngester(l, l.options.LogPath, l.options.Dir, podLabels)
+	go ingester.Loop(ctx, l.options.PollInterval)
+}
+
+// Close closes the segment files
+func (l *Local) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, segments := range l.segments {
+		for _, segment := range segments {
+			segment.close()
+		}
+	}
+	l.segments = make(map[string][]*localSegment)
+}
+
+// Append stores entries, in the segment of the day of their timestamp
+func (l *Local) Append(entries []*entities.LogEntry) derrors.Error {
+	days := make(map[string][]*entities.LogEntry)
+	for _, entry := range entries {
+		day := entry.Timestamp.UTC().Format(localDayFormat)
+		days[day] = append(days[day], entry)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for day, dayEntries := range days {
+		segment, derr := l.activeSegment(day)
+		if derr != nil {
+			return derr
+		}
+		derr = segment.append(dayEntries)
+		if derr != nil {
+			return derr
+		}
+	}
+	return nil
+}
+
+// activeSegment returns the segment where entries of a day are appended, starting a new one
+// when the last one is full. Must be called with the mutex held.
+func (l *Local) activeSegment(day string) (*localSegment, derrors.Error) {
+	segments := l.segments[day]
+	sequence := 0
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		if last.size < l.options.SegmentSize {
+			return last, nil
+		}
+		sequence = last.sequence + 1
+	}
+
+	err := os.MkdirAll(filepath.Join(l.options.Dir, day), 0755)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create storage directory", err).WithParams(day)
+	}
+	segment, derr := openSegment(l.options.Dir, day, sequence)
+	if derr != nil {
+		return nil, derr
+	}
+	l.segments[day] = append(segments, segment)
+	return segment, nil
+}
+
+// localHit is an entry matching the index of a search
+type localHit struct {
+	segment    *localSegment
+	ordinal    int
+	timestamp  int64
+	tiebreaker string
+}
+
+// before checks if a hit is sorted before a cursor in ascending order
+func (h *localHit) before(timestamp int64, tiebreaker string) bool {
+	if h.timestamp != timestamp {
+		return h.timestamp < timestamp
+	}
+	return h.tiebreaker < tiebreaker
+}
+
+// follows checks if a hit is sorted after a cursor in the given order
+func (h *localHit) follows(cursor *entities.Cursor, ascending bool) bool {
+	if h.timestamp == cursor.Timestamp && h.tiebreaker == cursor.Tiebreaker {
+		return false
+	}
+	return h.before(cursor.Timestamp, cursor.Tiebreaker) != ascending
+}
+
+func (l *Local) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
+	// If no limit, we set to the default maximum window
+	if limit < 0 {
+		limit = entities.LimitPerSearch
+	}
+	ascending := request.Order.ToAscending()
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Find the entries matching the indices, after the cursor
+	hits := make([]*localHit, 0)
+	for _, segments := range l.segments {
+		for _, segment := range segments {
+			if !segment.overlaps(request.From, request.To) {
+				continue
+			}
+			for _, ordinal := range segment.candidates(request) {
+				record := segment.records[ordinal]
+				if (request.From != 0 && record.timestamp < request.From) || (request.To != 0 && record.timestamp > request.To) {
+					continue
+				}
+				hit := &localHit{
+					segment:    segment,
+					ordinal:    ordinal,
+					timestamp:  record.timestamp,
+					tiebreaker: segment.tiebreaker(ordinal),
+				}
+				if request.After != nil && !hit.follows(request.After, ascending) {
+					continue
+				}
+				hits = append(hits, hit)
+			}
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if ascending {
+			return hits[i].before(hits[j].timestamp, hits[j].tiebreaker)
+		}
+		return hits[j].before(hits[i].timestamp, hits[i].tiebreaker)
+	})
+
+	// Read the entries in order until the limit, matching the query
+	entries := make(entities.LogEntries, 0)
+	for _, hit := range hits {
+		if len(entries) >= limit {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, derrors.NewUnavailableError("search cancelled", ctx.Err())
+		}
+		entry, derr := hit.segment.read(hit.ordinal)
+		if derr != nil {
+			return nil, derr
+		}
+		if request.Query != nil && !entities.MatchQuery(request.Query, entry) {
+			continue
+		}
+		entry.Cursor = &entities.Cursor{
+			Timestamp:  hit.timestamp,
+			Tiebreaker: hit.tiebreaker,
+		}
+		entries = append(entries, entry)
+	}
+	log.Debug().Int("hits", len(hits)).Int("entries", len(entries)).Msg("local search")
+
+	return entries, nil
+}
+
+func (l *Local) Expire(ctx context.Context, request *entities.SearchRequest) derrors.Error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	deleted := 0
+	for day, segments := range l.segments {
+		remaining := make([]*localSegment, 0, len(segments))
+		for _, segment := range segments {
+			// Delete until to
+			ordinals := make([]int, 0)
+			if segment.overlaps(0, request.To) {
+				for _, ordinal := range segment.candidates(request) {
+					if request.To != 0 && segment.records[ordinal].timestamp > request.To {
+						continue
+					}
+					// The query needs the whole entry, which is only read when there is one
+					if request.Query != nil {
+						entry, derr := segment.read(ordinal)
+						if derr != nil {
+							return derr
+						}
+						if !entities.MatchQuery(request.Query, entry) {
+							continue
+						}
+					}
+					ordinals = append(ordinals, ordinal)
+				}
+			}
+			derr := segment.delete(ordinals)
+			if derr != nil {
+				return derr
+			}
+			deleted += len(ordinals)
+
+			if segment.isEmpty() {
+				derr = segment.remove()
+				if derr != nil {
+					return derr
+				}
+				continue
+			}
+			remaining = append(remaining, segment)
+		}
+		l.segments[day] = remaining
+		if len(remaining) == 0 {
+			derr := l.removeDay(day)
+			if derr != nil {
+				return derr
+			}
+		}
+	}
+	log.Debug().Int("deleted", deleted).Msg("expired entries")
+
+	return nil
+}
+
+// RemoveIndex removes the segments of a day
+func (l *Local) RemoveIndex(ctx context.Context, index string) derrors.Error {
+	if !localDayPattern.MatchString(index) {
+		return derrors.NewInvalidArgumentError("invalid index name").WithParams(index)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, exists := l.segments[index]
+	if !exists {
+		log.Debug().Str("index", index).Msg("Index not exists")
+		return nil
+	}
+	for _, segment := range segments {
+		segment.close()
+	}
+	derr := l.removeDay(index)
+	if derr != nil {
+		return derr
+	}
+	log.Debug().Str("index", index).Msg("Removed")
+
+	return nil
+}
+
+// removeDay deletes the directory of a day. Must be called with the mutex held.
+func (l *Local) removeDay(day string) derrors.Error {
+	delete(l.segments, day)
+	err := os.RemoveAll(filepath.Join(l.options.Dir, day))
+	if err != nil {
+		return derrors.NewInternalError("cannot remove index", err).WithParams(day)
+	}
+	return nil
+}
+
+// GetIndexList returns the days with segments
+func (l *Local) GetIndexList(ctx context.Context) ([]string, derrors.Error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	indexList := make([]string, 0, len(l.segments))
+	for day := range l.segments {
+		indexList = append(indexList, day)
+	}
+	sort.Strings(indexList)
+	return indexList, nil
+}
+
+// GetStorageStats returns the size of the segment files of every day. The disk usage is unknown.
+func (l *Local) GetStorageStats(ctx context.Context) (*StorageStats, derrors.Error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	stats := &StorageStats{
+		Indices: make([]IndexStats, 0, len(l.segments)),
+	}
+	for day, segments := range l.segments {
+		indexStats := IndexStats{Name: day}
+		for _, segment := range segments {
+			indexStats.SizeBytes += segment.size
+			indexStats.Documents += int64(len(segment.records) - len(segment.deleted))
+		}
+		stats.Indices = append(stats.Indices, indexStats)
+	}
+	sort.Slice(stats.Indices, func(i, j int) bool {
+		return stats.Indices[i].Name < stats.Indices[j].Name
+	})
+	return stats, nil
+}
@@ -0,0 +1,476 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Ingestion of the container log files by the local logging storage provider
+
+package loggingstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// offsetsFile is the name of the file with the offsets of the container log files already ingested
+	offsetsFile = "offsets.json"
+	// maxIngestRead is the number of bytes of a container log file read at once
+	maxIngestRead = 1024 * 1024
+	// maxPartialLine is the maximum size of a log line split by the container runtime
+	maxPartialLine = 1024 * 1024
+	// maxContainerLine is the maximum size of a line of a container log file, longer ones are skipped
+	maxContainerLine = 4 * 1024 * 1024
+	// podCacheTTL is the time the labels of a pod are cached
+	podCacheTTL = time.Minute * 5
+	// sidecarContainer is the name of the platform container deployed with the applications, as Filebeat we skip its logs
+	sidecarContainer = "zt-sidecar"
+	// serviceAccountDir has the credentials of the service account of the pod
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// containerLogName matches the names of the container log files: <pod>_<namespace>_<container>-<container id>.log
+var containerLogName = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+
+// podLabels returns the labels of a pod, or a NotFound error if the pod does not exist
+type podLabels func(ctx context.Context, namespace string, pod string) (map[string]string, derrors.Error)
+
+// containerLogFile is the pod and container of a container log file
+type containerLogFile struct {
+	namespace string
+	pod       string
+	container string
+}
+
+// parseContainerLogName returns the pod and container of a container log file name
+func parseContainerLogName(path string) (*containerLogFile, bool) {
+	match := containerLogName.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return nil, false
+	}
+	return &containerLogFile{
+		pod:       match[1],
+		namespace: match[2],
+		container: match[3],
+	}, true
+}
+
+// dockerLogLine is a line of the Docker JSON log driver
+type dockerLogLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// parseContainerLine returns the timestamp and message of a line of a container log file, in
+// the Docker JSON or CRI formats. partial is true if the message continues on the next line.
+func parseContainerLine(line []byte) (timestamp time.Time, message string, partial bool, derr derrors.Error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		entry := dockerLogLine{}
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return time.Time{}, "", false, derrors.NewInvalidArgumentError("invalid docker log line", err)
+		}
+		// Docker splits long lines, only the last part ends with a line break
+		if !strings.HasSuffix(entry.Log, "\n") {
+			return entry.Time, entry.Log, true, nil
+		}
+		return entry.Time, strings.TrimRight(entry.Log, "\r\n"), false, nil
+	}
+
+	// CRI: <time> <stream> <P|F> <message>
+	parts := strings.SplitN(string(line), " ", 4)
+	if len(parts) < 3 {
+		return time.Time{}, "", false, derrors.NewInvalidArgumentError("invalid CRI log line").WithParams(string(line))
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", false, derrors.NewInvalidArgumentError("invalid CRI log line", err)
+	}
+	if len(parts) == 4 {
+		message = parts[3]
+	}
+	return timestamp, message, parts[2] == "P", nil
+}
+
+// podCacheEntry are the cached labels of a pod, nil if it does not exist
+type podCacheEntry struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+// localAppender stores ingested entries
+type localAppender interface {
+	Append(entries []*entities.LogEntry) derrors.Error
+}
+
+// fileID identifies a file by device and inode, zero if the platform does not provide them
+type fileID struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+}
+
+// ingestOffset is the position of the ingestion of a container log file
+type ingestOffset struct {
+	// Offset is the number of bytes of the file already ingested
+	Offset int64 `json:"offset"`
+	// File identifies the file read, so a new file created by the log rotation is read from the beginning
+	File fileID `json:"file"`
+}
+
+// longLine is the beginning of a line of a container log file longer than the read buffer
+type longLine struct {
+	data []byte
+	// dropped is set when the line is longer than maxContainerLine, and its end is skipped too
+	dropped bool
+}
+
+// localIngester reads the new lines of the container log files, as Filebeat does, and stores
+// the ones of the containers of user applications. The offsets of the files are saved after the
+// entries are stored, so entries can be stored twice if the slave stops in between.
+type localIngester struct {
+	store     localAppender
+	pattern   string
+	dir       string
+	podLabels podLabels
+	// offsets are the positions of each file already ingested
+	offsets map[string]ingestOffset
+	// partial are the beginnings of the split lines of each file
+	partial map[string]string
+	// longLines are the beginnings of the lines of each file longer than the read buffer
+	longLines map[string]*longLine
+	pods      map[string]podCacheEntry
+}
+
+func newLocalIngester(store localAppender, pattern string, dir string, podLabels podLabels) *localIngester {
+	return &localIngester{
+		store:     store,
+		pattern:   pattern,
+		dir:       dir,
+		podLabels: podLabels,
+		offsets:   make(map[string]ingestOffset),
+		partial:   make(map[string]string),
+		longLines: make(map[string]*longLine),
+		pods:      make(map[string]podCacheEntry),
+	}
+}
+
+// Loop ingests the container log files every interval until ctx is done
+func (i *localIngester) Loop(ctx context.Context, interval time.Duration) {
+	derr := i.loadOffsets()
+	if derr != nil {
+		log.Error().Str("err", derr.DebugReport()).Msg("cannot read the offsets of the container logs, ingesting them again")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		i.poll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll ingests the new lines of every container log file
+func (i *localIngester) poll(ctx context.Context) {
+	paths, err := filepath.Glob(i.pattern)
+	if err != nil {
+		log.Error().Err(err).Str("pattern", i.pattern).Msg("invalid container log pattern")
+		return
+	}
+
+	existing := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		existing[path] = true
+		derr := i.ingestFile(ctx, path)
+		if derr != nil {
+			log.Warn().Str("file", path).Str("err", derr.DebugReport()).Msg("cannot ingest container log")
+		}
+	}
+	// Forget the files of removed containers
+	for path := range i.offsets {
+		if !existing[path] {
+			delete(i.offsets, path)
+			delete(i.partial, path)
+			delete(i.longLines, path)
+		}
+	}
+
+	derr := i.saveOffsets()
+	if derr != nil {
+		log.Warn().Str("err", derr.DebugReport()).Msg("cannot save the offsets of the container logs")
+	}
+}
+
+// ingestFile stores the new complete lines of a container log file
+func (i *localIngester) ingestFile(ctx context.Context, path string) derrors.Error {
+	name, ok := parseContainerLogName(path)
+	if !ok || name.container == sidecarContainer {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return derrors.NewInternalError("cannot open container log", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return derrors.NewInternalError("cannot read container log", err)
+	}
+
+	id := fileIdentity(info)
+	position := i.offsets[path]
+	offset := position.Offset
+	if position.File != id || info.Size() < offset {
+		// The file was replaced by the log rotation, or truncated
+		offset = 0
+		delete(i.partial, path)
+		delete(i.longLines, path)
+	}
+	if info.Size() == offset {
+		return nil
+	}
+
+	labels, derr := i.labels(ctx, name)
+	if derr != nil {
+		return derr
+	}
+	if labels[entities.NALEJ_ANNOTATION_ORGANIZATION_ID] == "" {
+		// Not a user application
+		i.offsets[path] = ingestOffset{Offset: info.Size(), File: id}
+		return nil
+	}
+
+	buffer := make([]byte, maxIngestRead)
+	for offset < info.Size() {
+		n, err := file.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return derrors.NewInternalError("cannot read container log", err)
+		}
+		data := buffer[:n]
+		end := bytes.LastIndexByte(data, '\n')
+		if end < 0 {
+			if n < len(buffer) {
+				// Incomplete line, wait for the rest of it
+				break
+			}
+			// A line longer than the buffer is kept until its end is read
+			i.carryLine(path, data)
+			offset += int64(n)
+			i.offsets[path] = ingestOffset{Offset: offset, File: id}
+			continue
+		}
+
+		entries := i.parseLines(path, name, labels, i.completeLine(path, data[:end+1]))
+		if len(entries) > 0 {
+			derr = i.store.Append(entries)
+			if derr != nil {
+				return derr
+			}
+		}
+		offset += int64(end + 1)
+		i.offsets[path] = ingestOffset{Offset: offset, File: id}
+	}
+	return nil
+}
+
+// carryLine keeps the beginning of a line longer than the read buffer, dropping the line if it
+// is longer than maxContainerLine. It is lost if the slave stops before the end of the line is read.
+func (i *localIngester) carryLine(path string, data []byte) {
+	line, exists := i.longLines[path]
+	if !exists {
+		line = &longLine{}
+		i.longLines[path] = line
+	}
+	if line.dropped {
+		return
+	}
+	if len(line.data)+len(data) > maxContainerLine {
+		log.Warn().Str("file", path).Int("max", maxContainerLine).Msg("skipping container log line too long")
+		line.data = nil
+		line.dropped = true
+		return
+	}
+	line.data = append(line.data, data...)
+}
+
+// completeLine returns complete lines of a container log file, prepending the beginning of
+// the first one if it was longer than the read buffer
+func (i *localIngester) completeLine(path string, data []byte) []byte {
+	line, exists := i.longLines[path]
+	if !exists {
+		return data
+	}
+	delete(i.longLines, path)
+	end := bytes.IndexByte(data, '\n') + 1
+	if !line.dropped && len(line.data)+end > maxContainerLine {
+		log.Warn().Str("file", path).Int("max", maxContainerLine).Msg("skipping container log line too long")
+		line.dropped = true
+	}
+	if line.dropped {
+		return data[end:]
+	}
+	return append(line.data, data...)
+}
+
+// parseLines returns the entries of complete lines of a container log file
+func (i *localIngester) parseLines(path string, name *containerLogFile, labels map[string]string, data []byte) []*entities.LogEntry {
+	entries := make([]*entities.LogEntry, 0)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		timestamp, message, partial, derr := parseContainerLine(line)
+		if derr != nil {
+			log.Debug().Str("file", path).Str("err", derr.DebugReport()).Msg("skipping container log line")
+			continue
+		}
+		if partial {
+			if len(i.partial[path])+len(message) <= maxPartialLine {
+				i.partial[path] += message
+			}
+			continue
+		}
+		message = i.partial[path] + message
+		delete(i.partial, path)
+		entries = append(entries, newLocalLogEntry(name.namespace, labels, timestamp, message))
+	}
+	return entries
+}
+
+// newLocalLogEntry returns the entry of a message of a pod, with the level found in the message
+func newLocalLogEntry(namespace string, labels map[string]string, timestamp time.Time, message string) *entities.LogEntry {
+	entry := &entities.LogEntry{
+		Timestamp: timestamp.UTC(),
+		Msg:       message,
+		Kubernetes: entities.KubernetesEntry{
+			Namespace: namespace,
+		},
+	}
+	// The JSON names of the labels of the entries are the names of the pod labels
+	data, _ := json.Marshal(labels)
+	_ = json.Unmarshal(data, &entry.Kubernetes.Labels)
+	if level := entities.DetectLevel(message); level != entities.UnknownLevel {
+		entry.Level = level.String()
+	}
+	return entry
+}
+
+// labels returns the labels of the pod of a container log file, nil if the pod does not exist
+func (i *localIngester) labels(ctx context.Context, name *containerLogFile) (map[string]string, derrors.Error) {
+	key := fmt.Sprintf("%s/%s", name.namespace, name.pod)
+	cached, exists := i.pods[key]
+	if exists && time.Now().Before(cached.expires) {
+		return cached.labels, nil
+	}
+
+	labels, derr := i.podLabels(ctx, name.namespace, name.pod)
+	if derr != nil && derr.Type() != derrors.NotFound {
+		return nil, derr
+	}
+	i.pods[key] = podCacheEntry{labels: labels, expires: time.Now().Add(podCacheTTL)}
+	return labels, nil
+}
+
+func (i *localIngester) loadOffsets() derrors.Error {
+	data, err := ioutil.ReadFile(filepath.Join(i.dir, offsetsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return derrors.NewInternalError("cannot read offsets", err)
+	}
+	err = json.Unmarshal(data, &i.offsets)
+	if err != nil {
+		return derrors.NewInternalError("offsets deserialization error", err)
+	}
+	return nil
+}
+
+// saveOffsets replaces the offsets file, writing a new one first so it is never left incomplete
+func (i *localIngester) saveOffsets() derrors.Error {
+	data, err := json.Marshal(i.offsets)
+	if err != nil {
+		return derrors.NewInternalError("offsets serialization error", err)
+	}
+	path := filepath.Join(i.dir, offsetsFile)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return derrors.NewInternalError("cannot write offsets", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return derrors.NewInternalError("cannot write offsets", err)
+	}
+	return nil
+}
+
+// newKubernetesPodLabels returns the labels of the pods from the Kubernetes API, with the service
+// account of the slave, which needs to get pods
+func newKubernetesPodLabels() (podLabels, derrors.Error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, derrors.NewFailedPreconditionError("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, derrors.NewFailedPreconditionError("cannot read service account token", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, derrors.NewFailedPreconditionError("cannot read service account certificate", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, derrors.NewFailedPreconditionError("invalid service account certificate")
+	}
+
+	client := newHTTPClient(fmt.Sprintf("https://%s", net.JoinHostPort(host, port)), time.Second*10)
+	client.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	client.header.Set("Authorization", fmt.Sprintf("Bearer %s", strings.TrimSpace(string(token))))
+
+	return func(ctx context.Context, namespace string, pod string) (map[string]string, derrors.Error) {
+		result := struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}{}
+		path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, pod)
+		derr := client.do(ctx, http.MethodGet, path, nil, nil, &result)
+		if derr != nil {
+			return nil, derr
+		}
+		return result.Metadata.Labels, nil
+	}, nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// fakeAppender keeps the appended entries in memory
+type fakeAppender struct {
+	entries []*entities.LogEntry
+}
+
+func (f *fakeAppender) Append(entries []*entities.LogEntry) derrors.Error {
+	f.entries = append(f.entries, entries...)
+	return nil
+}
+
+const containerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+var _ = ginkgo.Describe("localIngester", func() {
+	var dir string
+	var store *fakeAppender
+	var ingester *localIngester
+	var lookups int
+
+	pods := map[string]map[string]string{
+		"user/api-1":   {"nalej-organization": "org", "nalej-app-instance-id": "app", "nalej-service-name": "api"},
+		"system/dns-1": {"k8s-app": "dns"},
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "local-ingest")
+		gomega.Expect(err).Should(gomega.Succeed())
+		store = &fakeAppender{}
+		lookups = 0
+		ingester = newLocalIngester(store, filepath.Join(dir, "*.log"), dir,
+			func(ctx context.Context, namespace string, pod string) (map[string]string, derrors.Error) {
+				lookups++
+				labels, exists := pods[namespace+"/"+pod]
+				if !exists {
+					return nil, derrors.NewNotFoundError("pod not found")
+				}
+				return labels, nil
+			})
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(name string, lines ...string) {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		gomega.Expect(err).Should(gomega.Succeed())
+		defer file.Close()
+		_, err = file.WriteString(strings.Join(lines, ""))
+		gomega.Expect(err).Should(gomega.Succeed())
+	}
+
+	ginkgo.It("should parse the names of container log files", func() {
+		name, ok := parseContainerLogName("/var/log/containers/api-1_user_api-server-" + containerID + ".log")
+		gomega.Expect(ok).Should(gomega.BeTrue())
+		gomega.Expect(name).Should(gomega.Equal(&containerLogFile{namespace: "user", pod: "api-1", container: "api-server"}))
+		_, ok = parseContainerLogName("/var/log/syslog")
+		gomega.Expect(ok).Should(gomega.BeFalse())
+	})
+
+	ginkgo.It("should parse Docker and CRI lines", func() {
+		timestamp, message, partial, derr := parseContainerLine([]byte(`{"log":"hello\n","stream":"stdout","time":"2020-01-17T10:00:00.5Z"}`))
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(timestamp).Should(gomega.Equal(time.Date(2020, 1, 17, 10, 0, 0, 500000000, time.UTC)))
+		gomega.Expect(message).Should(gomega.Equal("hello"))
+		gomega.Expect(partial).Should(gomega.BeFalse())
+
+		_, message, partial, derr = parseContainerLine([]byte(`2020-01-17T10:00:00.5Z stderr P part of a line`))
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(message).Should(gomega.Equal("part of a line"))
+		gomega.Expect(partial).Should(gomega.BeTrue())
+
+		_, _, _, derr = parseContainerLine([]byte(`garbage`))
+		gomega.Expect(derr).ShouldNot(gomega.BeNil())
+	})
+
+	ginkgo.It("should ingest the new lines of application containers", func() {
+		user := "api-1_user_api-" + containerID + ".log"
+		write(user,
+			`{"log":"level=error msg=failed\n","stream":"stderr","time":"2020-01-17T10:00:00Z"}`+"\n",
+			`2020-01-17T10:00:01Z stdout P a long `+"\n",
+			`2020-01-17T10:00:01Z stdout F line`+"\n",
+			`{"log":"incomplete`)
+		write("api-1_user_zt-sidecar-"+containerID+".log", `2020-01-17T10:00:00Z stdout F sidecar`+"\n")
+		write("dns-1_system_dns-"+containerID+".log", `2020-01-17T10:00:00Z stdout F system`+"\n")
+		write("gone-1_user_api-"+containerID+".log", `2020-01-17T10:00:00Z stdout F gone`+"\n")
+
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.Equal([]string{"level=error msg=failed", "a long line"}))
+		entry := store.entries[0]
+		gomega.Expect(entry.Level).Should(gomega.Equal("error"))
+		gomega.Expect(entry.Kubernetes.Namespace).Should(gomega.Equal("user"))
+		gomega.Expect(entry.Kubernetes.Labels.AppInstanceId).Should(gomega.Equal("app"))
+		gomega.Expect(entry.Kubernetes.Labels.AppServiceName).Should(gomega.Equal("api"))
+
+		// The rest of the line is ingested on the next poll, and the pod labels are cached
+		write(user, ` line\n","stream":"stdout","time":"2020-01-17T10:00:02Z"}`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.HaveLen(3))
+		gomega.Expect(store.entries[2].Msg).Should(gomega.Equal("incomplete line"))
+		gomega.Expect(lookups).Should(gomega.Equal(3))
+
+		// The offsets are kept, so nothing is ingested twice
+		restarted := newLocalIngester(store, ingester.pattern, dir, ingester.podLabels)
+		gomega.Expect(restarted.loadOffsets()).Should(gomega.BeNil())
+		restarted.poll(context.Background())
+		gomega.Expect(store.entries).Should(gomega.HaveLen(3))
+	})
+
+	ginkgo.It("should ingest rotated files from the beginning", func() {
+		user := "api-1_user_api-" + containerID + ".log"
+		write(user, `2020-01-17T10:00:00Z stdout F first line before rotation`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(store.entries).Should(gomega.HaveLen(1))
+
+		gomega.Expect(os.Remove(filepath.Join(dir, user))).Should(gomega.Succeed())
+		write(user, `2020-01-17T10:00:01Z stdout F second`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.Equal([]string{"first line before rotation", "second"}))
+
+		// The new file is detected by its identity, also when it is larger than the one rotated
+		gomega.Expect(os.Rename(filepath.Join(dir, user), filepath.Join(dir, user+".1"))).Should(gomega.Succeed())
+		write(user, `2020-01-17T10:00:02Z stdout F third, a line longer than the second`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.HaveLen(3))
+		gomega.Expect(store.entries[2].Msg).Should(gomega.Equal("third, a line longer than the second"))
+	})
+
+	ginkgo.It("should ingest lines longer than the read buffer", func() {
+		user := "api-1_user_api-" + containerID + ".log"
+		long := strings.Repeat("x", maxIngestRead+maxIngestRead/2)
+		write(user, `2020-01-17T10:00:00Z stdout F `+long+"\n", `2020-01-17T10:00:01Z stdout F next`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.Equal([]string{long, "next"}))
+
+		// Lines longer than the maximum are skipped
+		write(user, `2020-01-17T10:00:02Z stdout F `+strings.Repeat("x", maxContainerLine)+"\n", `2020-01-17T10:00:03Z stdout F last`+"\n")
+		ingester.poll(context.Background())
+		gomega.Expect(localMessages(store.entries)).Should(gomega.Equal([]string{long, "next", "last"}))
+	})
+})
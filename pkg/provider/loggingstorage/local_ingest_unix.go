@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Identity of the container log files on Unix systems
+
+package loggingstorage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file
+func fileIdentity(info os.FileInfo) fileID {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
+	}
+	return fileID{Device: uint64(stat.Dev), Inode: uint64(stat.Ino)}
+}
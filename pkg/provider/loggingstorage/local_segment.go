@@ -0,0 +1,444 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Append-only segment files of the local logging storage provider
+
+package loggingstorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// segmentExtension is the extension of the files with the entries of a segment, one JSON document per line
+	segmentExtension = ".seg"
+	// deletedExtension is the extension of the files with the deleted entries of a segment, one ordinal per line
+	deletedExtension = ".del"
+)
+
+// indexedFields are the fields of the label index, the ones used in search filters
+var indexedFields = []entities.Field{
+	entities.NamespaceField,
+	entities.OrganizationIdField,
+	entities.AppDescriptorField,
+	entities.AppDescriptorNameField,
+	entities.AppInstanceIdField,
+	entities.AppInstanceNameField,
+	entities.ServiceGroupIdField,
+	entities.AppServiceGroupNameField,
+	entities.ServiceGroupInstanceIdField,
+	entities.ServiceIdField,
+	entities.AppServiceNameField,
+	entities.ServiceInstanceIdField,
+	entities.LevelField,
+}
+
+// localRecord is the time index entry of an entry of a segment
+type localRecord struct {
+	// timestamp of the entry in Unixnano time format
+	timestamp int64
+	// offset of the entry in the segment file
+	offset int64
+	// length of the entry, without the line break
+	length int
+	level  entities.Level
+}
+
+// localLabel is a value of an indexed field
+type localLabel struct {
+	field entities.Field
+	value string
+}
+
+// localSegment is an append-only file with the entries of a day. Its time and label indices
+// are kept in memory and rebuilt from the file when the segment is opened.
+type localSegment struct {
+	// day of the entries, YYYY.MM.DD
+	day string
+	// sequence of the segment in its day
+	sequence int
+	path     string
+	file     *os.File
+	size     int64
+	// minTime and maxTime are the timestamps of the oldest and newest entries
+	minTime int64
+	maxTime int64
+	// records are the index entries of the entries, indexed by ordinal
+	records []localRecord
+	// labels are the ordinals of the entries with each value of the indexed fields, in ascending order
+	labels map[localLabel][]int
+	// deleted are the ordinals of the deleted entries
+	deleted     map[int]bool
+	deletedFile *os.File
+}
+
+// segmentPath returns the path of the file of a segment
+func segmentPath(dir string, day string, sequence int) string {
+	return filepath.Join(dir, day, fmt.Sprintf("%06d%s", sequence, segmentExtension))
+}
+
+// segmentSequence returns the sequence of a segment file name
+func segmentSequence(name string) (int, bool) {
+	if !strings.HasSuffix(name, segmentExtension) {
+		return 0, false
+	}
+	sequence, err := strconv.Atoi(strings.TrimSuffix(name, segmentExtension))
+	if err != nil || sequence < 0 {
+		return 0, false
+	}
+	return sequence, true
+}
+
+// openSegment opens or creates a segment and rebuilds its indices. A partially written last
+// entry, from a crash while appending, is truncated.
+func openSegment(dir string, day string, sequence int) (*localSegment, derrors.Error) {
+	path := segmentPath(dir, day, sequence)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot open segment", err).WithParams(path)
+	}
+	segment := &localSegment{
+		day:      day,
+		sequence: sequence,
+		path:     path,
+		file:     file,
+		labels:   make(map[localLabel][]int),
+		deleted:  make(map[int]bool),
+	}
+
+	derr := segment.load()
+	if derr != nil {
+		file.Close()
+		return nil, derr
+	}
+	derr = segment.loadDeleted()
+	if derr != nil {
+		file.Close()
+		return nil, derr
+	}
+	return segment, nil
+}
+
+// load rebuilds the indices from the entries of the file
+func (s *localSegment) load() derrors.Error {
+	reader := bufio.NewReader(s.file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Incomplete last entry
+			if len(line) > 0 {
+				log.Warn().Str("segment", s.path).Int64("offset", offset).Msg("truncating incomplete entry")
+				if err := s.file.Truncate(offset); err != nil {
+					return derrors.NewInternalError("cannot truncate segment", err).WithParams(s.path)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return derrors.NewInternalError("cannot read segment", err).WithParams(s.path)
+		}
+		entry := &entities.LogEntry{}
+		err = json.Unmarshal(line, entry)
+		if err != nil {
+			return derrors.NewInternalError("segment entry deserialization error", err).WithParams(s.path, offset)
+		}
+		s.index(entry, offset, len(line)-1)
+		offset += int64(len(line))
+	}
+	s.size = offset
+	return nil
+}
+
+// loadDeleted reads the ordinals of the deleted entries
+func (s *localSegment) loadDeleted() derrors.Error {
+	file, err := os.Open(s.deletedPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return derrors.NewInternalError("cannot open deleted entries", err).WithParams(s.path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Incomplete lines from a crash are ignored, the entries are deleted again on the next expiration
+		ordinal, err := strconv.Atoi(scanner.Text())
+		if err == nil && ordinal >= 0 && ordinal < len(s.records) {
+			s.deleted[ordinal] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return derrors.NewInternalError("cannot read deleted entries", err).WithParams(s.path)
+	}
+	return nil
+}
+
+func (s *localSegment) deletedPath() string {
+	return strings.TrimSuffix(s.path, segmentExtension) + deletedExtension
+}
+
+// index adds an entry to the indices
+func (s *localSegment) index(entry *entities.LogEntry, offset int64, length int) {
+	ordinal := len(s.records)
+	timestamp := entry.Timestamp.UnixNano()
+	level, _ := entities.ParseLevel(entry.Level)
+	s.records = append(s.records, localRecord{
+		timestamp: timestamp,
+		offset:    offset,
+		length:    length,
+		level:     level,
+	})
+	if ordinal == 0 || timestamp < s.minTime {
+		s.minTime = timestamp
+	}
+	if ordinal == 0 || timestamp > s.maxTime {
+		s.maxTime = timestamp
+	}
+	for _, field := range indexedFields {
+		label := localLabel{field: field, value: entry.FieldValue(field)}
+		s.labels[label] = append(s.labels[label], ordinal)
+	}
+}
+
+// append writes the entries at the end of the segment, and syncs it
+func (s *localSegment) append(entries []*entities.LogEntry) derrors.Error {
+	var buffer []byte
+	lengths := make([]int, len(entries))
+	for i, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return derrors.NewInternalError("segment entry serialization error", err)
+		}
+		lengths[i] = len(data)
+		buffer = append(buffer, data...)
+		buffer = append(buffer, '\n')
+	}
+
+	_, err := s.file.WriteAt(buffer, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Remove what could have been written, so the file ends with a complete entry
+		_ = s.file.Truncate(s.size)
+		return derrors.NewInternalError("cannot write segment", err).WithParams(s.path)
+	}
+
+	offset := s.size
+	for i, entry := range entries {
+		s.index(entry, offset, lengths[i])
+		offset += int64(lengths[i]) + 1
+	}
+	s.size = offset
+	return nil
+}
+
+// read returns the entry with the given ordinal
+func (s *localSegment) read(ordinal int) (*entities.LogEntry, derrors.Error) {
+	record := s.records[ordinal]
+	data := make([]byte, record.length)
+	_, err := s.file.ReadAt(data, record.offset)
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot read segment", err).WithParams(s.path, record.offset)
+	}
+	entry := &entities.LogEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil {
+		return nil, derrors.NewInternalError("segment entry deserialization error", err).WithParams(s.path, record.offset)
+	}
+	return entry, nil
+}
+
+// delete marks entries as deleted, recording their ordinals before updating the index
+func (s *localSegment) delete(ordinals []int) derrors.Error {
+	if len(ordinals) == 0 {
+		return nil
+	}
+	if s.deletedFile == nil {
+		file, err := os.OpenFile(s.deletedPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return derrors.NewInternalError("cannot open deleted entries", err).WithParams(s.path)
+		}
+		s.deletedFile = file
+	}
+
+	var buffer strings.Builder
+	for _, ordinal := range ordinals {
+		buffer.WriteString(strconv.Itoa(ordinal))
+		buffer.WriteByte('\n')
+	}
+	_, err := s.deletedFile.WriteString(buffer.String())
+	if err == nil {
+		err = s.deletedFile.Sync()
+	}
+	if err != nil {
+		return derrors.NewInternalError("cannot write deleted entries", err).WithParams(s.path)
+	}
+
+	for _, ordinal := range ordinals {
+		s.deleted[ordinal] = true
+	}
+	return nil
+}
+
+// isEmpty checks if all the entries of the segment are deleted
+func (s *localSegment) isEmpty() bool {
+	return len(s.deleted) == len(s.records)
+}
+
+// overlaps checks if the segment may have entries between from and to, 0 meaning no limit
+func (s *localSegment) overlaps(from int64, to int64) bool {
+	if len(s.records) == 0 {
+		return false
+	}
+	return (from == 0 || s.maxTime >= from) && (to == 0 || s.minTime <= to)
+}
+
+// candidates returns the ordinals of the entries that are not deleted and match the filters
+// and minimum level of the request, in ascending order
+func (s *localSegment) candidates(request *entities.SearchRequest) []int {
+	var ordinals []int
+	clauses := 0
+	for field, values := range request.Filters {
+		if len(values) == 0 {
+			continue
+		}
+		// Entries with any of the values of the field
+		var matching []int
+		for _, value := range values {
+			matching = unionOrdinals(matching, s.labels[localLabel{field: field, value: value}])
+		}
+		switch {
+		case clauses == 0:
+			ordinals = matching
+		case request.IsUnionFilter:
+			ordinals = unionOrdinals(ordinals, matching)
+		default:
+			ordinals = intersectOrdinals(ordinals, matching)
+		}
+		clauses++
+	}
+	if clauses == 0 {
+		ordinals = make([]int, len(s.records))
+		for i := range ordinals {
+			ordinals[i] = i
+		}
+	}
+
+	result := make([]int, 0, len(ordinals))
+	for _, ordinal := range ordinals {
+		if s.deleted[ordinal] {
+			continue
+		}
+		// Entries without a known level are excluded
+		if request.MinLevel != entities.UnknownLevel && s.records[ordinal].level < request.MinLevel {
+			continue
+		}
+		result = append(result, ordinal)
+	}
+	return result
+}
+
+// tiebreaker returns a unique value of an entry, sorted as the segments and entries are
+func (s *localSegment) tiebreaker(ordinal int) string {
+	return fmt.Sprintf("%s/%06d/%010d", s.day, s.sequence, ordinal)
+}
+
+// close closes the files of the segment
+func (s *localSegment) close() {
+	s.file.Close()
+	if s.deletedFile != nil {
+		s.deletedFile.Close()
+	}
+}
+
+// remove closes and deletes the files of the segment
+func (s *localSegment) remove() derrors.Error {
+	s.close()
+	err := os.Remove(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return derrors.NewInternalError("cannot remove segment", err).WithParams(s.path)
+	}
+	err = os.Remove(s.deletedPath())
+	if err != nil && !os.IsNotExist(err) {
+		return derrors.NewInternalError("cannot remove deleted entries", err).WithParams(s.path)
+	}
+	return nil
+}
+
+// unionOrdinals returns the ordinals in any of two ascending lists, in ascending order
+func unionOrdinals(a []int, b []int) []int {
+	result := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			result = append(result, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// intersectOrdinals returns the ordinals in both ascending lists, in ascending order
+func intersectOrdinals(a []int, b []int) []int {
+	result := make([]int, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case b[j] < a[i]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// sortSegments sorts segments by day and sequence
+func sortSegments(segments []*localSegment) {
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].day != segments[j].day {
+			return segments[i].day < segments[j].day
+		}
+		return segments[i].sequence < segments[j].sequence
+	})
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// localEntry returns an entry of an application instance at a time
+func localEntry(appInstanceId string, timestamp time.Time, message string, level entities.Level) *entities.LogEntry {
+	entry := &entities.LogEntry{
+		Timestamp: timestamp.UTC(),
+		Msg:       message,
+		Kubernetes: entities.KubernetesEntry{
+			Namespace: "ns",
+			Labels: entities.KubernetesLabelsEntry{
+				OrganizationId: "org",
+				AppInstanceId:  appInstanceId,
+			},
+		},
+	}
+	if level != entities.UnknownLevel {
+		entry.Level = level.String()
+	}
+	return entry
+}
+
+func localMessages(entries entities.LogEntries) []string {
+	messages := make([]string, len(entries))
+	for i, entry := range entries {
+		messages[i] = entry.Msg
+	}
+	return messages
+}
+
+var _ = ginkgo.Describe("Local", func() {
+	var dir string
+	var local *Local
+	day := time.Date(2020, 1, 17, 10, 0, 0, 0, time.UTC)
+
+	open := func() {
+		var derr error
+		local, derr = NewLocal(&LocalOptions{Dir: dir, SegmentSize: 300})
+		gomega.Expect(derr).Should(gomega.BeNil())
+	}
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "local-storage")
+		gomega.Expect(err).Should(gomega.Succeed())
+		open()
+		derr := local.Append([]*entities.LogEntry{
+			localEntry("app1", day, "first starting", entities.InfoLevel),
+			localEntry("app2", day.Add(time.Second), "second other app", entities.InfoLevel),
+			localEntry("app1", day.Add(time.Second*2), "third connection refused", entities.ErrorLevel),
+			localEntry("app1", day.Add(time.Hour*24), "fourth next day", entities.UnknownLevel),
+		})
+		gomega.Expect(derr).Should(gomega.BeNil())
+		derr = local.Append([]*entities.LogEntry{
+			localEntry("app1", day.Add(time.Second*3), "fifth stopping", entities.WarnLevel),
+		})
+		gomega.Expect(derr).Should(gomega.BeNil())
+	})
+
+	ginkgo.AfterEach(func() {
+		local.Close()
+		os.RemoveAll(dir)
+	})
+
+	search := func(request *entities.SearchRequest, limit int) []string {
+		entries, derr := local.Search(context.Background(), request, limit)
+		gomega.Expect(derr).Should(gomega.BeNil())
+		return localMessages(entries)
+	}
+
+	app1 := entities.SearchFilter{entities.AppInstanceIdField: {"app1"}}
+
+	ginkgo.It("should search by filters, level, query and time range", func() {
+		gomega.Expect(search(&entities.SearchRequest{Filters: app1}, -1)).Should(gomega.Equal(
+			[]string{"first starting", "third connection refused", "fifth stopping", "fourth next day"}))
+		gomega.Expect(search(&entities.SearchRequest{Filters: app1, MinLevel: entities.WarnLevel}, -1)).Should(gomega.Equal(
+			[]string{"third connection refused", "fifth stopping"}))
+		gomega.Expect(search(&entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app2"}, entities.NamespaceField: {"other"}},
+		}, -1)).Should(gomega.BeEmpty())
+		gomega.Expect(search(&entities.SearchRequest{
+			Filters:       entities.SearchFilter{entities.AppInstanceIdField: {"app2"}, entities.NamespaceField: {"other"}},
+			IsUnionFilter: true,
+		}, -1)).Should(gomega.Equal([]string{"second other app"}))
+
+		query, derr := entities.ParseQuery("refused OR stopping")
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{Filters: app1, Query: query}, -1)).Should(gomega.Equal(
+			[]string{"third connection refused", "fifth stopping"}))
+
+		gomega.Expect(search(&entities.SearchRequest{
+			Filters: app1,
+			From:    day.Add(time.Second).UnixNano(),
+			To:      day.Add(time.Second * 3).UnixNano(),
+			Order:   entities.Descending,
+		}, -1)).Should(gomega.Equal([]string{"fifth stopping", "third connection refused"}))
+	})
+
+	ginkgo.It("should continue after the cursor of the last entry", func() {
+		request := &entities.SearchRequest{Order: entities.Descending}
+		pages := make([][]string, 0)
+		for {
+			entries, derr := local.Search(context.Background(), request, 2)
+			gomega.Expect(derr).Should(gomega.BeNil())
+			if len(entries) == 0 {
+				break
+			}
+			pages = append(pages, localMessages(entries))
+			request.After = entries[len(entries)-1].Cursor
+		}
+		gomega.Expect(pages).Should(gomega.Equal([][]string{
+			{"fourth next day", "fifth stopping"},
+			{"third connection refused", "second other app"},
+			{"first starting"},
+		}))
+	})
+
+	ginkgo.It("should list and remove the days", func() {
+		indices, derr := local.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(indices).Should(gomega.Equal([]string{"2020.01.17", "2020.01.18"}))
+
+		gomega.Expect(local.RemoveIndex(context.Background(), "2020.01.17")).Should(gomega.BeNil())
+		gomega.Expect(local.RemoveIndex(context.Background(), "2020.01.17")).Should(gomega.BeNil())
+		gomega.Expect(local.RemoveIndex(context.Background(), "../2020.01.18")).ShouldNot(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal([]string{"fourth next day"}))
+		_, err := os.Stat(filepath.Join(dir, "2020.01.17"))
+		gomega.Expect(os.IsNotExist(err)).Should(gomega.BeTrue())
+	})
+
+	ginkgo.It("should expire entries until to and keep them deleted when reopened", func() {
+		derr := local.Expire(context.Background(), &entities.SearchRequest{
+			Filters: app1,
+			To:      day.Add(time.Second * 2).UnixNano(),
+		})
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal(
+			[]string{"second other app", "fifth stopping", "fourth next day"}))
+
+		local.Close()
+		open()
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal(
+			[]string{"second other app", "fifth stopping", "fourth next day"}))
+
+		// Segments without entries are removed
+		derr = local.Expire(context.Background(), &entities.SearchRequest{})
+		gomega.Expect(derr).Should(gomega.BeNil())
+		indices, derr := local.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(indices).Should(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should start new segments and truncate incomplete entries when reopened", func() {
+		segments, err := filepath.Glob(filepath.Join(dir, "2020.01.17", "*"+segmentExtension))
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(len(segments)).Should(gomega.BeNumerically(">", 1))
+
+		local.Close()
+		last := segments[len(segments)-1]
+		file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+		gomega.Expect(err).Should(gomega.Succeed())
+		_, err = file.WriteString(`{"@timestamp":"2020-01-17T10:00:`)
+		gomega.Expect(err).Should(gomega.Succeed())
+		file.Close()
+
+		open()
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.HaveLen(5))
+		derr := local.Append([]*entities.LogEntry{localEntry("app1", day.Add(time.Second*4), "sixth", entities.UnknownLevel)})
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{From: day.Add(time.Second * 4).UnixNano()}, -1)).Should(gomega.Equal(
+			[]string{"sixth", "fourth next day"}))
+	})
+})
+
+var _ = ginkgo.Describe("ordinals", func() {
+	ginkgo.It("should merge and intersect sorted lists", func() {
+		gomega.Expect(unionOrdinals([]int{1, 3, 5}, []int{2, 3, 6})).Should(gomega.Equal([]int{1, 2, 3, 5, 6}))
+		gomega.Expect(unionOrdinals(nil, []int{2})).Should(gomega.Equal([]int{2}))
+		gomega.Expect(intersectOrdinals([]int{1, 3, 5}, []int{2, 3, 5})).Should(gomega.Equal([]int{3, 5}))
+		gomega.Expect(intersectOrdinals([]int{1}, nil)).Should(gomega.BeEmpty())
+	})
+})
@@ -18,9 +18,12 @@ package loggingstorage
 
 import (
 	"testing"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
 )
 
 func TestHandlerPackage(t *testing.T) {
-	//gomega.RegisterFailHandler(ginkgo.Fail)
-	//ginkgo.RunSpecs(t, "Loggingstorage package suite")
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Loggingstorage package suite")
 }
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Grafana Loki logging storage provider implementation
+
+package loggingstorage
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// LokiBackend is the name of the Loki provider
+const LokiBackend = "loki"
+
+// lokiMaxRange is the time range searched when a request has no start, within the default Loki limit
+const lokiMaxRange = time.Hour * 24 * 30
+
+func init() {
+	RegisterProvider(LokiBackend, func(config *ProviderConfig) (Provider, derrors.Error) {
+		return NewLoki(config.Address, config.RequestTimeout), nil
+	})
+}
+
+// Loki stores the log entries in Grafana Loki, with the Kubernetes labels as stream labels and
+// the log line as the entry. Loki has no indices: retention is managed by its compactor.
+type Loki struct {
+	address string
+	client  *httpClient
+}
+
+func NewLoki(address string, requestTimeout time.Duration) *Loki {
+	return &Loki{
+		address: address,
+		client:  newHTTPClient(address, requestTimeout),
+	}
+}
+
+// lokiQueryResult is the response of a range query of log streams
+type lokiQueryResult struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (l *Loki) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
+	log.Debug().Str("address", l.address).Msg("loki search")
+
+	query, derr := createLogQLQuery(request)
+	if derr != nil {
+		return nil, derr
+	}
+	log.Debug().Str("query", query).Msg("executing search")
+
+	// If no limit, we set to the default maximum window
+	if limit < 0 {
+		limit = entities.LimitPerSearch
+	}
+
+	// Loki returns entries in [start, end)
+	end := time.Now().UnixNano()
+	if request.To != 0 {
+		end = request.To + 1
+	}
+	start := request.From
+	if start == 0 {
+		start = end - lokiMaxRange.Nanoseconds()
+	}
+	direction := "forward"
+	if !request.Order.ToAscending() {
+		direction = "backward"
+	}
+
+	// Continue after the last entry. Loki has no tiebreaker, so entries with the very same
+	// timestamp as the last one of a page are skipped.
+	if request.After != nil {
+		if request.Order.ToAscending() {
+			start = request.After.Timestamp + 1
+		} else {
+			end = request.After.Timestamp
+		}
+	}
+	if start >= end {
+		return entities.LogEntries{}, nil
+	}
+
+	params := url.Values{
+		"query":     []string{query},
+		"start":     []string{strconv.FormatInt(start, 10)},
+		"end":       []string{strconv.FormatInt(end, 10)},
+		"limit":     []string{strconv.Itoa(limit)},
+		"direction": []string{direction},
+	}
+	result := &lokiQueryResult{}
+	derr = l.client.do(ctx, http.MethodGet, "/loki/api/v1/query_range", params, nil, result)
+	if derr != nil {
+		return nil, derr
+	}
+	if result.Data.ResultType != "streams" {
+		return nil, derrors.NewInternalError("unexpected loki result type").WithParams(result.Data.ResultType)
+	}
+
+	// Merge the entries of all the streams in the requested order
+	entries := make(entities.LogEntries, 0)
+	for _, stream := range result.Data.Result {
+		for _, value := range stream.Values {
+			timestamp, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, derrors.NewInternalError("loki entry deserialization error", err)
+			}
+			entries = append(entries, lokiLogEntry(stream.Stream, timestamp, value[1]))
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if request.Order.ToAscending() {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		}
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
+
+func (l *Loki) Expire(ctx context.Context, request *entities.SearchRequest) derrors.Error {
+	log.Debug().Str("address", l.address).Msg("loki expire")
+
+	// The delete API accepts a selector with line filters
+	query, derr := createLogQLDeleteQuery(request)
+	if derr != nil {
+		return derr
+	}
+
+	// Delete until to, the delete API takes Unix seconds
+	end := time.Now()
+	if request.To != 0 {
+		end = time.Unix(0, request.To)
+	}
+	params := url.Values{
+		"query": []string{query},
+		"start": []string{"0"},
+		"end":   []string{strconv.FormatInt(end.Unix(), 10)},
+	}
+	return l.client.do(ctx, http.MethodPost, "/loki/api/v1/delete", params, nil, nil)
+}
+
+// RemoveIndex is not supported, Loki has no indices
+func (l *Loki) RemoveIndex(ctx context.Context, index string) derrors.Error {
+	return derrors.NewUnimplementedError("loki has no indices").WithParams(index)
+}
+
+// GetIndexList returns no indices, Loki has none
+func (l *Loki) GetIndexList(ctx context.Context) ([]string, derrors.Error) {
+	return []string{}, nil
+}
+
+// lokiLogEntry returns the log entry of a line of a stream
+func lokiLogEntry(stream map[string]string, timestamp int64, line string) *entities.LogEntry {
+	label := func(field entities.Field) string {
+		return stream[lokiLabel(field)]
+	}
+	return &entities.LogEntry{
+		Timestamp: time.Unix(0, timestamp).UTC(),
+		Msg:       line,
+		Level:     label(entities.LevelField),
+		Kubernetes: entities.KubernetesEntry{
+			Namespace: label(entities.NamespaceField),
+			Labels: entities.KubernetesLabelsEntry{
+				OrganizationId:            label(entities.OrganizationIdField),
+				AppDescriptorId:           label(entities.AppDescriptorField),
+				AppDescriptorName:         label(entities.AppDescriptorNameField),
+				AppInstanceId:             label(entities.AppInstanceIdField),
+				AppInstanceName:           label(entities.AppInstanceNameField),
+				AppServiceGroupId:         label(entities.ServiceGroupIdField),
+				AppServiceGroupName:       label(entities.AppServiceGroupNameField),
+				AppServiceGroupInstanceId: label(entities.ServiceGroupInstanceIdField),
+				AppServiceId:              label(entities.ServiceIdField),
+				AppServiceName:            label(entities.AppServiceNameField),
+				AppServiceInstanceId:      label(entities.ServiceInstanceIdField),
+			},
+		},
+		Cursor: &entities.Cursor{
+			Timestamp: timestamp,
+		},
+	}
+}
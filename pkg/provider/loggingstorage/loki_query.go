@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Translation of search requests into LogQL queries
+
+package loggingstorage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+)
+
+const (
+	// kubernetesLabelsPrefix is the prefix of the fields of the Kubernetes labels
+	kubernetesLabelsPrefix = "kubernetes.labels."
+	// kubernetesPrefix is the prefix of the other Kubernetes fields
+	kubernetesPrefix = "kubernetes."
+)
+
+// lokiLabel returns the Loki label of a field: the Kubernetes label or field name, with the
+// characters that are not valid in label names replaced by underscores, as Promtail does
+func lokiLabel(field entities.Field) string {
+	name := strings.TrimPrefix(field.String(), kubernetesLabelsPrefix)
+	name = strings.TrimPrefix(name, kubernetesPrefix)
+	return strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
+
+// logQLBuilder collects the label matchers and line filters of a LogQL query
+type logQLBuilder struct {
+	matchers []string
+	filters  []string
+	// selective is set when a matcher selects streams by equality, which Loki requires
+	selective bool
+}
+
+// createLogQLQuery returns the query of a search request: its filters and query. The time
+// range is sent as parameters of the request.
+func createLogQLQuery(request *entities.SearchRequest) (string, derrors.Error) {
+	builder, derr := newLogQLBuilder(request)
+	if derr != nil {
+		return "", derr
+	}
+	return builder.query()
+}
+
+// createLogQLDeleteQuery returns the query of the entries an expiration deletes. Expirations
+// that select no streams, as the catch-all of the retention policies, delete from all the
+// streams, which Promtail ships with a namespace.
+func createLogQLDeleteQuery(request *entities.SearchRequest) (string, derrors.Error) {
+	builder, derr := newLogQLBuilder(request)
+	if derr != nil {
+		return "", derr
+	}
+	if !builder.selective {
+		builder.addMatcher(entities.NamespaceField, "=~", ".+")
+	}
+	return builder.query()
+}
+
+// newLogQLBuilder returns a builder with the matchers and line filters of a search request
+func newLogQLBuilder(request *entities.SearchRequest) (*logQLBuilder, derrors.Error) {
+	builder := &logQLBuilder{}
+	derr := builder.addFilters(request)
+	if derr != nil {
+		return nil, derr
+	}
+	if request.Query != nil {
+		derr = builder.addNode(request.Query, false)
+		if derr != nil {
+			return nil, derr
+		}
+	}
+	return builder, nil
+}
+
+// query returns the stream selector followed by the line filters
+func (b *logQLBuilder) query() (string, derrors.Error) {
+	selector, derr := b.selector()
+	if derr != nil {
+		return "", derr
+	}
+	return strings.Join(append([]string{selector}, b.filters...), " "), nil
+}
+
+// selector returns the stream selector with the matchers, which needs one selecting streams in Loki
+func (b *logQLBuilder) selector() (string, derrors.Error) {
+	if !b.selective {
+		return "", derrors.NewInvalidArgumentError("loki queries need at least one label filter")
+	}
+	return fmt.Sprintf("{%s}", strings.Join(b.matchers, ",")), nil
+}
+
+func (b *logQLBuilder) addMatcher(field entities.Field, operator string, value string) {
+	b.matchers = append(b.matchers, fmt.Sprintf("%s%s%s", lokiLabel(field), operator, strconv.Quote(value)))
+	if (operator == "=" || operator == "=~") && value != "" {
+		b.selective = true
+	}
+}
+
+func (b *logQLBuilder) addFilter(operator string, value string) {
+	b.filters = append(b.filters, fmt.Sprintf("%s %s", operator, strconv.Quote(value)))
+}
+
+// addFilters adds a matcher for every field of the filters, and one for the minimum level
+func (b *logQLBuilder) addFilters(request *entities.SearchRequest) derrors.Error {
+	// Sort the fields, so the same filters always result in the same query
+	fields := make([]entities.Field, 0, len(request.Filters))
+	for field, values := range request.Filters {
+		if len(values) > 0 {
+			fields = append(fields, field)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i] < fields[j]
+	})
+
+	// Stream selectors can only express intersections
+	if request.IsUnionFilter && len(fields) > 1 {
+		return derrors.NewUnimplementedError("loki does not support union filters")
+	}
+
+	for _, field := range fields {
+		values := request.Filters[field]
+		if len(values) == 1 {
+			b.addMatcher(field, "=", values[0])
+			continue
+		}
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = regexp.QuoteMeta(value)
+		}
+		b.addMatcher(field, "=~", strings.Join(quoted, "|"))
+	}
+
+	if request.MinLevel != entities.UnknownLevel {
+		names := entities.LevelNames()[request.MinLevel:]
+		b.addMatcher(entities.LevelField, "=~", strings.Join(names, "|"))
+	}
+
+	return nil
+}
+
+// addNode adds the matchers and line filters of a query node. LogQL can only express
+// intersections, so unions are limited to terms on the log line.
+func (b *logQLBuilder) addNode(node entities.QueryNode, negated bool) derrors.Error {
+	switch n := node.(type) {
+	case *entities.QueryAnd:
+		if negated {
+			return derrors.NewUnimplementedError("loki does not support negated intersections").WithParams(n.String())
+		}
+		for _, operand := range n.Operands {
+			derr := b.addNode(operand, false)
+			if derr != nil {
+				return derr
+			}
+		}
+		return nil
+	case *entities.QueryOr:
+		if negated {
+			// NOT (a OR b) is NOT a AND NOT b
+			for _, operand := range n.Operands {
+				derr := b.addNode(operand, true)
+				if derr != nil {
+					return derr
+				}
+			}
+			return nil
+		}
+		alternatives := make([]string, len(n.Operands))
+		for i, operand := range n.Operands {
+			term, ok := operand.(*entities.QueryTerm)
+			if !ok || !isLineTerm(term) {
+				return derrors.NewUnimplementedError("loki only supports unions of terms on the log line").WithParams(n.String())
+			}
+			alternatives[i] = fmt.Sprintf("(?:%s)", termRegex(term))
+		}
+		b.addFilter("|~", strings.Join(alternatives, "|"))
+		return nil
+	case *entities.QueryNot:
+		return b.addNode(n.Operand, !negated)
+	case *entities.QueryTerm:
+		b.addTerm(n, negated)
+		return nil
+	}
+	return derrors.NewInternalError("unknown query node").WithParams(node.String())
+}
+
+// addTerm adds a line filter for terms on the log line, and a label matcher otherwise
+func (b *logQLBuilder) addTerm(term *entities.QueryTerm, negated bool) {
+	if isLineTerm(term) {
+		switch {
+		case term.Kind == entities.RegexMatch || term.Kind == entities.WildcardMatch:
+			b.addFilter(choose(negated, "!~", "|~"), termRegex(term))
+		default:
+			b.addFilter(choose(negated, "!=", "|="), term.Value)
+		}
+		return
+	}
+	switch term.Kind {
+	case entities.RegexMatch, entities.WildcardMatch:
+		b.addMatcher(term.Field, choose(negated, "!~", "=~"), termRegex(term))
+	default:
+		b.addMatcher(term.Field, choose(negated, "!=", "="), term.Value)
+	}
+}
+
+// isLineTerm checks if a term matches the log line. Terms without a field only match the
+// log line, as the names are labels and a line filter cannot match them.
+func isLineTerm(term *entities.QueryTerm) bool {
+	return term.Field == "" || term.Field == entities.MessageField
+}
+
+// termRegex returns the regular expression matching a term
+func termRegex(term *entities.QueryTerm) string {
+	switch term.Kind {
+	case entities.RegexMatch:
+		return term.Value
+	case entities.WildcardMatch:
+		quoted := regexp.QuoteMeta(term.Value)
+		return strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(quoted)
+	}
+	return regexp.QuoteMeta(term.Value)
+}
+
+func choose(condition bool, ifTrue string, ifFalse string) string {
+	if condition {
+		return ifTrue
+	}
+	return ifFalse
+}
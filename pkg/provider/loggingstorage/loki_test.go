@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Loki", func() {
+	var server *httptest.Server
+	var requests []storageRequest
+	var provider *Loki
+
+	start := func(responses map[string]string) {
+		requests = []storageRequest{}
+		server = newStorageServer(responses, &requests)
+		provider = NewLoki(server.URL, time.Second)
+	}
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should merge the streams in the requested order", func() {
+		start(map[string]string{
+			"GET /loki/api/v1/query_range": `{"status":"success","data":{"resultType":"streams","result":[
+				{"stream":{"nalej_app_instance_id":"app","nalej_service_name":"api","level":"info"},"values":[["300","third"],["100","first"]]},
+				{"stream":{"nalej_app_instance_id":"app","nalej_service_name":"web"},"values":[["200","second"]]}
+			]}}`,
+		})
+		request := &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+			From:    50,
+			To:      500,
+			Order:   entities.Descending,
+		}
+
+		entries, derr := provider.Search(context.Background(), request, 2)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(entries).Should(gomega.HaveLen(2))
+		gomega.Expect(entries[0].Msg).Should(gomega.Equal("third"))
+		gomega.Expect(entries[0].Level).Should(gomega.Equal("info"))
+		gomega.Expect(entries[0].Kubernetes.Labels.AppServiceName).Should(gomega.Equal("api"))
+		gomega.Expect(entries[0].Cursor).Should(gomega.Equal(&entities.Cursor{Timestamp: 300}))
+		gomega.Expect(entries[1].Msg).Should(gomega.Equal("second"))
+
+		gomega.Expect(requests).Should(gomega.HaveLen(1))
+		params, err := url.ParseQuery(requests[0].query)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(params.Get("query")).Should(gomega.Equal(`{nalej_app_instance_id="app"}`))
+		gomega.Expect(params.Get("start")).Should(gomega.Equal("50"))
+		gomega.Expect(params.Get("end")).Should(gomega.Equal("501"))
+		gomega.Expect(params.Get("limit")).Should(gomega.Equal("2"))
+		gomega.Expect(params.Get("direction")).Should(gomega.Equal("backward"))
+	})
+
+	ginkgo.It("should continue before the cursor in descending order", func() {
+		start(map[string]string{
+			"GET /loki/api/v1/query_range": `{"status":"success","data":{"resultType":"streams","result":[]}}`,
+		})
+		request := &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+			From:    50,
+			Order:   entities.Descending,
+			After:   &entities.Cursor{Timestamp: 300},
+		}
+
+		entries, derr := provider.Search(context.Background(), request, 10)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(entries).Should(gomega.BeEmpty())
+		params, err := url.ParseQuery(requests[0].query)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(params.Get("end")).Should(gomega.Equal("300"))
+	})
+
+	ginkgo.It("should reject searches without label filters", func() {
+		start(map[string]string{})
+		_, derr := provider.Search(context.Background(), &entities.SearchRequest{}, 10)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.InvalidArgument))
+		gomega.Expect(requests).Should(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should delete the entries of the stream selector on expire", func() {
+		start(map[string]string{
+			"POST /loki/api/v1/delete": ``,
+		})
+		derr := provider.Expire(context.Background(), &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+			Query:   &entities.QueryNot{Operand: &entities.QueryTerm{Field: entities.ServiceIdField, Value: "svc"}},
+			To:      int64(time.Second) * 1000,
+		})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		params, err := url.ParseQuery(requests[0].query)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(params.Get("query")).Should(gomega.Equal(`{nalej_app_instance_id="app",nalej_service_id!="svc"}`))
+		gomega.Expect(params.Get("end")).Should(gomega.Equal("1000"))
+	})
+
+	ginkgo.It("should delete the entries of all the streams on expire without filters", func() {
+		start(map[string]string{
+			"POST /loki/api/v1/delete": ``,
+		})
+		// The catch-all of the retention policies only excludes some organizations
+		derr := provider.Expire(context.Background(), &entities.SearchRequest{
+			Query: &entities.QueryNot{Operand: &entities.QueryTerm{Field: entities.OrganizationIdField, Value: "org"}},
+		})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		params, err := url.ParseQuery(requests[0].query)
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(params.Get("query")).Should(gomega.Equal(`{nalej_organization!="org",namespace=~".+"}`))
+	})
+
+	ginkgo.It("should have no indices", func() {
+		start(map[string]string{})
+		indices, derr := provider.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(indices).Should(gomega.BeEmpty())
+		gomega.Expect(provider.RemoveIndex(context.Background(), "index")).ShouldNot(gomega.Succeed())
+	})
+})
+
+type logQLTest struct {
+	description string
+	query       string
+	minLevel    entities.Level
+	expected    string
+}
+
+// logQLFilters are the filters of all the logQLTests
+var logQLFilters = entities.SearchFilter{
+	entities.AppInstanceIdField:  {"app"},
+	entities.ServiceGroupIdField: {"sg1", "sg.2"},
+}
+
+const logQLSelector = `{nalej_app_instance_id="app",nalej_service_group_id=~"sg1|sg\\.2"`
+
+var logQLTests = []logQLTest{
+	{
+		description: "the filters",
+		expected:    logQLSelector + `}`,
+	},
+	{
+		description: "a minimum level",
+		minLevel:    entities.ErrorLevel,
+		expected:    logQLSelector + `,level=~"error|fatal"}`,
+	},
+	{
+		description: "line filters for words",
+		query:       `connection -refused`,
+		expected:    logQLSelector + `} |= "connection" != "refused"`,
+	},
+	{
+		description: "a single line filter for a union of terms",
+		query:       `timeout OR /fail(ed|ure)/`,
+		expected:    logQLSelector + `} |~ "(?:timeout)|(?:fail(ed|ure))"`,
+	},
+	{
+		description: "line filters for a negated union",
+		query:       `NOT (timeout OR retry*)`,
+		expected:    logQLSelector + `} != "timeout" !~ "retry.*"`,
+	},
+	{
+		description: "label matchers for fields",
+		query:       `service_name:api -level:debug`,
+		expected:    logQLSelector + `,nalej_service_name="api",level!="debug"}`,
+	},
+}
+
+var _ = ginkgo.Describe("createLogQLQuery", func() {
+	for _, test := range logQLTests {
+		test := test
+		ginkgo.It("should create "+test.description, func() {
+			request := &entities.SearchRequest{Filters: logQLFilters, MinLevel: test.minLevel}
+			if test.query != "" {
+				node, derr := entities.ParseQuery(test.query)
+				gomega.Expect(derr).Should(gomega.Succeed())
+				request.Query = node
+			}
+			logQL, derr := createLogQLQuery(request)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			gomega.Expect(logQL).Should(gomega.Equal(test.expected))
+		})
+	}
+
+	ginkgo.It("should reject union filters", func() {
+		_, derr := createLogQLQuery(&entities.SearchRequest{Filters: logQLFilters, IsUnionFilter: true})
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+	})
+
+	for _, query := range []string{"service_name:api OR error", "NOT (timeout AND retry)"} {
+		query := query
+		ginkgo.It("should reject "+query, func() {
+			node, derr := entities.ParseQuery(query)
+			gomega.Expect(derr).Should(gomega.Succeed())
+			_, derr = createLogQLQuery(&entities.SearchRequest{Filters: logQLFilters, Query: node})
+			gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		})
+	}
+})
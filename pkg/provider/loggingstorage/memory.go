@@ -0,0 +1,290 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// In-memory logging storage provider implementation, for tests and local development
+
+package loggingstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/rs/zerolog/log"
+)
+
+// MemoryBackend is the name of the in-memory provider
+const MemoryBackend = "memory"
+
+// MemoryIndexPrefix is the prefix of the names of the indices, followed by the day of their
+// entries, as the indices created by Filebeat
+const MemoryIndexPrefix = "filebeat-6.6.0-"
+
+func init() {
+	RegisterProvider(MemoryBackend, func(config *ProviderConfig) (Provider, derrors.Error) {
+		return NewMemory(), nil
+	})
+}
+
+// memoryEntry is a stored entry with its unique identifier
+type memoryEntry struct {
+	entry *entities.LogEntry
+	id    string
+}
+
+// Memory keeps the log entries in memory, in one index per day, and evaluates requests as
+// the ElasticSearch provider does: timestamps have millisecond precision, both ends of time
+// ranges are included and entries are sorted by timestamp and identifier.
+type Memory struct {
+	// mutex protects indices, created, sequence and diskBytes
+	mutex sync.RWMutex
+	// indices are the entries of every index, by name
+	indices map[string][]*memoryEntry
+	// created is the creation time of every index
+	created map[string]time.Time
+	// sequence is the identifier of the last entry added
+	sequence int64
+	// diskBytes is the size of the disk reported in the stats, 0 if unknown
+	diskBytes int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		indices: make(map[string][]*memoryEntry),
+		created: make(map[string]time.Time),
+	}
+}
+
+// MemoryIndexName returns the name of the index of the entries of a time
+func MemoryIndexName(timestamp time.Time) string {
+	return MemoryIndexPrefix + timestamp.UTC().Format("2006.01.02")
+}
+
+// Add stores copies of entries, in the index of the day of their timestamp
+func (m *Memory) Add(entries ...*entities.LogEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, entry := range entries {
+		stored := *entry
+		stored.Timestamp = entry.Timestamp.UTC().Truncate(time.Millisecond)
+		stored.Cursor = nil
+		m.sequence++
+		index := MemoryIndexName(stored.Timestamp)
+		m.createIndex(index)
+		m.indices[index] = append(m.indices[index], &memoryEntry{
+			entry: &stored,
+			id:    fmt.Sprintf("%020d", m.sequence),
+		})
+	}
+}
+
+// SetDiskSize sets the size of the disk the entries are stored on, so the stats report its usage
+func (m *Memory) SetDiskSize(bytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.diskBytes = bytes
+}
+
+// AddIndex creates an empty index, if it does not exist
+func (m *Memory) AddIndex(index string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.createIndex(index)
+}
+
+// SetIndexCreationDate creates an empty index, if it does not exist, and sets its creation time
+func (m *Memory) SetIndexCreationDate(index string, created time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.createIndex(index)
+	m.created[index] = created.UTC()
+}
+
+// createIndex creates an empty index created now, if it does not exist. The mutex must be held.
+func (m *Memory) createIndex(index string) {
+	if _, exists := m.indices[index]; !exists {
+		m.indices[index] = []*memoryEntry{}
+		m.created[index] = time.Now().UTC()
+	}
+}
+
+// memoryCursor returns the cursor of an entry, with the sort values that ElasticSearch returns
+func memoryCursor(stored *memoryEntry) *entities.Cursor {
+	return &entities.Cursor{
+		Timestamp:  stored.entry.Timestamp.UnixNano() / int64(time.Millisecond),
+		Tiebreaker: stored.id,
+	}
+}
+
+// compareCursors returns a negative number if a is sorted before b in ascending order, 0 if they are equal
+func compareCursors(a *entities.Cursor, b *entities.Cursor) int {
+	if a.Timestamp != b.Timestamp {
+		if a.Timestamp < b.Timestamp {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.Tiebreaker, b.Tiebreaker)
+}
+
+func (m *Memory) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
+	// If no limit, we set to the default maximum window
+	if limit < 0 {
+		limit = entities.LimitPerSearch
+	}
+	ascending := request.Order.ToAscending()
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matching := make([]*memoryEntry, 0)
+	for _, index := range m.indices {
+		for _, stored := range index {
+			if !request.Matches(stored.entry) {
+				continue
+			}
+			if request.After != nil {
+				comparison := compareCursors(memoryCursor(stored), request.After)
+				if comparison == 0 || (comparison < 0) == ascending {
+					continue
+				}
+			}
+			matching = append(matching, stored)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		comparison := compareCursors(memoryCursor(matching[i]), memoryCursor(matching[j]))
+		if ascending {
+			return comparison < 0
+		}
+		return comparison > 0
+	})
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+
+	result := make(entities.LogEntries, len(matching))
+	for i, stored := range matching {
+		entry := *stored.entry
+		entry.Cursor = memoryCursor(stored)
+		result[i] = &entry
+	}
+	log.Debug().Int("hits", len(result)).Msg("memory search")
+
+	return result, nil
+}
+
+func (m *Memory) Expire(ctx context.Context, request *entities.SearchRequest) derrors.Error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	deleted := 0
+	for name, index := range m.indices {
+		remaining := make([]*memoryEntry, 0, len(index))
+		for _, stored := range index {
+			if request.MatchesExpire(stored.entry) {
+				deleted++
+				continue
+			}
+			remaining = append(remaining, stored)
+		}
+		// Indices are kept, as ElasticSearch does
+		m.indices[name] = remaining
+	}
+	log.Debug().Int("deleted", deleted).Msg("expired entries")
+
+	return nil
+}
+
+func (m *Memory) RemoveIndex(ctx context.Context, index string) derrors.Error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.indices[index]; !exists {
+		log.Debug().Str("index", index).Msg("Index not exists")
+		return nil
+	}
+	delete(m.indices, index)
+	delete(m.created, index)
+	log.Debug().Str("index", index).Msg("Removed")
+
+	return nil
+}
+
+func (m *Memory) GetIndexList(ctx context.Context) ([]string, derrors.Error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	indexList := make([]string, 0, len(m.indices))
+	for index := range m.indices {
+		indexList = append(indexList, index)
+	}
+	sort.Strings(indexList)
+	return indexList, nil
+}
+
+// GetStorageStats returns the size of the indices as the size of their entries in JSON. The disk
+// usage is the size of all the indices, if the size of the disk is set.
+func (m *Memory) GetStorageStats(ctx context.Context) (*StorageStats, derrors.Error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	stats := &StorageStats{
+		Indices: make([]IndexStats, 0, len(m.indices)),
+	}
+	var used int64
+	for name, index := range m.indices {
+		indexStats := IndexStats{
+			Name:      name,
+			Documents: int64(len(index)),
+		}
+		for _, stored := range index {
+			// Marshalling our own structures cannot fail
+			data, _ := json.Marshal(stored.entry)
+			indexStats.SizeBytes += int64(len(data))
+		}
+		used += indexStats.SizeBytes
+		stats.Indices = append(stats.Indices, indexStats)
+	}
+	sort.Slice(stats.Indices, func(i, j int) bool {
+		return stats.Indices[i].Name < stats.Indices[j].Name
+	})
+	if m.diskBytes > 0 {
+		stats.Disk = &DiskUsage{
+			UsedBytes:  used,
+			TotalBytes: m.diskBytes,
+		}
+	}
+	return stats, nil
+}
+
+// GetIndexCreationDates returns the creation time of every index
+func (m *Memory) GetIndexCreationDates(ctx context.Context) (map[string]time.Time, derrors.Error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	dates := make(map[string]time.Time, len(m.created))
+	for index, created := range m.created {
+		dates[index] = created
+	}
+	return dates, nil
+}
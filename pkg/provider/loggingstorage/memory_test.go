@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Memory", func() {
+	var memory *Memory
+	day := time.Date(2020, 1, 17, 10, 0, 0, 0, time.UTC)
+
+	ginkgo.BeforeEach(func() {
+		memory = NewMemory()
+		memory.Add(
+			localEntry("app1", day, "first starting", entities.InfoLevel),
+			localEntry("app2", day.Add(time.Second), "second other app", entities.InfoLevel),
+			localEntry("app1", day.Add(time.Second*2+time.Microsecond), "third connection refused", entities.ErrorLevel),
+			localEntry("app1", day.Add(time.Hour*24), "fourth next day", entities.UnknownLevel),
+			localEntry("app1", day.Add(time.Second*2), "fifth same time", entities.WarnLevel),
+		)
+	})
+
+	search := func(request *entities.SearchRequest, limit int) []string {
+		entries, derr := memory.Search(context.Background(), request, limit)
+		gomega.Expect(derr).Should(gomega.BeNil())
+		return localMessages(entries)
+	}
+
+	app1 := entities.SearchFilter{entities.AppInstanceIdField: {"app1"}}
+
+	ginkgo.It("should search by filters, level, query and time range", func() {
+		gomega.Expect(search(&entities.SearchRequest{Filters: app1}, -1)).Should(gomega.Equal(
+			[]string{"first starting", "third connection refused", "fifth same time", "fourth next day"}))
+		gomega.Expect(search(&entities.SearchRequest{Filters: app1, MinLevel: entities.WarnLevel}, -1)).Should(gomega.Equal(
+			[]string{"third connection refused", "fifth same time"}))
+
+		query, derr := entities.ParseQuery("connection OR next")
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{Query: query, Order: entities.Descending}, -1)).Should(gomega.Equal(
+			[]string{"fourth next day", "third connection refused"}))
+
+		// Timestamps have millisecond precision, and both ends are included
+		gomega.Expect(search(&entities.SearchRequest{
+			From: day.Add(time.Second).UnixNano(),
+			To:   day.Add(time.Second * 2).UnixNano(),
+		}, -1)).Should(gomega.Equal([]string{"second other app", "third connection refused", "fifth same time"}))
+		gomega.Expect(search(&entities.SearchRequest{}, 2)).Should(gomega.HaveLen(2))
+	})
+
+	ginkgo.It("should continue after the cursor of the last entry", func() {
+		request := &entities.SearchRequest{Order: entities.Descending}
+		pages := make([][]string, 0)
+		for {
+			entries, derr := memory.Search(context.Background(), request, 2)
+			gomega.Expect(derr).Should(gomega.BeNil())
+			if len(entries) == 0 {
+				break
+			}
+			pages = append(pages, localMessages(entries))
+			request.After = entries[len(entries)-1].Cursor
+		}
+		gomega.Expect(pages).Should(gomega.Equal([][]string{
+			{"fourth next day", "fifth same time"},
+			{"third connection refused", "second other app"},
+			{"first starting"},
+		}))
+	})
+
+	ginkgo.It("should expire entries until to and keep the indices", func() {
+		derr := memory.Expire(context.Background(), &entities.SearchRequest{Filters: app1, To: day.Add(time.Second * 2).UnixNano()})
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal([]string{"second other app", "fourth next day"}))
+
+		indices, derr := memory.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(indices).Should(gomega.Equal([]string{"filebeat-6.6.0-2020.01.17", "filebeat-6.6.0-2020.01.18"}))
+	})
+
+	ginkgo.It("should remove indices", func() {
+		memory.AddIndex("filebeat-6.6.0-2020.01.01")
+		gomega.Expect(memory.RemoveIndex(context.Background(), "filebeat-6.6.0-2020.01.17")).Should(gomega.BeNil())
+		gomega.Expect(memory.RemoveIndex(context.Background(), "filebeat-6.6.0-2020.01.17")).Should(gomega.BeNil())
+		indices, derr := memory.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(indices).Should(gomega.Equal([]string{"filebeat-6.6.0-2020.01.01", "filebeat-6.6.0-2020.01.18"}))
+		gomega.Expect(search(&entities.SearchRequest{}, -1)).Should(gomega.Equal([]string{"fourth next day"}))
+	})
+
+	ginkgo.It("should report the creation date of the indices", func() {
+		created := day.Add(-time.Hour)
+		memory.SetIndexCreationDate("filebeat-000001", created)
+		dates, derr := memory.GetIndexCreationDates(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(dates).Should(gomega.HaveLen(3))
+		gomega.Expect(dates["filebeat-000001"]).Should(gomega.Equal(created))
+
+		gomega.Expect(memory.RemoveIndex(context.Background(), "filebeat-000001")).Should(gomega.BeNil())
+		dates, derr = memory.GetIndexCreationDates(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(dates).Should(gomega.HaveLen(2))
+	})
+
+	ginkgo.It("should report the size of the indices and the disk usage", func() {
+		stats, derr := memory.GetStorageStats(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(stats.Indices).Should(gomega.HaveLen(2))
+		gomega.Expect(stats.Indices[0].Name).Should(gomega.Equal("filebeat-6.6.0-2020.01.17"))
+		gomega.Expect(stats.Indices[0].Documents).Should(gomega.Equal(int64(4)))
+		gomega.Expect(stats.Indices[0].SizeBytes).Should(gomega.BeNumerically(">", stats.Indices[1].SizeBytes))
+		gomega.Expect(stats.Disk).Should(gomega.BeNil())
+
+		memory.SetDiskSize(stats.Indices[0].SizeBytes * 2)
+		stats, derr = memory.GetStorageStats(context.Background())
+		gomega.Expect(derr).Should(gomega.BeNil())
+		gomega.Expect(stats.Disk.UsedBytes).Should(gomega.Equal(stats.Indices[0].SizeBytes + stats.Indices[1].SizeBytes))
+	})
+})
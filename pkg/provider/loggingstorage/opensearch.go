@@ -0,0 +1,301 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// OpenSearch logging storage provider implementation
+
+package loggingstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/olivere/elastic"
+	"github.com/rs/zerolog/log"
+)
+
+// OpenSearchBackend is the name of the OpenSearch provider
+const OpenSearchBackend = "opensearch"
+
+func init() {
+	RegisterProvider(OpenSearchBackend, func(config *ProviderConfig) (Provider, derrors.Error) {
+		provider := NewOpenSearch(config.Address, config.RequestTimeout)
+		provider.ExpireIndices = config.ExpireIndices
+		return provider, nil
+	})
+}
+
+// OpenSearch stores the log entries in OpenSearch. It uses the REST API directly, as the responses
+// are not compatible with the ElasticSearch 6 client, but builds the same queries.
+type OpenSearch struct {
+	address string
+	client  *httpClient
+	// ExpireIndices are the index patterns entries are deleted from, all if empty
+	ExpireIndices []string
+}
+
+func NewOpenSearch(address string, requestTimeout time.Duration) *OpenSearch {
+	return &OpenSearch{
+		address: address,
+		client:  newHTTPClient(address, requestTimeout),
+	}
+}
+
+// openSearchResult is the part of a search response we use
+type openSearchResult struct {
+	Hits struct {
+		Hits []*elastic.SearchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+// openSearchIndex is an entry of the index list
+type openSearchIndex struct {
+	Index     string `json:"index"`
+	StoreSize string `json:"store.size"`
+	DocsCount string `json:"docs.count"`
+}
+
+// openSearchSettings are the settings of an index
+type openSearchSettings struct {
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// openSearchAllocation is the disk usage of a node
+type openSearchAllocation struct {
+	DiskUsed  string `json:"disk.used"`
+	DiskTotal string `json:"disk.total"`
+}
+
+// Start installs the ingest pipeline until it succeeds or ctx is done
+func (o *OpenSearch) Start(ctx context.Context) {
+	go installPipelineLoop(ctx, o.InstallPipeline)
+}
+
+// InstallPipeline creates or updates the ingest pipeline of the log entries, and then makes it
+// the default pipeline of the new and existing Filebeat indices
+func (o *OpenSearch) InstallPipeline(ctx context.Context) derrors.Error {
+	pipeline := json.RawMessage(ingestPipeline())
+	derr := o.client.do(ctx, http.MethodPut, fmt.Sprintf("/_ingest/pipeline/%s", PipelineName), nil, pipeline, nil)
+	if derr != nil {
+		return derr
+	}
+	derr = o.client.do(ctx, http.MethodPut, fmt.Sprintf("/_template/%s", PipelineName), nil, pipelineTemplate(), nil)
+	if derr != nil {
+		return derr
+	}
+	derr = o.client.do(ctx, http.MethodPut, fmt.Sprintf("/%s/_settings", PipelineIndexPattern), nil, pipelineSettings(), nil)
+	if derr != nil && derr.Type() != derrors.NotFound {
+		return derr
+	}
+	return nil
+}
+
+func (o *OpenSearch) Search(ctx context.Context, request *entities.SearchRequest, limit int) (entities.LogEntries, derrors.Error) {
+	log.Debug().Str("address", o.address).Msg("opensearch search")
+
+	query, err := createSearchQuery(request).Source()
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create opensearch query", err)
+	}
+
+	// If no limit, we set to the default maximum window
+	if limit < 0 {
+		limit = entities.LimitPerSearch
+	}
+
+	// Sort on the timestamp and a unique field, so we can continue after the last entry with search_after
+	order := "asc"
+	if !request.Order.ToAscending() {
+		order = "desc"
+	}
+	tiebreaker, err := tiebreakerSort(request.Order.ToAscending()).Source()
+	if err != nil {
+		return nil, derrors.NewInternalError("cannot create opensearch sort", err)
+	}
+	body := map[string]interface{}{
+		"query": query,
+		"size":  limit,
+		"sort": []interface{}{
+			map[string]interface{}{entities.TimestampField.String(): order},
+			tiebreaker,
+		},
+	}
+	if request.After != nil {
+		body["search_after"] = []interface{}{request.After.Timestamp, request.After.Tiebreaker}
+	}
+
+	result := &openSearchResult{}
+	derr := o.client.do(ctx, http.MethodPost, "/_search", nil, body, result)
+	if derr != nil {
+		return nil, derr
+	}
+
+	return getLogEntries(result.Hits.Hits)
+}
+
+func (o *OpenSearch) Expire(ctx context.Context, request *entities.SearchRequest) derrors.Error {
+	log.Debug().Str("address", o.address).Msg("opensearch expire")
+
+	query, err := createExpireQuery(request).Source()
+	if err != nil {
+		return derrors.NewInternalError("cannot create opensearch query", err)
+	}
+
+	result := &elastic.BulkIndexByScrollResponse{}
+	// Refresh, so the deleted entries are not found by the next searches
+	params := expireParams()
+	derr := o.client.do(ctx, http.MethodPost, o.deleteByQueryPath(), params, map[string]interface{}{"query": query}, result)
+	if derr != nil {
+		return derr
+	}
+	log.Debug().Int64("deleted", result.Deleted).Msg("expired entries")
+
+	// Flush deleted docs
+	return o.client.do(ctx, http.MethodPost, "/_flush", nil, nil, nil)
+}
+
+// deleteByQueryPath returns the path of the deletions by query in the expired indices
+func (o *OpenSearch) deleteByQueryPath() string {
+	return fmt.Sprintf("/%s/_delete_by_query", expireIndices(o.ExpireIndices))
+}
+
+// expireParams returns the parameters of the deletions by query, which refresh the indices and
+// skip the patterns matching no index
+func expireParams() url.Values {
+	return url.Values{
+		"refresh":            []string{"true"},
+		"ignore_unavailable": []string{"true"},
+		"allow_no_indices":   []string{"true"},
+	}
+}
+
+// StartExpire starts a delete by query task with the entries Expire would delete. The deleted
+// entries are refreshed once the task completes, instead of flushed.
+func (o *OpenSearch) StartExpire(ctx context.Context, request *entities.SearchRequest) (string, derrors.Error) {
+	query, err := createExpireQuery(request).Source()
+	if err != nil {
+		return "", derrors.NewInternalError("cannot create opensearch query", err)
+	}
+
+	result := &elastic.StartTaskResult{}
+	params := expireParams()
+	params.Set("wait_for_completion", "false")
+	derr := o.client.do(ctx, http.MethodPost, o.deleteByQueryPath(), params, map[string]interface{}{"query": query}, result)
+	if derr != nil {
+		return "", derr
+	}
+	log.Debug().Str("task", result.TaskId).Msg("expire task started")
+	return result.TaskId, nil
+}
+
+// GetExpireTask returns the progress of a delete by query task
+func (o *OpenSearch) GetExpireTask(ctx context.Context, taskId string) (*ExpireTask, derrors.Error) {
+	response := json.RawMessage{}
+	derr := o.client.do(ctx, http.MethodGet, fmt.Sprintf("/_tasks/%s", url.PathEscape(taskId)), nil, nil, &response)
+	if derr != nil {
+		return nil, derr
+	}
+	return expireTask(response)
+}
+
+func (o *OpenSearch) RemoveIndex(ctx context.Context, index string) derrors.Error {
+	path := fmt.Sprintf("/%s", url.PathEscape(index))
+	derr := o.client.do(ctx, http.MethodHead, path, nil, nil, nil)
+	if derr != nil {
+		if derr.Type() == derrors.NotFound {
+			log.Debug().Str("index", index).Msg("Index not exists")
+			return nil
+		}
+		return derr
+	}
+
+	derr = o.client.do(ctx, http.MethodDelete, path, nil, nil, nil)
+	if derr != nil {
+		return derr
+	}
+	log.Debug().Str("index", index).Msg("Removed")
+
+	return nil
+}
+
+func (o *OpenSearch) GetIndexList(ctx context.Context) ([]string, derrors.Error) {
+	indices := make([]openSearchIndex, 0)
+	derr := o.client.do(ctx, http.MethodGet, "/_cat/indices", url.Values{"format": []string{"json"}}, nil, &indices)
+	if derr != nil {
+		return nil, derr
+	}
+
+	indexList := make([]string, 0, len(indices))
+	for _, index := range indices {
+		indexList = append(indexList, index.Index)
+	}
+	return indexList, nil
+}
+
+// GetStorageStats returns the size of the indices and the disk usage of the data nodes
+func (o *OpenSearch) GetStorageStats(ctx context.Context) (*StorageStats, derrors.Error) {
+	params := url.Values{"format": []string{"json"}, "bytes": []string{"b"}}
+	indices := make([]openSearchIndex, 0)
+	derr := o.client.do(ctx, http.MethodGet, "/_cat/indices", params, nil, &indices)
+	if derr != nil {
+		return nil, derr
+	}
+	stats := &StorageStats{
+		Indices: make([]IndexStats, 0, len(indices)),
+	}
+	for _, index := range indices {
+		stats.Indices = append(stats.Indices, IndexStats{
+			Name:      index.Index,
+			SizeBytes: parseBytes(index.StoreSize),
+			Documents: parseCount(index.DocsCount),
+		})
+	}
+
+	allocation := make([]openSearchAllocation, 0)
+	derr = o.client.do(ctx, http.MethodGet, "/_cat/allocation", params, nil, &allocation)
+	if derr != nil {
+		return nil, derr
+	}
+	used := make([]string, len(allocation))
+	total := make([]string, len(allocation))
+	for i, node := range allocation {
+		used[i] = node.DiskUsed
+		total[i] = node.DiskTotal
+	}
+	stats.Disk = diskUsage(used, total)
+
+	return stats, nil
+}
+
+// GetIndexCreationDates returns the creation time of every index
+func (o *OpenSearch) GetIndexCreationDates(ctx context.Context) (map[string]time.Time, derrors.Error) {
+	response := make(map[string]openSearchSettings)
+	path := fmt.Sprintf("/_all/_settings/%s", creationDateSetting)
+	derr := o.client.do(ctx, http.MethodGet, path, url.Values{"flat_settings": []string{"true"}}, nil, &response)
+	if derr != nil {
+		return nil, derr
+	}
+	settings := make(map[string]map[string]interface{}, len(response))
+	for index, indexSettings := range response {
+		settings[index] = indexSettings.Settings
+	}
+	return creationDates(settings), nil
+}
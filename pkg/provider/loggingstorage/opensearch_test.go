@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loggingstorage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/unified-logging/pkg/entities"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// storageRequest is a request received by a fake storage server
+type storageRequest struct {
+	method string
+	path   string
+	query  string
+	body   string
+}
+
+// newStorageServer returns a server that records the requests and answers them with
+// the responses of their method and path
+func newStorageServer(responses map[string]string, requests *[]storageRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, storageRequest{r.Method, r.URL.Path, r.URL.RawQuery, string(body)})
+		response, exists := responses[r.Method+" "+r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	}))
+}
+
+var _ = ginkgo.Describe("OpenSearch", func() {
+	var server *httptest.Server
+	var requests []storageRequest
+	var provider *OpenSearch
+
+	start := func(responses map[string]string) {
+		requests = []storageRequest{}
+		server = newStorageServer(responses, &requests)
+		provider = NewOpenSearch(server.URL, time.Second)
+	}
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should search after the cursor and return the cursor of every entry", func() {
+		start(map[string]string{
+			"POST /_search": `{"hits":{"total":{"value":1,"relation":"eq"},"hits":[
+				{"_id":"doc1","_source":{"@timestamp":"2020-01-02T03:04:05Z","message":"hello","level":"info"},"sort":[1577934245000,"doc1"]}
+			]}}`,
+		})
+		request := &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+			Order:   entities.Descending,
+			After:   &entities.Cursor{Timestamp: 1577934246000, Tiebreaker: "doc0"},
+		}
+
+		entries, derr := provider.Search(context.Background(), request, 10)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(entries).Should(gomega.HaveLen(1))
+		gomega.Expect(entries[0].Msg).Should(gomega.Equal("hello"))
+		gomega.Expect(entries[0].Level).Should(gomega.Equal("info"))
+		gomega.Expect(entries[0].Cursor).Should(gomega.Equal(&entities.Cursor{Timestamp: 1577934245000, Tiebreaker: "doc1"}))
+
+		gomega.Expect(requests).Should(gomega.HaveLen(1))
+		query, err := createSearchQuery(request).Source()
+		gomega.Expect(err).Should(gomega.Succeed())
+		expected, err := json.Marshal(map[string]interface{}{
+			"query":        query,
+			"size":         10,
+			"sort":         []interface{}{map[string]string{"@timestamp": "desc"}, map[string]interface{}{"event_id": map[string]string{"order": "desc", "missing": "", "unmapped_type": "keyword"}}},
+			"search_after": []interface{}{1577934246000, "doc0"},
+		})
+		gomega.Expect(err).Should(gomega.Succeed())
+		gomega.Expect(requests[0].body).Should(gomega.MatchJSON(expected))
+	})
+
+	ginkgo.It("should return the error of a failed search", func() {
+		start(map[string]string{})
+		_, derr := provider.Search(context.Background(), &entities.SearchRequest{}, 10)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should delete the entries of the expired indices and flush on expire", func() {
+		start(map[string]string{
+			"POST /filebeat-*,-.*/_delete_by_query": `{"deleted":2}`,
+			"POST /_flush":                          `{}`,
+		})
+		provider.ExpireIndices = []string{"filebeat-*", "-.*"}
+		derr := provider.Expire(context.Background(), &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+		})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(requests).Should(gomega.HaveLen(2))
+		gomega.Expect(requests[0].path).Should(gomega.Equal("/filebeat-*,-.*/_delete_by_query"))
+		gomega.Expect(requests[0].query).Should(gomega.Equal("allow_no_indices=true&ignore_unavailable=true&refresh=true"))
+		gomega.Expect(requests[0].body).Should(gomega.ContainSubstring(`"app"`))
+		gomega.Expect(requests[1].path).Should(gomega.Equal("/_flush"))
+	})
+
+	ginkgo.It("should start an expire task and report its progress", func() {
+		start(map[string]string{
+			"POST /_all/_delete_by_query": `{"task":"node1:42"}`,
+			"GET /_tasks/node1:42": `{"completed":true,"task":{"status":{"total":3,"deleted":1}},
+				"response":{"total":3,"deleted":2,"failures":[{"index":"filebeat","cause":{"type":"version_conflict_engine_exception"}}]}}`,
+		})
+		taskId, derr := provider.StartExpire(context.Background(), &entities.SearchRequest{
+			Filters: entities.SearchFilter{entities.AppInstanceIdField: {"app"}},
+		})
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(taskId).Should(gomega.Equal("node1:42"))
+		gomega.Expect(requests[0].query).Should(gomega.Equal("allow_no_indices=true&ignore_unavailable=true&refresh=true&wait_for_completion=false"))
+
+		task, derr := provider.GetExpireTask(context.Background(), taskId)
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(task.Completed).Should(gomega.BeTrue())
+		gomega.Expect(task.Total).Should(gomega.Equal(int64(3)))
+		gomega.Expect(task.Deleted).Should(gomega.Equal(int64(2)))
+		gomega.Expect(task.Failures).Should(gomega.HaveLen(1))
+		gomega.Expect(task.Failures[0]).Should(gomega.ContainSubstring("version_conflict_engine_exception"))
+
+		_, derr = provider.GetExpireTask(context.Background(), "node1:43")
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.NotFound))
+	})
+
+	ginkgo.It("should not delete an index that does not exist", func() {
+		start(map[string]string{})
+		derr := provider.RemoveIndex(context.Background(), "filebeat-6.6.0-2020.01.01")
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(requests).Should(gomega.HaveLen(1))
+		gomega.Expect(requests[0].method).Should(gomega.Equal(http.MethodHead))
+	})
+
+	ginkgo.It("should delete an existing index", func() {
+		start(map[string]string{
+			"HEAD /filebeat-6.6.0-2020.01.01":   ``,
+			"DELETE /filebeat-6.6.0-2020.01.01": `{"acknowledged":true}`,
+		})
+		derr := provider.RemoveIndex(context.Background(), "filebeat-6.6.0-2020.01.01")
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(requests).Should(gomega.HaveLen(2))
+		gomega.Expect(requests[1].method).Should(gomega.Equal(http.MethodDelete))
+	})
+
+	ginkgo.It("should list the indices", func() {
+		start(map[string]string{
+			"GET /_cat/indices": `[{"index":"filebeat-6.6.0-2020.01.01"},{"index":"filebeat-6.6.0-2020.01.02"}]`,
+		})
+		indices, derr := provider.GetIndexList(context.Background())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(indices).Should(gomega.Equal([]string{"filebeat-6.6.0-2020.01.01", "filebeat-6.6.0-2020.01.02"}))
+		gomega.Expect(requests[0].query).Should(gomega.Equal("format=json"))
+	})
+
+	ginkgo.It("should report the size of the indices and the disk usage", func() {
+		start(map[string]string{
+			"GET /_cat/indices":    `[{"index":"filebeat-6.6.0-2020.01.01","store.size":"2048","docs.count":"10"},{"index":".kibana","store.size":null}]`,
+			"GET /_cat/allocation": `[{"disk.used":"600","disk.total":"1000"},{"disk.used":"200","disk.total":"1000"},{"node":"UNASSIGNED"}]`,
+		})
+		stats, derr := provider.GetStorageStats(context.Background())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(stats.Indices).Should(gomega.Equal([]IndexStats{
+			{Name: "filebeat-6.6.0-2020.01.01", SizeBytes: 2048, Documents: 10},
+			{Name: ".kibana"},
+		}))
+		gomega.Expect(stats.Disk).Should(gomega.Equal(&DiskUsage{UsedBytes: 800, TotalBytes: 2000}))
+		gomega.Expect(stats.Disk.Percent()).Should(gomega.Equal(40.0))
+		gomega.Expect(requests[0].query).Should(gomega.Equal("bytes=b&format=json"))
+	})
+
+	ginkgo.It("should return the creation date of the indices", func() {
+		start(map[string]string{
+			"GET /_all/_settings/index.creation_date": `{"filebeat-000001":{"settings":{"index.creation_date":"1579219200000"}},".kibana":{"settings":{}}}`,
+		})
+		dates, derr := provider.GetIndexCreationDates(context.Background())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(dates).Should(gomega.Equal(map[string]time.Time{
+			"filebeat-000001": time.Date(2020, 1, 17, 0, 0, 0, 0, time.UTC),
+		}))
+		gomega.Expect(requests[0].query).Should(gomega.Equal("flat_settings=true"))
+	})
+
+	ginkgo.It("should install the ingest pipeline as the default one of the Filebeat indices", func() {
+		start(map[string]string{
+			"PUT /_ingest/pipeline/" + PipelineName: `{"acknowledged":true}`,
+			"PUT /_template/" + PipelineName:        `{"acknowledged":true}`,
+			"PUT /filebeat-*/_settings":             `{"acknowledged":true}`,
+		})
+		derr := provider.InstallPipeline(context.Background())
+		gomega.Expect(derr).Should(gomega.Succeed())
+		gomega.Expect(requests).Should(gomega.HaveLen(3))
+		gomega.Expect(requests[0].body).Should(gomega.MatchJSON(ingestPipeline()))
+		gomega.Expect(requests[1].body).Should(gomega.MatchJSON(`{"index_patterns":["filebeat-*"],"settings":{"index.default_pipeline":"unified-logging"}}`))
+		gomega.Expect(requests[2].body).Should(gomega.MatchJSON(`{"index.default_pipeline":"unified-logging"}`))
+	})
+})
+
+var _ = ginkgo.Describe("httpClient", func() {
+	ginkgo.It("should add the scheme to host:port addresses", func() {
+		gomega.Expect(newHTTPClient("localhost:9200/", 0).baseURL).Should(gomega.Equal("http://localhost:9200"))
+		gomega.Expect(newHTTPClient("https://opensearch:9200", 0).baseURL).Should(gomega.Equal("https://opensearch:9200"))
+	})
+
+	ginkgo.It("should return unavailable when the server cannot be reached", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		derr := newHTTPClient(server.URL, time.Second).do(context.Background(), http.MethodGet, "/", nil, nil, nil)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Unavailable))
+	})
+
+	ginkgo.It("should include the body of failed responses in the error", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("parsing_exception"))
+		}))
+		defer server.Close()
+		derr := newHTTPClient(server.URL, time.Second).do(context.Background(), http.MethodGet, "/", nil, nil, nil)
+		gomega.Expect(derr).ShouldNot(gomega.Succeed())
+		gomega.Expect(derr.Type()).Should(gomega.Equal(derrors.Internal))
+		gomega.Expect(derr.DebugReport()).Should(gomega.ContainSubstring("parsing_exception"))
+	})
+})
@@ -20,6 +20,7 @@ package loggingstorage
 
 import (
 	"context"
+	"time"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/unified-logging/pkg/entities"
@@ -32,3 +33,83 @@ type Provider interface {
 	RemoveIndex(ctx context.Context, index string) derrors.Error
 	GetIndexList(ctx context.Context) ([]string, derrors.Error)
 }
+
+// Starter is implemented by providers with background tasks, which run until ctx is done
+type Starter interface {
+	Start(ctx context.Context)
+}
+
+// Closer is implemented by providers holding connections to the storage
+type Closer interface {
+	Close()
+}
+
+// IndexStats is the size of an index
+type IndexStats struct {
+	Name string
+	// SizeBytes is the size of the index in the storage
+	SizeBytes int64
+	// Documents is the number of log entries in the index
+	Documents int64
+}
+
+// DiskUsage is the usage of the disk of the storage
+type DiskUsage struct {
+	UsedBytes  int64
+	TotalBytes int64
+}
+
+// Percent returns the percentage of the disk in use
+func (d *DiskUsage) Percent() float64 {
+	if d.TotalBytes <= 0 {
+		return 0
+	}
+	return float64(d.UsedBytes) * 100 / float64(d.TotalBytes)
+}
+
+// StorageStats are the sizes of the indices, and the disk usage if the provider knows it
+type StorageStats struct {
+	Indices []IndexStats
+	// Disk is nil when the usage of the disk is unknown
+	Disk *DiskUsage
+}
+
+// StatsReporter is implemented by providers that report the size of their indices
+type StatsReporter interface {
+	GetStorageStats(ctx context.Context) (*StorageStats, derrors.Error)
+}
+
+// IndexCreationReporter is implemented by providers that know when their indices were created,
+// the only date of the indices named by rollover
+type IndexCreationReporter interface {
+	GetIndexCreationDates(ctx context.Context) (map[string]time.Time, derrors.Error)
+}
+
+// LifecycleManager is implemented by providers whose storage can roll over and delete the log
+// indices itself
+type LifecycleManager interface {
+	// ReconcileLifecycle installs the lifecycle policy, or updates it if it drifted, returning
+	// whether anything changed. It returns an unimplemented error if the storage cannot do it.
+	ReconcileLifecycle(ctx context.Context, policy *LifecyclePolicy) (bool, derrors.Error)
+}
+
+// ExpireTask is the progress of an expiration running in the storage
+type ExpireTask struct {
+	// Completed is set once the storage finished the task, successfully or not
+	Completed bool
+	// Total is the number of entries to delete, and Deleted the ones already deleted
+	Total   int64
+	Deleted int64
+	// Failures describe the entries that could not be deleted, or the error that stopped the task
+	Failures []string
+}
+
+// AsyncExpirer is implemented by providers whose storage deletes the expired entries in a task,
+// instead of during the request
+type AsyncExpirer interface {
+	// StartExpire starts deleting the entries Expire would delete, returning the identifier of the task
+	StartExpire(ctx context.Context, request *entities.SearchRequest) (string, derrors.Error)
+	// GetExpireTask returns the progress of a task started by StartExpire, or a not found error
+	// if the storage does not know it
+	GetExpireTask(ctx context.Context, taskId string) (*ExpireTask, derrors.Error)
+}
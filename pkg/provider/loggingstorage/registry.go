@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Registry of logging storage providers
+
+package loggingstorage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// ProviderConfig is the configuration of a logging storage provider
+type ProviderConfig struct {
+	// Address with host:port of the storage server
+	Address string
+	// RequestTimeout is the maximum duration of a request, 0 means no timeout other than the caller's
+	RequestTimeout time.Duration
+	// ElasticSearch are the client options of the ElasticSearch provider
+	ElasticSearch *ElasticSearchOptions
+	// Local are the storage options of the local provider
+	Local *LocalOptions
+	// ExpireIndices are the index patterns the ElasticSearch and OpenSearch providers delete entries
+	// from, in their multi-target syntax, all if empty
+	ExpireIndices []string
+}
+
+// ProviderFactory creates a provider with the given configuration
+type ProviderFactory func(config *ProviderConfig) (Provider, derrors.Error)
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a provider available with the given name
+func RegisterProvider(name string, factory ProviderFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[name] = factory
+}
+
+// NewProvider creates the provider registered with the given name
+func NewProvider(name string, config *ProviderConfig) (Provider, derrors.Error) {
+	registryMutex.Lock()
+	factory, exists := registry[name]
+	registryMutex.Unlock()
+	if !exists {
+		return nil, derrors.NewInvalidArgumentError("unknown storage backend").WithParams(name, ProviderNames())
+	}
+	return factory(config)
+}
+
+// ProviderNames returns the names of the registered providers, sorted
+func ProviderNames() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}